@@ -0,0 +1,273 @@
+package dfwriter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// OverflowPolicy determines what happens to a write when the queue of an async writer is full, see
+// WithAsync.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the write until the queue has room (default).
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the write that doesn't fit into the queue.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued write to make room for the new one.
+	OverflowDropOldest
+)
+
+// asyncEntry is a write queued for the async worker.
+type asyncEntry struct {
+	data []byte
+	// line is set for writes made like WriteLine rather than Write
+	line bool
+	// prefix replaces the static prefix unless nil, see Child
+	prefix []byte
+	// dropped is the number of writes dropped right after this one
+	dropped int64
+}
+
+// asyncQueue is the bounded queue of writes of an async writer, see WithAsync.
+type asyncQueue struct {
+	mu sync.Mutex
+	// cond is broadcast whenever entries are added or removed and when the queue is closed
+	cond    sync.Cond
+	ring    []asyncEntry
+	head    int
+	count   int
+	policy  OverflowPolicy
+	pushed  uint64 // number of entries queued so far
+	done    uint64 // number of queued entries written or dropped so far
+	dropped int64  // number of writes dropped right before the head
+	// err is the worker's error returned by the next write, see WithAsyncFailOnError
+	err         error
+	failOnError bool
+	closed      bool
+}
+
+// newAsyncQueue returns a queue holding up to size writes.
+func newAsyncQueue(size int, policy OverflowPolicy, failOnError bool) *asyncQueue {
+	q := &asyncQueue{ring: make([]asyncEntry, size), policy: policy, failOnError: failOnError}
+	q.cond.L = &q.mu
+	return q
+}
+
+// pop removes the oldest entry. The caller must hold q.mu and the queue must not be empty.
+func (q *asyncQueue) pop() asyncEntry {
+	entry := q.ring[q.head]
+	q.ring[q.head] = asyncEntry{}
+	q.head = (q.head + 1) % len(q.ring)
+	q.count--
+	return entry
+}
+
+// takeError returns and clears the worker's error to be returned by the next write.
+// The caller must hold q.mu.
+func (q *asyncQueue) takeError() error {
+	err := q.err
+	q.err = nil
+	return err
+}
+
+// validateAsync checks the settings of WithAsync and WithAsyncFailOnError.
+func (w *DistributedFileWriter) validateAsync() error {
+	if w.asyncSize < 0 {
+		return fmt.Errorf("invalid async queue size %d", w.asyncSize)
+	}
+	switch w.asyncPolicy {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	default:
+		return fmt.Errorf("invalid overflow policy %d", w.asyncPolicy)
+	}
+	if w.asyncFailOnError && (w.asyncSize == 0 || w.asyncPolicy != OverflowBlock) {
+		return fmt.Errorf("failing writes on async errors requires an async writer with OverflowBlock")
+	}
+	return nil
+}
+
+// enqueue queues a copy of data for the async worker, to be written like WriteLine if line is set
+// and like Write otherwise. If the queue is full, the write is handled according to the overflow
+// policy, waiting for room until ctx, if not nil, is done.
+func (w *DistributedFileWriter) enqueue(ctx context.Context, data []byte, line bool) error {
+	return w.enqueueEntry(ctx, asyncEntry{data: data, line: line})
+}
+
+// enqueueEntry queues entry with a copy of its data, like enqueue.
+func (w *DistributedFileWriter) enqueueEntry(ctx context.Context, entry asyncEntry) error {
+	q := w.async
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if err := q.takeError(); err != nil {
+		return err
+	}
+
+	for q.count == len(q.ring) {
+		switch q.policy {
+		case OverflowDropNewest:
+			// The queue is full, so the dropped write follows its newest entry
+			q.ring[(q.head+q.count-1)%len(q.ring)].dropped++
+			w.stats.asyncDropped.Add(1)
+			return nil
+		case OverflowDropOldest:
+			q.pop()
+			q.dropped++
+			q.done++
+			w.stats.asyncDropped.Add(1)
+			q.cond.Broadcast()
+		default:
+			if ctx != nil {
+				if err := ctx.Err(); err != nil {
+					return fmt.Errorf("failed to wait for async queue: %w", err)
+				}
+				stop := context.AfterFunc(ctx, func() {
+					q.mu.Lock()
+					defer q.mu.Unlock()
+					q.cond.Broadcast()
+				})
+				q.cond.Wait()
+				stop()
+			} else {
+				q.cond.Wait()
+			}
+			if q.closed {
+				return ErrClosed
+			}
+		}
+	}
+
+	entry.data = bytes.Clone(entry.data)
+	entry.prefix = bytes.Clone(entry.prefix)
+	q.ring[(q.head+q.count)%len(q.ring)] = entry
+	q.count++
+	q.pushed++
+	q.cond.Broadcast()
+	return nil
+}
+
+// asyncLoop writes the queued writes in order until the writer is closed and the queue is drained.
+// Failures are reported to the error handler and, with WithAsyncFailOnError, returned by the next
+// write.
+func (w *DistributedFileWriter) asyncLoop() {
+	q := w.async
+	for {
+		q.mu.Lock()
+		for q.count == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.count == 0 {
+			q.mu.Unlock()
+			return
+		}
+		entry := q.pop()
+		droppedBefore := q.dropped
+		q.dropped = 0
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		err := w.writeQueued(entry, droppedBefore)
+
+		q.mu.Lock()
+		q.done++
+		if err != nil && q.failOnError && q.err == nil {
+			q.err = err
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		if err != nil {
+			w.handleError(fmt.Errorf("failed to write queued line: %w", err))
+		}
+	}
+}
+
+// writeQueued writes a queued entry, preceded by a marker line for the droppedBefore writes dropped
+// right before it and followed by a marker for those dropped right after it, if any.
+func (w *DistributedFileWriter) writeQueued(entry asyncEntry, droppedBefore int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if err := w.writeAsyncDropped(droppedBefore); err != nil {
+		return err
+	}
+	if entry.prefix != nil {
+		defer func(prefix []byte) { w.prefix = prefix }(w.prefix)
+		w.prefix = entry.prefix
+	}
+	var err error
+	if entry.line {
+		err = w.writeLine(entry.data)
+	} else {
+		_, err = w.write(entry.data)
+	}
+	if err != nil {
+		return err
+	}
+	return w.writeAsyncDropped(entry.dropped)
+}
+
+// writeAsyncDropped writes a marker line for n writes dropped because the async queue was full,
+// unless n is 0. The caller must hold w.mu.
+func (w *DistributedFileWriter) writeAsyncDropped(n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	w.notice = append(w.notice[:0], "dfwriter: dropped "...)
+	w.notice = strconv.AppendInt(w.notice, n, 10)
+	w.notice = append(w.notice, " lines, async queue full"...)
+	return w.writeContent(w.notice, true)
+}
+
+// flushAsync waits until the writes queued before the call are written, if the writer is async.
+// Returns the worker's error with WithAsyncFailOnError.
+func (w *DistributedFileWriter) flushAsync() error {
+	q := w.async
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for target := q.pushed; q.done < target; {
+		q.cond.Wait()
+	}
+	return q.takeError()
+}
+
+// closeAsync stops accepting writes, if the writer is async. The worker drains the queue before
+// it returns, so it has to be waited for with stopBackground.
+func (w *DistributedFileWriter) closeAsync() {
+	q := w.async
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// asyncError returns the worker's error not yet returned by a write, with WithAsyncFailOnError.
+func (w *DistributedFileWriter) asyncError() error {
+	q := w.async
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.takeError()
+}
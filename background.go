@@ -0,0 +1,158 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// startBackground runs fn in a background goroutine that is stopped and waited for by Close.
+func (w *DistributedFileWriter) startBackground(fn func()) {
+	w.background.Add(1)
+	go func() {
+		defer w.background.Done()
+		fn()
+	}()
+}
+
+// stopBackground signals all background goroutines to stop and waits for them to return.
+// It must not be called while holding w.mu.
+func (w *DistributedFileWriter) stopBackground() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+	w.background.Wait()
+}
+
+// flushLoop periodically writes any buffered partial line and syncs the log file until the writer is closed.
+func (w *DistributedFileWriter) flushLoop(interval time.Duration) {
+	ticker := w.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C():
+			if err := w.flush(); err != nil && !errors.Is(err, ErrClosed) {
+				w.handleError(fmt.Errorf("failed to flush log file: %w", err))
+			}
+		}
+	}
+}
+
+// flush writes any buffered partial line and syncs the log file.
+func (w *DistributedFileWriter) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if w.buf.Len() != 0 {
+		err := w.writeLine(w.buf.Bytes())
+		if errors.Is(err, ErrLineTooLong) {
+			w.buf.Reset()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.syncLog()
+}
+
+// cleanupLoop periodically deletes the backups exceeding the limits until the writer is closed.
+func (w *DistributedFileWriter) cleanupLoop(interval time.Duration) {
+	ticker := w.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C():
+			w.cleanup()
+		}
+	}
+}
+
+// cleanup deletes the backups exceeding the limits, if any, while holding the exclusive file lock,
+// if file locking is enabled, as well as orphaned temporary and empty backups. Failures are reported to the error handler.
+func (w *DistributedFileWriter) cleanup() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	// Without limits, only garbage untouched for an hour is removed, which needs no file lock
+	limited := w.maxBackups > 0 || w.maxAge > 0 || w.maxTotalBytes > 0 || len(w.retentionTiers) > 0
+	if w.fsLock && limited {
+		if err := w.lock(true); err != nil {
+			w.handleError(fmt.Errorf("failed to clean up backups: %w", err))
+			return
+		}
+		defer func() {
+			if err := w.lockMode.unlock(w.lockedFile()); err != nil {
+				w.handleError(fmt.Errorf("failed to unlock %s: %w", w.lockedFile().Name(), err))
+			}
+		}()
+	}
+
+	if err := w.cleanupOldBackups(); err != nil {
+		w.handleError(fmt.Errorf("failed to clean up backups: %w", err))
+	}
+}
+
+// notifyRotate queues the path of a completed backup for the rotation hook and the post-rotate
+// command, if set, which are called in a background goroutine. Calls are serialized in the order
+// the backups completed.
+func (w *DistributedFileWriter) notifyRotate(backupPath string) {
+	if w.events != nil {
+		var size int64
+		if info, err := w.fs.Stat(backupPath); err == nil {
+			size = info.Size()
+		}
+		w.emit(Rotated{BackupPath: backupPath, Size: size})
+	}
+
+	if w.onRotate == nil && w.postRotateCommand == nil {
+		return
+	}
+
+	w.hookMu.Lock()
+	defer w.hookMu.Unlock()
+	w.hookQueue = append(w.hookQueue, backupPath)
+	if w.hooksRunning {
+		return
+	}
+	w.hooksRunning = true
+	w.hooks.Add(1)
+	go w.runHooks()
+}
+
+// runHooks calls the rotation hooks for the queued backups until the queue is empty.
+func (w *DistributedFileWriter) runHooks() {
+	defer w.hooks.Done()
+	for {
+		w.hookMu.Lock()
+		if len(w.hookQueue) == 0 {
+			w.hooksRunning = false
+			w.hookMu.Unlock()
+			return
+		}
+		backupPath := w.hookQueue[0]
+		w.hookQueue = w.hookQueue[1:]
+		w.hookMu.Unlock()
+
+		if w.onRotate != nil {
+			w.onRotate(backupPath)
+		}
+		if w.postRotateCommand != nil {
+			w.runPostRotateCommand(backupPath)
+		}
+	}
+}
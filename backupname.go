@@ -0,0 +1,169 @@
+package dfwriter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupNameTimeFormat is the layout of {timestamp} in backup name templates.
+const backupNameTimeFormat = backupTimeFormat + ".000"
+
+// backupNameTemplate names backups after a template set with WithBackupNameTemplate
+// and parses the rotation time and index back out of the names.
+type backupNameTemplate struct {
+	dir     string
+	logName string
+	logExt  string
+	parts   []string // literal text and {token}s
+	pattern *regexp.Regexp
+}
+
+// compileBackupNameTemplate compiles tmpl for backups of the log file at logPath stored in backupDir.
+// The template must contain the {timestamp} and {index} tokens.
+func compileBackupNameTemplate(tmpl, logPath, backupDir string) (*backupNameTemplate, error) {
+	base := filepath.Base(logPath)
+	ext := filepath.Ext(base)
+	t := &backupNameTemplate{
+		dir:     filepath.Dir(backupPrefix(logPath, backupDir)),
+		logName: strings.TrimSuffix(base, ext),
+		logExt:  ext,
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	tokens := map[string]bool{}
+	for rest := tmpl; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			start = len(rest)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, rest[:start])
+			pattern.WriteString(regexp.QuoteMeta(rest[:start]))
+			rest = rest[start:]
+			continue
+		}
+
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid backup name template %q: unterminated token", tmpl)
+		}
+		token := rest[:end+1]
+		rest = rest[end+1:]
+		switch token {
+		case "{name}":
+			pattern.WriteString(regexp.QuoteMeta(t.logName))
+		case "{ext}":
+			pattern.WriteString(regexp.QuoteMeta(t.logExt))
+		case "{timestamp}":
+			pattern.WriteString(`(?P<timestamp>\d{8}-\d{6}\.\d{3})`)
+		case "{index}":
+			pattern.WriteString(`(?P<index>\d+)`)
+		case "{pid}":
+			pattern.WriteString(`\d+`)
+		default:
+			return nil, fmt.Errorf("invalid backup name template %q: unknown token %s", tmpl, token)
+		}
+		if tokens[token] && (token == "{timestamp}" || token == "{index}") {
+			return nil, fmt.Errorf("invalid backup name template %q: duplicate token %s", tmpl, token)
+		}
+		tokens[token] = true
+		t.parts = append(t.parts, token)
+	}
+	if !tokens["{timestamp}"] || !tokens["{index}"] {
+		return nil, fmt.Errorf("invalid backup name template %q: {timestamp} and {index} are required", tmpl)
+	}
+	if strings.ContainsRune(tmpl, filepath.Separator) || strings.ContainsRune(tmpl, '/') {
+		return nil, fmt.Errorf("invalid backup name template %q: must not contain a path separator", tmpl)
+	}
+
+	// Compressed and encrypted backups carry their extensions after the expanded template
+	pattern.WriteString(`(?:` + regexp.QuoteMeta(CompressionGzip.extension()) + `|` +
+		regexp.QuoteMeta(CompressionZstd.extension()) + `)?(?:` + regexp.QuoteMeta(encryptedExt) + `)?$`)
+	var err error
+	t.pattern, err = regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup name template %q: %w", tmpl, err)
+	}
+
+	return t, nil
+}
+
+// name returns the path of the backup rotated at ts with the given index, without compression extension.
+func (t *backupNameTemplate) name(ts time.Time, index int) string {
+	var name strings.Builder
+	for _, part := range t.parts {
+		switch part {
+		case "{name}":
+			name.WriteString(t.logName)
+		case "{ext}":
+			name.WriteString(t.logExt)
+		case "{timestamp}":
+			name.WriteString(ts.Format(backupNameTimeFormat))
+		case "{index}":
+			name.WriteString(strconv.Itoa(index))
+		case "{pid}":
+			name.WriteString(strconv.Itoa(os.Getpid()))
+		default:
+			name.WriteString(part)
+		}
+	}
+	return filepath.Join(t.dir, name.String())
+}
+
+// parse parses the rotation time and index out of the backup at path.
+// Reports false if the name doesn't match the template.
+func (t *backupNameTemplate) parse(path string) (backupFile, bool) {
+	m := t.pattern.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return backupFile{}, false
+	}
+
+	ts, err := time.ParseInLocation(backupNameTimeFormat, m[t.pattern.SubexpIndex("timestamp")], time.Local)
+	if err != nil {
+		return backupFile{}, false
+	}
+	index, _ := strconv.Atoi(m[t.pattern.SubexpIndex("index")])
+
+	return backupFile{path: path, time: ts, index: index}, true
+}
+
+// matches returns the paths in the backup directory on fsys with names matching the template, after
+// removing the given suffix.
+func (t *backupNameTemplate) matches(fsys fileSystem, suffix string) ([]string, error) {
+	entries, err := fsys.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), suffix)
+		if ok && t.pattern.MatchString(name) {
+			matches = append(matches, filepath.Join(t.dir, entry.Name()))
+		}
+	}
+	return matches, nil
+}
+
+// list returns the backups on fsys named after the template, oldest first, ordered by their rotation
+// time and index.
+func (t *backupNameTemplate) list(fsys fileSystem) ([]backupFile, error) {
+	matches, err := t.matches(fsys, "")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]backupFile, 0, len(matches))
+	for _, path := range matches {
+		if backup, ok := t.parse(path); ok {
+			backups = append(backups, backup)
+		}
+	}
+	return sortBackups(backups), nil
+}
@@ -0,0 +1,68 @@
+package dfwriter
+
+import (
+	"strings"
+	"time"
+)
+
+// BackupInfo describes a rotated backup of a log file.
+type BackupInfo struct {
+	// Path is the path of the backup file.
+	Path string
+	// Timestamp is the rotation time encoded in the backup name.
+	Timestamp time.Time
+	// Index distinguishes backups rotated at the same time, starting at 0.
+	Index int
+	// Size is the size of the backup file in bytes.
+	Size int64
+	// Compressed is true if the backup is gzip or zstd compressed.
+	Compressed bool
+}
+
+// ListBackups returns the backups of the log file, oldest first. Backups that are still being written
+// or compressed and files not named like backups are skipped.
+func (w *DistributedFileWriter) ListBackups() ([]BackupInfo, error) {
+	backups, err := w.backups()
+	return backupInfos(w.fs, backups, err)
+}
+
+// OpenBackups returns the backups of the log file at logPath, oldest first, in the same order
+// in which a writer removes them. Backups that are still being written or compressed and files
+// not named like backups are skipped.
+func OpenBackups(logPath string) ([]BackupInfo, error) {
+	return OpenBackupsInDir(logPath, "")
+}
+
+// OpenBackupsInDir is like OpenBackups for backups stored in backupDir, see WithBackupDir.
+func OpenBackupsInDir(logPath, backupDir string) ([]BackupInfo, error) {
+	fsys := osFS{}
+	backups, err := listBackups(fsys, backupPrefix(logPath, backupDir))
+	return backupInfos(fsys, backups, err)
+}
+
+// backupInfos returns the info of the backups on fsys, passing through err.
+func backupInfos(fsys fileSystem, backups []backupFile, err error) ([]BackupInfo, error) {
+	infos := make([]BackupInfo, 0, len(backups))
+	for _, backup := range backups {
+		stat, statErr := fsys.Stat(backup.path)
+		if statErr != nil {
+			// Removed since it was listed
+			continue
+		}
+		infos = append(infos, BackupInfo{
+			Path:       backup.path,
+			Timestamp:  backup.time,
+			Index:      backup.index,
+			Size:       stat.Size(),
+			Compressed: isCompressed(backup.path),
+		})
+	}
+
+	return infos, err
+}
+
+// isCompressed reports whether path has the extension of a compressed backup, encrypted or not.
+func isCompressed(path string) bool {
+	path = strings.TrimSuffix(path, encryptedExt)
+	return strings.HasSuffix(path, CompressionGzip.extension()) || strings.HasSuffix(path, CompressionZstd.extension())
+}
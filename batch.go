@@ -0,0 +1,119 @@
+package dfwriter
+
+// WriteLines writes each of the given lines like WriteLine, but batches consecutive lines into as
+// few writes as possible. With file locking, the lock is acquired and the need for rotation is
+// checked once per batch. Batches are kept within the atomic line size and the max size, so each
+// batch is written as atomically as a single line and never spans a rotation.
+// Returns the first error encountered, the lines before the failed batch have been written.
+// With WithAsync, each line is queued like by WriteLine.
+func (w *DistributedFileWriter) WriteLines(lines [][]byte) error {
+	if w.async != nil {
+		for _, line := range lines {
+			if err := w.enqueue(nil, line, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	_, err := w.writeLines(lines)
+	return err
+}
+
+// writeLines implements WriteLines. Returns the number of lines written before an error, i.e. the
+// index of the first line not written. The caller must hold w.mu.
+func (w *DistributedFileWriter) writeLines(lines [][]byte) (int, error) {
+	w.scratch = w.scratch[:0]
+	batched := 0 // number of lines in the scratch buffer
+	start := 0   // index of the first line in the scratch buffer
+	for i, line := range lines {
+		content, delimited := w.trimDelimiter(line)
+		if len(content) == 0 && !delimited && !w.binaryRecords {
+			continue
+		}
+		content, ok := w.transformLine(content)
+		if !ok {
+			continue
+		}
+		admitted, err := w.admitLine(content, delimited)
+		if err != nil || w.pendingNotices() && admitted {
+			// Summaries precede the line, so the batch so far is written first
+			if batched > 0 {
+				if err := w.writeData(w.scratch, batched); err != nil {
+					return start, err
+				}
+				w.commitSequence(batched)
+				w.scratch = w.scratch[:0]
+				batched = 0
+			}
+			if err == nil {
+				err = w.writeNotices()
+				w.scratch = w.scratch[:0]
+			}
+		}
+		if err != nil {
+			return i, err
+		}
+		if !admitted {
+			continue
+		}
+		if batched > 0 && w.sequenceExhausted(batched) {
+			// Reserving more sequence numbers requires the batch so far to be written
+			if err := w.writeData(w.scratch, batched); err != nil {
+				return start, err
+			}
+			w.commitSequence(batched)
+			w.scratch = w.scratch[:0]
+			batched = 0
+		}
+		prefix, line, err := w.sequence(w.linePrefix(), content, batched)
+		if err != nil {
+			return i, err
+		}
+		prefix, line, lineDelimited := w.envelope(prefix, line, delimited)
+		n := w.lineLength(len(prefix), len(line), lineDelimited)
+		oversize := w.isOversize(n)
+
+		if batched > 0 && (oversize || len(w.scratch)+n > w.atomicLineSize ||
+			int64(len(w.scratch)+n) > w.maxSize && w.maxSize > 0) {
+			if err := w.writeData(w.scratch, batched); err != nil {
+				return start, err
+			}
+			w.commitSequence(batched)
+			w.scratch = w.scratch[:0]
+			batched = 0
+		}
+
+		if oversize {
+			// The sequence number and envelope count towards the prefix
+			if err := w.writeOversizeLine(content, delimited, len(prefix)+len(line)-len(content)); err != nil {
+				return i, err
+			}
+			// The oversize line was written through the scratch buffer
+			w.scratch = w.scratch[:0]
+			continue
+		}
+
+		if batched == 0 {
+			start = i
+		}
+		w.scratch = w.appendLine(w.scratch, prefix, line, lineDelimited)
+		batched++
+	}
+
+	if batched > 0 {
+		if err := w.writeData(w.scratch, batched); err != nil {
+			return start, err
+		}
+		w.commitSequence(batched)
+	}
+
+	return len(lines), nil
+}
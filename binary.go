@@ -0,0 +1,38 @@
+package dfwriter
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// frameHeaderSize is the size of the big-endian record length preceding every binary record.
+const frameHeaderSize = 4
+
+// maxFrameSize is the size of the largest binary record frame, limited by the length header.
+const maxFrameSize = frameHeaderSize + math.MaxUint32
+
+// ScanRecords is a bufio.SplitFunc splitting the log written with WithBinaryRecords, as read with
+// NewReader or Follow, into records. The returned tokens consist of the prefix, if any, followed
+// by the record. Records larger than the scanner's buffer, 64KB by default, require a larger
+// buffer to be set with bufio.Scanner.Buffer. A frame cut short by the end of the input is
+// reported as io.ErrUnexpectedEOF.
+func ScanRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < frameHeaderSize {
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+
+	size := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-frameHeaderSize) < uint64(size) {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+
+	end := frameHeaderSize + int(size)
+	return end, data[frameHeaderSize:end], nil
+}
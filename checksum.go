@@ -0,0 +1,213 @@
+package dfwriter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumExt is appended to the backup prefix to name the checksum manifest, see WithChecksums.
+const checksumExt = ".sha256"
+
+// VerifyResult is the result of verifying a backup against the checksum recorded in the manifest,
+// see VerifyBackups.
+type VerifyResult struct {
+	// Path is the path of the backup file.
+	Path string
+	// Expected is the hex-encoded SHA-256 digest recorded in the manifest.
+	Expected string
+	// Actual is the hex-encoded SHA-256 digest of the backup file, or empty if it couldn't be read.
+	Actual string
+	// Err is the error reading the backup file, e.g. if it was removed.
+	Err error
+}
+
+// OK reports whether the backup file matches its recorded checksum.
+func (r VerifyResult) OK() bool {
+	return r.Err == nil && r.Actual == r.Expected
+}
+
+// VerifyBackups hashes the backups of the log file at logPath recorded in its checksum manifest and
+// compares them with the recorded checksums, see WithChecksums. Returns a result per manifest entry,
+// in the order of the manifest.
+func VerifyBackups(logPath string) ([]VerifyResult, error) {
+	return VerifyBackupsInDir(logPath, "")
+}
+
+// VerifyBackupsInDir is like VerifyBackups for backups stored in backupDir, see WithBackupDir.
+func VerifyBackupsInDir(logPath, backupDir string) ([]VerifyResult, error) {
+	fsys := osFS{}
+	manifest := backupPrefix(logPath, backupDir) + checksumExt
+	data, err := readFile(fsys, manifest)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum manifest %s: %w", manifest, err)
+	}
+
+	results := make([]VerifyResult, 0, len(entries))
+	for _, entry := range entries {
+		result := VerifyResult{Path: filepath.Join(filepath.Dir(manifest), entry.name), Expected: entry.sum}
+		h := sha256.New()
+		if result.Err = hashFile(fsys, result.Path, h); result.Err == nil {
+			result.Actual = hex.EncodeToString(h.Sum(nil))
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// manifestEntry is a line of a checksum manifest.
+type manifestEntry struct {
+	sum  string // hex-encoded
+	name string // relative to the manifest's directory
+	line []byte
+}
+
+// parseManifest parses the lines of a checksum manifest, formatted like by sha256sum.
+func parseManifest(data []byte) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 1; scanner.Scan(); i++ {
+		line := scanner.Bytes()
+		sum, name, ok := strings.Cut(string(line), "  ")
+		if !ok || len(sum) != hex.EncodedLen(sha256.Size) || name == "" {
+			return nil, fmt.Errorf("malformed line %d", i)
+		}
+		entries = append(entries, manifestEntry{sum: sum, name: name, line: bytes.Clone(line)})
+	}
+	return entries, scanner.Err()
+}
+
+// hashFile writes the contents of the file at path on fsys to h.
+func hashFile(fsys fileSystem, path string, h hash.Hash) error {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// newChecksum returns the hash computing the checksum of a backup, or nil if checksums are disabled.
+func (w *DistributedFileWriter) newChecksum() hash.Hash {
+	if !w.checksums {
+		return nil
+	}
+	return sha256.New()
+}
+
+// manifestPath returns the path of the checksum manifest next to the backups.
+func (w *DistributedFileWriter) manifestPath() string {
+	return w.backupPrefix() + checksumExt
+}
+
+// openManifest opens the checksum manifest with flag, holding the exclusive file lock on it if file
+// locking is enabled. The caller must hold w.manifestMu.
+func (w *DistributedFileWriter) openManifest(flag int) (fsFile, error) {
+	return w.openSharedFile(w.manifestPath(), flag)
+}
+
+// openSharedFile opens the file at path kept alongside the log file with flag, holding the exclusive
+// file lock on it if file locking is enabled. The caller must hold the mutex guarding the file.
+func (w *DistributedFileWriter) openSharedFile(path string, flag int) (fsFile, error) {
+	f, err := w.fs.OpenFile(path, flag, w.mode)
+	if err != nil {
+		return nil, err
+	}
+	if w.fsLock || w.exclusiveOwner {
+		// The file is locked itself, independently of the lock held on the log file while writing
+		if err := w.lockSharedFile(f); err != nil {
+			f.Close()
+			return nil, &LockError{Path: f.Name(), Exclusive: true, Err: err}
+		}
+	}
+	return f, nil
+}
+
+// recordChecksum appends the checksum of the complete backup at path to the manifest.
+func (w *DistributedFileWriter) recordChecksum(path string, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+
+	w.manifestMu.Lock()
+	defer w.manifestMu.Unlock()
+
+	f, err := w.openManifest(os.O_CREATE | os.O_WRONLY | os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("failed to open checksum manifest: %w", err)
+	}
+	// Closing the manifest releases its lock
+	defer f.Close()
+
+	line := fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(path))
+	if _, err := f.Write([]byte(line)); err != nil {
+		return fmt.Errorf("failed to record checksum of %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// pruneChecksums removes the entries of backups that don't exist anymore from the manifest. The
+// manifest is rewritten in place, so writers appending to it concurrently keep their lock on it.
+func (w *DistributedFileWriter) pruneChecksums() error {
+	if !w.checksums {
+		return nil
+	}
+
+	w.manifestMu.Lock()
+	defer w.manifestMu.Unlock()
+
+	f, err := w.openManifest(os.O_RDWR)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open checksum manifest: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	entries, err := parseManifest(data)
+	if err != nil {
+		return fmt.Errorf("invalid checksum manifest %s: %w", f.Name(), err)
+	}
+	var kept []byte
+	for _, entry := range entries {
+		if _, err := w.fs.Stat(filepath.Join(filepath.Dir(f.Name()), entry.name)); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		kept = append(append(kept, entry.line...), '\n')
+	}
+	if len(kept) == len(data) {
+		return nil
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(kept, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,241 @@
+package dfwriter
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// ChildWriter writes to the log file of the DistributedFileWriter it was created from, sharing its
+// file, size, locking, rotation and cleanup, but assembling lines in a buffer of its own. Goroutines
+// writing partial lines through their own child only contend for the parent's lock once a line is
+// complete. A ChildWriter is safe for concurrent use, but meant to be used by a single goroutine.
+type ChildWriter struct {
+	parent *DistributedFileWriter
+	// prefix replaces the parent's static prefix unless nil
+	prefix []byte
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	lines  [][]byte
+	closed bool
+}
+
+// Child returns a writer sharing the log file of w with its own partial-line buffer, see
+// ChildWriter. Unless nil, prefix replaces the static prefix set with WithPrefix for the lines of
+// the child, other prefixes are still applied. Closing w flushes and closes its children.
+func (w *DistributedFileWriter) Child(prefix []byte) *ChildWriter {
+	c := &ChildWriter{parent: w, prefix: bytes.Clone(prefix)}
+
+	w.childMu.Lock()
+	defer w.childMu.Unlock()
+	if w.childrenClosed {
+		c.closed = true
+		return c
+	}
+	if w.children == nil {
+		w.children = make(map[*ChildWriter]struct{})
+	}
+	w.children[c] = struct{}{}
+	return c
+}
+
+// Write buffers the given bytes like DistributedFileWriter.Write, writing the complete lines to the
+// parent's log file as a batch. Buffered partial lines are only limited by WithMaxBufferedBytes.
+// Returns the number of bytes buffered and any error encountered. On error, the returned count
+// covers the input up to the last line successfully written.
+func (c *ChildWriter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	return c.write(b)
+}
+
+// WriteString is like Write, but takes a string, implementing io.StringWriter.
+func (c *ChildWriter) WriteString(s string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	// Like the parent's write, write never modifies or retains b
+	return c.write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// WriteLine writes the given bytes to the parent's log file like DistributedFileWriter.WriteLine.
+// A buffered partial line is kept for the following writes.
+func (c *ChildWriter) WriteLine(line []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	_, err := c.parent.writeChild(c.prefix, [][]byte{line})
+	return err
+}
+
+// write implements Write. The caller must hold c.mu.
+func (c *ChildWriter) write(b []byte) (int, error) {
+	w := c.parent
+	if w.binaryRecords {
+		// Every write is a complete record
+		if _, err := w.writeChild(c.prefix, [][]byte{b}); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	// Collect the complete lines without holding the parent's lock
+	buffered := c.buf.Len()
+	c.lines = c.lines[:0]
+	consumed := 0
+	for {
+		end := bytes.IndexByte(b[consumed:], w.delimiter)
+		if end < 0 {
+			break
+		}
+		// Complete lines are written straight from b unless they continue a buffered partial line
+		line := b[consumed : consumed+end+1]
+		if len(c.lines) == 0 && buffered > 0 {
+			c.buf.Write(line)
+			line = c.buf.Bytes()
+		}
+		c.lines = append(c.lines, line)
+		consumed += end + 1
+	}
+	pending := len(b) - consumed
+	if len(c.lines) == 0 {
+		pending += buffered
+	}
+	var limitErr error
+	if w.maxBuffered > 0 && pending > w.maxBuffered {
+		limitErr = &LineTooLongError{Length: pending, Max: int64(w.maxBuffered)}
+	}
+
+	n, err := w.writeChild(c.prefix, c.lines)
+	// Number of bytes of b written to the file up to and including the last newline
+	written := 0
+	for _, line := range c.lines[:n] {
+		written += len(line)
+	}
+	if buffered > 0 && n > 0 {
+		written -= buffered
+		c.buf.Reset()
+	}
+	if err != nil {
+		if errors.Is(err, ErrLineTooLong) {
+			c.buf.Reset()
+		} else if c.buf.Len() == 0 {
+			// Keep the line buffered, so Sync and Close retry it
+			c.buf.Write(c.lines[n])
+		}
+		return written, err
+	}
+	if limitErr != nil {
+		// Discard the oversized partial line so the child recovers
+		c.buf.Reset()
+		return written, limitErr
+	}
+
+	c.buf.Write(b[consumed:])
+	return len(b), nil
+}
+
+// flush writes the buffered partial line, if any, as a log entry. The caller must hold c.mu.
+func (c *ChildWriter) flush() error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.parent.writeChild(c.prefix, [][]byte{c.buf.Bytes()})
+	if err == nil || errors.Is(err, ErrLineTooLong) {
+		c.buf.Reset()
+	}
+	return err
+}
+
+// Sync writes the buffered partial line, if any, as a complete log entry and syncs the parent like
+// DistributedFileWriter.Sync.
+func (c *ChildWriter) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return c.parent.Sync()
+}
+
+// Close writes the buffered partial line, if any, as a complete log entry, without closing the parent's
+// log file. Closing an already closed child is a no-op.
+func (c *ChildWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	err := c.flush()
+	c.closed = true
+	c.parent.childMu.Lock()
+	delete(c.parent.children, c)
+	c.parent.childMu.Unlock()
+	return err
+}
+
+// writeChild writes the complete lines of a child with prefix replacing the static prefix unless
+// nil, like writeLines. Returns the number of lines written before an error.
+func (w *DistributedFileWriter) writeChild(prefix []byte, lines [][]byte) (int, error) {
+	if w.async != nil {
+		for i, line := range lines {
+			if err := w.enqueueEntry(nil, asyncEntry{data: line, line: true, prefix: prefix}); err != nil {
+				return i, err
+			}
+		}
+		return len(lines), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	if prefix != nil {
+		defer func(prefix []byte) { w.prefix = prefix }(w.prefix)
+		w.prefix = prefix
+	}
+	return w.writeLines(lines)
+}
+
+// closeChildren flushes and closes the children of w, waiting for their writes in progress, and
+// keeps new children from being opened. Returns the errors flushing their buffers.
+func (w *DistributedFileWriter) closeChildren() error {
+	w.childMu.Lock()
+	w.childrenClosed = true
+	children := make([]*ChildWriter, 0, len(w.children))
+	for c := range w.children {
+		children = append(children, c)
+	}
+	w.childMu.Unlock()
+
+	var errs []error
+	for _, c := range children {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,53 @@
+package dfwriter
+
+import "time"
+
+// Clock provides the current time and tickers to a writer, see WithClock. It must be safe for
+// concurrent use.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a ticker delivering the time on its channel every d, like time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a Clock.
+type Ticker interface {
+	// C returns the channel the ticks are delivered on.
+	C() <-chan time.Time
+	// Stop turns off the ticker. No more ticks are delivered afterwards.
+	Stop()
+}
+
+// realClock is the Clock of the time package, used unless WithClock is set.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts time.Ticker to Ticker.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// sleep waits for d on the writer's clock. Returns false without waiting for d if done is closed
+// first.
+func (w *DistributedFileWriter) sleep(d time.Duration, done <-chan struct{}) bool {
+	ticker := w.clock.NewTicker(d)
+	defer ticker.Stop()
+	select {
+	case <-ticker.C():
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,254 @@
+package dfwriter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/romosch/dfwriter"
+	"github.com/romosch/dfwriter/dfwritertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// backupTimeFormat is the timestamp format of backup names.
+const backupTimeFormat = "20060102-150405"
+
+// TestMaxAgeNonLogFilename verifies that MaxAge cleanup works for log files not named "*.log" and
+// that a stray file matching the backup glob doesn't abort the cleanup of valid backups.
+func TestMaxAgeNonLogFilename(t *testing.T) {
+	clock := dfwritertest.NewClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local))
+	logPath := filepath.Join(t.TempDir(), "audit.txt")
+
+	expired := logPath + "." + clock.Now().Add(-48*time.Hour).Format(backupTimeFormat) + ".0"
+	recent := logPath + "." + clock.Now().Add(-time.Hour).Format(backupTimeFormat) + ".0"
+	stray := logPath + ".pos"
+	for _, f := range []string{expired, recent, stray} {
+		assert.NoError(t, os.WriteFile(f, []byte("data\n"), 0644))
+	}
+	logger, err := dfwriter.New(logPath, dfwriter.WithMaxAge(24*time.Hour), dfwriter.WithClock(clock))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
+
+	assert.NoFileExists(t, expired)
+	assert.FileExists(t, recent)
+	assert.FileExists(t, stray)
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+}
+
+// TestCleanupWithoutWrites verifies that the backup limits are enforced by New and periodically with
+// WithCleanupInterval, without any writes, as backups exceed them or age.
+func TestCleanupWithoutWrites(t *testing.T) {
+	clock := dfwritertest.NewClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local))
+	logPath := filepath.Join(t.TempDir(), "idle.log")
+	backup := func(age time.Duration) string {
+		path := logPath + "." + clock.Now().Add(-age).Format(backupTimeFormat)
+		assert.NoError(t, os.WriteFile(path, []byte("backup\n"), 0644))
+		return path
+	}
+	stale := []string{backup(5 * time.Hour), backup(4 * time.Hour), backup(3 * time.Hour)}
+	recent := backup(time.Minute)
+
+	logger, err := dfwriter.New(logPath,
+		dfwriter.WithMaxBackups(2),
+		dfwriter.WithMaxAge(2*time.Hour),
+		dfwriter.WithFileLocking(),
+		dfwriter.WithCleanupInterval(time.Minute),
+		dfwriter.WithClock(clock),
+	)
+	assert.NoError(t, err)
+	for _, path := range stale {
+		assert.NoFileExists(t, path)
+	}
+	assert.FileExists(t, recent)
+	assert.Equal(t, 1, logger.Stats().BackupCount)
+	clock.BlockUntilTickers(1)
+
+	// Backups exceeding the limits later are removed in the background. The second tick is only
+	// received once the cleanup of the first one is done.
+	older := backup(90 * time.Minute)
+	oldest := backup(3 * time.Hour)
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	assert.NoFileExists(t, oldest)
+	assert.FileExists(t, older)
+	assert.FileExists(t, recent)
+
+	// Backups are removed once they exceed the max age
+	clock.Advance(30 * time.Minute)
+	clock.Advance(time.Minute)
+	assert.NoFileExists(t, older)
+	assert.FileExists(t, recent)
+	assert.NoError(t, logger.Close())
+
+	// Without limits, New doesn't remove anything
+	clock.Advance(24 * time.Hour)
+	logger, err = dfwriter.New(logPath, dfwriter.WithClock(clock))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+	assert.FileExists(t, recent)
+}
+
+// TestClockRotation verifies that time-based rotation and backup names follow the clock set with
+// WithClock.
+func TestClockRotation(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	clock := dfwritertest.NewClock(start)
+	logPath := filepath.Join(t.TempDir(), "clock.log")
+	logger, err := dfwriter.New(logPath,
+		dfwriter.WithRotationInterval(time.Hour),
+		dfwriter.WithMaxAge(24*time.Hour),
+		dfwriter.WithClock(clock),
+	)
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("first\n"))
+	assert.NoError(t, err)
+	clock.Advance(30 * time.Minute)
+	_, err = logger.Write([]byte("second\n"))
+	assert.NoError(t, err)
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+
+	// The first write after the hour boundary rotates, naming the backup after the clock's time
+	clock.Advance(time.Hour)
+	_, err = logger.Write([]byte("third\n"))
+	assert.NoError(t, err)
+	backups, err = logger.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		assert.Equal(t, start.Add(90*time.Minute), backups[0].Timestamp)
+		data, err := os.ReadFile(backups[0].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, "first\nsecond\n", string(data))
+	}
+
+	// The backup expires a day later
+	clock.Advance(25 * time.Hour)
+	assert.NoError(t, logger.Rotate())
+	backups, err = logger.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		assert.Equal(t, start.Add(26*time.Hour+30*time.Minute), backups[0].Timestamp)
+	}
+}
+
+// TestRetentionTiers verifies that the retention tiers keep the newest backup per interval of each
+// tier as of the clock, combined with the max backups.
+func TestRetentionTiers(t *testing.T) {
+	const day = 24 * time.Hour
+	// A Wednesday
+	now := time.Date(2024, 6, 5, 12, 0, 0, 0, time.UTC)
+	policy := []dfwriter.Tier{{Age: day}, {Age: 14 * day, Granularity: day}, {Age: 90 * day, Granularity: 7 * day}}
+	days := func(from, to, step int) []time.Duration {
+		var ages []time.Duration
+		for d := from; d <= to; d += step {
+			ages = append(ages, time.Duration(d)*day)
+		}
+		return ages
+	}
+
+	tests := []struct {
+		name       string
+		tiers      []dfwriter.Tier
+		maxBackups int
+		backups    []time.Duration // ages of the backups
+		kept       []time.Duration
+	}{
+		{
+			name:    "keep all",
+			tiers:   []dfwriter.Tier{{Age: day}},
+			backups: []time.Duration{time.Hour, 5 * time.Hour, 23 * time.Hour, 25 * time.Hour, 48 * time.Hour},
+			kept:    []time.Duration{time.Hour, 5 * time.Hour, 23 * time.Hour},
+		},
+		{
+			name:  "daily",
+			tiers: policy[:2],
+			backups: []time.Duration{time.Hour, 13 * time.Hour, 30 * time.Hour, 33 * time.Hour, 40 * time.Hour,
+				13*day + time.Hour, 13*day + 2*time.Hour, 15 * day},
+			kept: []time.Duration{time.Hour, 13 * time.Hour, 30 * time.Hour, 40 * time.Hour, 13*day + time.Hour},
+		},
+		{
+			name:    "weekly over months",
+			tiers:   policy,
+			backups: days(1, 120, 1),
+			kept:    append(days(1, 14, 1), days(17, 87, 7)...),
+		},
+		{
+			name:  "several per day over months",
+			tiers: policy,
+			backups: append(days(1, 100, 1), 6*time.Hour, 18*time.Hour, 5*day+6*time.Hour, 6*day-6*time.Hour,
+				30*day+time.Hour),
+			// The newest backup of each day is kept, which is the one at 18:00 six days ago
+			kept: append(append([]time.Duration{6 * time.Hour, 18 * time.Hour, 6*day - 6*time.Hour}, days(1, 5, 1)...),
+				append(days(7, 14, 1), days(17, 87, 7)...)...),
+		},
+		{
+			name:       "max backups deletes more",
+			tiers:      policy,
+			maxBackups: 5,
+			backups:    days(1, 120, 1),
+			kept:       days(1, 5, 1),
+		},
+		{
+			name:       "tiers delete more",
+			tiers:      policy,
+			maxBackups: 50,
+			backups:    days(1, 120, 1),
+			kept:       append(days(1, 14, 1), days(17, 87, 7)...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "tiers.log")
+			clock := dfwritertest.NewClock(now)
+			backup := func(age time.Duration) string {
+				return logPath + "." + now.Add(-age).In(time.Local).Format(backupTimeFormat)
+			}
+			for _, age := range tt.backups {
+				assert.NoError(t, os.WriteFile(backup(age), []byte("backup\n"), 0644))
+			}
+
+			logger, err := dfwriter.New(logPath, dfwriter.WithRetentionTiers(tt.tiers), dfwriter.WithMaxBackups(tt.maxBackups), dfwriter.WithClock(clock))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Close())
+
+			var want []string
+			for _, age := range tt.kept {
+				want = append(want, backup(age))
+			}
+			got, err := filepath.Glob(logPath + ".*")
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, want, got)
+		})
+	}
+
+	// The tiers follow the clock
+	logPath := filepath.Join(t.TempDir(), "clock.log")
+	clock := dfwritertest.NewClock(now)
+	recent := logPath + "." + now.Add(-time.Hour).In(time.Local).Format(backupTimeFormat)
+	sameDay := logPath + "." + now.Add(-2*time.Hour).In(time.Local).Format(backupTimeFormat)
+	for _, path := range []string{recent, sameDay} {
+		assert.NoError(t, os.WriteFile(path, []byte("backup\n"), 0644))
+	}
+	logger, err := dfwriter.New(logPath, dfwriter.WithRetentionTiers(policy), dfwriter.WithCleanupInterval(time.Hour), dfwriter.WithClock(clock))
+	assert.NoError(t, err)
+	clock.BlockUntilTickers(1)
+	assert.FileExists(t, sameDay)
+	clock.Advance(day)
+	clock.Advance(time.Hour)
+	assert.NoFileExists(t, sameDay)
+	assert.FileExists(t, recent)
+
+	assert.Error(t, logger.Reconfigure(dfwriter.WithRetentionTiers([]dfwriter.Tier{{Age: 2 * day}, {Age: day}})))
+	assert.NoError(t, logger.Close())
+	_, err = dfwriter.New(logPath, dfwriter.WithRetentionTiers([]dfwriter.Tier{{Age: day, Granularity: -time.Hour}}))
+	assert.Error(t, err)
+}
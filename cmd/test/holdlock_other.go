@@ -0,0 +1,12 @@
+//go:build (!unix && !windows) || aix || (solaris && !illumos)
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func holdLock(path string, shared bool, d time.Duration) error {
+	return errors.New("holding a lock is not supported on this platform")
+}
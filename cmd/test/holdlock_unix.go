@@ -0,0 +1,31 @@
+//go:build unix && !aix && (!solaris || illumos)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// holdLock acquires a flock on the file at path, reports it on stdout and holds it for d,
+// simulating a writer or follower hanging while holding the lock.
+func holdLock(path string, shared bool, d time.Duration) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		return err
+	}
+	fmt.Println("locked")
+	time.Sleep(d)
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// holdLock acquires a LockFileEx lock on the file at path, reports it on stdout and holds it for d,
+// simulating a writer or follower hanging while holding the lock. It locks the same byte as the writer.
+func holdLock(path string, shared bool, d time.Duration) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var flags uint32
+	if !shared {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := windows.Overlapped{Offset: 0xFFFFFFFE, OffsetHigh: 0xFFFFFFFF}
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &ol); err != nil {
+		return err
+	}
+	fmt.Println("locked")
+	time.Sleep(d)
+	return nil
+}
@@ -16,9 +16,25 @@ func main() {
 	lineSize := flag.Int("lineSize", 0, "number of lines to write")
 	rot := flag.Int64("rotationSize", 0, "rotation size")
 	lock := flag.Bool("lock", false, "use file locking")
+	rename := flag.Bool("rename", false, "use rename based rotation")
+	rotateEvery := flag.Int("rotateEvery", 0, "force a rotation after every n lines")
+	numeric := flag.Bool("numeric", false, "use numeric backup names")
+	lockFile := flag.Bool("lockFile", false, "lock the default lock file instead of the log file")
+	ofd := flag.Bool("ofd", false, "use open file description locks")
+	seq := flag.Bool("seq", false, "add sequence numbers")
+	hold := flag.Duration("holdLock", 0, "hold a lock on the log file for the given duration instead of writing")
+	shared := flag.Bool("shared", false, "hold a shared instead of an exclusive lock with -holdLock")
 
 	flag.Parse()
 
+	if *hold > 0 {
+		if err := holdLock(*log, *shared, *hold); err != nil {
+			fmt.Fprintf(os.Stderr, "id=%s hold lock: %v\n", *prefix, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	options := []dfwriter.Option{
 		dfwriter.WithMaxBytes(*rot),
 		dfwriter.WithMaxBackups(10000),
@@ -27,6 +43,21 @@ func main() {
 	if *lock {
 		options = append(options, dfwriter.WithFileLocking())
 	}
+	if *lockFile {
+		options = append(options, dfwriter.WithLockFile(""))
+	}
+	if *ofd {
+		options = append(options, dfwriter.WithLockMode(dfwriter.LockOFD))
+	}
+	if *rename {
+		options = append(options, dfwriter.WithRenameRotation())
+	}
+	if *numeric {
+		options = append(options, dfwriter.WithNumericBackups())
+	}
+	if *seq {
+		options = append(options, dfwriter.WithSequenceNumbers())
+	}
 
 	logger, err := dfwriter.New(*log, options...)
 	if err != nil {
@@ -41,6 +72,12 @@ func main() {
 			fmt.Fprintf(os.Stderr, "id=%s write: %v\n", *prefix, err)
 			os.Exit(1)
 		}
+		if *rotateEvery > 0 && (j+1)%*rotateEvery == 0 {
+			if err := logger.Rotate(); err != nil {
+				fmt.Fprintf(os.Stderr, "id=%s rotate: %v\n", *prefix, err)
+				os.Exit(1)
+			}
+		}
 	}
 	if err := logger.Sync(); err != nil {
 		fmt.Fprintf(os.Stderr, "id=%s sync: %v\n", *prefix, err)
@@ -0,0 +1,37 @@
+package dfwriter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// backupEnv is the environment variable passing the backup path to the post-rotate command.
+const backupEnv = "DFWRITER_BACKUP"
+
+// runPostRotateCommand runs the post-rotate command for the backup at backupPath, killing it once
+// the timeout elapses. Failures are reported to the error handler with the command's output.
+func (w *DistributedFileWriter) runPostRotateCommand(backupPath string) {
+	ctx := context.Background()
+	if w.postRotateTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.postRotateTimeout)
+		defer cancel()
+	}
+
+	argv := w.postRotateCommand
+	cmd := exec.CommandContext(ctx, argv[0], append(argv[1:len(argv):len(argv)], backupPath)...)
+	cmd.Env = append(os.Environ(), backupEnv+"="+backupPath)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait for children of a killed command keeping its output open
+	cmd.WaitDelay = w.postRotateTimeout
+
+	if err := cmd.Run(); err != nil {
+		w.handleError(fmt.Errorf("post-rotate command %s failed for %s: %w: %s", argv[0], backupPath, err,
+			bytes.TrimSpace(output.Bytes())))
+	}
+}
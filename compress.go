@@ -0,0 +1,247 @@
+package dfwriter
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressBackup compresses the complete, uncompressed backup at src into dst with format and
+// encrypts it if encryption is enabled, removes src and enforces the backup limits again now that
+// the new backup counts towards them. It is run in a background goroutine after rotation and
+// reports failures to the error handler.
+func (w *DistributedFileWriter) compressBackup(format CompressionFormat, src, dst string) {
+	defer w.compressions.Done()
+	defer func() {
+		w.cleanupMu.Lock()
+		delete(w.compressing, src)
+		w.cleanupMu.Unlock()
+	}()
+
+	opts := w.compressOptions(format)
+	if err := compressFile(w.fs, src, dst, opts); err != nil {
+		w.handleError(fmt.Errorf("failed to compress backup %s: %w", src, err))
+		return
+	}
+	if w.verifyRotation {
+		if err := verifyCompressed(w.fs, src, dst, opts.key); err != nil {
+			// The uncompressed backup is kept instead
+			w.fs.Remove(dst)
+			w.handleError(fmt.Errorf("failed to compress backup %s: %w", src, err))
+			return
+		}
+	}
+	// The uncompressed backup may have been removed by another process' cleanup already
+	if err := w.fs.Remove(src); err != nil && !errors.Is(err, os.ErrNotExist) {
+		w.handleError(fmt.Errorf("failed to compress backup %s: %w", src, err))
+		return
+	}
+	if err := w.syncDir(filepath.Dir(dst)); err != nil {
+		w.handleError(err)
+	}
+	if err := w.recordChecksum(dst, opts.checksum); err != nil {
+		w.handleError(err)
+	}
+	// Only now the compressed backup may be linked or removed by a cleanup
+	w.cleanupMu.Lock()
+	delete(w.compressing, src)
+	w.cleanupMu.Unlock()
+	w.linkLatest()
+	w.notifyRotate(dst)
+	w.enqueueUpload(dst)
+
+	if err := w.cleanupOldBackups(); err != nil {
+		w.handleError(fmt.Errorf("failed to clean up backups: %w", err))
+	}
+}
+
+// isCompressing reports whether backup is still being compressed, under its uncompressed or its
+// compressed name. The caller must hold w.cleanupMu.
+func (w *DistributedFileWriter) isCompressing(backup backupFile) bool {
+	_, ok := w.compressing[backupKey(backup).path]
+	return ok
+}
+
+// compressOptions configures how compressFile processes a backup.
+type compressOptions struct {
+	format CompressionFormat
+	// level is the gzip compression level
+	level int
+	// key encrypts the compressed backup unless nil
+	key []byte
+	// checksum receives the final contents unless nil
+	checksum hash.Hash
+	// done interrupts the compression once closed, unless nil
+	done <-chan struct{}
+	// dropCache is called with src and dst once dst is synced, unless nil
+	dropCache func(files ...fsFile)
+	// preserveTimes sets the access and modification times of dst to the modification time of src
+	preserveTimes bool
+}
+
+// compressOptions returns the options compressing a backup of the writer with format.
+func (w *DistributedFileWriter) compressOptions(format CompressionFormat) compressOptions {
+	return compressOptions{
+		format:        format,
+		level:         w.compressionLevel,
+		key:           w.encryptionKey,
+		checksum:      w.newChecksum(),
+		dropCache:     w.dropCache,
+		preserveTimes: w.preserveTimes,
+	}
+}
+
+// errCompressionInterrupted is returned by compressFile when its done channel is closed.
+var errCompressionInterrupted = errors.New("compression interrupted")
+
+// compressFile writes a compressed and, with a key, encrypted copy of src to a temporary file on fsys
+// with the permissions and ownership of src and renames it to dst once complete. src is left in
+// place. The temporary file is removed if the compression fails.
+func compressFile(fsys fileSystem, src, dst string, opts compressOptions) (err error) {
+	srcFile, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := dst + tmpExt
+	outFile, err := createBackupFile(fsys, tmpPath, info)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	defer func() {
+		if err != nil {
+			fsys.Remove(tmpPath)
+		}
+	}()
+
+	var out io.Writer = outFile
+	if opts.checksum != nil {
+		out = io.MultiWriter(outFile, opts.checksum)
+	}
+
+	// The compressed data is encrypted, as encrypted data doesn't compress
+	var encrypter *encryptWriter
+	if opts.key != nil {
+		if encrypter, err = newEncryptWriter(out, opts.key); err != nil {
+			return err
+		}
+		out = encrypter
+	}
+
+	var encoder io.WriteCloser
+	switch opts.format {
+	case CompressionNone:
+		encoder = nopWriteCloser{out}
+	case CompressionGzip:
+		// Reuse a pooled gzip.Writer on top of the file writer
+		gzipWriter := getGzipWriter(out, opts.level)
+		defer putGzipWriter(gzipWriter, opts.level)
+		encoder = gzipWriter
+	case CompressionZstd:
+		// Create a zstd.Encoder on top of the file writer
+		encoder, err = zstd.NewWriter(out)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported compression format %q", opts.format)
+	}
+
+	var in io.Reader = srcFile
+	if opts.done != nil {
+		in = interruptibleReader{r: srcFile, done: opts.done}
+	}
+	if _, err := io.Copy(encoder, in); err != nil {
+		encoder.Close()
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return err
+		}
+	}
+	if err := outFile.Sync(); err != nil {
+		return err
+	}
+	if opts.dropCache != nil {
+		opts.dropCache(srcFile, outFile)
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+	if opts.preserveTimes {
+		if err := fsys.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return fsys.Rename(tmpPath, dst)
+}
+
+// interruptibleReader reads from r until done is closed.
+type interruptibleReader struct {
+	r    io.Reader
+	done <-chan struct{}
+}
+
+func (r interruptibleReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.done:
+		return 0, errCompressionInterrupted
+	default:
+		return r.r.Read(p)
+	}
+}
+
+// gzipWriters pools gzip writers per compression level, indexed from gzip.HuffmanOnly, as each
+// holds over a megabyte of compression state.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+// validateGzipLevel checks that level is accepted by gzip.NewWriterLevel.
+func validateGzipLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	return nil
+}
+
+// getGzipWriter returns a gzip writer with the valid compression level writing to out.
+func getGzipWriter(out io.Writer, level int) *gzip.Writer {
+	if gzipWriter, ok := gzipWriters[level-gzip.HuffmanOnly].Get().(*gzip.Writer); ok {
+		gzipWriter.Reset(out)
+		return gzipWriter
+	}
+	gzipWriter, _ := gzip.NewWriterLevel(out, level)
+	return gzipWriter
+}
+
+// putGzipWriter returns a gzip writer obtained with getGzipWriter to the pool.
+func putGzipWriter(gzipWriter *gzip.Writer, level int) {
+	// Don't keep the output alive while pooled
+	gzipWriter.Reset(io.Discard)
+	gzipWriters[level-gzip.HuffmanOnly].Put(gzipWriter)
+}
+
+// nopWriteCloser passes writes through without compressing them.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
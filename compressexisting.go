@@ -0,0 +1,148 @@
+package dfwriter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CompressBackups gzips the uncompressed backups of the log file at logPath, e.g. after enabling
+// compression for a writer that ran without it, one at a time. Each compressed backup is verified
+// before the uncompressed one is removed. Backups being compressed by a writer are skipped.
+func CompressBackups(logPath string) error {
+	backups, err := listBackups(osFS{}, backupPrefix(logPath, ""))
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var errs []error
+	opts := compressOptions{format: CompressionGzip, level: gzip.DefaultCompression}
+	for _, backup := range backups {
+		if isCompressed(backup.path) || isEncrypted(backup.path) {
+			continue
+		}
+		err := compressExisting(osFS{}, backup.path, backup.path+CompressionGzip.extension(), opts)
+		if err != nil && !errors.Is(err, os.ErrExist) && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to compress backup %s: %w", backup.path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compressExistingLoop compresses the backups left uncompressed by previous runs, one at a time,
+// until none are left or the writer is closed. Failures are reported to the error handler.
+func (w *DistributedFileWriter) compressExistingLoop() {
+	failed := map[string]bool{}
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		src, format, ok := w.nextUncompressed(failed)
+		if !ok {
+			return
+		}
+		dst := src + format.extension()
+		if w.encryptionKey != nil {
+			dst += encryptedExt
+		}
+
+		opts := w.compressOptions(format)
+		opts.done = w.done
+		err := compressExisting(w.fs, src, dst, opts)
+		w.cleanupMu.Lock()
+		delete(w.compressing, src)
+		w.cleanupMu.Unlock()
+		switch {
+		case err == nil:
+			if err := w.syncDir(filepath.Dir(dst)); err != nil {
+				w.handleError(err)
+			}
+			if err := w.recordChecksum(dst, opts.checksum); err != nil {
+				w.handleError(err)
+			}
+		case errors.Is(err, errCompressionInterrupted):
+			return
+		case errors.Is(err, os.ErrExist) || errors.Is(err, os.ErrNotExist):
+			// Compressed or removed by another process
+			failed[src] = true
+		default:
+			failed[src] = true
+			w.handleError(fmt.Errorf("failed to compress existing backup %s: %w", src, err))
+		}
+	}
+}
+
+// nextUncompressed returns the oldest backup that is neither compressed nor encrypted and marks it
+// as being compressed, along with the current compression format. Backups in skip are ignored.
+// Reports false if there is none or the writer is closed.
+func (w *DistributedFileWriter) nextUncompressed(skip map[string]bool) (string, CompressionFormat, bool) {
+	// Holding w.mu, no rotation is creating a backup that is yet to be compressed
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || (w.compression == CompressionNone && w.encryptionKey == nil) {
+		return "", "", false
+	}
+
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+	// Unparsable backups don't prevent compressing the others
+	backups, _ := w.backups()
+	for _, backup := range backups {
+		if skip[backup.path] || isCompressed(backup.path) || isEncrypted(backup.path) {
+			continue
+		}
+		if w.isCompressing(backup) {
+			continue
+		}
+		w.compressing[backup.path] = struct{}{}
+		return backup.path, w.compression, true
+	}
+	return "", "", false
+}
+
+// compressExisting compresses the backup at src into dst on fsys, verifies that dst reads back as
+// src and removes src.
+func compressExisting(fsys fileSystem, src, dst string, opts compressOptions) error {
+	if err := compressFile(fsys, src, dst, opts); err != nil {
+		return err
+	}
+	if err := verifyCompressed(fsys, src, dst, opts.key); err != nil {
+		fsys.Remove(dst)
+		return err
+	}
+	return fsys.Remove(src)
+}
+
+// verifyCompressed checks that the compressed backup at dst on fsys, decrypted with key unless nil,
+// has the contents of src.
+func verifyCompressed(fsys fileSystem, src, dst string, key []byte) error {
+	want := sha256.New()
+	if err := hashFile(fsys, src, want); err != nil {
+		return err
+	}
+
+	r, closers, err := openBackupFile(fsys, dst, key)
+	if err != nil {
+		return err
+	}
+	got := sha256.New()
+	_, err = io.Copy(got, r)
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i].Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", dst, err)
+	}
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		return fmt.Errorf("%w: %s differs from %s", ErrBackupVerification, dst, src)
+	}
+	return nil
+}
@@ -0,0 +1,655 @@
+package dfwriter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of a DistributedFileWriter as plain data, e.g. to load them from a
+// JSON or YAML configuration file instead of passing options. Zero values keep the defaults of the
+// corresponding options. Settings taking functions or secrets, like the error handler, hooks, the
+// uploader and the encryption key, have no field and are passed as options to Config.New.
+//
+// Sizes are given as Size, e.g. "10MB", and durations as Duration, e.g. "7d". Enumerations are
+// given by name, as documented on each field.
+type Config struct {
+	// MaxBytes is the size at which the log file is rotated, see WithMaxBytes.
+	MaxBytes Size `json:"maxBytes,omitempty" yaml:"maxBytes,omitempty"`
+	// MaxBackups is the number of backups to keep, see WithMaxBackups.
+	MaxBackups int `json:"maxBackups,omitempty" yaml:"maxBackups,omitempty"`
+	// NoBackups truncates the log file on rotation without keeping a backup, see NoBackups.
+	NoBackups bool `json:"noBackups,omitempty" yaml:"noBackups,omitempty"`
+	// MaxTotalBytes limits the total size of the backups, see WithMaxTotalBytes.
+	MaxTotalBytes Size `json:"maxTotalBytes,omitempty" yaml:"maxTotalBytes,omitempty"`
+	// MaxAge is the age at which backups are deleted, see WithMaxAge.
+	MaxAge Duration `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+	// MaxBufferedBytes limits partial lines buffered by Write, see WithMaxBufferedBytes.
+	MaxBufferedBytes Size `json:"maxBufferedBytes,omitempty" yaml:"maxBufferedBytes,omitempty"`
+
+	// BackupDir is the directory of the backups, see WithBackupDir.
+	BackupDir string `json:"backupDir,omitempty" yaml:"backupDir,omitempty"`
+	// BackupNameTemplate names the backups, see WithBackupNameTemplate.
+	BackupNameTemplate string `json:"backupNameTemplate,omitempty" yaml:"backupNameTemplate,omitempty"`
+	// NumericBackups names the backups with numbers, see WithNumericBackups.
+	NumericBackups bool `json:"numericBackups,omitempty" yaml:"numericBackups,omitempty"`
+	// ArchiveDir is the directory backups are moved to instead of being deleted, see WithArchiveDir.
+	ArchiveDir string `json:"archiveDir,omitempty" yaml:"archiveDir,omitempty"`
+
+	// RotationInterval rotates the log file at a fixed interval, see WithRotationInterval.
+	RotationInterval Duration `json:"rotationInterval,omitempty" yaml:"rotationInterval,omitempty"`
+	// RotateAt rotates the log file daily at the given local time "HH:MM", see WithRotateAt.
+	RotateAt string `json:"rotateAt,omitempty" yaml:"rotateAt,omitempty"`
+	// RotateOnOpen is "never", "limits" or a duration for RotateOnOpenOlderThan, see WithRotateOnOpen.
+	RotateOnOpen string `json:"rotateOnOpen,omitempty" yaml:"rotateOnOpen,omitempty"`
+	// RenameRotation rotates by renaming the log file, see WithRenameRotation.
+	RenameRotation bool `json:"renameRotation,omitempty" yaml:"renameRotation,omitempty"`
+	// ReopenOnRotate reopens the log file once renamed or removed, see WithReopenOnRotate.
+	ReopenOnRotate bool `json:"reopenOnRotate,omitempty" yaml:"reopenOnRotate,omitempty"`
+
+	// Compression is the compression format of backups, "gzip" or "zstd", see WithCompressionFormat.
+	Compression CompressionFormat `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// CompressionLevel is the gzip compression level, see WithCompressionLevel.
+	CompressionLevel *int `json:"compressionLevel,omitempty" yaml:"compressionLevel,omitempty"`
+	// CompressExisting compresses the backups of previous runs, see WithCompressExisting.
+	CompressExisting bool `json:"compressExisting,omitempty" yaml:"compressExisting,omitempty"`
+	// Checksums records the digests of backups, see WithChecksums.
+	Checksums bool `json:"checksums,omitempty" yaml:"checksums,omitempty"`
+	// VerifyRotation verifies backups after copying them, see WithVerifyRotation.
+	VerifyRotation bool `json:"verifyRotation,omitempty" yaml:"verifyRotation,omitempty"`
+	// LatestSymlink maintains a link to the newest backup, see WithLatestSymlink.
+	LatestSymlink bool `json:"latestSymlink,omitempty" yaml:"latestSymlink,omitempty"`
+	// LatestSymlinkPath is the path of the link to the newest backup, see WithLatestSymlink.
+	LatestSymlinkPath string `json:"latestSymlinkPath,omitempty" yaml:"latestSymlinkPath,omitempty"`
+	// PostRotateCommand is run for every backup, see WithPostRotateCommand.
+	PostRotateCommand []string `json:"postRotateCommand,omitempty" yaml:"postRotateCommand,omitempty"`
+	// PostRotateTimeout limits the run time of the post-rotate command, see WithPostRotateCommand.
+	PostRotateTimeout Duration `json:"postRotateTimeout,omitempty" yaml:"postRotateTimeout,omitempty"`
+	// DiskFullRetries deletes backups when the disk is full, see WithDiskFullPolicy.
+	DiskFullRetries int `json:"diskFullRetries,omitempty" yaml:"diskFullRetries,omitempty"`
+	// DiskFullMinBackups is the number of backups never deleted when the disk is full, see
+	// WithDiskFullPolicy.
+	DiskFullMinBackups int `json:"diskFullMinBackups,omitempty" yaml:"diskFullMinBackups,omitempty"`
+
+	// Prefix is prepended to every line, see WithPrefix.
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// PrefixTemplate is expanded and prepended to every line, see WithPrefixTemplate.
+	PrefixTemplate string `json:"prefixTemplate,omitempty" yaml:"prefixTemplate,omitempty"`
+	// PrefixTimeLayout is the layout of %t in the prefix template, see WithPrefixTimeLayout.
+	PrefixTimeLayout string `json:"prefixTimeLayout,omitempty" yaml:"prefixTimeLayout,omitempty"`
+	// Timestamps is the layout of timestamps prepended to every line, see WithTimestamps.
+	Timestamps string `json:"timestamps,omitempty" yaml:"timestamps,omitempty"`
+	// TimestampsUTC formats the timestamps in UTC, see WithTimestamps.
+	TimestampsUTC bool `json:"timestampsUTC,omitempty" yaml:"timestampsUTC,omitempty"`
+	// Delimiter is the single byte terminating lines, see WithDelimiter.
+	Delimiter string `json:"delimiter,omitempty" yaml:"delimiter,omitempty"`
+	// OversizeLinePolicy is "error", "truncate" or "split", see WithOversizeLinePolicy.
+	OversizeLinePolicy string `json:"oversizeLinePolicy,omitempty" yaml:"oversizeLinePolicy,omitempty"`
+	// TruncationMarker is appended to truncated lines, see WithTruncationMarker.
+	TruncationMarker *string `json:"truncationMarker,omitempty" yaml:"truncationMarker,omitempty"`
+	// NormalizeCRLF strips carriage returns before delimiters, see WithNormalizeCRLF.
+	NormalizeCRLF bool `json:"normalizeCRLF,omitempty" yaml:"normalizeCRLF,omitempty"`
+	// BinaryRecords writes binary records instead of lines, see WithBinaryRecords.
+	BinaryRecords bool `json:"binaryRecords,omitempty" yaml:"binaryRecords,omitempty"`
+	// Sanitize lists the sanitize modes "utf8", "ansi", "control" or "all", see WithSanitize.
+	Sanitize []string `json:"sanitize,omitempty" yaml:"sanitize,omitempty"`
+	// SequenceNumbers adds sequence numbers to lines, see WithSequenceNumbers.
+	SequenceNumbers bool `json:"sequenceNumbers,omitempty" yaml:"sequenceNumbers,omitempty"`
+	// SequencePosition is "start" or "end", see WithSequencePosition.
+	SequencePosition string `json:"sequencePosition,omitempty" yaml:"sequencePosition,omitempty"`
+	// JSONEnvelope writes every line as a JSON object, see WithJSONEnvelope.
+	JSONEnvelope bool `json:"jsonEnvelope,omitempty" yaml:"jsonEnvelope,omitempty"`
+	// JSONEnvelopeFields are the field names of the JSON envelope, see WithJSONEnvelope.
+	JSONEnvelopeFields []string `json:"jsonEnvelopeFields,omitempty" yaml:"jsonEnvelopeFields,omitempty"`
+	// Dedupe is the window of suppressing duplicate lines, see WithDedupe.
+	Dedupe Duration `json:"dedupe,omitempty" yaml:"dedupe,omitempty"`
+	// RateLimit is the number of lines written per second, see WithRateLimit.
+	RateLimit float64 `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty"`
+	// RateLimitBurst is the burst of the rate limit, see WithRateLimit.
+	RateLimitBurst int `json:"rateLimitBurst,omitempty" yaml:"rateLimitBurst,omitempty"`
+	// RateLimitMode is "drop" or "block", see WithRateLimitMode.
+	RateLimitMode string `json:"rateLimitMode,omitempty" yaml:"rateLimitMode,omitempty"`
+
+	// FileMode is the octal permissions of the log file, e.g. "0640", see WithFileMode.
+	FileMode string `json:"fileMode,omitempty" yaml:"fileMode,omitempty"`
+	// MkdirAll is the octal permissions of missing parent directories, see WithMkdirAll.
+	MkdirAll string `json:"mkdirAll,omitempty" yaml:"mkdirAll,omitempty"`
+	// FileLocking locks the log file while writing, see WithFileLocking.
+	FileLocking bool `json:"fileLocking,omitempty" yaml:"fileLocking,omitempty"`
+	// LockFile locks a dedicated lock file instead of the log file, see WithLockFile.
+	LockFile bool `json:"lockFile,omitempty" yaml:"lockFile,omitempty"`
+	// LockFilePath is the path of the lock file, see WithLockFile.
+	LockFilePath string `json:"lockFilePath,omitempty" yaml:"lockFilePath,omitempty"`
+	// LockMode is "flock" or "ofd", see WithLockMode.
+	LockMode string `json:"lockMode,omitempty" yaml:"lockMode,omitempty"`
+	// LockTimeout limits waiting for the file lock, see WithLockTimeout.
+	LockTimeout Duration `json:"lockTimeout,omitempty" yaml:"lockTimeout,omitempty"`
+	// ExclusiveOwnership holds the file lock until Close, see WithExclusiveOwnership.
+	ExclusiveOwnership bool `json:"exclusiveOwnership,omitempty" yaml:"exclusiveOwnership,omitempty"`
+
+	// SyncEveryLine syncs the log file after every write, see SyncEveryLine.
+	SyncEveryLine bool `json:"syncEveryLine,omitempty" yaml:"syncEveryLine,omitempty"`
+	// SyncEveryBytes syncs the log file after the given number of bytes, see SyncEveryNBytes.
+	SyncEveryBytes Size `json:"syncEveryBytes,omitempty" yaml:"syncEveryBytes,omitempty"`
+	// SyncInterval syncs the log file in the background, see SyncInterval.
+	SyncInterval Duration `json:"syncInterval,omitempty" yaml:"syncInterval,omitempty"`
+	// FullFsync syncs with F_FULLFSYNC on darwin, see WithFullFsync.
+	FullFsync bool `json:"fullFsync,omitempty" yaml:"fullFsync,omitempty"`
+	// OpenSync opens the log file with O_SYNC, see WithOpenSync.
+	OpenSync bool `json:"openSync,omitempty" yaml:"openSync,omitempty"`
+	// DirSync syncs the directory after changing backups, see WithDirSync.
+	DirSync bool `json:"dirSync,omitempty" yaml:"dirSync,omitempty"`
+	// Preallocate reserves disk space for the log file, see WithPreallocate.
+	Preallocate bool `json:"preallocate,omitempty" yaml:"preallocate,omitempty"`
+	// DropCacheAfterRotate drops backups from the page cache, see WithDropCacheAfterRotate.
+	DropCacheAfterRotate bool `json:"dropCacheAfterRotate,omitempty" yaml:"dropCacheAfterRotate,omitempty"`
+
+	// Async is the number of writes queued for a background goroutine, see WithAsync.
+	Async int `json:"async,omitempty" yaml:"async,omitempty"`
+	// AsyncOverflow is "block", "dropNewest" or "dropOldest", see WithAsync.
+	AsyncOverflow string `json:"asyncOverflow,omitempty" yaml:"asyncOverflow,omitempty"`
+	// AsyncFailOnError returns errors of queued writes, see WithAsyncFailOnError.
+	AsyncFailOnError bool `json:"asyncFailOnError,omitempty" yaml:"asyncFailOnError,omitempty"`
+	// FlushInterval writes partial lines after the given duration, see WithFlushInterval.
+	FlushInterval Duration `json:"flushInterval,omitempty" yaml:"flushInterval,omitempty"`
+	// CleanupInterval enforces the backup limits periodically, see WithCleanupInterval.
+	CleanupInterval Duration `json:"cleanupInterval,omitempty" yaml:"cleanupInterval,omitempty"`
+	// RecentBuffer keeps the given number of lines written in memory, see WithRecentBuffer.
+	RecentBuffer int `json:"recentBuffer,omitempty" yaml:"recentBuffer,omitempty"`
+	// PreserveBackupTimes gives backups the modification time of their data, see WithPreserveBackupTimes.
+	PreserveBackupTimes bool `json:"preserveBackupTimes,omitempty" yaml:"preserveBackupTimes,omitempty"`
+	// EventBuffer delivers events on a channel of the given size, see WithEventBuffer.
+	EventBuffer int `json:"eventBuffer,omitempty" yaml:"eventBuffer,omitempty"`
+	// AtomicLineSize is the size of writes assumed to be atomic, see WithAtomicLineSize.
+	AtomicLineSize Size `json:"atomicLineSize,omitempty" yaml:"atomicLineSize,omitempty"`
+	// ReadBufferSize is the size of the chunks read by ReadFrom, see WithReadBufferSize.
+	ReadBufferSize Size `json:"readBufferSize,omitempty" yaml:"readBufferSize,omitempty"`
+	// MaxOpenFiles limits the writers a MultiWriter keeps open, see WithMaxOpenFiles.
+	MaxOpenFiles int `json:"maxOpenFiles,omitempty" yaml:"maxOpenFiles,omitempty"`
+	// IdleTimeout closes idle writers of a MultiWriter, see WithIdleTimeout.
+	IdleTimeout Duration `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+}
+
+// New returns a writer for the log file at path with the settings of c, followed by options, e.g.
+// for the settings Config has no field for. Returns a *ConfigError naming the offending field if a
+// setting is invalid.
+func (c *Config) New(path string, options ...Option) (*DistributedFileWriter, error) {
+	configOptions, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	return New(path, append(configOptions, options...)...)
+}
+
+// Options returns the options corresponding to the settings of c, e.g. to apply a reloaded
+// configuration with Reconfigure. Zero values add no option. Returns a *ConfigError naming the offending field if a setting is
+// invalid.
+func (c *Config) Options() ([]Option, error) {
+	var options []Option
+	add := func(set bool, o Option) {
+		if set {
+			options = append(options, o)
+		}
+	}
+
+	for _, count := range []struct {
+		field string
+		value int
+	}{
+		{"maxBackups", c.MaxBackups},
+		{"diskFullRetries", c.DiskFullRetries},
+		{"diskFullMinBackups", c.DiskFullMinBackups},
+		{"rateLimitBurst", c.RateLimitBurst},
+		{"async", c.Async},
+		{"recentBuffer", c.RecentBuffer},
+		{"eventBuffer", c.EventBuffer},
+		{"maxOpenFiles", c.MaxOpenFiles},
+	} {
+		if count.value < 0 {
+			return nil, &ConfigError{Field: count.field, Err: fmt.Errorf("invalid count %d, must not be negative", count.value)}
+		}
+	}
+	if c.NoBackups && c.MaxBackups != 0 {
+		return nil, &ConfigError{Field: "noBackups", Err: fmt.Errorf("only one of maxBackups and noBackups can be set")}
+	}
+
+	add(c.MaxBytes != 0, WithMaxBytes(int64(c.MaxBytes)))
+	add(c.MaxBackups != 0, WithMaxBackups(c.MaxBackups))
+	add(c.NoBackups, WithMaxBackups(NoBackups))
+	add(c.MaxTotalBytes != 0, WithMaxTotalBytes(int64(c.MaxTotalBytes)))
+	add(c.MaxAge != 0, WithMaxAge(time.Duration(c.MaxAge)))
+	add(c.MaxBufferedBytes != 0, WithMaxBufferedBytes(int(c.MaxBufferedBytes)))
+
+	add(c.BackupDir != "", WithBackupDir(c.BackupDir))
+	add(c.BackupNameTemplate != "", WithBackupNameTemplate(c.BackupNameTemplate))
+	add(c.NumericBackups, WithNumericBackups())
+	add(c.ArchiveDir != "", WithArchiveDir(c.ArchiveDir))
+
+	add(c.RotationInterval != 0, WithRotationInterval(time.Duration(c.RotationInterval)))
+	if c.RotateAt != "" {
+		at, err := time.Parse("15:04", c.RotateAt)
+		if err != nil {
+			return nil, &ConfigError{Field: "rotateAt", Err: fmt.Errorf("invalid time of day %q, expected HH:MM", c.RotateAt)}
+		}
+		options = append(options, WithRotateAt(at.Hour(), at.Minute()))
+	}
+	switch c.RotateOnOpen {
+	case "", "never":
+	case "limits":
+		options = append(options, WithRotateOnOpen(RotateOnOpenLimits))
+	default:
+		var age Duration
+		if err := age.UnmarshalText([]byte(c.RotateOnOpen)); err != nil {
+			return nil, &ConfigError{Field: "rotateOnOpen", Err: fmt.Errorf("expected never, limits or a duration: %w", err)}
+		}
+		options = append(options, WithRotateOnOpen(RotateOnOpenOlderThan(time.Duration(age))))
+	}
+	add(c.RenameRotation, WithRenameRotation())
+	add(c.ReopenOnRotate, WithReopenOnRotate())
+
+	switch c.Compression {
+	case CompressionNone:
+	case CompressionGzip, CompressionZstd:
+		options = append(options, WithCompressionFormat(c.Compression))
+	default:
+		return nil, &ConfigError{Field: "compression", Err: fmt.Errorf("unsupported compression format %q", c.Compression)}
+	}
+	if c.CompressionLevel != nil {
+		if err := validateGzipLevel(*c.CompressionLevel); err != nil {
+			return nil, &ConfigError{Field: "compressionLevel", Err: err}
+		}
+		options = append(options, WithCompressionLevel(*c.CompressionLevel))
+	}
+	add(c.CompressExisting, WithCompressExisting())
+	add(c.Checksums, WithChecksums())
+	add(c.VerifyRotation, WithVerifyRotation())
+	add(c.LatestSymlink, WithLatestSymlink(c.LatestSymlinkPath))
+	add(c.PostRotateCommand != nil, WithPostRotateCommand(c.PostRotateCommand, time.Duration(c.PostRotateTimeout)))
+	add(c.DiskFullRetries != 0, WithDiskFullPolicy(c.DiskFullRetries, c.DiskFullMinBackups, nil))
+
+	add(c.Prefix != "", WithPrefix([]byte(c.Prefix)))
+	add(c.PrefixTemplate != "", WithPrefixTemplate(c.PrefixTemplate))
+	add(c.PrefixTimeLayout != "", WithPrefixTimeLayout(c.PrefixTimeLayout))
+	add(c.Timestamps != "", WithTimestamps(c.Timestamps, c.TimestampsUTC))
+	if c.Delimiter != "" {
+		if len(c.Delimiter) != 1 {
+			return nil, &ConfigError{Field: "delimiter", Err: fmt.Errorf("delimiter %q must be a single byte", c.Delimiter)}
+		}
+		options = append(options, WithDelimiter(c.Delimiter[0]))
+	}
+	switch c.OversizeLinePolicy {
+	case "", "error":
+	case "truncate":
+		options = append(options, WithOversizeLinePolicy(OversizeTruncate))
+	case "split":
+		options = append(options, WithOversizeLinePolicy(OversizeSplit))
+	default:
+		return nil, &ConfigError{Field: "oversizeLinePolicy", Err: fmt.Errorf("unknown policy %q, expected error, truncate or split", c.OversizeLinePolicy)}
+	}
+	if c.TruncationMarker != nil {
+		options = append(options, WithTruncationMarker([]byte(*c.TruncationMarker)))
+	}
+	add(c.NormalizeCRLF, WithNormalizeCRLF())
+	add(c.BinaryRecords, WithBinaryRecords())
+	if len(c.Sanitize) > 0 {
+		var mode SanitizeMode
+		for _, name := range c.Sanitize {
+			switch name {
+			case "utf8":
+				mode |= SanitizeUTF8
+			case "ansi":
+				mode |= SanitizeANSI
+			case "control":
+				mode |= SanitizeControl
+			case "all":
+				mode |= SanitizeAll
+			default:
+				return nil, &ConfigError{Field: "sanitize", Err: fmt.Errorf("unknown mode %q, expected utf8, ansi, control or all", name)}
+			}
+		}
+		options = append(options, WithSanitize(mode))
+	}
+	add(c.SequenceNumbers, WithSequenceNumbers())
+	switch c.SequencePosition {
+	case "", "start":
+	case "end":
+		options = append(options, WithSequencePosition(SequenceEnd))
+	default:
+		return nil, &ConfigError{Field: "sequencePosition", Err: fmt.Errorf("unknown position %q, expected start or end", c.SequencePosition)}
+	}
+	add(c.JSONEnvelope, WithJSONEnvelope(c.JSONEnvelopeFields...))
+	add(c.Dedupe != 0, WithDedupe(time.Duration(c.Dedupe)))
+	add(c.RateLimit != 0, WithRateLimit(c.RateLimit, c.RateLimitBurst))
+	switch c.RateLimitMode {
+	case "", "drop":
+	case "block":
+		options = append(options, WithRateLimitMode(RateLimitBlock))
+	default:
+		return nil, &ConfigError{Field: "rateLimitMode", Err: fmt.Errorf("unknown mode %q, expected drop or block", c.RateLimitMode)}
+	}
+
+	for _, perm := range []struct {
+		field, value string
+		option       func(os.FileMode) Option
+	}{
+		{"fileMode", c.FileMode, WithFileMode},
+		{"mkdirAll", c.MkdirAll, WithMkdirAll},
+	} {
+		if perm.value == "" {
+			continue
+		}
+		mode, err := strconv.ParseUint(perm.value, 8, 32)
+		if err != nil || mode&^uint64(os.ModePerm) != 0 {
+			return nil, &ConfigError{Field: perm.field, Err: fmt.Errorf("invalid permissions %q, expected octal like 0644", perm.value)}
+		}
+		options = append(options, perm.option(os.FileMode(mode)))
+	}
+	add(c.FileLocking, WithFileLocking())
+	add(c.LockFile, WithLockFile(c.LockFilePath))
+	switch c.LockMode {
+	case "", LockFlock.String():
+	case LockOFD.String():
+		options = append(options, WithLockMode(LockOFD))
+	default:
+		return nil, &ConfigError{Field: "lockMode", Err: fmt.Errorf("unknown lock mode %q, expected flock or ofd", c.LockMode)}
+	}
+	add(c.LockTimeout != 0, WithLockTimeout(time.Duration(c.LockTimeout)))
+	add(c.ExclusiveOwnership, WithExclusiveOwnership())
+
+	syncPolicies := 0
+	for _, set := range []bool{c.SyncEveryLine, c.SyncEveryBytes != 0, c.SyncInterval != 0} {
+		if set {
+			syncPolicies++
+		}
+	}
+	if syncPolicies > 1 {
+		return nil, &ConfigError{Field: "syncEveryLine", Err: fmt.Errorf("only one of syncEveryLine, syncEveryBytes and syncInterval can be set")}
+	}
+	add(c.SyncEveryLine, WithSyncPolicy(SyncEveryLine))
+	add(c.SyncEveryBytes != 0, WithSyncPolicy(SyncEveryNBytes(int64(c.SyncEveryBytes))))
+	add(c.SyncInterval != 0, WithSyncPolicy(SyncInterval(time.Duration(c.SyncInterval))))
+	add(c.FullFsync, WithFullFsync())
+	add(c.OpenSync, WithOpenSync())
+	add(c.DirSync, WithDirSync())
+	add(c.Preallocate, WithPreallocate())
+	add(c.DropCacheAfterRotate, WithDropCacheAfterRotate())
+
+	var policy OverflowPolicy
+	switch c.AsyncOverflow {
+	case "", "block":
+	case "dropNewest":
+		policy = OverflowDropNewest
+	case "dropOldest":
+		policy = OverflowDropOldest
+	default:
+		return nil, &ConfigError{Field: "asyncOverflow", Err: fmt.Errorf("unknown policy %q, expected block, dropNewest or dropOldest", c.AsyncOverflow)}
+	}
+	if c.AsyncFailOnError && (c.Async == 0 || policy != OverflowBlock) {
+		return nil, &ConfigError{Field: "asyncFailOnError", Err: fmt.Errorf("requires async with the block overflow policy")}
+	}
+	add(c.Async != 0, WithAsync(c.Async, policy))
+	add(c.AsyncFailOnError, WithAsyncFailOnError())
+	add(c.FlushInterval != 0, WithFlushInterval(time.Duration(c.FlushInterval)))
+	add(c.CleanupInterval != 0, WithCleanupInterval(time.Duration(c.CleanupInterval)))
+	add(c.RecentBuffer != 0, WithRecentBuffer(c.RecentBuffer))
+	add(c.PreserveBackupTimes, WithPreserveBackupTimes())
+	add(c.EventBuffer != 0, WithEventBuffer(c.EventBuffer))
+	add(c.AtomicLineSize != 0, WithAtomicLineSize(int(c.AtomicLineSize)))
+	add(c.ReadBufferSize != 0, WithReadBufferSize(int(c.ReadBufferSize)))
+	add(c.MaxOpenFiles != 0, WithMaxOpenFiles(c.MaxOpenFiles))
+	add(c.IdleTimeout != 0, WithIdleTimeout(time.Duration(c.IdleTimeout)))
+
+	return options, nil
+}
+
+// Config returns a snapshot of the settings of w, e.g. to log or verify the effective
+// configuration. Paths are resolved like by New, and settings without a Config field are omitted.
+// Passing the snapshot to Config.New creates a writer with the same settings.
+func (w *DistributedFileWriter) Config() Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+
+	c := Config{
+		MaxBytes:             Size(w.maxSize),
+		MaxBackups:           max(w.maxBackups, 0),
+		NoBackups:            w.maxBackups == NoBackups,
+		MaxTotalBytes:        Size(w.maxTotalBytes),
+		MaxAge:               Duration(w.maxAge),
+		MaxBufferedBytes:     Size(w.maxBuffered),
+		BackupDir:            w.backupDir,
+		BackupNameTemplate:   w.nameTemplateText,
+		NumericBackups:       w.numericBackups,
+		ArchiveDir:           w.archiveDir,
+		RotationInterval:     Duration(w.interval),
+		RenameRotation:       w.renameRotation,
+		ReopenOnRotate:       w.reopenOnRotate && !w.renameRotation,
+		Compression:          w.compression,
+		CompressExisting:     w.compressExisting,
+		Checksums:            w.checksums,
+		VerifyRotation:       w.verifyRotation,
+		LatestSymlink:        w.latestLink,
+		LatestSymlinkPath:    w.latestPath,
+		PostRotateCommand:    slices.Clone(w.postRotateCommand),
+		PostRotateTimeout:    Duration(w.postRotateTimeout),
+		DiskFullRetries:      w.diskFullRetries,
+		DiskFullMinBackups:   w.diskFullMinBackups,
+		Prefix:               string(w.prefix),
+		PrefixTemplate:       w.templateText,
+		NormalizeCRLF:        w.normalizeCRLF,
+		BinaryRecords:        w.binaryRecords,
+		SequenceNumbers:      w.sequenceNumbers,
+		JSONEnvelope:         w.envelopeFields != nil,
+		JSONEnvelopeFields:   slices.Clone(w.envelopeFields),
+		Dedupe:               Duration(w.dedupe.window),
+		RateLimit:            w.rateLimit.rate,
+		FileMode:             fmt.Sprintf("%#o", w.mode),
+		FileLocking:          w.fsLock && !w.useLockFile,
+		LockFile:             w.useLockFile,
+		LockFilePath:         w.lockPath,
+		LockMode:             w.lockMode.String(),
+		LockTimeout:          Duration(w.lockTimeout),
+		ExclusiveOwnership:   w.exclusiveOwner,
+		SyncEveryLine:        w.syncPolicy.everyLine,
+		SyncEveryBytes:       Size(w.syncPolicy.bytes),
+		SyncInterval:         Duration(w.syncPolicy.interval),
+		FullFsync:            w.fullFsync,
+		OpenSync:             w.openSync,
+		DirSync:              w.dirSync,
+		Preallocate:          w.preallocateSpace,
+		DropCacheAfterRotate: w.dropCacheOnRotate,
+		Async:                w.asyncSize,
+		AsyncFailOnError:     w.asyncFailOnError,
+		FlushInterval:        Duration(w.flushInterval),
+		CleanupInterval:      Duration(w.cleanupInterval),
+		RecentBuffer:         w.recentSize,
+		PreserveBackupTimes:  w.preserveTimes,
+		EventBuffer:          w.eventBuffer,
+		AtomicLineSize:       Size(w.atomicLineSize),
+		ReadBufferSize:       Size(w.readBufferSize),
+		MaxOpenFiles:         w.maxOpenFiles,
+		IdleTimeout:          Duration(w.idleTimeout),
+	}
+	if w.rotateDaily {
+		c.RotateAt = fmt.Sprintf("%02d:%02d", w.rotateHour, w.rotateMinute)
+	}
+	switch {
+	case w.openPolicy.maxAge > 0:
+		c.RotateOnOpen = Duration(w.openPolicy.maxAge).String()
+	case w.openPolicy.limits:
+		c.RotateOnOpen = "limits"
+	}
+	if w.compressionLevel != gzip.DefaultCompression {
+		level := w.compressionLevel
+		c.CompressionLevel = &level
+	}
+	if w.templateText != "" {
+		c.PrefixTimeLayout = w.timeLayout
+	}
+	if w.timestamps != nil {
+		c.Timestamps, c.TimestampsUTC = w.timestamps.layout, w.timestamps.utc
+	}
+	if w.delimiter != '\n' {
+		c.Delimiter = string(w.delimiter)
+	}
+	switch w.oversizePolicy {
+	case OversizeTruncate:
+		c.OversizeLinePolicy = "truncate"
+	case OversizeSplit:
+		c.OversizeLinePolicy = "split"
+	}
+	if !bytes.Equal(w.truncationMarker, defaultTruncationMarker) {
+		marker := string(w.truncationMarker)
+		c.TruncationMarker = &marker
+	}
+	for _, mode := range []struct {
+		mode SanitizeMode
+		name string
+	}{{SanitizeUTF8, "utf8"}, {SanitizeANSI, "ansi"}, {SanitizeControl, "control"}} {
+		if w.sanitizeMode&mode.mode != 0 {
+			c.Sanitize = append(c.Sanitize, mode.name)
+		}
+	}
+	if w.sequencePosition == SequenceEnd {
+		c.SequencePosition = "end"
+	}
+	if w.rateLimit.rate != 0 {
+		c.RateLimitBurst = int(w.rateLimit.burst)
+		if w.rateLimit.mode == RateLimitBlock {
+			c.RateLimitMode = "block"
+		}
+	}
+	if w.mkdirPerm != 0 {
+		c.MkdirAll = fmt.Sprintf("%#o", w.mkdirPerm)
+	}
+	switch w.asyncPolicy {
+	case OverflowDropNewest:
+		c.AsyncOverflow = "dropNewest"
+	case OverflowDropOldest:
+		c.AsyncOverflow = "dropOldest"
+	}
+	return c
+}
+
+// UnmarshalJSON decodes c from a JSON object like encoding/json, returning a *ConfigError naming
+// the offending field if a value is invalid, and rejecting unknown fields.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(c).Elem()
+	for key, value := range fields {
+		field, name := configField(v, key)
+		if !field.IsValid() {
+			return &ConfigError{Field: key, Err: fmt.Errorf("unknown field")}
+		}
+		if err := json.Unmarshal(value, field.Addr().Interface()); err != nil {
+			return &ConfigError{Field: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// configField returns the field of the Config v named key in JSON, matched case-insensitively like
+// by encoding/json, and its JSON name. The returned value is invalid if there is no such field.
+func configField(v reflect.Value, key string) (reflect.Value, string) {
+	t := v.Type()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if strings.EqualFold(name, key) {
+			return v.Field(i), name
+		}
+	}
+	return reflect.Value{}, ""
+}
+
+// Size is a number of bytes in a Config. As text, it is parsed with ParseSize, e.g. "10MB". In
+// JSON, it may also be a number of bytes.
+type Size int64
+
+// String returns the size with the largest unit dividing it, e.g. "10MB".
+func (s Size) String() string {
+	for shift := uint(50); s != 0 && shift > 0; shift -= 10 {
+		if s%(1<<shift) == 0 {
+			return strconv.FormatInt(int64(s>>shift), 10) + string("KMGTP"[shift/10-1]) + "B"
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+// MarshalText encodes the size like String.
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a size with ParseSize.
+func (s *Size) UnmarshalText(text []byte) error {
+	n, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = Size(n)
+	return nil
+}
+
+// UnmarshalJSON decodes a size from a string like "10MB" or a number of bytes.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return s.UnmarshalText([]byte(text))
+	}
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %s", data)
+	}
+	*s = Size(n)
+	return nil
+}
+
+// Duration is a time.Duration in a Config. As text, it is parsed with ParseAge, e.g. "7d" or
+// "1d12h".
+type Duration time.Duration
+
+// String returns the duration like time.Duration, with whole days in the unit d, e.g. "7d".
+func (d Duration) String() string {
+	days, rest := time.Duration(d)/day, time.Duration(d)%day
+	switch {
+	case days <= 0:
+		return time.Duration(d).String()
+	case rest == 0:
+		return strconv.FormatInt(int64(days), 10) + "d"
+	default:
+		return strconv.FormatInt(int64(days), 10) + "d" + rest.String()
+	}
+}
+
+// MarshalText encodes the duration like String.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText decodes a duration with ParseAge.
+func (d *Duration) UnmarshalText(text []byte) error {
+	age, err := ParseAge(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(age)
+	return nil
+}
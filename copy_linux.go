@@ -0,0 +1,45 @@
+//go:build linux
+
+package dfwriter
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyFileRange is the copy_file_range system call. It is a variable so tests can make it fail.
+var copyFileRange = unix.CopyFileRange
+
+// maxCopyRange is the number of bytes requested per copy_file_range call.
+const maxCopyRange = 1 << 30
+
+// kernelCopy copies the rest of src to dst within the kernel using copy_file_range, which also
+// lets filesystems supporting it share the data instead of copying it. Reports false if the kernel
+// or the filesystems don't support it, in which case nothing was copied. Files not opened by the
+// os package are always copied in userspace.
+func kernelCopy(dst, src fsFile) (int64, bool, error) {
+	if _, ok := dst.(*os.File); !ok {
+		return 0, false, nil
+	}
+	if _, ok := src.(*os.File); !ok {
+		return 0, false, nil
+	}
+
+	var written int64
+	for {
+		n, err := copyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, maxCopyRange, 0)
+		if err != nil {
+			if written == 0 && (errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) ||
+				errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)) {
+				return 0, false, nil
+			}
+			return written, true, err
+		}
+		if n == 0 {
+			return written, true, nil
+		}
+		written += int64(n)
+	}
+}
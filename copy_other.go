@@ -0,0 +1,8 @@
+//go:build !linux
+
+package dfwriter
+
+// kernelCopy reports false, as copying within the kernel is only supported on Linux.
+func kernelCopy(dst, src fsFile) (int64, bool, error) {
+	return 0, false, nil
+}
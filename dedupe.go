@@ -0,0 +1,110 @@
+package dfwriter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// dedupeState tracks the previous line and its suppressed duplicates for WithDedupe.
+type dedupeState struct {
+	window    time.Duration
+	last      []byte // content of the previous line written
+	delimited bool   // whether the previous line ended with the delimiter
+	valid     bool   // whether last holds a line to compare against
+	since     time.Time
+	repeated  int64 // duplicates of the previous line suppressed since
+}
+
+// suppressDuplicate reports whether a line of content is a duplicate of the previous line written
+// within the dedupe window, counting it if so. Otherwise the line is remembered as the previous line.
+func (w *DistributedFileWriter) suppressDuplicate(content []byte, delimited bool) bool {
+	d := &w.dedupe
+	if d.window <= 0 {
+		return false
+	}
+
+	now := w.clock.Now()
+	if d.valid && delimited == d.delimited && bytes.Equal(content, d.last) && now.Sub(d.since) < d.window {
+		d.repeated++
+		return true
+	}
+	d.last = append(d.last[:0], content...)
+	d.delimited = delimited
+	d.valid = true
+	d.since = now
+	return false
+}
+
+// writeRepeated writes a summary line for the suppressed duplicates of the previous line, if any.
+// The caller must hold w.mu.
+func (w *DistributedFileWriter) writeRepeated() error {
+	d := &w.dedupe
+	if d.repeated == 0 {
+		return nil
+	}
+
+	w.notice = append(w.notice[:0], "… last message repeated "...)
+	w.notice = strconv.AppendInt(w.notice, d.repeated, 10)
+	w.notice = append(w.notice, " times"...)
+	if err := w.writeContent(w.notice, true); err != nil {
+		return err
+	}
+	d.repeated = 0
+	return nil
+}
+
+// pendingNotices reports whether a summary of suppressed duplicates or a marker for dropped lines
+// is due to be written before the next line.
+func (w *DistributedFileWriter) pendingNotices() bool {
+	return w.dedupe.repeated > 0 || w.rateLimit.dropped > 0
+}
+
+// writeNotices writes the summary of suppressed duplicates and the marker for dropped lines, if
+// due. The caller must hold w.mu.
+func (w *DistributedFileWriter) writeNotices() error {
+	if err := w.writeRepeated(); err != nil {
+		return err
+	}
+	return w.writeDropped()
+}
+
+// resetDedupe forgets the previous line, so the next line is written even if it is a duplicate.
+func (w *DistributedFileWriter) resetDedupe() {
+	w.dedupe.valid = false
+}
+
+// dedupeLoop writes the summary of suppressed duplicates once the dedupe window has expired
+// without another line being written, until the writer is closed.
+func (w *DistributedFileWriter) dedupeLoop() {
+	ticker := w.clock.NewTicker(w.dedupe.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C():
+			if err := w.writeExpiredRepeated(); err != nil && !errors.Is(err, ErrClosed) {
+				w.handleError(fmt.Errorf("failed to write repeated message summary: %w", err))
+			}
+		}
+	}
+}
+
+// writeExpiredRepeated writes the summary of suppressed duplicates if the dedupe window expired.
+func (w *DistributedFileWriter) writeExpiredRepeated() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.clock.Now().Sub(w.dedupe.since) < w.dedupe.window {
+		return nil
+	}
+
+	return w.writeRepeated()
+}
@@ -2,89 +2,568 @@ package dfwriter
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
+	"unsafe"
 )
 
+// CompressionFormat identifies the compression algorithm applied to rotated backup files.
+type CompressionFormat string
+
+const (
+	// CompressionNone stores backups uncompressed.
+	CompressionNone CompressionFormat = ""
+	// CompressionGzip compresses backups with gzip and appends a .gz extension.
+	CompressionGzip CompressionFormat = "gzip"
+	// CompressionZstd compresses backups with Zstandard and appends a .zst extension.
+	CompressionZstd CompressionFormat = "zstd"
+)
+
+// Special values of the max backups, see WithMaxBackups.
+const (
+	// UnlimitedBackups keeps all backups (default).
+	UnlimitedBackups = 0
+	// NoBackups discards the contents of the log file on rotation instead of keeping a backup.
+	NoBackups = -1
+)
+
+// backupTimeFormat is the layout of the rotation timestamp in backup file names.
+const backupTimeFormat = "20060102-150405"
+
+// backupNamePattern matches the part of a backup name following the log file name, capturing the
+// timestamp, the optional milliseconds and the optional index, followed by the optional compression
+// and encryption extensions.
+var backupNamePattern = regexp.MustCompile(`^(\d{8}-\d{6})(?:\.(\d{3})\.pid\d+)?(?:\.(\d+))?(?:\.gz|\.zst)?(?:\.enc)?$`)
+
+// Operations used for rotation beyond those of the file system. They are variables so tests can
+// observe and interfere with them.
+var (
+	copyFile = io.Copy
+	// dropFileCache drops the cached pages of a synced file, see WithDropCacheAfterRotate
+	dropFileCache = fadviseDontNeed
+)
+
+// orphanedTempAge is the time after which an untouched temporary backup file is considered orphaned.
+const orphanedTempAge = time.Hour
+
+// emptyBackupAge is the time after which an untouched empty backup is removed.
+const emptyBackupAge = time.Hour
+
+// Bounds of the backoff between attempts to acquire a file lock with a lock timeout.
+const (
+	minLockBackoff = time.Millisecond
+	maxLockBackoff = 100 * time.Millisecond
+)
+
+// lockExt is appended to the log path to name the default lock file, see WithLockFile.
+const lockExt = ".lock"
+
+// tmpExt is appended to backups that are still being written or compressed.
+const tmpExt = ".tmp"
+
+// extension returns the file extension used for backups compressed with f.
+func (f CompressionFormat) extension() string {
+	switch f {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// DistributedFileWriter is safe for concurrent use by multiple goroutines.
 type DistributedFileWriter struct {
-	fsLock         bool
-	compress       bool
-	maxBackups     int
-	maxSize        int64
-	atomicLineSize int
-	file           *os.File
-	maxAge         time.Duration
-	prefix         []byte
-	buf            bytes.Buffer
-}
-
-// Write buffers the given bytes. If a newline is encountered, the buffer
-// contents are written to the file via the WriteLine method.
-// Returns the number of bytes buffered and any error encountered.
+	mu                 sync.Mutex
+	clock              Clock
+	fs                 fileSystem
+	fsLock             bool
+	lockMode           LockMode
+	exclusiveOwner     bool
+	syncPolicy         SyncPolicy
+	unsynced           int64 // bytes written since the last sync of the log file
+	fullFsync          bool
+	openSync           bool
+	useLockFile        bool
+	lockPath           string
+	lockHandle         fsFile // open lock file, if locking through a lock file
+	lockTimeout        time.Duration
+	lockCtx            context.Context // context of the write in progress, if any
+	renameRotation     bool
+	dirSync            bool
+	reopenOnRotate     bool
+	onReopen           func(string)
+	mode               os.FileMode
+	mkdirPerm          os.FileMode
+	compression        CompressionFormat
+	compressionLevel   int
+	compressExisting   bool
+	verifyRotation     bool
+	preallocateSpace   bool
+	dropCacheOnRotate  bool
+	asyncSize          int
+	asyncPolicy        OverflowPolicy
+	asyncFailOnError   bool
+	async              *asyncQueue
+	childMu            sync.Mutex
+	children           map[*ChildWriter]struct{}
+	childrenClosed     bool
+	envelopeFields     []string // nil unless WithJSONEnvelope is set
+	jsonEnvelope       *jsonEnvelope
+	envelopeBuf        []byte
+	sanitizeMode       SanitizeMode
+	sanitizeBuf        []byte
+	optionErr          error // errors of options parsing their arguments, see WithMaxBytesString
+	sequenceNumbers    bool
+	sequencePosition   SequencePosition
+	sequencePath       string
+	seqEpoch           int64 // epoch of the sequence numbers with file locking, set by New
+	seqNext            int64 // next sequence number to use
+	seqLimit           int64 // end of the reserved sequence numbers
+	seqBuf             []byte
+	maxBackups         int
+	maxSize            int64
+	maxTotalBytes      int64
+	retentionTiers     []Tier
+	preserveTimes      bool
+	onBackupRemoved    func(path string, reason RemovalReason)
+	keepBackup         func(path string, reason RemovalReason) bool
+	archiveDir         string
+	backupDir          string
+	nameTemplateText   string
+	nameTemplate       *backupNameTemplate
+	numericBackups     bool
+	stats              writerStats
+	diskFullRetries    int
+	diskFullMinBackups int
+	onDiskFullPrune    func(path string, err error)
+	maxBuffered        int
+	oversizePolicy     OversizeLinePolicy
+	truncationMarker   []byte
+	atomicLineSize     int
+	delimiter          byte
+	normalizeCRLF      bool
+	binaryRecords      bool
+	lineTransform      func(line []byte) []byte
+	readBufferSize     int
+	path               string    // path of the log file, set by New and never changed
+	file               fsFile    // guarded by mu, replaced by reopening and rename rotation
+	size               int64     // size of the log file as of the last stat or write
+	modTime            time.Time // modification time of the log file as of the last stat or write
+	maxAge             time.Duration
+	interval           time.Duration
+	rotateDaily        bool
+	rotateHour         int
+	rotateMinute       int
+	prefix             []byte
+	prefixFunc         func() []byte
+	prefixBuf          []byte
+	timestamps         *timestampCache
+	dedupe             dedupeState
+	rateLimit          rateLimiter
+	notice             []byte // scratch buffer for summary and marker lines
+	tees               []io.Writer
+	recentSize         int           // lines kept by the recent buffer
+	recent             *recentLines  // nil without WithRecentBuffer
+	eventBuffer        int           // size of the event channel
+	events             *eventQueue   // nil without WithEventBuffer
+	maxOpenFiles       int           // only used by NewMulti
+	idleTimeout        time.Duration // only used by NewMulti
+	templateText       string
+	template           prefixTemplate
+	timeLayout         string
+	buf                bytes.Buffer
+	scratch            []byte
+	lines              [][]byte
+	closed             bool
+	onError            func(error)
+	reporter           *errorReporter
+	cleanupMu          sync.Mutex
+	compressing        map[string]struct{} // guarded by cleanupMu
+	filled             map[string]struct{} // backups known not to be empty, guarded by cleanupMu
+	compressions       sync.WaitGroup
+	onRotate           func(backupPath string)
+	postRotateCommand  []string
+	postRotateTimeout  time.Duration
+	hookMu             sync.Mutex
+	hookQueue          []string // guarded by hookMu
+	hooksRunning       bool     // guarded by hookMu
+	hooks              sync.WaitGroup
+	flushInterval      time.Duration
+	cleanupInterval    time.Duration
+	openPolicy         RotateOnOpenPolicy
+	header             func() []byte
+	headerSize         int64 // size of the last header written
+	footer             func(stats FileStats) []byte
+	segment            FileStats // written to the current log file
+	latestLink         bool
+	checksums          bool
+	encryptionKey      []byte
+	manifestMu         sync.Mutex
+	latestPath         string
+	uploader           Uploader
+	deleteUploaded     bool
+	uploadQueuePath    string
+	uploadMu           sync.Mutex // guards the upload queue file
+	uploadWake         chan struct{}
+	done               chan struct{}
+	stopOnce           sync.Once
+	background         sync.WaitGroup
+}
+
+// Write buffers the given bytes. The complete lines are written to the file as a batch,
+// see WriteLines, the first one continuing the buffered partial line, if any.
+// Returns the number of bytes buffered and any error encountered. On error, the
+// returned count covers the input up to the last line successfully written.
 func (w *DistributedFileWriter) Write(b []byte) (int, error) {
-	for i := range b {
-		w.buf.WriteByte(b[i])
-		if b[i] == '\n' {
-			err := w.WriteLine(w.buf.Bytes())
-			if err != nil {
-				return 0, err
-			}
+	if w.async != nil {
+		if err := w.enqueue(nil, b, false); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	return w.write(b)
+}
+
+// WriteString is like Write, but takes a string, implementing io.StringWriter. The string is not
+// converted to a byte slice up front, its bytes are only copied once buffered or written.
+func (w *DistributedFileWriter) WriteString(s string) (int, error) {
+	if w.async != nil {
+		// The queued write is a copy
+		if err := w.enqueue(nil, unsafe.Slice(unsafe.StringData(s), len(s)), false); err != nil {
+			return 0, err
 		}
+		return len(s), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	// write never modifies or retains b, complete lines are copied into the scratch buffer and a
+	// trailing partial line into the line buffer, so the string's bytes can be used directly
+	return w.write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// WriteContext is like Write, but stops waiting for the file lock once ctx is done, returning a
+// *LockError wrapping ctx.Err(), and likewise for a blocking rate limit, see WithRateLimitMode.
+// The context doesn't interrupt writing once the lock is held. With WithAsync, the context only
+// bounds waiting for room in the queue.
+func (w *DistributedFileWriter) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if w.async != nil {
+		if err := w.enqueue(ctx, b, false); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	w.lockCtx = ctx
+	defer func() { w.lockCtx = nil }()
+	return w.write(b)
+}
+
+// write implements Write. The caller must hold w.mu.
+func (w *DistributedFileWriter) write(b []byte) (int, error) {
+	if w.binaryRecords {
+		// Every write is a complete record
+		if err := w.writeLine(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	// Collect the complete lines, stopping at a partial line exceeding the buffer limit
+	buffered := w.buf.Len()
+	w.lines = w.lines[:0]
+	consumed := 0
+	var limitErr error
+	for consumed < len(b) {
+		rest := b[consumed:]
+		end := bytes.IndexByte(rest, w.delimiter)
+		partial := rest
+		if end >= 0 {
+			partial = rest[:end]
+		}
+		pending := 0
+		if len(w.lines) == 0 {
+			pending = buffered
+		}
+		if limitErr = w.checkBufferLimit(pending + len(partial)); limitErr != nil || end < 0 {
+			break
+		}
+
+		// Complete lines are written straight from b unless they continue a buffered partial line
+		line := rest[:end+1]
+		if pending > 0 {
+			w.buf.Write(line)
+			line = w.buf.Bytes()
+		}
+		w.lines = append(w.lines, line)
+		consumed += end + 1
+	}
+
+	n, err := w.writeLines(w.lines)
+	// Number of bytes of b written to the file up to and including the last newline
+	written := 0
+	for _, line := range w.lines[:n] {
+		written += len(line)
+	}
+	if buffered > 0 && n > 0 {
+		written -= buffered
+		w.buf.Reset()
+	}
+	if err != nil {
+		if errors.Is(err, ErrLineTooLong) {
+			w.buf.Reset()
+		} else if w.buf.Len() == 0 {
+			// Keep the line buffered, so Sync and Close retry it
+			w.buf.Write(w.lines[n])
+		}
+		return written, err
+	}
+	if limitErr != nil {
+		// Discard the oversized partial line so the writer recovers
+		w.buf.Reset()
+		return written, limitErr
 	}
 
+	w.buf.Write(b[consumed:])
 	return len(b), nil
 }
 
+// checkBufferLimit returns a *LineTooLongError if a buffered partial line of n bytes exceeds the
+// configured max buffered bytes or, if unset, can no longer fit within the max file size
+// and oversized lines are rejected without a line transform.
+func (w *DistributedFileWriter) checkBufferLimit(n int) error {
+	if w.maxBuffered > 0 {
+		if n > w.maxBuffered {
+			return &LineTooLongError{Length: n, Max: int64(w.maxBuffered)}
+		}
+		return nil
+	}
+
+	// A transformed or sanitized line may fit after all
+	if w.oversizePolicy != OversizeError || w.lineTransform != nil || w.sanitizeMode != 0 {
+		return nil
+	}
+	if n += len(w.prefix); int64(n) > w.maxSize && w.maxSize > 0 {
+		return &LineTooLongError{Length: n, Max: w.maxSize}
+	}
+
+	return nil
+}
+
 // WriteLine writes the given bytes to the file, prepending the prefix if set.
 // It handles rotation if the line exceeds the max size and manages file locking
 // to ensure atomic writes. Returns any error encountered.
-func (w *DistributedFileWriter) WriteLine(line []byte) (err error) {
-	if len(line) == 0 {
+func (w *DistributedFileWriter) WriteLine(line []byte) error {
+	if w.async != nil {
+		return w.enqueue(nil, line, true)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	return w.writeLine(line)
+}
+
+// WriteLineContext is like WriteLine, but stops waiting for the file lock once ctx is done, returning
+// a *LockError wrapping ctx.Err(), and likewise for a blocking rate limit, see WithRateLimitMode.
+// The context doesn't interrupt writing once the lock is held. With WithAsync, the context only
+// bounds waiting for room in the queue.
+func (w *DistributedFileWriter) WriteLineContext(ctx context.Context, line []byte) error {
+	if w.async != nil {
+		return w.enqueue(ctx, line, true)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.lockCtx = ctx
+	defer func() { w.lockCtx = nil }()
+	return w.writeLine(line)
+}
+
+// writeLine implements WriteLine. The caller must hold w.mu.
+func (w *DistributedFileWriter) writeLine(line []byte) error {
+	content, delimited := w.trimDelimiter(line)
+	content, ok := w.transformLine(content)
+	if ok {
+		var err error
+		if ok, err = w.admitLine(content, delimited); err != nil {
+			return err
+		}
+	}
+	if !ok {
+		// Like a written line, a dropped line flushed from the buffer is done with
+		w.buf.Truncate(0)
 		return nil
 	}
-	n := len(line) + len(w.prefix)
-	if int64(n) > w.maxSize && w.maxSize > 0 {
-		return fmt.Errorf("line exceeds max size")
+	if err := w.writeNotices(); err != nil {
+		return err
 	}
+	return w.writeContent(content, delimited)
+}
 
-	shouldRotate, err := w.shouldRotate(n)
+// writeContent writes a line consisting of content, followed by the delimiter if delimited.
+// The caller must hold w.mu.
+func (w *DistributedFileWriter) writeContent(content []byte, delimited bool) error {
+	if len(content) == 0 && !delimited && !w.binaryRecords {
+		return nil
+	}
+	prefix, line, err := w.sequence(w.linePrefix(), content, 0)
 	if err != nil {
 		return err
 	}
+	prefix, line, lineDelimited := w.envelope(prefix, line, delimited)
+	if w.isOversize(w.lineLength(len(prefix), len(line), lineDelimited)) {
+		// The sequence number and envelope count towards the prefix
+		return w.writeOversizeLine(content, delimited, len(prefix)+len(line)-len(content))
+	}
+
+	// Assemble prefix and line in a scratch buffer owned by the writer, so neither the
+	// caller's prefix nor line slices are ever appended to.
+	w.scratch = w.appendLine(w.scratch[:0], prefix, line, lineDelimited)
+	if err := w.writeData(w.scratch, 1); err != nil {
+		return err
+	}
+	w.commitSequence(1)
+
+	w.buf.Truncate(0)
+
+	return nil
+}
+
+// trimDelimiter returns the content of line without the trailing delimiter and whether there was
+// one. With WithNormalizeCRLF, a '\r' preceding the delimiter is trimmed as well. Binary records
+// are returned as is.
+func (w *DistributedFileWriter) trimDelimiter(line []byte) ([]byte, bool) {
+	if w.binaryRecords || len(line) == 0 || line[len(line)-1] != w.delimiter {
+		return line, false
+	}
+	line = line[:len(line)-1]
+	if w.normalizeCRLF && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, true
+}
+
+// lineLength returns the length of a line of content with a prefix of prefixLen as written by
+// appendLine, i.e. including the trailing delimiter or the record frame header.
+func (w *DistributedFileWriter) lineLength(prefixLen, contentLen int, delimited bool) int {
+	n := prefixLen + contentLen
+	if w.binaryRecords {
+		n += frameHeaderSize
+	} else if delimited {
+		n++
+	}
+	return n
+}
+
+// isOversize reports whether a line of n bytes, see lineLength, exceeds the max size or, with
+// binary records, the largest frame.
+func (w *DistributedFileWriter) isOversize(n int) bool {
+	return int64(n) > w.maxSize && w.maxSize > 0 || w.binaryRecords && int64(n) > maxFrameSize
+}
+
+// appendLine appends a line of content with the given prefix to dst, followed by the delimiter
+// if delimited. With binary records, the prefix and content are framed instead.
+func (w *DistributedFileWriter) appendLine(dst, prefix, content []byte, delimited bool) []byte {
+	if w.binaryRecords {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(prefix)+len(content)))
+	}
+	dst = append(append(dst, prefix...), content...)
+	if delimited {
+		dst = append(dst, w.delimiter)
+	}
+	return dst
+}
+
+// writeData writes data consisting of the given number of complete lines with their prefixes in
+// a single write, rotating beforehand if necessary. The caller must hold w.mu.
+func (w *DistributedFileWriter) writeData(data []byte, lines int) (err error) {
+	n := len(data)
+	if w.reopenOnRotate && !w.fsLock && !w.exclusiveOwner {
+		// Without locking, detect a rotation by another writer before writing
+		if err := w.reopenIfStale(); err != nil {
+			return err
+		}
+	}
+
+	// Without locking, only this writer is expected to grow the file, so the cached size is used
+	shouldRotate := w.shouldRotate(n)
 
 	// If the line is larger than PIPE_BUF, we need to acquire an exclusive lock
 	// to ensure atomic writes. Otherwise, we can use a shared lock.
 	// On Unix-like systems, writes to a file descriptor are atomic if the size
 	// of the write is less than or equal to the system’s PIPE_BUF size
 	if w.fsLock {
-		if n > w.atomicLineSize || shouldRotate {
-			if err := syscall.Flock(int(w.file.Fd()), syscall.LOCK_EX); err != nil {
-				return fmt.Errorf("failed to acquire exclusive lock on %s: %w", w.file.Name(), err)
+		exclusive := n > w.atomicLineSize || shouldRotate
+		for {
+			if err := w.lock(exclusive); err != nil {
+				return err
 			}
-			// Check again if we need to rotate after acquiring the write-lock
-			shouldRotate, err = w.shouldRotate(n)
-			if err != nil {
+			// Other processes may have grown the file, so check again once locked
+			if err := w.statFile(); err != nil {
+				w.lockMode.unlock(w.lockedFile())
 				return err
 			}
-		} else {
-			if err := syscall.Flock(int(w.file.Fd()), syscall.LOCK_SH); err != nil {
-				return fmt.Errorf("failed to acquire shared lock on %s: %w", w.file.Name(), err)
+			shouldRotate = w.shouldRotate(n)
+			if !shouldRotate || exclusive {
+				break
 			}
+			// Rotating requires the write-lock after all
+			if err := w.lockMode.unlock(w.lockedFile()); err != nil {
+				return fmt.Errorf("failed to unlock %s: %w", w.lockedFile().Name(), err)
+			}
+			exclusive = true
 		}
 		defer func() {
 			if n > w.atomicLineSize || shouldRotate {
 				// Sync the file to ensure all data is written before unlocking
-				syncErr := w.file.Sync()
+				syncErr := w.syncLog()
 				if syncErr != nil {
-					syncErr = fmt.Errorf("failed to sync %s: %w", w.file.Name(), syncErr)
+					syncErr = fmt.Errorf("failed to sync %s: %w", w.path, syncErr)
 					if err != nil {
 						err = fmt.Errorf("%w; %w", err, syncErr)
 					} else {
@@ -93,9 +572,9 @@ func (w *DistributedFileWriter) WriteLine(line []byte) (err error) {
 				}
 			}
 			// Unlock the file after writing
-			unlockErr := syscall.Flock(int(w.file.Fd()), syscall.LOCK_UN)
+			unlockErr := w.lockMode.unlock(w.lockedFile())
 			if unlockErr != nil {
-				unlockErr = fmt.Errorf("failed to unlock %s: %w", w.file.Name(), unlockErr)
+				unlockErr = fmt.Errorf("failed to unlock %s: %w", w.lockedFile().Name(), unlockErr)
 				if err != nil {
 					err = fmt.Errorf("%w; %w", err, unlockErr)
 				} else {
@@ -106,175 +585,1107 @@ func (w *DistributedFileWriter) WriteLine(line []byte) (err error) {
 	}
 
 	if shouldRotate {
-		err = w.rotate()
+		err = w.retryOnDiskFull(w.rotate)
 		if err != nil {
 			return err
 		}
 	}
 
-	line = append(w.prefix, line...)
+	// After a partial write to a full disk, only the remainder is retried
+	written := 0
+	err = w.retryOnDiskFull(func() error {
+		n, err := w.file.Write(data[written:])
+		written += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.setSize(w.size+int64(written), w.clock.Now())
+	w.stats.bytesWritten.Add(int64(written))
+	w.stats.linesWritten.Add(int64(lines))
+	w.segment.Lines += int64(lines)
+	w.segment.Bytes += int64(written)
+	w.tee(data)
+	if w.recent != nil {
+		w.recent.add(data, w.delimiter)
+	}
+
+	return w.syncAfterWrite(written)
+}
+
+// tee copies data written to the log file to the tee writers. Errors are reported to the error
+// handler instead of failing the write.
+func (w *DistributedFileWriter) tee(data []byte) {
+	for _, tee := range w.tees {
+		if _, err := tee.Write(data); err != nil {
+			w.handleError(fmt.Errorf("failed to write to tee: %w", err))
+		}
+	}
+}
+
+// linePrefix returns the prefix for the next line, consisting of the timestamp and the static
+// prefix followed by the expanded prefix template and the output of the prefix function, if set.
+// The returned slice is only valid until the next call.
+func (w *DistributedFileWriter) linePrefix() []byte {
+	if w.prefixFunc == nil && w.template == nil && w.timestamps == nil {
+		return w.prefix
+	}
+
+	w.prefixBuf = w.prefixBuf[:0]
+	if w.timestamps != nil {
+		w.prefixBuf = append(w.timestamps.appendTo(w.prefixBuf, w.clock.Now()), ' ')
+	}
+	w.prefixBuf = append(w.prefixBuf, w.prefix...)
+	w.prefixBuf = w.template.appendTo(w.prefixBuf, w.timeLayout, w.clock.Now())
+	if w.prefixFunc != nil {
+		w.prefixBuf = append(w.prefixBuf, w.prefixFunc()...)
+	}
+	return w.prefixBuf
+}
+
+// Rotate writes any remaining buffered data and then forces a rotation of the log file,
+// regardless of its size. If file locking is enabled, an exclusive lock is held while rotating.
+// Rotate is a no-op if the log file is empty.
+func (w *DistributedFileWriter) Rotate() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if w.buf.Len() != 0 {
+		if err := w.writeLine(w.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := w.writeNotices(); err != nil {
+		return err
+	}
+	// The fresh log file starts with the next line, even if it is a duplicate
+	w.resetDedupe()
+
+	if w.fsLock {
+		if err := w.lock(true); err != nil {
+			return err
+		}
+		defer w.unlock(&err)
+	}
+
+	if err := w.statFile(); err != nil {
+		return err
+	}
+	if !w.hasContent() {
+		return nil
+	}
+
+	return w.retryOnDiskFull(w.rotate)
+}
+
+// lock acquires the file lock on the current log file. If reopening on rotation is enabled, the log
+// file may have been renamed by another process while waiting for the lock, in which case the lock
+// is released and acquired again on the freshly opened log file.
+func (w *DistributedFileWriter) lock(exclusive bool) error {
+	start := w.clock.Now()
+	defer func() {
+		wait := w.clock.Now().Sub(start)
+		w.stats.lockWait.Add(int64(wait))
+		w.stats.observeLockWait(wait)
+	}()
+
+	for {
+		if err := w.lockFile(w.lockedFile(), exclusive); err != nil {
+			return &LockError{Path: w.lockedFile().Name(), Exclusive: exclusive, Err: err}
+		}
+		if !w.reopenOnRotate {
+			return nil
+		}
+
+		stale, err := w.isStale()
+		if err == nil && !stale {
+			return nil
+		}
+		if unlockErr := w.lockMode.unlock(w.lockedFile()); unlockErr != nil {
+			unlockErr = fmt.Errorf("failed to unlock %s: %w", w.lockedFile().Name(), unlockErr)
+			if err != nil {
+				return fmt.Errorf("%w; %w", err, unlockErr)
+			}
+			return unlockErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.reopen(); err != nil {
+			return err
+		}
+	}
+}
 
-	_, err = w.file.Write(line)
+// unlock releases the file lock, joining a failure with *err.
+func (w *DistributedFileWriter) unlock(err *error) {
+	unlockErr := w.lockMode.unlock(w.lockedFile())
+	if unlockErr != nil {
+		unlockErr = fmt.Errorf("failed to unlock %s: %w", w.lockedFile().Name(), unlockErr)
+		if *err != nil {
+			*err = fmt.Errorf("%w; %w", *err, unlockErr)
+		} else {
+			*err = unlockErr
+		}
+	}
+}
+
+// lockedFile returns the file the file lock is acquired on: the lock file, if set, or the log file.
+func (w *DistributedFileWriter) lockedFile() fsFile {
+	if w.lockHandle != nil {
+		return w.lockHandle
+	}
+	return w.file
+}
+
+// closeLockFile closes the lock file, if open.
+func (w *DistributedFileWriter) closeLockFile() {
+	if w.lockHandle != nil {
+		w.lockHandle.Close()
+	}
+}
+
+// acquireOwnership acquires the exclusive file lock held until Close, see WithExclusiveOwnership.
+func (w *DistributedFileWriter) acquireOwnership() error {
+	f := w.lockedFile()
+	if w.lockTimeout > 0 {
+		if err := w.lockFile(f, true); err != nil {
+			return &LockError{Path: f.Name(), Exclusive: true, Err: err}
+		}
+		return nil
+	}
+
+	locked, err := w.lockMode.tryLock(f, true)
+	if err == nil && !locked {
+		err = ErrLocked
+	}
 	if err != nil {
+		return &LockError{Path: f.Name(), Exclusive: true, Err: err}
+	}
+	return nil
+}
+
+// lockFile acquires the file lock on f, giving up with ErrLockTimeout once the lock timeout, if set,
+// has passed, or with the context's error once the context of the write in progress, if any, is done.
+// Until then, acquiring the lock is retried with exponential backoff. The caller must hold w.mu.
+func (w *DistributedFileWriter) lockFile(f fsFile, exclusive bool) error {
+	return w.lockFileContext(w.lockCtx, f, exclusive)
+}
+
+// lockSharedFile acquires the exclusive file lock on a file kept alongside the log file, giving up
+// with ErrLockTimeout once the lock timeout, if set, has passed. Such files are also locked by
+// background goroutines not holding w.mu, so the context of the write in progress doesn't apply.
+func (w *DistributedFileWriter) lockSharedFile(f fsFile) error {
+	return w.lockFileContext(nil, f, true)
+}
+
+// lockFileContext is lockFile with the context ctx, which is ignored if nil.
+func (w *DistributedFileWriter) lockFileContext(ctx context.Context, f fsFile, exclusive bool) error {
+	if w.lockTimeout <= 0 && ctx == nil {
+		return w.lockMode.lock(f, exclusive)
+	}
+
+	var deadline time.Time
+	if w.lockTimeout > 0 {
+		deadline = w.clock.Now().Add(w.lockTimeout)
+	}
+	backoff := minLockBackoff
+	for {
+		locked, err := w.lockMode.tryLock(f, exclusive)
+		if locked || err != nil {
+			return err
+		}
+
+		wait := backoff
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(w.clock.Now())
+			if remaining <= 0 {
+				return fmt.Errorf("%w after %s", ErrLockTimeout, w.lockTimeout)
+			}
+			wait = min(wait, remaining)
+		}
+		if ctx == nil {
+			w.sleep(wait, nil)
+		} else if !w.sleep(wait, ctx.Done()) {
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, maxLockBackoff)
+	}
+}
+
+// isStale reports whether the open file no longer is the file at the log path,
+// i.e. it was renamed or removed.
+func (w *DistributedFileWriter) isStale() (bool, error) {
+	pathStat, err := w.fs.Stat(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fileStat, err := w.file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(pathStat, fileStat), nil
+}
+
+// reopenIfStale reopens the log file if it was renamed or removed.
+func (w *DistributedFileWriter) reopenIfStale() error {
+	stale, err := w.isStale()
+	if err != nil || !stale {
 		return err
 	}
 
-	w.buf.Truncate(0)
+	return w.reopen()
+}
+
+// reopen opens the log path again, creating it if necessary, and replaces the current file with it.
+func (w *DistributedFileWriter) reopen() error {
+	file, err := w.openLogFile(w.path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen log file: %w", err)
+	}
+
+	if err := w.file.Close(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to close rotated log file: %w", err)
+	}
+	w.file = file
+	w.segment = FileStats{}
+	if err := w.statFile(); err != nil {
+		return err
+	}
+	w.preallocate()
+
+	if w.onReopen != nil {
+		w.onReopen(file.Name())
+	}
+	w.emit(Reopened{})
 
 	return nil
 }
 
+// openLogFile opens the log file at path for appending, creating it with the log file mode if it
+// doesn't exist.
+func (w *DistributedFileWriter) openLogFile(path string) (fsFile, error) {
+	flag := os.O_CREATE | os.O_RDWR | os.O_APPEND
+	if w.openSync {
+		flag |= os.O_SYNC
+	}
+	return w.fs.OpenFile(path, flag, w.mode)
+}
+
+// createBackupFile exclusively creates the backup file at path with the permissions of src,
+// regardless of the umask, and, where possible, the owner and group of src.
+// Returns an error matching os.ErrExist if the file already exists.
+func createBackupFile(fsys fileSystem, path string, src os.FileInfo) (fsFile, error) {
+	mode := src.Mode().Perm()
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := copyOwner(file, src); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
 // rotate creates a timestamped backup of the current log file, truncates the original, and cleans up old backups.
+// The backup is written to a temporary file that is only renamed into place once it is complete and synced,
+// so a crash never leaves a truncated log file behind without a complete backup. With WithDirSync, the
+// rename is persisted by syncing the directory before truncating. If compression or encryption is
+// enabled, the backup is compressed and encrypted in the background once the caller releases its locks.
 func (w *DistributedFileWriter) rotate() error {
-	i := 0
-	timestamp := time.Now().Format("20060102-150405")
-	backupPath := fmt.Sprintf("%s.%s.%d", w.file.Name(), timestamp, i)
-	if w.compress {
-		backupPath += ".gz"
+	start := w.clock.Now()
+	if w.maxBackups == NoBackups {
+		// Without backups, the log file is simply truncated
+		if err := w.file.Truncate(0); err != nil {
+			return err
+		}
+		w.rotated(start)
+		return w.writeHeader()
 	}
 
-	// Check if a file with the same backupPath already exists
+	// Before the footer, so the modification time is that of the data
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
 
-	_, err := os.Stat(backupPath)
-	for err == nil {
-		// Increment the backup number
-		i++
-		backupPath = fmt.Sprintf("%s.%s.%d", w.file.Name(), timestamp, i)
-		_, err = os.Stat(backupPath)
+	// A failed footer shows that the backup may be incomplete, so it doesn't prevent the rotation
+	if err := w.writeFooter(); err != nil {
+		w.handleError(err)
+	}
+
+	ext := w.compression.extension()
+	if w.encryptionKey != nil {
+		ext += encryptedExt
+	}
+	// Compressed and encrypted backups are written from the uncompressed one in the background
+	process := w.compression != CompressionNone || w.encryptionKey != nil
+	var tmpFile fsFile
+	var backupPath string
+	if w.numericBackups {
+		tmpFile, backupPath, err = w.createNumericBackup(info)
+	} else {
+		// Millisecond resolution and the pid keep names of concurrently rotating processes apart
+		now := w.clock.Now()
+		backupName := func(index int) string {
+			return w.nameTemplate.name(now, index)
+		}
+		if w.nameTemplate == nil {
+			namePrefix := fmt.Sprintf("%s.%s.%03d.pid%d", w.backupPrefix(), now.Format(backupTimeFormat),
+				now.Nanosecond()/int(time.Millisecond), os.Getpid())
+			backupName = indexedName(namePrefix)
+		}
+		tmpFile, backupPath, err = createUniqueBackup(w.fs, backupName, info)
+	}
+	if err != nil {
+		return err
 	}
+	tmpPath := tmpFile.Name()
 
-	var backupFile io.WriteCloser
+	// The checksum covers the final backup, so processed backups are hashed while compressing
+	var checksum hash.Hash
+	if !process {
+		checksum = w.newChecksum()
+	}
 
-	// 1) Create the backup file
-	if w.compress {
-		outFile, err := os.Create(backupPath)
+	if w.renameRotation {
+		// The exclusively created temporary file only reserves the name. Renaming the log file is
+		// atomic by itself, so it is moved to its final name directly.
+		tmpFile.Close()
+		err := w.renameToBackup(backupPath)
+		w.removeTempFile(tmpPath)
 		if err != nil {
 			return err
 		}
-		defer outFile.Close()
-		// Create a gzip.Writer on top of the file writer
-		backupFile = gzip.NewWriter(outFile)
+		if err := w.syncDir(filepath.Dir(backupPath)); err != nil {
+			return err
+		}
+		// Without copying, the backup has to be read to hash it
+		if checksum != nil {
+			if err := hashFile(w.fs, backupPath, checksum); err != nil {
+				w.handleError(fmt.Errorf("failed to hash backup %s: %w", backupPath, err))
+				checksum = nil
+			}
+		}
 	} else {
-		// Create a regular file writer (no compression)
-		backupFile, err = os.Create(backupPath)
-		if err != nil {
+		if err := w.copyToBackup(tmpFile, checksum); err != nil {
+			tmpFile.Close()
+			w.removeTempFile(tmpPath)
+			return err
+		}
+
+		// Move the complete backup into place and persist the rename
+		if err := w.fs.Rename(tmpPath, backupPath); err != nil {
+			w.removeTempFile(tmpPath)
+			return err
+		}
+		if err := w.syncDir(filepath.Dir(backupPath)); err != nil {
+			return err
+		}
+
+		// Only now that the backup is durable, the log file may be truncated
+		if err := w.file.Truncate(0); err != nil {
 			return err
 		}
 	}
-	defer backupFile.Close()
+
+	// The name keeps the rotation time
+	if w.preserveTimes {
+		if err := w.fs.Chtimes(backupPath, info.ModTime(), info.ModTime()); err != nil {
+			w.handleError(fmt.Errorf("failed to set modification time of backup %s: %w", backupPath, err))
+		}
+	}
+
+	// Compress and encrypt the backup without holding up other writers. Numeric backups are
+	// processed right away, as the next rotation renames them.
+	if process {
+		w.cleanupMu.Lock()
+		w.compressing[backupPath] = struct{}{}
+		w.cleanupMu.Unlock()
+		w.compressions.Add(1)
+		if w.numericBackups {
+			w.compressBackup(w.compression, backupPath, backupPath+ext)
+		} else {
+			go w.compressBackup(w.compression, backupPath, backupPath+ext)
+		}
+	} else {
+		if err := w.recordChecksum(backupPath, checksum); err != nil {
+			w.handleError(err)
+		}
+		w.linkLatest()
+		w.notifyRotate(backupPath)
+		w.enqueueUpload(backupPath)
+	}
+
+	w.rotated(start)
+
+	// Cleanup is best-effort, the rotation itself already succeeded
+	if err := w.cleanupOldBackups(); err != nil {
+		w.handleError(fmt.Errorf("failed to clean up backups: %w", err))
+	}
+
+	return w.writeHeader()
+}
+
+// rotated resets the cached size after a rotation started at start and records it in the stats.
+func (w *DistributedFileWriter) rotated(start time.Time) {
+	end := w.clock.Now()
+	w.setSize(0, end)
+	w.segment = FileStats{}
+	w.stats.rotations.Add(1)
+	w.stats.lastRotation.Store(end.UnixNano())
+	w.stats.observeRotation(end.Sub(start))
+	w.preallocate()
+}
+
+// preallocate allocates disk space for the log file up to the max size, if enabled, without changing
+// its size, so writes don't fragment it or run out of space midway. Filesystems not supporting it
+// are skipped, other failures are reported to the error handler.
+func (w *DistributedFileWriter) preallocate() {
+	if !w.preallocateSpace || w.maxSize <= 0 {
+		return
+	}
+	err := preallocateFile(w.file, w.maxSize)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		w.handleError(fmt.Errorf("failed to preallocate log file: %w", err))
+	}
+}
+
+// dropCache drops the cached pages of the synced files written or read by a rotation, if enabled,
+// so rotating large files doesn't evict the page cache of other processes. Platforms not supporting
+// it are skipped, other failures are reported to the error handler.
+func (w *DistributedFileWriter) dropCache(files ...fsFile) {
+	if !w.dropCacheOnRotate {
+		return
+	}
+	for _, f := range files {
+		err := dropFileCache(f)
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			w.handleError(fmt.Errorf("failed to drop cached pages of %s: %w", f.Name(), err))
+		}
+	}
+}
+
+// createUniqueBackup exclusively creates a temporary backup file named by backupName, increasing the index
+// passed to it while the name is taken by a finished, compressed or in-progress backup.
+// Returns the created temporary file and the path of the backup once it is complete.
+func createUniqueBackup(fsys fileSystem, backupName func(index int) string, info os.FileInfo) (fsFile, string, error) {
+	for i := 0; ; i++ {
+		backupPath := backupName(i)
+		if backupExists(fsys, backupPath) {
+			continue
+		}
+
+		tmpFile, err := createBackupFile(fsys, backupPath+tmpExt, info)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return tmpFile, backupPath, nil
+	}
+}
+
+// removeTempFile removes the temporary file at path created by a rotation, reporting failures to
+// the error handler since they don't fail the rotation.
+func (w *DistributedFileWriter) removeTempFile(path string) {
+	if err := w.fs.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		w.handleError(fmt.Errorf("failed to remove temporary file: %w", err))
+	}
+}
+
+// renameToBackup moves the log file to backupPath and continues on a fresh log file.
+// If file locking is enabled, the exclusive lock is carried over to the new file
+// so the caller's unlock applies to it.
+func (w *DistributedFileWriter) renameToBackup(backupPath string) error {
+	// 1) Sync the log file to ensure all data is written
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dropCache(w.file)
+
+	// 2) Move the log file out of the way
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := w.fs.Rename(w.path, backupPath); err != nil {
+		return err
+	}
+
+	// 3) Open a fresh log file at the original path, owned by the same user as the previous one
+	file, err := w.openLogFile(w.path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen log file: %w", err)
+	}
+	if err := copyOwner(file, info); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to set log file owner: %w", err)
+	}
+	if (w.fsLock || w.exclusiveOwner) && w.lockHandle == nil {
+		if err := w.lockFile(file, true); err != nil {
+			file.Close()
+			return &LockError{Path: file.Name(), Exclusive: true, Err: err}
+		}
+	}
+
+	// 4) Closing the backup releases its lock, letting waiting writers detect the rotation
+	oldFile := w.file
+	w.file = file
+
+	return oldFile.Close()
+}
+
+// copyToBackup copies the log file to backupFile, syncs and closes it. If checksum is not nil, the
+// copied contents are written to it as well. With WithVerifyRotation, the backup is read back and
+// compared with the copied contents.
+func (w *DistributedFileWriter) copyToBackup(backupFile fsFile, checksum hash.Hash) error {
+	// 1) The backup file was created by the caller with the log file's permissions and ownership
 
 	// 2) Open the log for reading only
-	srcFile, err := os.Open(w.file.Name()) // O_RDONLY
+	srcFile, err := w.fs.OpenFile(w.path, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	// 3) Copy everything into the backup
-	if _, err := io.Copy(backupFile, srcFile); err != nil {
-		return err
+	// 3) Copy everything into the backup, keeping track of what was read for verification
+	var dst io.Writer = backupFile
+	if checksum != nil {
+		dst = io.MultiWriter(backupFile, checksum)
+	}
+	var src io.Reader = srcFile
+	var digest *copyDigest
+	if w.verifyRotation {
+		digest = newCopyDigest()
+		src = io.TeeReader(srcFile, digest)
+	}
+	copied := false
+	if checksum == nil && digest == nil {
+		// Without having to see the data, it is copied within the kernel where supported
+		if _, copied, err = kernelCopy(backupFile, srcFile); err != nil {
+			return err
+		}
+	}
+	if !copied {
+		if checksum == nil {
+			// Hide the backup file's ReadFrom, so the fallback doesn't retry the kernel copy
+			dst = struct{ io.Writer }{backupFile}
+		}
+		if _, err := copyFile(dst, src); err != nil {
+			return err
+		}
 	}
 
 	// 4) Sync the backup file to ensure all data is written
-	err = w.file.Sync()
-	if err != nil {
+	if err := backupFile.Sync(); err != nil {
 		return err
 	}
-
-	// 5) Truncate your append-only writer
-	if err := w.file.Truncate(0); err != nil {
+	w.dropCache(backupFile, srcFile)
+	if err := backupFile.Close(); err != nil {
 		return err
 	}
 
-	return w.cleanupOldBackups()
+	// 5) Read the backup back to catch writes that were silently lost
+	if digest != nil {
+		return digest.verify(w.fs, backupFile.Name())
+	}
+	return nil
 }
 
-// cleanupOldBackups deletes oldest backup files to enforce the maxBackups limit.
-func (w *DistributedFileWriter) cleanupOldBackups() error {
-	matches, err := filepath.Glob(w.file.Name() + ".*")
+// indexedName returns a function naming backups after namePrefix, appending the index unless it is 0.
+func indexedName(namePrefix string) func(index int) string {
+	return func(index int) string {
+		if index == 0 {
+			return namePrefix
+		}
+		return fmt.Sprintf("%s.%d", namePrefix, index)
+	}
+}
+
+// backupExists reports whether a backup at backupPath exists, either finished, compressed, encrypted
+// or still in progress. Backups are checked with every extension, as writers sharing the backups may
+// have been configured differently.
+func backupExists(fsys fileSystem, backupPath string) bool {
+	paths := []string{backupPath, backupPath + tmpExt}
+	for _, ext := range backupExtensions {
+		paths = append(paths, backupPath+ext, backupPath+ext+tmpExt)
+	}
+	for _, path := range paths {
+		if _, err := fsys.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// syncDir fsyncs the directory at path if directory syncing is enabled.
+func (w *DistributedFileWriter) syncDir(path string) error {
+	if !w.dirSync {
+		return nil
+	}
+	if err := syncDir(path); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", path, err)
+	}
+	return nil
+}
+
+// removeOrphanedTempFiles removes temporary backup files left behind by crashed rotations or compressions.
+// Their data is still present in the log file or the uncompressed backup, respectively. To not interfere
+// with rotations in progress in other processes, only files untouched for orphanedTempAge are removed.
+// Temporary files of other tools, not named like a backup, are left alone.
+// The caller must hold w.cleanupMu.
+func (w *DistributedFileWriter) removeOrphanedTempFiles() error {
+	var matches []string
+	var err error
+	if w.nameTemplate != nil {
+		matches, err = w.nameTemplate.matches(w.fs, tmpExt)
+	} else {
+		prefix := w.backupPrefix()
+		matches, err = w.fs.Glob(prefix + ".*" + tmpExt)
+		matches = slices.DeleteFunc(matches, func(file string) bool {
+			name := strings.TrimSuffix(file, tmpExt)
+			if w.numericBackups {
+				return !numericBackupPattern.MatchString(strings.TrimPrefix(name, prefix+"."))
+			}
+			_, ok := parseBackup(prefix, name)
+			return !ok
+		})
+	}
 	if err != nil {
 		return err
 	}
 
-	var backups []string
+	var errs []error
 	for _, file := range matches {
-		if strings.HasPrefix(file, w.file.Name()+".") && len(file) > len(w.file.Name())+1 {
-			backups = append(backups, file)
+		info, err := w.fs.Stat(file)
+		if err != nil {
+			continue
+		}
+		if w.clock.Now().Sub(info.ModTime()) < orphanedTempAge {
+			continue
+		}
+		if _, err := w.removeBackup(file, RemovalOrphanedTemp); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// cleanupOldBackups deletes the oldest backup files to enforce the maxBackups, maxAge and maxTotalBytes
+// limits and the retention tiers. Regardless of the limits, it deletes orphaned temporary backups
+// and empty backups untouched for emptyBackupAge, which crashes may leave behind.
+func (w *DistributedFileWriter) cleanupOldBackups() error {
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+
+	errs := []error{w.removeOrphanedTempFiles()}
+
+	// Unparsable backups are reported, but don't prevent cleaning up the others
+	backups, err := w.backups()
+	errs = append(errs, err)
+
+	// The byte budget covers the log file and all of its backups
+	var total int64
+	if w.maxTotalBytes > 0 || w.maxBackups > 0 {
+		total, err = w.totalBytes(backups)
+		errs = append(errs, err)
+	} else {
+		w.statUnfilled(backups)
+	}
+	// Empty backups left by older versions and backups removed by the retention tiers don't count
+	// towards the max backups
+	expired := tierExpired(w.retentionTiers, backups, w.clock.Now())
+	counted := 0
+	for i, backup := range backups {
+		if backup.size > 0 && !expired[i] {
+			counted++
 		}
 	}
 
-	sort.Strings(backups)
-	for i, file := range backups {
-		expired, err := w.isOlderThanFilename(file)
+	removed := 0
+	for i, backup := range backups {
+		excess := backup.size > 0 && !expired[i] && counted > w.maxBackups
+		if backup.size > 0 && !expired[i] {
+			counted--
+		}
+		if w.isCompressing(backup) {
+			// Removed by compressBackup once the compressed copy is complete
+			continue
+		}
+
+		var reason RemovalReason
+		switch {
+		case backup.size == 0 && !backup.modTime.IsZero() && w.clock.Now().Sub(backup.modTime) >= emptyBackupAge:
+			reason = RemovalEmpty
+		case w.maxAge > 0 && backup.time.Before(w.clock.Now().Add(-w.maxAge)):
+			reason = RemovalMaxAge
+		case excess && w.maxBackups > 0:
+			reason = RemovalMaxBackups
+		case w.maxTotalBytes > 0 && total > w.maxTotalBytes:
+			reason = RemovalMaxTotalBytes
+		case expired[i]:
+			reason = RemovalRetentionTier
+		default:
+			continue
+		}
+
+		gone, err := w.removeBackup(backup.path, reason)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
-		if (len(backups)-i > w.maxBackups && w.maxBackups > 0) || expired {
-			err = os.Remove(file)
-			if err != nil {
-				return err
-			}
+		if gone {
+			removed++
+			total -= backup.size
 		}
 	}
+	w.stats.backups.Store(int64(len(backups) - removed))
 
-	return nil
+	// Persist the removals
+	if removed > 0 {
+		errs = append(errs, w.syncDir(filepath.Dir(backups[0].path)), w.pruneChecksums())
+	}
+
+	return errors.Join(errs...)
+}
+
+// totalBytes returns the size of the log file and backups, recording each backup's size and
+// modification time.
+func (w *DistributedFileWriter) totalBytes(backups []backupFile) (int64, error) {
+	var total int64
+	info, err := w.fs.Stat(w.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if err == nil {
+		total += info.Size()
+	}
+
+	for i := range backups {
+		info, err := w.fs.Stat(backups[i].path)
+		if err != nil {
+			// Removed by another process since the glob
+			continue
+		}
+		backups[i].size = info.Size()
+		backups[i].modTime = info.ModTime()
+		total += backups[i].size
+	}
+
+	return total, nil
+}
+
+// statUnfilled records the size and modification time of the backups not known to hold data, the
+// only ones that may be removed as empty, so each backup is statted once rather than in every
+// cleanup. The caller must hold w.cleanupMu.
+func (w *DistributedFileWriter) statUnfilled(backups []backupFile) {
+	filled := make(map[string]struct{}, len(backups))
+	for i := range backups {
+		if _, ok := w.filled[backups[i].path]; ok {
+			filled[backups[i].path] = struct{}{}
+			continue
+		}
+		info, err := w.fs.Stat(backups[i].path)
+		if err != nil {
+			// Removed by another process since the glob
+			continue
+		}
+		if info.Size() > 0 {
+			filled[backups[i].path] = struct{}{}
+			continue
+		}
+		backups[i].modTime = info.ModTime()
+	}
+	w.filled = filled
+}
+
+// backupFile describes a backup of the log file.
+type backupFile struct {
+	path    string
+	time    time.Time
+	index   int
+	size    int64     // only set by cleanups enforcing a byte budget or max backups
+	modTime time.Time // only set by cleanups, for all backups that may be empty
 }
 
-// isOlderThanFilename returns true if the embedded timestamp in fname
-// (in the form ".log.YYYYMMDD-HHMMSS.") is before cutoff.
-func (w *DistributedFileWriter) isOlderThanFilename(fname string) (bool, error) {
-	if w.maxAge <= 0 {
-		return false, nil
+// backups returns the backups of the log file, oldest first, ordered by their rotation time and index.
+// Backups that are still being written or compressed are skipped.
+func (w *DistributedFileWriter) backups() ([]backupFile, error) {
+	if w.numericBackups {
+		return listNumericBackups(w.fs, w.backupPrefix())
 	}
-	re := regexp.MustCompile(`\.log\.(\d{8}-\d{6})\.`)
-	matches := re.FindStringSubmatch(fname)
-	if len(matches) < 2 {
-		return false, fmt.Errorf("no timestamp found in %q", fname)
+	if w.nameTemplate != nil {
+		return w.nameTemplate.list(w.fs)
 	}
+	backups, err := listBackups(w.fs, w.backupPrefix())
+	// A lock file or latest backup link named like a backup is never one
+	return slices.DeleteFunc(backups, func(backup backupFile) bool {
+		return backup.path == w.lockPath || backup.path == w.latestPath
+	}), err
+}
+
+// backupPrefix returns the path the names of the log file's backups start with.
+func (w *DistributedFileWriter) backupPrefix() string {
+	return backupPrefix(w.path, w.backupDir)
+}
+
+// backupPrefix returns the path the names of backups of the log file at logPath start with.
+// If backupDir is empty, backups are stored next to the log file, otherwise in backupDir,
+// which is relative to the log file's directory unless absolute.
+func backupPrefix(logPath, backupDir string) string {
+	if backupDir == "" {
+		return logPath
+	}
+	if !filepath.IsAbs(backupDir) {
+		backupDir = filepath.Join(filepath.Dir(logPath), backupDir)
+	}
+	return filepath.Join(backupDir, filepath.Base(logPath))
+}
 
-	ts, err := time.Parse("20060102-150405", matches[1])
+// listBackups implements backups for backups named after prefix, as returned by backupPrefix.
+func listBackups(fsys fileSystem, prefix string) ([]backupFile, error) {
+	matches, err := fsys.Glob(prefix + ".*")
 	if err != nil {
-		return false, fmt.Errorf("cannot parse timestamp %q: %w", matches[1], err)
+		return nil, err
 	}
-	cutoff := time.Now().Add(-w.maxAge)
 
-	return ts.Before(cutoff), nil
+	var backups []backupFile
+	for _, file := range matches {
+		// Skip temporary files of backups that are still being compressed, lock files, links to the
+		// latest backup, checksum manifests, upload queues and files of other tools, e.g. the
+		// position file of a log shipper
+		if backup, ok := parseBackup(prefix, file); ok {
+			backups = append(backups, backup)
+		}
+	}
+
+	return sortBackups(backups), nil
 }
 
-// Close calls the Sync function and then closes the underlying log file.
+// sortBackups sorts backups oldest first. A backup found both uncompressed and compressed is just
+// being compressed and only returned once, as the compressed backup.
+func sortBackups(backups []backupFile) []backupFile {
+	sort.Slice(backups, func(i, j int) bool {
+		return backupLess(backups[i], backups[j])
+	})
+
+	// The compressed backup is ordered right after the uncompressed one
+	compacted := backups[:0]
+	for i, backup := range backups {
+		if i+1 < len(backups) && sameBackup(backup, backups[i+1]) {
+			continue
+		}
+		compacted = append(compacted, backup)
+	}
+	return compacted
+}
+
+// backupLess orders backups by their rotation time, then index.
+func backupLess(a, b backupFile) bool {
+	if !a.time.Equal(b.time) {
+		return a.time.Before(b.time)
+	}
+	if a.index != b.index {
+		return a.index < b.index
+	}
+	return a.path < b.path
+}
+
+// parseBackup parses the rotation time and index embedded in the name of the backup fname named after
+// prefix, in the form "<prefix>.YYYYMMDD-HHMMSS.mmm.pidPID[.N]" or the older "<prefix>.YYYYMMDD-HHMMSS[.N]",
+// followed by the compression and encryption extensions, if any. Reports false for files not named
+// like a backup, e.g. the files of other tools next to the log file.
+func parseBackup(prefix, fname string) (backupFile, bool) {
+	suffix, ok := strings.CutPrefix(fname, prefix+".")
+	if !ok {
+		return backupFile{}, false
+	}
+	m := backupNamePattern.FindStringSubmatch(suffix)
+	if m == nil {
+		return backupFile{}, false
+	}
+	ts, err := time.ParseInLocation(backupTimeFormat, m[1], time.Local)
+	if err != nil {
+		return backupFile{}, false
+	}
+	if m[2] != "" {
+		ms, _ := strconv.Atoi(m[2])
+		ts = ts.Add(time.Duration(ms) * time.Millisecond)
+	}
+	index, _ := strconv.Atoi(m[3])
+	return backupFile{path: fname, time: ts, index: index}, true
+}
+
+// Close flushes and closes the writer's children, writes the queued writes of an async writer, calls the Sync function, waits for outstanding
+// backup compressions, rotation hooks and post-rotate commands and then closes
+// the underlying log file.
+// Errors reported to the error handler before are delivered before Close returns.
+// Closing an already closed writer is a no-op.
 func (w *DistributedFileWriter) Close() error {
-	syncErr := w.Sync()
+	childErr := w.closeChildren()
+	// The async worker drains the queue before it returns
+	w.closeAsync()
+	w.stopBackground()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	syncErr := w.sync()
+	if syncErr == nil {
+		syncErr = w.closeFooter()
+	}
+	if err := w.releaseSequence(); err != nil {
+		w.handleError(fmt.Errorf("failed to release sequence numbers: %w", err))
+	}
+	w.compressions.Wait()
+	w.hooks.Wait()
 	closeErr := w.file.Close()
+	if w.lockHandle != nil {
+		closeErr = errors.Join(closeErr, w.lockHandle.Close())
+	}
+	w.closed = true
+
+	var err error
 	if syncErr != nil && closeErr != nil {
-		return fmt.Errorf("failed to sync and close file: %w; %w", syncErr, closeErr)
+		err = fmt.Errorf("failed to sync and close file: %w; %w", syncErr, closeErr)
 	} else if syncErr != nil {
-		return fmt.Errorf("failed to sync file: %w", syncErr)
+		err = fmt.Errorf("failed to sync file: %w", syncErr)
 	} else if closeErr != nil {
-		return fmt.Errorf("failed to close file: %w", closeErr)
+		err = fmt.Errorf("failed to close file: %w", closeErr)
+	} else {
+		err = errors.Join(childErr, w.asyncError())
 	}
-	return nil
+
+	// All background operations are done, so no more errors are reported
+	w.reporter.close()
+	w.closeEvents()
+
+	return err
 }
 
-// Sync writes any remaining buffered data as a complete log entry.
+// Sync writes any remaining buffered data as a complete log entry. With WithAsync, it first waits for
+// the writes queued before the call to be written.
 func (w *DistributedFileWriter) Sync() error {
+	if err := w.flushAsync(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	return w.sync()
+}
+
+// sync implements Sync. The caller must hold w.mu.
+func (w *DistributedFileWriter) sync() error {
 	if w.buf.Len() != 0 {
 		// Write the remaining buffer content with the prefix
-		return w.WriteLine(w.buf.Bytes())
+		err := w.writeLine(w.buf.Bytes())
+		if errors.Is(err, ErrLineTooLong) {
+			w.buf.Reset()
+		}
+		if err != nil {
+			return err
+		}
+		return w.writeNotices()
 	}
 
-	return w.file.Sync()
+	if err := w.writeNotices(); err != nil {
+		return err
+	}
+	return w.syncLog()
 }
 
 // Name returns the name of the log file.
 func (w *DistributedFileWriter) Name() string {
-	return w.file.Name()
+	return w.path
 }
 
-func (w *DistributedFileWriter) shouldRotate(n int) (bool, error) {
-	stat, err := w.file.Stat()
+// shouldRotate reports whether writing n more bytes requires a rotation, either because the
+// file would exceed the max size or because it was last written before the most recent
+// time-based rotation boundary. The decision is based on the cached size and modification time,
+// which are refreshed from the file once locked, so it is shared by all processes writing to the
+// same file with locking enabled.
+func (w *DistributedFileWriter) shouldRotate(n int) bool {
+	// An empty file is never rotated, even if the line fills it, as that would leave an empty backup
+	if w.hasContent() && w.size+int64(n) >= w.maxSize && w.maxSize > 0 {
+		return true
+	}
+
+	if w.hasContent() {
+		boundary := w.rotationBoundary(w.clock.Now())
+		if !boundary.IsZero() && w.modTime.Before(boundary) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasContent reports whether the log file contains more than the header, based on the cached size.
+func (w *DistributedFileWriter) hasContent() bool {
+	return w.size > w.headerSize
+}
+
+// statFile refreshes the cached size and modification time from the log file.
+func (w *DistributedFileWriter) statFile() error {
+	size, modTime, err := fileSize(w.file)
 	if err != nil {
-		return false, err
+		return err
+	}
+	w.setSize(size, modTime)
+	return nil
+}
+
+// setSize updates the cached size and modification time of the log file.
+func (w *DistributedFileWriter) setSize(size int64, modTime time.Time) {
+	w.size = size
+	w.modTime = modTime
+	w.stats.size.Store(size)
+}
+
+// rotationBoundary returns the most recent time-based rotation boundary at or before now,
+// or the zero time if time-based rotation is disabled.
+func (w *DistributedFileWriter) rotationBoundary(now time.Time) time.Time {
+	var boundary time.Time
+	if w.interval > 0 {
+		boundary = now.Truncate(w.interval)
+	}
+	if w.rotateDaily {
+		daily := time.Date(now.Year(), now.Month(), now.Day(), w.rotateHour, w.rotateMinute, 0, 0, now.Location())
+		if daily.After(now) {
+			daily = daily.AddDate(0, 0, -1)
+		}
+		if daily.After(boundary) {
+			boundary = daily
+		}
 	}
 
-	return stat.Size()+int64(n) >= w.maxSize && w.maxSize > 0, nil
+	return boundary
 }
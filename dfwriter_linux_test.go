@@ -0,0 +1,265 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// TestOFDLocking verifies that open file description locks exclude writers using another open file
+// description of the same file, even within one process, and allow shared locks to coexist.
+func TestOFDLocking(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "ofd.log")
+	logger, err := New(logPath, WithFileLocking(), WithLockMode(LockOFD), WithLockTimeout(100*time.Millisecond))
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	other, err := os.OpenFile(logPath, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	defer other.Close()
+
+	// A shared lock held elsewhere allows short lines but blocks rotation
+	assert.NoError(t, LockOFD.lock(other, false))
+	assert.NoError(t, logger.WriteLine([]byte("shared\n")))
+	assert.ErrorIs(t, logger.Rotate(), ErrLockTimeout)
+
+	// An exclusive lock held elsewhere blocks everything
+	assert.NoError(t, LockOFD.unlock(other))
+	assert.NoError(t, LockOFD.lock(other, true))
+	assert.ErrorIs(t, logger.WriteLine([]byte("exclusive\n")), ErrLockTimeout)
+
+	assert.NoError(t, LockOFD.unlock(other))
+	assert.NoError(t, logger.WriteLine([]byte("unlocked\n")))
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "shared\nunlocked\n", string(contents))
+}
+
+// TestOFDLockingMultiProc ensures that no lines are lost when several processes write and rotate
+// with open file description locks.
+func TestOFDLockingMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-ofd")
+}
+
+// TestOFDLockingRenameMultiProc is TestOFDLockingMultiProc with rotation by renaming.
+func TestOFDLockingRenameMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-ofd", "-rename")
+}
+
+// TestOpenSync verifies that WithOpenSync opens the log file with O_SYNC, also when reopening it after
+// rotation by renaming.
+func TestOpenSync(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "osync.log")
+	logger, err := New(logPath, WithOpenSync(), WithRenameRotation())
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	openFlags := func() int64 {
+		info, err := os.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", logger.file.Fd()))
+		assert.NoError(t, err)
+		for _, line := range strings.Split(string(info), "\n") {
+			if value, ok := strings.CutPrefix(line, "flags:"); ok {
+				flags, err := strconv.ParseInt(strings.TrimSpace(value), 8, 64)
+				assert.NoError(t, err)
+				return flags
+			}
+		}
+		t.Fatal("no flags in fdinfo")
+		return 0
+	}
+
+	assert.Equal(t, int64(syscall.O_SYNC), openFlags()&syscall.O_SYNC)
+	assert.NoError(t, logger.WriteLine([]byte("line\n")))
+	assert.NoError(t, logger.Rotate())
+	assert.Equal(t, int64(syscall.O_SYNC), openFlags()&syscall.O_SYNC)
+}
+
+// TestKernelCopy verifies that rotation copies the log file with copy_file_range, falls back to
+// copying in userspace if the system call isn't supported for the files, and fails the rotation
+// without truncating the log file if the system call fails midway.
+func TestKernelCopy(t *testing.T) {
+	defer func(copyRange func(int, *int64, int, *int64, int, int) (int, error)) {
+		copyFileRange = copyRange
+	}(copyFileRange)
+	realCopyRange := copyFileRange
+
+	content := strings.Repeat("line of the log file\n", 1000)
+	for _, tt := range []struct {
+		name    string
+		failure error
+		calls   int
+	}{
+		{name: "kernel", calls: 2},
+		{name: "cross-device", failure: unix.EXDEV, calls: 1},
+		{name: "unsupported", failure: unix.ENOSYS, calls: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			copyFileRange = func(rfd int, roff *int64, wfd int, woff *int64, len int, flags int) (int, error) {
+				calls++
+				if tt.failure != nil {
+					return 0, tt.failure
+				}
+				return realCopyRange(rfd, roff, wfd, woff, len, flags)
+			}
+
+			logPath := filepath.Join(t.TempDir(), "copy.log")
+			logger, err := New(logPath)
+			assert.NoError(t, err)
+			_, err = logger.WriteString(content)
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+			assert.NoError(t, logger.Close())
+
+			backups, err := OpenBackups(logPath)
+			assert.NoError(t, err)
+			if assert.Len(t, backups, 1) {
+				data, err := os.ReadFile(backups[0].Path)
+				assert.NoError(t, err)
+				assert.Equal(t, content, string(data))
+			}
+			assert.Equal(t, tt.calls, calls)
+		})
+	}
+
+	t.Run("midway", func(t *testing.T) {
+		copyFileRange = func(rfd int, roff *int64, wfd int, woff *int64, len int, flags int) (int, error) {
+			if n, err := unix.Seek(wfd, 0, io.SeekCurrent); err != nil || n > 0 {
+				return 0, unix.EIO
+			}
+			return realCopyRange(rfd, roff, wfd, woff, 100, flags)
+		}
+
+		logPath := filepath.Join(t.TempDir(), "copy.log")
+		logger, err := New(logPath)
+		assert.NoError(t, err)
+		_, err = logger.WriteString(content)
+		assert.NoError(t, err)
+		assert.ErrorIs(t, logger.Rotate(), unix.EIO)
+		assert.NoError(t, logger.Close())
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(data))
+		files, err := filepath.Glob(logPath + ".*")
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
+
+// BenchmarkRotateCopy measures rotating a 256 MB log file by copying it within the kernel with
+// copy_file_range and in userspace.
+func BenchmarkRotateCopy(b *testing.B) {
+	defer func(copyRange func(int, *int64, int, *int64, int, int) (int, error)) {
+		copyFileRange = copyRange
+	}(copyFileRange)
+	realCopyRange := copyFileRange
+
+	chunk := []byte(strings.Repeat("x", 1<<20-1) + "\n")
+	for _, bb := range []struct {
+		name      string
+		copyRange func(int, *int64, int, *int64, int, int) (int, error)
+	}{
+		{name: "copy_file_range", copyRange: realCopyRange},
+		{name: "userspace", copyRange: func(int, *int64, int, *int64, int, int) (int, error) {
+			return 0, unix.ENOSYS
+		}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			copyFileRange = bb.copyRange
+			logger, err := New(filepath.Join(b.TempDir(), "benchmark.log"), WithMaxBackups(1))
+			if err != nil {
+				b.Fatalf("failed to create logger: %v", err)
+			}
+			defer logger.Close()
+
+			b.SetBytes(256 * int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for range 256 {
+					if err := logger.WriteLine(chunk); err != nil {
+						b.Fatalf("failed to write log: %v", err)
+					}
+				}
+				b.StartTimer()
+				if err := logger.Rotate(); err != nil {
+					b.Fatalf("failed to rotate: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestPreallocate verifies that the log file's disk space is preallocated up to the max size when
+// opening it and after rotations, while its size and the rotation keep following the data written.
+func TestPreallocate(t *testing.T) {
+	const maxSize = 1 << 20
+	tmpDir := t.TempDir()
+	probe, err := os.Create(filepath.Join(tmpDir, "probe"))
+	assert.NoError(t, err)
+	err = unix.Fallocate(int(probe.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, 4096)
+	probe.Close()
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("fallocate is not supported by the filesystem")
+	}
+
+	allocated := func(path string) int64 {
+		var stat unix.Stat_t
+		assert.NoError(t, unix.Stat(path, &stat))
+		return stat.Blocks * 512
+	}
+
+	for _, options := range [][]Option{nil, {WithRenameRotation()}} {
+		logPath := filepath.Join(t.TempDir(), "prealloc.log")
+		logger, err := New(logPath, append(options, WithMaxBytes(maxSize), WithPreallocate())...)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, allocated(logPath), int64(maxSize))
+		info, err := os.Stat(logPath)
+		assert.NoError(t, err)
+		assert.Zero(t, info.Size())
+
+		// The preallocated space doesn't count towards the max size
+		line := []byte(strings.Repeat("x", 1023) + "\n")
+		for range maxSize/len(line) - 1 {
+			assert.NoError(t, logger.WriteLine(line))
+		}
+		assert.Zero(t, logger.Stats().Rotations)
+		assert.NoError(t, logger.WriteLine(line))
+		assert.Equal(t, int64(1), logger.Stats().Rotations)
+		assert.GreaterOrEqual(t, allocated(logPath), int64(maxSize))
+		info, err = os.Stat(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(line)), info.Size())
+		assert.NoError(t, logger.Close())
+	}
+
+	// Without the option, only the written data is allocated
+	logPath := filepath.Join(t.TempDir(), "sparse.log")
+	logger, err := New(logPath, WithMaxBytes(maxSize))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+	assert.Less(t, allocated(logPath), int64(maxSize))
+}
+
+func TestDropCacheAfterRotateFadvise(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "fadvise.log")
+	var errs []error
+	logger, err := New(logPath, WithMaxBytes(16), WithDropCacheAfterRotate(), WithCompression(),
+		WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.WriteLine([]byte("first line\n")))
+	assert.NoError(t, logger.WriteLine([]byte("second line\n")))
+	assert.NoError(t, logger.Close())
+	assert.Empty(t, errs)
+}
@@ -1,18 +1,34 @@
 package dfwriter
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -100,345 +116,6050 @@ func TestLoggerPartialWrites(t *testing.T) {
 	assert.Equal(t, "[TEST] foo bar\n[TEST] baz", string(contents))
 }
 
-// TestLineExceedsMaxSize ensures that attempting to write a line larger than the maximum size
-// results in an error and no data is written to the log file.
-func TestLineExceedsMaxSize(t *testing.T) {
+// TestSharedPrefixNotMutated verifies that a prefix slice with spare capacity, shared between
+// concurrently writing loggers, is neither modified nor causes lines to be corrupted.
+func TestSharedPrefixNotMutated(t *testing.T) {
 	tmpDir := t.TempDir()
-	logPath := filepath.Join(tmpDir, "exceed.log")
-	logger, err := New(logPath,
-		WithMaxBytes(100),
-		WithMaxBackups(5),
-	)
-	assert.NoError(t, err)
+	prefix := make([]byte, 0, 64)
+	prefix = append(prefix, "[SHARED] "...)
 
-	longMessage := strings.Repeat("x", 200) + "\n"
-	n, err := logger.Write([]byte(longMessage))
-	assert.Error(t, err)
-	assert.Equal(t, 0, n)
+	const lineCount = 100
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			logPath := filepath.Join(tmpDir, fmt.Sprintf("shared%d.log", id))
+			logger, err := New(logPath, WithPrefix(prefix))
+			assert.NoError(t, err)
 
-	err = logger.Sync()
-	assert.Error(t, err)
-	err = logger.Close()
-	assert.Error(t, err)
+			msg := fmt.Sprintf("writer %d\n", id)
+			for range lineCount {
+				_, err := logger.Write([]byte(msg))
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, logger.Close())
 
-	contents, err := os.ReadFile(logPath)
-	if err != nil {
-		t.Fatalf("failed to read log file: %v", err)
+			contents, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Repeat("[SHARED] "+msg, lineCount), string(contents))
+		}(i)
 	}
-	assert.Equal(t, len(contents), 0)
+	wg.Wait()
+
+	assert.Equal(t, "[SHARED] ", string(prefix))
+	assert.Equal(t, make([]byte, cap(prefix)-len(prefix)), prefix[len(prefix):cap(prefix)])
 }
 
-// TestLogRotationOccurs verifies that log rotation occurs when the maximum file size is exceeded.
-func TestLogRotationOccurs(t *testing.T) {
+// TestPrefixFunc verifies that the prefix function is evaluated per line, written after the static
+// prefix and included in the max size and rotation accounting.
+func TestPrefixFunc(t *testing.T) {
 	tmpDir := t.TempDir()
-	logPath := filepath.Join(tmpDir, "rotate.log")
-	prefix := []byte("[ROTATE] ")
+	logPath := filepath.Join(tmpDir, "prefixfunc.log")
+	calls := 0
 	logger, err := New(logPath,
-		WithMaxBytes(100),
+		WithMaxBytes(30),
 		WithMaxBackups(5),
-		WithPrefix(prefix),
+		WithPrefix([]byte("[S]")),
+		WithPrefixFunc(func() []byte {
+			calls++
+			return []byte(fmt.Sprintf("[%d] ", calls))
+		}),
 	)
 	assert.NoError(t, err)
 
-	// Write enough data to exceed 100 bytes
-	for i := 0; i < 10; i++ {
-		msg := strings.Repeat("x", 15) + "\n"
-		n, err := logger.Write([]byte(msg))
+	_, err = logger.Write([]byte("one\ntwo\n"))
+	assert.NoError(t, err)
+
+	// Fits within the max size on its own, but not with both prefixes
+	err = logger.WriteLine([]byte(strings.Repeat("x", 24) + "\n"))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+
+	// Both prefixes count towards the rotation size
+	_, err = logger.Write([]byte("four\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		data, err := os.ReadFile(files[0])
 		assert.NoError(t, err)
-		assert.Equal(t, len(msg), n)
+		assert.Equal(t, "[S][1] one\n[S][2] two\n", string(data))
 	}
-
-	err = logger.Sync()
+	contents, err := os.ReadFile(logPath)
 	assert.NoError(t, err)
-	err = logger.Close()
+	assert.Equal(t, "[S][4] four\n", string(contents))
+
+	layout := "2006-01-02"
+	prefix := TimestampPrefix(layout)()
+	assert.Equal(t, time.Now().Format(layout)+" ", string(prefix))
+}
+
+// TestPrefixTemplate verifies the expansion of each prefix template token, that a template
+// without tokens behaves like a static prefix, and that expansion does not allocate.
+func TestPrefixTemplate(t *testing.T) {
+	hostname, err := os.Hostname()
 	assert.NoError(t, err)
+	layout := "2006-01-02"
 
-	files, err := filepath.Glob(logPath + ".*")
-	if err != nil {
-		t.Fatalf("failed to list rotated files: %v", err)
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{"timestamp", "%t ", time.Now().Format(layout) + " "},
+		{"pid", "[%p] ", "[" + strconv.Itoa(os.Getpid()) + "] "},
+		{"hostname", "%h: ", hostname + ": "},
+		{"percent", "100%% ", "100% "},
+		{"combined", "%h/%p %t ", hostname + "/" + strconv.Itoa(os.Getpid()) + " " + time.Now().Format(layout) + " "},
+		{"no tokens", "[STATIC] ", "[STATIC] "},
 	}
 
-	if len(files) == 0 {
-		t.Error("expected rotated log file, found none")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "template.log")
+			logger, err := New(logPath,
+				WithPrefixTemplate(tt.tmpl),
+				WithPrefixTimeLayout(layout),
+			)
+			assert.NoError(t, err)
+
+			_, err = logger.Write([]byte("line\n"))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Close())
+
+			contents, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want+"line\n", string(contents))
+		})
 	}
+
+	// The expanded template counts towards the max size
+	logPath := filepath.Join(t.TempDir(), "template-size.log")
+	logger, err := New(logPath, WithPrefixTemplate("[%p] "), WithMaxBytes(20))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, logger.WriteLine([]byte(strings.Repeat("x", 15)+"\n")), ErrLineTooLong)
+
+	logger.linePrefix()
+	allocs := testing.AllocsPerRun(100, func() {
+		logger.linePrefix()
+	})
+	assert.Equal(t, float64(0), allocs)
+	assert.NoError(t, logger.Close())
+
+	_, err = New(filepath.Join(t.TempDir(), "invalid.log"), WithPrefixTemplate("%x"))
+	assert.Error(t, err)
 }
 
-// TestMaxBackupsIsEnforced ensures that the maximum number of backup files is enforced.
-func TestMaxBackupsIsEnforced(t *testing.T) {
+// TestTimestamps verifies that timestamps are prepended to every line before the prefix, that they
+// count towards the max size when rotating, and that the resolution of a layout is detected.
+func TestTimestamps(t *testing.T) {
 	tmpDir := t.TempDir()
-	logPath := filepath.Join(tmpDir, "maxbackup.log")
-	prefix := []byte("[MAX] ")
+	logPath := filepath.Join(tmpDir, "timestamps.log")
+	const layout = "2006-01-02T15:04:05.000Z07:00"
+	// Every line takes 25 bytes of timestamp, 4 of prefix and 2 of content, so 3 lines fit
 	logger, err := New(logPath,
-		WithMaxBytes(100),
-		WithMaxBackups(3),
-		WithPrefix(prefix),
+		WithTimestamps(layout, true),
+		WithPrefix([]byte("[P] ")),
+		WithMaxBytes(94),
+		WithMaxBackups(10),
 	)
 	assert.NoError(t, err)
 
-	for i := 0; i < 5; i++ {
-		msg := strings.Repeat("y", 80) + "\n"
-		_, err := logger.Write([]byte(msg))
+	start := time.Now().Truncate(time.Millisecond)
+	for range 7 {
+		_, err := logger.Write([]byte("x\n"))
 		assert.NoError(t, err)
 	}
+	end := time.Now()
+	assert.NoError(t, logger.Close())
 
 	files, err := filepath.Glob(logPath + ".*")
 	assert.NoError(t, err)
+	sort.Strings(files)
+	var lines []string
+	var counts []int
+	for _, f := range append(files, logPath) {
+		data, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 94)
+		fileLines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		lines = append(lines, fileLines...)
+		counts = append(counts, len(fileLines))
+	}
+	assert.Equal(t, []int{3, 3, 1}, counts)
+	previous := start
+	for _, line := range lines {
+		timestamp, rest, _ := strings.Cut(line, " ")
+		assert.Equal(t, "[P] x", rest)
+		parsed, err := time.Parse(layout, timestamp)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(timestamp, "Z"), timestamp)
+		assert.False(t, parsed.Before(previous), "timestamp %s out of order", timestamp)
+		assert.False(t, parsed.After(end))
+		previous = parsed
+	}
+
+	// Local time, with a static prefix
+	logPath = filepath.Join(tmpDir, "local.log")
+	logger, err = New(logPath, WithTimestamps(time.DateTime, false))
+	assert.NoError(t, err)
+	before := time.Now().Truncate(time.Second)
+	assert.NoError(t, logger.WriteLine([]byte("line\n")))
+	assert.NoError(t, logger.Close())
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, " line\n", string(contents[len(time.DateTime):]))
+	parsed, err := time.ParseInLocation(time.DateTime, string(contents[:len(time.DateTime)]), time.Local)
+	assert.NoError(t, err)
+	assert.False(t, parsed.Before(before))
 
-	assert.Equal(t, 3, len(files), "expected 3 backups, found %d", len(files))
+	for layout, resolution := range map[string]time.Duration{
+		time.RFC3339:          time.Second,
+		time.Kitchen:          time.Second,
+		time.StampMilli:       time.Millisecond,
+		time.RFC3339Nano:      time.Nanosecond,
+		"15:04:05,000000":     time.Microsecond,
+		"2006.01.02 15:04:05": time.Second,
+	} {
+		assert.Equal(t, int64(resolution), layoutResolution(layout), layout)
+	}
 }
 
-// TestRotationLinesRetained ensures that all log lines are retained across rotated files.
-func TestRotationLinesRetained(t *testing.T) {
-	tmpDir := t.TempDir()
-	logPath := filepath.Join(tmpDir, "file.log")
+// TestFileModeAndMkdirAll verifies that missing parent directories are created and that the log file
+// and its backups, compressed or not, are created with the configured mode.
+func TestFileModeAndMkdirAll(t *testing.T) {
+	for _, compression := range []CompressionFormat{CompressionNone, CompressionGzip} {
+		t.Run(string(compression), func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "nested", "dir", "mode.log")
+			logger, err := New(logPath,
+				WithMkdirAll(0750),
+				WithFileMode(0600),
+				WithCompressionFormat(compression),
+			)
+			assert.NoError(t, err)
 
-	const lineCount = 50
-	const lineSize = 15
-	const rotationSize = 100
+			_, err = logger.Write([]byte("line\n"))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+			assert.NoError(t, logger.Close())
 
-	logger, err := New(logPath,
-		WithMaxBytes(rotationSize),
-		WithMaxBackups(100),
-		WithFileLocking(),
-	)
-	assert.NoError(t, err)
+			info, err := os.Stat(filepath.Dir(logPath))
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
 
-	for i := 0; i < lineCount; i++ {
-		msg := strings.Repeat("y", lineSize) + "\n"
-		_, err := logger.Write([]byte(msg))
-		assert.NoError(t, err)
+			files, err := filepath.Glob(logPath + "*")
+			assert.NoError(t, err)
+			assert.Len(t, files, 2)
+			for _, f := range files {
+				info, err := os.Stat(f)
+				assert.NoError(t, err)
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "unexpected mode of %s", f)
+			}
+		})
 	}
+}
 
-	files, err := filepath.Glob(logPath + "*")
+// TestBackupPreservesMode verifies that backups of a 0600 log file are created with 0600.
+func TestBackupPreservesMode(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "private.log")
+	assert.NoError(t, os.WriteFile(logPath, nil, 0600))
+	logger, err := New(logPath)
 	assert.NoError(t, err)
 
-	nLogFiles := lineCount/(rotationSize/lineSize) + 1
-	assert.Equal(t, nLogFiles, len(files), "expected %d logFiles, found %d", nLogFiles, len(files))
-
-	total := 0
+	_, err = logger.Write([]byte("secret\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
 
-	for _, f := range files {
-		data, err := os.ReadFile(f)
-		if err != nil {
-			t.Fatalf("read %s: %v", f, err)
-		}
-		total += len(bytes.Split(data, []byte("\n"))) - 1
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		info, err := os.Stat(files[0])
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
 	}
-
-	assert.Equal(t, lineCount, total, "expected %d lines in all files, got %d", lineCount, total)
 }
 
-// TestCompression verifies that log files are compressed after rotation.
-func TestCompression(t *testing.T) {
+// TestLineExceedsMaxSize ensures that attempting to write a line larger than the maximum size
+// results in an error and no data is written to the log file.
+func TestLineExceedsMaxSize(t *testing.T) {
 	tmpDir := t.TempDir()
-	logPath := filepath.Join(tmpDir, "compress.log")
-	const lineCount = 8
-	const lineSize = 15
-	const rotationSize = 100
-
+	logPath := filepath.Join(tmpDir, "exceed.log")
 	logger, err := New(logPath,
-		WithMaxBytes(rotationSize),
-		WithMaxBackups(100),
-		WithCompression(),
-		WithFileLocking(),
+		WithMaxBytes(100),
+		WithMaxBackups(5),
 	)
 	assert.NoError(t, err)
 
-	for i := 0; i < lineCount; i++ {
-		msg := strings.Repeat("y", lineSize) + "\n"
-		_, err := logger.Write([]byte(msg))
-		assert.NoError(t, err)
-	}
+	longMessage := strings.Repeat("x", 200) + "\n"
+	n, err := logger.Write([]byte(longMessage))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+	assert.Equal(t, 0, n)
 
+	// The oversized line is discarded, so the writer recovers
 	err = logger.Sync()
 	assert.NoError(t, err)
 	err = logger.Close()
 	assert.NoError(t, err)
 
-	files, err := filepath.Glob(logPath + ".*")
+	contents, err := os.ReadFile(logPath)
 	if err != nil {
-		t.Fatalf("failed to list rotated files: %v", err)
+		t.Fatalf("failed to read log file: %v", err)
 	}
+	assert.Equal(t, len(contents), 0)
+}
 
-	if len(files) != 1 {
-		t.Fatalf("expected exactly one rotated file, found %d", len(files))
-	}
+// TestTypedErrors verifies that errors returned by the writer can be matched with errors.Is and errors.As.
+func TestTypedErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "errors.log")
+	logger, err := New(logPath,
+		WithMaxBytes(100),
+		WithPrefix([]byte("[ERR] ")),
+		WithFileLocking(),
+	)
+	assert.NoError(t, err)
 
-	gzFile, err := os.Open(files[0])
-	if err != nil {
-		t.Fatalf("failed to list rotated files: %v", err)
+	err = logger.WriteLine([]byte(strings.Repeat("x", 200) + "\n"))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+	var lineErr *LineTooLongError
+	if assert.ErrorAs(t, err, &lineErr) {
+		assert.Equal(t, 207, lineErr.Length)
+		assert.Equal(t, int64(100), lineErr.Max)
 	}
-	defer gzFile.Close()
 
-	// Create a gzip.Reader
-	gr, err := gzip.NewReader(gzFile)
-	if err != nil {
-		t.Fatalf("Failed to create gzip reader: %v", err)
+	// Locking a file that can no longer be locked yields a LockError
+	file := logger.file
+	logger.file, err = os.Open(logPath)
+	assert.NoError(t, err)
+	logger.file.Close()
+	var lockErr *LockError
+	if assert.ErrorAs(t, logger.lock(true), &lockErr) {
+		assert.Equal(t, logPath, lockErr.Path)
+		assert.True(t, lockErr.Exclusive)
 	}
-	defer gr.Close()
+	logger.file = file
 
-	decompressedData, err := io.ReadAll(gr)
-	if err != nil {
-		t.Fatalf("Failed to read decompressed data: %v", err)
-	}
-	assert.Equal(t, (lineSize+1)*(rotationSize/lineSize), len(decompressedData), "expected %d bytes, got %d", lineSize*(rotationSize/lineSize), len(decompressedData))
-	lines := bytes.Split(decompressedData, []byte("\n"))
-	assert.Equal(t, rotationSize/lineSize, len(lines)-1, "expected %d lines, got %d", rotationSize/lineSize, len(lines)-1)
+	assert.NoError(t, logger.Close())
+
+	_, err = logger.Write([]byte("closed\n"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, logger.WriteLine([]byte("closed\n")), ErrClosed)
+	assert.ErrorIs(t, logger.Sync(), ErrClosed)
 }
 
-func TestConcurrentWritesAndRotation(t *testing.T) {
-	// Parent mode: spawn N child processes
-	dir := t.TempDir()
-	logPath := filepath.Join(dir, "app.log")
+// TestWriteAfterClose verifies that Close is idempotent, that writes after Close fail with ErrClosed
+// without buffering anything, and that Close can safely race with concurrent writes.
+func TestWriteAfterClose(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "closed.log")
+	logger, err := New(logPath)
+	assert.NoError(t, err)
 
-	const (
-		writers        = 5
-		linesPerWriter = 20
-		lineSize       = 10
-		rotationSize   = 100
-	)
+	_, err = logger.Write([]byte("open\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+	assert.NoError(t, logger.Close())
 
-	var wg sync.WaitGroup
-	for i := range writers {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			prefix := strconv.Itoa(id)
-			logger, err := New(
-				logPath,
-				WithMaxBytes(rotationSize),
-				WithMaxBackups(10000),
-				WithPrefix([]byte(prefix)),
-				WithFileLocking(),
-			)
-			assert.NoError(t, err)
-			defer logger.Close()
+	n, err := logger.Write([]byte("partial"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 0, logger.buf.Len())
+	assert.ErrorIs(t, logger.WriteLine([]byte("closed\n")), ErrClosed)
+	assert.ErrorIs(t, logger.Sync(), ErrClosed)
+	assert.ErrorIs(t, logger.Rotate(), ErrClosed)
 
-			msg := []byte(strings.Repeat("x", lineSize-len(prefix)-1) + "\n")
-			for range linesPerWriter {
-				_, err := logger.Write(msg)
-				assert.NoError(t, err)
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "open\n", string(contents))
+
+	// Close racing with writes must neither panic nor lose acknowledged lines
+	racePath := filepath.Join(tmpDir, "race.log")
+	logger, err = New(racePath, WithFileLocking())
+	assert.NoError(t, err)
+
+	var written sync.WaitGroup
+	var acknowledged int64
+	var mu sync.Mutex
+	for range 10 {
+		written.Add(1)
+		go func() {
+			defer written.Done()
+			for range 100 {
+				_, err := logger.Write([]byte("line\n"))
+				if err != nil {
+					assert.ErrorIs(t, err, ErrClosed)
+					return
+				}
+				mu.Lock()
+				acknowledged++
+				mu.Unlock()
 			}
-			err = logger.Sync()
-			assert.NoError(t, err)
-		}(i)
+		}()
 	}
+	assert.NoError(t, logger.Close())
+	written.Wait()
 
-	wg.Wait()
+	contents, err = os.ReadFile(racePath)
+	assert.NoError(t, err)
+	assert.Equal(t, acknowledged, int64(bytes.Count(contents, []byte("\n"))))
+}
 
-	// now validate total lines
-	files, _ := filepath.Glob(logPath + "*")
-	assert.GreaterOrEqual(t, len(files), (writers*linesPerWriter*lineSize)/rotationSize)
-	total := 0
-	for _, f := range files {
-		data, err := os.ReadFile(f)
-		if err != nil {
-			t.Fatalf("read %s: %v", f, err)
-		}
-		total += len(bytes.Split(data, []byte("\n"))) - 1
+// TestWriteMultiLinePayloads verifies that payloads with several lines, empty lines and partial lines
+// spanning multiple Write calls are split into the same lines as when written byte by byte.
+func TestWriteMultiLinePayloads(t *testing.T) {
+	payloads := []string{"a\nb\nc", "d\n\ne", "f", "\n", "g\nh\n", "i"}
+	want := "[P] a\n[P] b\n[P] cd\n[P] \n[P] ef\n[P] g\n[P] h\n[P] i"
 
-	}
-	want := writers * linesPerWriter
-	assert.Equal(t, want, total, "expected %d lines in all files, got %d", want, total)
-}
+	for _, byteByByte := range []bool{false, true} {
+		logPath := filepath.Join(t.TempDir(), "multi.log")
+		logger, err := New(logPath, WithPrefix([]byte("[P] ")))
+		assert.NoError(t, err)
+
+		for _, payload := range payloads {
+			chunks := []string{payload}
+			if byteByByte {
+				chunks = strings.Split(payload, "")
+			}
+			for _, chunk := range chunks {
+				n, err := logger.Write([]byte(chunk))
+				assert.NoError(t, err)
+				assert.Equal(t, len(chunk), n)
+			}
+		}
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(contents), "byte by byte: %t", byteByByte)
+	}
+}
+
+// TestDelimiter verifies the splitting on a custom delimiter and the normalization of CRLF line
+// endings, and that the max size and atomic line size apply to normalized lines.
+func TestDelimiter(t *testing.T) {
+	t.Run("CRLF", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "crlf.log")
+		logger, err := New(logPath, WithPrefix([]byte("[P] ")), WithNormalizeCRLF())
+		assert.NoError(t, err)
+
+		for _, payload := range []string{"one\r\ntwo\r", "\n", "three\r\r\n", "bare\rcr\n", "\r\n"} {
+			n, err := logger.Write([]byte(payload))
+			assert.NoError(t, err)
+			assert.Equal(t, len(payload), n)
+		}
+		assert.NoError(t, logger.WriteLine([]byte("line\r\n")))
+		assert.NoError(t, logger.WriteLines([][]byte{[]byte("first\r\n"), []byte("second\n")}))
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "[P] one\n[P] two\n[P] three\r\n[P] bare\rcr\n[P] \n[P] line\n[P] first\n[P] second\n", string(contents))
+	})
+
+	t.Run("bare CR", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "cr.log")
+		logger, err := New(logPath)
+		assert.NoError(t, err)
+
+		_, err = logger.Write([]byte("one\r\ntwo\rthree\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "one\r\ntwo\rthree\n", string(contents))
+	})
+
+	t.Run("normalized size", func(t *testing.T) {
+		var mu sync.Mutex
+		syncs := 0
+		fsys := &faultFS{sync: func(f fsFile) error {
+			mu.Lock()
+			syncs++
+			mu.Unlock()
+			return f.Sync()
+		}}
+
+		// The normalized line fits the atomic line size exactly, so it is written without an
+		// exclusive lock, which would sync the file
+		logPath := filepath.Join(t.TempDir(), "size.log")
+		logger, err := New(logPath, WithNormalizeCRLF(), WithAtomicLineSize(10), WithFileLocking(), withFS(fsys))
+		assert.NoError(t, err)
+		_, err = logger.Write([]byte("123456789\r\n"))
+		assert.NoError(t, err)
+		mu.Lock()
+		assert.Equal(t, 0, syncs)
+		mu.Unlock()
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "123456789\n", string(contents))
+
+		// Only the normalized line fits the max size
+		for _, normalize := range []bool{false, true} {
+			options := []Option{WithMaxBytes(10)}
+			if normalize {
+				options = append(options, WithNormalizeCRLF())
+			}
+			logger, err = New(filepath.Join(t.TempDir(), "size.log"), options...)
+			assert.NoError(t, err)
+			_, err = logger.Write([]byte("123456789\r\n"))
+			if normalize {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrLineTooLong)
+			}
+			assert.NoError(t, logger.Close())
+		}
+	})
+
+	t.Run("custom delimiter", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "records.log")
+		logger, err := New(logPath, WithPrefix([]byte("[P] ")), WithDelimiter('\x1e'), WithNormalizeCRLF(),
+			WithMaxBytes(16), WithMaxBackups(10), WithOversizeLinePolicy(OversizeSplit))
+		assert.NoError(t, err)
+
+		for _, payload := range []string{"multi\nline\x1esecond\r\x1epar", "tial\n", "\x1e", "a long record exceeding\x1e"} {
+			n, err := logger.Write([]byte(payload))
+			assert.NoError(t, err)
+			assert.Equal(t, len(payload), n)
+		}
+		assert.NoError(t, logger.Close())
+
+		files, err := filepath.Glob(logPath + "*")
+		assert.NoError(t, err)
+		sort.Strings(files)
+		var contents string
+		for _, f := range append(files[1:], logPath) {
+			data, err := os.ReadFile(f)
+			assert.NoError(t, err)
+			contents += string(data)
+		}
+		assert.Equal(t, "[P] multi\nline\x1e[P] second\x1e[P] partial\n\x1e[P] a long reco\x1e[P] rd exceedin\x1e[P] g\x1e", contents)
+	})
+}
+
+// TestLineTransform verifies that lines are redacted, dropped or escaped by the line transform
+// before the max size is applied, so lines growing past the rotation threshold rotate the file and
+// oversized lines shrinking below it are written.
+func TestLineTransform(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "transform.log")
+	redact := RedactPatterns(regexp.MustCompile(`s\d`), regexp.MustCompile(`token=[a-z]+`))
+	logger, err := New(logPath,
+		WithMaxBytes(30),
+		WithMaxBackups(10),
+		WithPrefix([]byte("[P] ")),
+		WithLineTransform(func(line []byte) []byte {
+			switch {
+			case bytes.HasPrefix(line, []byte("DEBUG")):
+				return nil
+			case bytes.Equal(line, []byte("inject")):
+				return []byte("x\ny")
+			}
+			return redact(line)
+		}),
+	)
+	assert.NoError(t, err)
+
+	for _, line := range []string{
+		"hello\n",
+		"s1 s2\n", // grows past the max size with the previous line, so it rotates the file
+		"DEBUG a line far too long to fit within the max size\n",
+		"token=abcdefghijklmnopqrstuvwxyz\n", // too long unless redacted
+	} {
+		n, err := logger.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.NoError(t, logger.WriteLine([]byte("inject\n")))
+	assert.NoError(t, logger.WriteLines([][]byte{[]byte("DEBUG dropped\n"), []byte("s3\n")}))
+	assert.Equal(t, int64(3), logger.Stats().Rotations)
+	assert.NoError(t, logger.Close())
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	sort.Strings(files)
+	var contents []string
+	for _, f := range append(files, logPath) {
+		data, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		contents = append(contents, string(data))
+	}
+	assert.Equal(t, []string{
+		"[P] hello\n",
+		"[P] [REDACTED] [REDACTED]\n",
+		"[P] [REDACTED]\n[P] x\\ny\n",
+		"[P] [REDACTED]\n",
+	}, contents)
+}
+
+// TestDedupe verifies that consecutive duplicate lines are summarized, non-consecutive ones are
+// written, and that the summary is written on Sync, Rotate and Close and once the window expires.
+func TestDedupe(t *testing.T) {
+	t.Run("consecutive", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "dedupe.log")
+		logger, err := New(logPath, WithDedupe(time.Hour), WithPrefix([]byte("[P] ")))
+		assert.NoError(t, err)
+
+		_, err = logger.Write([]byte("a\na\na\nb\na\nb\na\nb\nb\n"))
+		assert.NoError(t, err)
+		for range 5 {
+			assert.NoError(t, logger.WriteLine([]byte("c\n")))
+		}
+		assert.NoError(t, logger.WriteLines([][]byte{[]byte("c\n"), []byte("d\n"), []byte("d\n")}))
+		assert.NoError(t, logger.Sync())
+		_, err = logger.Write([]byte("d\nd\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "[P] a\n[P] … last message repeated 2 times\n[P] b\n[P] a\n[P] b\n[P] a\n[P] b\n"+
+			"[P] … last message repeated 1 times\n[P] c\n[P] … last message repeated 5 times\n[P] d\n"+
+			"[P] … last message repeated 1 times\n[P] … last message repeated 2 times\n", string(contents))
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "dedupe.log")
+		logger, err := New(logPath, WithDedupe(time.Hour), WithMaxBytes(45), WithMaxBackups(10))
+		assert.NoError(t, err)
+
+		// The summary is written to the log file before a manual rotation, after which the next
+		// line is written even though it is a duplicate
+		_, err = logger.Write([]byte("a\na\na\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		_, err = logger.Write([]byte("a\na\n"))
+		assert.NoError(t, err)
+		// The summary is written to the file of the duplicates before the next line rotates it
+		_, err = logger.Write([]byte(strings.Repeat("x", 30) + "\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Close())
+
+		files, err := filepath.Glob(logPath + ".*")
+		assert.NoError(t, err)
+		sort.Strings(files)
+		var contents []string
+		for _, f := range append(files, logPath) {
+			data, err := os.ReadFile(f)
+			assert.NoError(t, err)
+			contents = append(contents, string(data))
+		}
+		assert.Equal(t, []string{
+			"a\n… last message repeated 2 times\n",
+			"a\n… last message repeated 1 times\n",
+			strings.Repeat("x", 30) + "\n",
+		}, contents)
+	})
+
+	t.Run("window", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "dedupe.log")
+		logger, err := New(logPath, WithDedupe(20*time.Millisecond))
+		assert.NoError(t, err)
+		defer logger.Close()
+
+		_, err = logger.Write([]byte("a\na\na\n"))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			contents, err := os.ReadFile(logPath)
+			return err == nil && string(contents) == "a\n… last message repeated 2 times\n"
+		}, time.Second, time.Millisecond)
+
+		// Once the window expired, a duplicate is written again
+		_, err = logger.Write([]byte("a\n"))
+		assert.NoError(t, err)
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "a\n… last message repeated 2 times\na\n", string(contents))
+	})
+}
+
+// TestRateLimit verifies that lines exceeding the rate limit are dropped and accounted for in
+// Stats and marker lines, or delayed in blocking mode until admitted or the context is done.
+func TestRateLimit(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "ratelimit.log")
+		logger, err := New(logPath, WithRateLimit(100, 100))
+		assert.NoError(t, err)
+
+		const lines = 10000
+		for i := range lines {
+			_, err := fmt.Fprintf(logger, "line %d\n", i)
+			assert.NoError(t, err)
+		}
+		dropped := logger.Stats().DroppedLines
+		assert.Greater(t, dropped, int64(0))
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		var written, marked int64
+		for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+			if count, ok := strings.CutPrefix(line, "dfwriter: dropped "); ok {
+				n, err := strconv.ParseInt(strings.TrimSuffix(count, " lines"), 10, 64)
+				assert.NoError(t, err)
+				marked += n
+				continue
+			}
+			written++
+		}
+		assert.Equal(t, int64(lines), written+dropped)
+		assert.Equal(t, dropped, marked)
+		assert.True(t, strings.HasPrefix(string(contents), "line 0\nline 1\n"))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "ratelimit.log")
+		logger, err := New(logPath, WithRateLimit(200, 1), WithRateLimitMode(RateLimitBlock))
+		assert.NoError(t, err)
+
+		start := time.Now()
+		for range 20 {
+			_, err := logger.Write([]byte("line\n"))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, logger.WriteLines([][]byte{[]byte("line\n"), []byte("line\n")}))
+		// The first line is admitted right away, the others one every 5ms
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		assert.Zero(t, logger.Stats().DroppedLines)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		logger.rateLimit.rate = 1
+		assert.ErrorIs(t, logger.WriteLineContext(ctx, []byte("late\n")), context.DeadlineExceeded)
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("line\n", 22), string(contents))
+	})
+}
+
+// TestWriteLineAllocations verifies that writing lines below 4KB with a prefix and file locking
+// doesn't allocate, and that the prefix is never appended to in place.
+func TestWriteLineAllocations(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "allocs.log")
+	prefix := make([]byte, 0, 64)
+	prefix = append(prefix, "[P] "...)
+	logger, err := New(logPath, WithPrefix(prefix), WithFileLocking(), WithMaxBytes(1024*1024))
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	short := []byte("short line\n")
+	long := []byte(strings.Repeat("x", 4000) + "\n")
+	allocs := testing.AllocsPerRun(100, func() {
+		assert.NoError(t, logger.WriteLine(short))
+		assert.NoError(t, logger.WriteLine(long))
+	})
+	assert.Zero(t, allocs)
+	assert.Equal(t, make([]byte, cap(prefix)-len(prefix)), prefix[len(prefix):cap(prefix)])
+}
+
+// TestWriteLinesBatches verifies that lines passed to Write and WriteLines together are written in as
+// few writes as the atomic line size and max size allow, each line with its own prefix.
+func TestWriteLinesBatches(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "batch.log")
+	var writes []int
+	fsys := &faultFS{write: func(f fsFile, b []byte) (int, error) {
+		if f.Name() == logPath {
+			writes = append(writes, len(b))
+		}
+		return f.Write(b)
+	}}
+
+	count := 0
+	logger, err := New(logPath,
+		withFS(fsys),
+		WithFileLocking(),
+		WithAtomicLineSize(50),
+		WithMaxBytes(100),
+		WithPrefixFunc(func() []byte {
+			count++
+			return []byte(fmt.Sprintf("%d ", count))
+		}),
+	)
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	// Lines of 9 bytes including the prefix: five fit into a batch
+	n, err := logger.Write([]byte("line-1\nline-2\nline-3\nline-4\nline-5\nline-6\nline-7\npart"))
+	assert.NoError(t, err)
+	assert.Equal(t, 53, n)
+	assert.Equal(t, []int{45, 18}, writes)
+
+	// The buffered partial line is completed by the first line of the next batch
+	writes = nil
+	assert.NoError(t, logger.WriteLines([][]byte{[]byte("line-9\n"), nil, []byte("line-10\n")}))
+	_, err = logger.Write([]byte("-8\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{19, 10}, writes)
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 line-1\n2 line-2\n3 line-3\n4 line-4\n5 line-5\n6 line-6\n7 line-7\n8 line-9\n9 line-10\n10 part-8\n",
+		string(contents))
+	assert.Equal(t, int64(10), logger.Stats().LinesWritten)
+
+	// A batch reaching the max size is written after rotating
+	writes = nil
+	lines := make([][]byte, 5)
+	for i := range lines {
+		lines[i] = []byte("rotate\n")
+	}
+	assert.NoError(t, logger.WriteLines(lines))
+	assert.Equal(t, []int{50}, writes)
+	assert.Equal(t, int64(1), logger.Stats().Rotations)
+	contents, err = os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "11 rotate\n12 rotate\n13 rotate\n14 rotate\n15 rotate\n", string(contents))
+}
+
+// TestWritePartialFailureCount verifies that a failing Write reports the bytes of the lines that
+// were written before the failure.
+func TestWritePartialFailureCount(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "partial.log")
+	logger, err := New(logPath, WithMaxBytes(100))
+	assert.NoError(t, err)
+
+	first := "first line\n"
+	n, err := logger.Write([]byte(first + strings.Repeat("x", 200) + "\nthird line\n"))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+	assert.Equal(t, len(first), n)
+	assert.NoError(t, logger.Close())
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, first, string(contents))
+}
+
+// TestWriteString verifies that WriteString behaves exactly like Write for partial lines, lines
+// exceeding the max size and the buffer limit, and writes after Close, and that it doesn't allocate.
+func TestWriteString(t *testing.T) {
+	payloads := []string{
+		"foo ", "bar\n", "baz", "", "\n",
+		"a\nb\nc", "d\n\ne",
+		"first line\n" + strings.Repeat("x", 200) + "\nthird line\n",
+		"partial " + strings.Repeat("y", 200),
+		"recovered\n",
+	}
+
+	writers := map[string]func(w *DistributedFileWriter, s string) (int, error){
+		"Write":       func(w *DistributedFileWriter, s string) (int, error) { return w.Write([]byte(s)) },
+		"WriteString": (*DistributedFileWriter).WriteString,
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	results := map[string][]result{}
+	contents := map[string]string{}
+	for name, write := range writers {
+		logPath := filepath.Join(t.TempDir(), "string.log")
+		logger, err := New(logPath, WithPrefix([]byte("[P] ")), WithMaxBytes(100), WithMaxBufferedBytes(150))
+		assert.NoError(t, err)
+
+		for _, payload := range payloads {
+			n, err := write(logger, payload)
+			results[name] = append(results[name], result{n, err})
+		}
+		assert.NoError(t, logger.Close())
+		n, err := write(logger, "closed\n")
+		results[name] = append(results[name], result{n, err})
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		contents[name] = string(data)
+	}
+
+	assert.Equal(t, results["Write"], results["WriteString"])
+	assert.Equal(t, contents["Write"], contents["WriteString"])
+	assert.Equal(t, "[P] foo bar\n[P] baz\n[P] a\n[P] b\n[P] cd\n[P] \n[P] efirst line\n[P] recovered\n", contents["WriteString"])
+	assert.ErrorIs(t, results["WriteString"][7].err, ErrLineTooLong)
+	assert.Equal(t, len("first line\n"), results["WriteString"][7].n)
+	assert.ErrorIs(t, results["WriteString"][8].err, ErrLineTooLong)
+	assert.ErrorIs(t, results["WriteString"][10].err, ErrClosed)
+
+	logger, err := New(filepath.Join(t.TempDir(), "allocs.log"), WithFileLocking())
+	assert.NoError(t, err)
+	defer logger.Close()
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := logger.WriteString("partial ")
+		assert.NoError(t, err)
+		_, err = logger.WriteString("line\nanother line\n")
+		assert.NoError(t, err)
+	})
+	assert.Zero(t, allocs)
+}
+
+// chunkReader delivers its data in reads of the given sizes, cycling through them.
+type chunkReader struct {
+	data  []byte
+	sizes []int
+	reads int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := min(r.sizes[r.reads%len(r.sizes)], len(p), len(r.data))
+	r.reads++
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestReadFrom verifies that io.Copy streams lines split across arbitrary read boundaries into the
+// log with prefixes, buffering the trailing partial line, and that errors report the bytes consumed.
+func TestReadFrom(t *testing.T) {
+	input := "first\nsecond line\n\nthird line which is a bit longer\nfourth\npartial"
+	want := "[P] first\n[P] second line\n[P] \n[P] third line which is a bit longer\n[P] fourth\n[P] partial"
+
+	readers := map[string]func() io.Reader{
+		"whole":       func() io.Reader { return strings.NewReader(input) },
+		"one byte":    func() io.Reader { return iotest.OneByteReader(strings.NewReader(input)) },
+		"data on EOF": func() io.Reader { return iotest.DataErrReader(strings.NewReader(input)) },
+		"uneven":      func() io.Reader { return &chunkReader{data: []byte(input), sizes: []int{3, 11, 1, 6}} },
+	}
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "readfrom.log")
+			logger, err := New(logPath, WithPrefix([]byte("[P] ")), WithReadBufferSize(7))
+			assert.NoError(t, err)
+
+			n, err := io.Copy(logger, reader())
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(input)), n)
+			assert.NoError(t, logger.Close())
+
+			contents, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			assert.Equal(t, want, string(contents))
+		})
+	}
+
+	t.Run("line too long", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "readfrom.log")
+		logger, err := New(logPath, WithReadBufferSize(16), WithMaxBytes(100))
+		assert.NoError(t, err)
+
+		first := "first line\n"
+		n, err := logger.ReadFrom(strings.NewReader(first + strings.Repeat("x", 200) + "\nthird line\n"))
+		assert.ErrorIs(t, err, ErrLineTooLong)
+		assert.Equal(t, int64(len(first)), n)
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, first, string(contents))
+	})
+
+	t.Run("read error", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "readfrom.log")
+		logger, err := New(logPath)
+		assert.NoError(t, err)
+
+		readErr := errors.New("broken pipe")
+		n, err := logger.ReadFrom(io.MultiReader(strings.NewReader("line\npart"), iotest.ErrReader(readErr)))
+		assert.ErrorIs(t, err, readErr)
+		assert.Equal(t, int64(9), n)
+		assert.NoError(t, logger.Close())
+
+		contents, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "line\npart", string(contents))
+
+		_, err = logger.ReadFrom(strings.NewReader("closed\n"))
+		assert.ErrorIs(t, err, ErrClosed)
+	})
+}
+
+// TestFlushInterval verifies that a partial line without newline is written to disk by the
+// background flush and that Close stops the flush goroutine.
+func TestFlushInterval(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "flush.log")
+	logger, err := New(logPath, WithFlushInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("no newline"))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		contents, err := os.ReadFile(logPath)
+		return err == nil && string(contents) == "no newline"
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, logger.Close())
+	select {
+	case <-logger.done:
+	default:
+		t.Error("expected flush goroutine to be stopped")
+	}
+}
+
+// TestMaxBufferedBytes verifies that an oversized partial line is rejected as soon as it exceeds the
+// buffer limit and that the writer keeps working afterwards.
+func TestMaxBufferedBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "buffered.log")
+	logger, err := New(logPath, WithMaxBufferedBytes(16))
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte(strings.Repeat("x", 10)))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte(strings.Repeat("x", 10)))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+	assert.Equal(t, 0, logger.buf.Len())
+
+	_, err = logger.Write([]byte("recovered\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Sync())
+	assert.NoError(t, logger.Close())
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "recovered\n", string(contents))
+}
+
+// TestOversizeLinePolicy verifies that oversized lines are rejected, truncated or split according to
+// the configured policy, that lines of exactly the max size are written unchanged, and that
+// truncated lines still trigger rotation.
+func TestOversizeLinePolicy(t *testing.T) {
+	const maxSize = 20
+	prefix := []byte("[P] ")
+	exact := strings.Repeat("e", maxSize-len(prefix)-1) + "\n"
+
+	tests := []struct {
+		name   string
+		policy OversizeLinePolicy
+		line   string
+		err    error
+		want   string
+	}{
+		{"error", OversizeError, strings.Repeat("x", 30) + "\n", ErrLineTooLong, ""},
+		{"error exact", OversizeError, exact, nil, "[P] " + exact},
+		{"truncate", OversizeTruncate, strings.Repeat("x", 30) + "\n", nil, "[P] x…[truncated]\n"},
+		{"truncate exact", OversizeTruncate, exact, nil, "[P] " + exact},
+		{"split", OversizeSplit, strings.Repeat("x", 40) + "\n", nil,
+			"[P] " + strings.Repeat("x", 15) + "\n[P] " + strings.Repeat("x", 15) + "\n[P] " + strings.Repeat("x", 10) + "\n"},
+		{"split exact", OversizeSplit, exact, nil, "[P] " + exact},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "oversize.log")
+			logger, err := New(logPath,
+				WithMaxBytes(maxSize),
+				WithMaxBackups(10),
+				WithPrefix(prefix),
+				WithOversizeLinePolicy(tt.policy),
+			)
+			assert.NoError(t, err)
+
+			_, err = logger.Write([]byte(tt.line))
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, logger.Close())
+
+			files, err := filepath.Glob(logPath + "*")
+			assert.NoError(t, err)
+			sort.Strings(files)
+			var contents []byte
+			for _, f := range files[1:] {
+				data, err := os.ReadFile(f)
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, len(data), maxSize)
+				contents = append(contents, data...)
+			}
+			data, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			contents = append(contents, data...)
+			assert.Equal(t, tt.want, string(contents))
+		})
+	}
+
+	// A truncated line must still rotate a file it no longer fits into
+	logPath := filepath.Join(t.TempDir(), "truncate-rotate.log")
+	logger, err := New(logPath,
+		WithMaxBytes(maxSize),
+		WithMaxBackups(10),
+		WithOversizeLinePolicy(OversizeTruncate),
+	)
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("short\n"))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte(strings.Repeat("x", 30) + "\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Len(t, data, maxSize)
+}
+
+// TestLogRotationOccurs verifies that log rotation occurs when the maximum file size is exceeded.
+func TestLogRotationOccurs(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "rotate.log")
+	prefix := []byte("[ROTATE] ")
+	logger, err := New(logPath,
+		WithMaxBytes(100),
+		WithMaxBackups(5),
+		WithPrefix(prefix),
+	)
+	assert.NoError(t, err)
+
+	// Write enough data to exceed 100 bytes
+	for i := 0; i < 10; i++ {
+		msg := strings.Repeat("x", 15) + "\n"
+		n, err := logger.Write([]byte(msg))
+		assert.NoError(t, err)
+		assert.Equal(t, len(msg), n)
+	}
+
+	err = logger.Sync()
+	assert.NoError(t, err)
+	err = logger.Close()
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(logPath + ".*")
+	if err != nil {
+		t.Fatalf("failed to list rotated files: %v", err)
+	}
+
+	if len(files) == 0 {
+		t.Error("expected rotated log file, found none")
+	}
+}
+
+// TestMaxBackupsIsEnforced ensures that the maximum number of backup files is enforced.
+func TestMaxBackupsIsEnforced(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "maxbackup.log")
+	prefix := []byte("[MAX] ")
+	logger, err := New(logPath,
+		WithMaxBytes(100),
+		WithMaxBackups(3),
+		WithPrefix(prefix),
+	)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		msg := strings.Repeat("y", 80) + "\n"
+		_, err := logger.Write([]byte(msg))
+		assert.NoError(t, err)
+	}
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(files), "expected 3 backups, found %d", len(files))
+}
+
+// TestMaxTotalBytesIsEnforced ensures that the oldest backups are deleted to keep the log file and
+// its backups within the byte budget.
+func TestMaxTotalBytesIsEnforced(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "budget.log")
+	logger, err := New(logPath,
+		WithMaxTotalBytes(300),
+	)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf("%02d%s\n", i, strings.Repeat("z", 97))
+		_, err := logger.Write([]byte(msg))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+	}
+	assert.NoError(t, logger.Close())
+
+	backups, err := logger.backups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 3) {
+		for i, backup := range backups {
+			data, err := os.ReadFile(backup.path)
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(data), fmt.Sprintf("%02d", 7+i)), "unexpected backup %s", backup.path)
+		}
+	}
+}
+
+// TestManualRotate verifies that Rotate flushes pending data into a backup and truncates the log,
+// and that rotating an empty log does not create a backup.
+func TestManualRotate(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "manual.log")
+	logger, err := New(logPath,
+		WithMaxBackups(5),
+		WithFileLocking(),
+	)
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("first\nsecond"))
+	assert.NoError(t, err)
+
+	err = logger.Rotate()
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	if len(files) != 1 {
+		t.Fatalf("expected exactly one rotated file, found %d", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond", string(data))
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Empty(t, contents)
+
+	// Rotating an empty log must not produce another backup
+	err = logger.Rotate()
+	assert.NoError(t, err)
+	files, err = filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	err = logger.Close()
+	assert.NoError(t, err)
+}
+
+// TestTimeBasedRotation verifies that a file last written before the rotation boundary is rotated
+// exactly once, even when several writers share the file.
+func TestTimeBasedRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "interval.log")
+	logger1, err := New(logPath, WithRotationInterval(time.Hour), WithFileLocking())
+	assert.NoError(t, err)
+	logger2, err := New(logPath, WithRotationInterval(time.Hour), WithFileLocking())
+	assert.NoError(t, err)
+
+	_, err = logger1.Write([]byte("old\n"))
+	assert.NoError(t, err)
+
+	// Pretend the file was last written in a previous interval
+	past := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(logPath, past, past)
+	assert.NoError(t, err)
+
+	_, err = logger2.Write([]byte("new2\n"))
+	assert.NoError(t, err)
+	_, err = logger1.Write([]byte("new1\n"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, logger1.Close())
+	assert.NoError(t, logger2.Close())
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	if len(files) != 1 {
+		t.Fatalf("expected exactly one rotated file, found %d", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "old\n", string(data))
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "new2\nnew1\n", string(contents))
+}
+
+// TestReopenOnExternalRotation verifies that a writer reopens the log file after it was renamed
+// from under it and that subsequent lines land in the new file.
+func TestReopenOnExternalRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "external.log")
+	var reopened []string
+	logger, err := New(logPath,
+		WithReopenOnRotate(),
+		WithOnReopen(func(path string) {
+			reopened = append(reopened, path)
+		}),
+	)
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("before\n"))
+	assert.NoError(t, err)
+
+	err = os.Rename(logPath, logPath+".1")
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("after\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+
+	assert.Equal(t, []string{logPath}, reopened)
+
+	data, err := os.ReadFile(logPath + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, "before\n", string(data))
+
+	data, err = os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "after\n", string(data))
+}
+
+// TestBackupOrderingNumeric verifies that backups rotated within the same second are ordered by
+// their numeric index, so the lowest indices are removed first.
+func TestBackupOrderingNumeric(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "numeric.log")
+	timestamp := time.Now().Format(backupTimeFormat)
+	for i := range 12 {
+		path := fmt.Sprintf("%s.%s.%d", logPath, timestamp, i)
+		assert.NoError(t, os.WriteFile(path, []byte("data\n"), 0644))
+	}
+
+	logger, err := New(logPath, WithMaxBackups(5))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.cleanupOldBackups())
+	assert.NoError(t, logger.Close())
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	sort.Strings(files)
+	var want []string
+	for i := 7; i < 12; i++ {
+		want = append(want, fmt.Sprintf("%s.%s.%d", logPath, timestamp, i))
+	}
+	sort.Strings(want)
+	assert.Equal(t, want, files)
+}
+
+// TestConcurrentBackupDeletion verifies that a backup removed by another process during cleanup
+// does not fail the write that triggered the rotation.
+func TestConcurrentBackupDeletion(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "shared.log")
+	var errs []error
+	fsys := &faultFS{}
+	logger, err := New(logPath,
+		WithMaxBytes(20),
+		WithMaxBackups(1),
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		}),
+		withFS(fsys),
+	)
+	assert.NoError(t, err)
+
+	// Simulate another process deleting each backup just before we do
+	fsys.remove = func(name string) error {
+		assert.NoError(t, os.Remove(name))
+		return os.Remove(name)
+	}
+
+	for range 5 {
+		_, err := logger.Write([]byte(strings.Repeat("x", 15) + "\n"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, logger.Close())
+	assert.Empty(t, errs)
+
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+// TestBackupNames verifies that backup names carry milliseconds and the pid, that taken names are
+// skipped instead of overwritten, and that old and new name formats are ordered together.
+func TestBackupNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "names.log")
+	logger, err := New(logPath)
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Rotate())
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		pattern := regexp.MustCompile(`\.\d{8}-\d{6}\.\d{3}\.pid` + strconv.Itoa(os.Getpid()) + `$`)
+		assert.Regexp(t, pattern, files[0])
+	}
+
+	// A concurrently created backup with the same name is never clobbered
+	info, err := logger.file.Stat()
+	assert.NoError(t, err)
+	namePrefix := logPath + ".20240101-120000.000.pid1"
+	assert.NoError(t, os.WriteFile(namePrefix+tmpExt, []byte("taken\n"), 0644))
+	assert.NoError(t, os.WriteFile(namePrefix+".1.gz", []byte("taken\n"), 0644))
+	reserved, basePath, err := createUniqueBackup(osFS{}, indexedName(namePrefix), info)
+	assert.NoError(t, err)
+	reserved.Close()
+	assert.Equal(t, namePrefix+".2", basePath)
+	assert.Equal(t, namePrefix+".2"+tmpExt, reserved.Name())
+	data, err := os.ReadFile(namePrefix + tmpExt)
+	assert.NoError(t, err)
+	assert.Equal(t, "taken\n", string(data))
+	assert.NoError(t, logger.Close())
+
+	// Old and new formats are ordered by time, then index
+	names := []string{
+		logPath + ".20240101-120000.500.pid2.gz",
+		logPath + ".20240101-120000.1",
+		logPath + ".20240101-120000.000.pid1.1",
+		logPath + ".20240101-115959.3.gz",
+		logPath + ".20240101-120000.000.pid1",
+	}
+	parsed := make([]backupFile, 0, len(names))
+	for _, name := range names {
+		backup, ok := parseBackup(logPath, name)
+		assert.True(t, ok, name)
+		assert.Equal(t, 2024, backup.time.Year(), "unparsed timestamp in %s", name)
+		parsed = append(parsed, backup)
+	}
+	sort.Slice(parsed, func(i, j int) bool { return backupLess(parsed[i], parsed[j]) })
+	var order []string
+	for _, backup := range parsed {
+		order = append(order, strings.TrimPrefix(backup.path, logPath+"."))
+	}
+	assert.Equal(t, []string{
+		"20240101-115959.3.gz",
+		"20240101-120000.000.pid1",
+		"20240101-120000.000.pid1.1",
+		"20240101-120000.1",
+		"20240101-120000.500.pid2.gz",
+	}, order)
+}
+
+// TestOnRotate verifies that the rotation hook receives the path of each completed backup,
+// including the compression extension, and that Close waits for in-flight calls.
+func TestOnRotate(t *testing.T) {
+	for name, compression := range map[string]CompressionFormat{"none": CompressionNone, "gzip": CompressionGzip} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "hook.log")
+			var mu sync.Mutex
+			var rotated []string
+			logger, err := New(logPath,
+				WithCompressionFormat(compression),
+				WithOnRotate(func(backupPath string) {
+					// Slow hooks don't block writers, but are waited for by Close
+					time.Sleep(10 * time.Millisecond)
+					_, err := os.Stat(backupPath)
+					assert.NoError(t, err)
+					mu.Lock()
+					defer mu.Unlock()
+					rotated = append(rotated, backupPath)
+				}),
+			)
+			assert.NoError(t, err)
+
+			for range 3 {
+				_, err := logger.Write([]byte("line\n"))
+				assert.NoError(t, err)
+				assert.NoError(t, logger.Rotate())
+			}
+			assert.NoError(t, logger.Close())
+
+			backups, err := OpenBackups(logPath)
+			assert.NoError(t, err)
+			var want []string
+			for _, backup := range backups {
+				want = append(want, backup.Path)
+				assert.True(t, strings.HasSuffix(backup.Path, compression.extension()))
+			}
+			assert.Len(t, want, 3)
+			assert.ElementsMatch(t, want, rotated)
+		})
+	}
+}
+
+// TestOnBackupRemoved verifies that the removal callback is called with the reason of each removal,
+// and that the removal filter can veto removals.
+func TestOnBackupRemoved(t *testing.T) {
+	tests := []struct {
+		name   string
+		option Option
+		reason RemovalReason
+	}{
+		{name: "max backups", option: WithMaxBackups(1), reason: RemovalMaxBackups},
+		{name: "max age", option: WithMaxAge(90 * time.Minute), reason: RemovalMaxAge},
+		{name: "max total bytes", option: WithMaxTotalBytes(25), reason: RemovalMaxTotalBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "removed.log")
+			var backups []string
+			for i := 3; i > 0; i-- {
+				path := logPath + "." + time.Now().Add(-time.Duration(i)*time.Hour).Format(backupTimeFormat)
+				assert.NoError(t, os.WriteFile(path, []byte("0123456789"), 0644))
+				backups = append(backups, path)
+			}
+
+			type removal struct {
+				path   string
+				reason RemovalReason
+			}
+			var removed, vetoed []removal
+			logger, err := New(logPath, tt.option,
+				WithOnBackupRemoved(func(path string, reason RemovalReason) {
+					_, err := os.Stat(path)
+					assert.ErrorIs(t, err, os.ErrNotExist)
+					removed = append(removed, removal{path, reason})
+				}),
+				WithBackupRemovalFilter(func(path string, reason RemovalReason) bool {
+					if path == backups[0] {
+						vetoed = append(vetoed, removal{path, reason})
+						return false
+					}
+					return true
+				}),
+			)
+			assert.NoError(t, err)
+			// The backups exceeding the limits are removed by New
+			assert.NoError(t, logger.Close())
+
+			assert.Equal(t, []removal{{backups[0], tt.reason}}, vetoed)
+			assert.Equal(t, []removal{{backups[1], tt.reason}}, removed)
+			assert.FileExists(t, backups[0])
+			assert.FileExists(t, backups[2])
+		})
+	}
+}
+
+// TestArchiveDir verifies that backups removed by the retention limits are moved into the archive
+// directory, with a suffix if the name is taken, and copied if they can't be renamed.
+func TestArchiveDir(t *testing.T) {
+	for _, crossDevice := range []bool{false, true} {
+		t.Run(fmt.Sprintf("crossDevice=%v", crossDevice), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "archived.log")
+			archiveDir := filepath.Join(tmpDir, "archive")
+
+			fsys := &faultFS{}
+			if crossDevice {
+				fsys.rename = func(oldPath, newPath string) error {
+					if filepath.Dir(newPath) == archiveDir {
+						return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errors.New("invalid cross-device link")}
+					}
+					return os.Rename(oldPath, newPath)
+				}
+			}
+
+			var backups []string
+			for i := 3; i > 0; i-- {
+				path := logPath + "." + time.Now().Add(-time.Duration(i)*time.Hour).Format(backupTimeFormat)
+				assert.NoError(t, os.WriteFile(path, []byte(path), 0600))
+				backups = append(backups, path)
+			}
+
+			// The name of the oldest backup is taken in the archive already
+			taken := filepath.Join(archiveDir, filepath.Base(backups[0]))
+			assert.NoError(t, os.Mkdir(archiveDir, 0755))
+			assert.NoError(t, os.WriteFile(taken, []byte("taken"), 0644))
+
+			// The backups exceeding the limits are archived by New
+			logger, err := New(logPath, WithMaxBackups(1), WithArchiveDir(archiveDir), withFS(fsys))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Close())
+
+			assert.NoFileExists(t, backups[0])
+			assert.NoFileExists(t, backups[1])
+			assert.FileExists(t, backups[2])
+			archived := map[string]string{
+				taken:        "taken",
+				taken + ".1": backups[0],
+				filepath.Join(archiveDir, filepath.Base(backups[1])): backups[1],
+			}
+			for path, want := range archived {
+				data, err := os.ReadFile(path)
+				assert.NoError(t, err)
+				assert.Equal(t, want, string(data))
+			}
+			info, err := os.Stat(taken + ".1")
+			if assert.NoError(t, err) && runtime.GOOS != "windows" {
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			}
+		})
+	}
+}
+
+// TestBackupDir verifies that backups are stored in, listed from and cleaned up in the backup directory,
+// both relative to the log file and on another mount point, if available.
+func TestBackupDir(t *testing.T) {
+	dirs := map[string]func(t *testing.T) (option, abs string){
+		"relative": func(t *testing.T) (string, string) {
+			return "backups", ""
+		},
+	}
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		dirs["tmpfs"] = func(t *testing.T) (string, string) {
+			dir, err := os.MkdirTemp("/dev/shm", "dfwriter")
+			if err != nil {
+				t.Skipf("tmpfs not writable: %v", err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			return filepath.Join(dir, "backups"), filepath.Join(dir, "backups")
+		}
+	}
+
+	for name, dir := range dirs {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "app.log")
+			option, backupDir := dir(t)
+			if backupDir == "" {
+				backupDir = filepath.Join(tmpDir, option)
+			}
+
+			logger, err := New(logPath, WithBackupDir(option), WithMaxBackups(2))
+			assert.NoError(t, err)
+			for i := range 3 {
+				_, err := fmt.Fprintf(logger, "line %d\n", i)
+				assert.NoError(t, err)
+				assert.NoError(t, logger.Rotate())
+			}
+			_, err = fmt.Fprintf(logger, "line 3\n")
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Close())
+
+			// Nothing but the log file is left next to it
+			files, err := filepath.Glob(logPath + ".*")
+			assert.NoError(t, err)
+			assert.Empty(t, files)
+
+			backups, err := logger.ListBackups()
+			assert.NoError(t, err)
+			if assert.Len(t, backups, 2) {
+				for _, backup := range backups {
+					assert.Equal(t, backupDir, filepath.Dir(backup.Path))
+				}
+			}
+
+			reader, err := NewReader(logPath, ReadBackupDir(option))
+			assert.NoError(t, err)
+			defer reader.Close()
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, "line 1\nline 2\nline 3\n", string(data))
+		})
+	}
+}
+
+// TestBackupNameTemplate verifies that backups are named after the template, keeping the log file's
+// extension, and that retention parses the rotation time and index back out of the names.
+func TestBackupNameTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "app.log")
+	expired := filepath.Join(tmpDir, "app-"+time.Now().Add(-48*time.Hour).Format(backupNameTimeFormat)+".0.log")
+	foreign := filepath.Join(tmpDir, "app-notes.log")
+	for _, f := range []string{expired, foreign} {
+		assert.NoError(t, os.WriteFile(f, []byte("data\n"), 0644))
+	}
+
+	logger, err := New(logPath,
+		WithBackupNameTemplate("{name}-{timestamp}.{index}{ext}"),
+		WithCompression(),
+		WithMaxBackups(2),
+		WithMaxAge(24*time.Hour),
+	)
+	assert.NoError(t, err)
+	for i := range 3 {
+		_, err := fmt.Fprintf(logger, "line %d\n", i)
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+	}
+	assert.NoError(t, logger.Close())
+
+	assert.NoFileExists(t, expired)
+	assert.FileExists(t, foreign)
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	name := regexp.MustCompile(`^app-\d{8}-\d{6}\.\d{3}\.\d+\.log\.gz$`)
+	if assert.Len(t, backups, 2) {
+		for i, backup := range backups {
+			assert.Regexp(t, name, filepath.Base(backup.Path))
+			assert.True(t, backup.Compressed)
+			compressed, err := os.ReadFile(backup.Path)
+			assert.NoError(t, err)
+			gr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if assert.NoError(t, err) {
+				data, err := io.ReadAll(gr)
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("line %d\n", i+1), string(data))
+			}
+		}
+	}
+
+	for _, tmpl := range []string{"{name}-{index}{ext}", "{name}-{timestamp}{ext}", "{name}-{time}.{index}", "backups/{timestamp}.{index}"} {
+		_, err := New(filepath.Join(tmpDir, "invalid.log"), WithBackupNameTemplate(tmpl))
+		assert.Error(t, err, tmpl)
+	}
+}
+
+// TestNumericBackups verifies that numeric backups are shifted on each rotation, so .1 always holds
+// the most recent backup, and that backups exceeding the max backups are removed.
+func TestNumericBackups(t *testing.T) {
+	for name, compression := range map[string]CompressionFormat{"none": CompressionNone, "gzip": CompressionGzip} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "numeric.log")
+			logger, err := New(logPath,
+				WithNumericBackups(),
+				WithCompressionFormat(compression),
+				WithMaxBackups(3),
+				WithFileLocking(),
+			)
+			assert.NoError(t, err)
+
+			read := func(path string) string {
+				data, err := os.ReadFile(path)
+				assert.NoError(t, err)
+				if compression == CompressionGzip {
+					gr, err := gzip.NewReader(bytes.NewReader(data))
+					if !assert.NoError(t, err) {
+						return ""
+					}
+					data, err = io.ReadAll(gr)
+					assert.NoError(t, err)
+				}
+				return string(data)
+			}
+
+			for i := range 5 {
+				_, err := fmt.Fprintf(logger, "rotation %d\n", i)
+				assert.NoError(t, err)
+				assert.NoError(t, logger.Rotate())
+
+				// After every rotation, the contents are strictly ordered across the indices
+				for index := 1; index <= min(i+1, 3); index++ {
+					path := fmt.Sprintf("%s.%d%s", logPath, index, compression.extension())
+					assert.Equal(t, fmt.Sprintf("rotation %d\n", i+1-index), read(path), path)
+				}
+			}
+			assert.NoError(t, logger.Close())
+
+			files, err := filepath.Glob(logPath + ".*")
+			assert.NoError(t, err)
+			assert.Len(t, files, 3)
+			backups, err := logger.ListBackups()
+			assert.NoError(t, err)
+			var paths []string
+			for _, backup := range backups {
+				paths = append(paths, filepath.Base(backup.Path))
+			}
+			ext := compression.extension()
+			assert.Equal(t, []string{"numeric.log.3" + ext, "numeric.log.2" + ext, "numeric.log.1" + ext}, paths)
+		})
+	}
+}
+
+// TestRotationAtSizeWithCachedSize verifies that rotation triggers at the max size with the size cached
+// between writes, both without locking and with locking, where other writers grow the file too.
+func TestRotationAtSizeWithCachedSize(t *testing.T) {
+	for _, locking := range []bool{false, true} {
+		t.Run(fmt.Sprintf("locking=%t", locking), func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "cached.log")
+			var options []Option
+			if locking {
+				options = append(options, WithFileLocking())
+			}
+			options = append(options, WithMaxBytes(35))
+
+			// With locking, a second writer grows the file between the writes of the first
+			writers := make([]*DistributedFileWriter, 1)
+			if locking {
+				writers = make([]*DistributedFileWriter, 2)
+			}
+			for i := range writers {
+				logger, err := New(logPath, options...)
+				assert.NoError(t, err)
+				defer logger.Close()
+				writers[i] = logger
+			}
+
+			// Every fourth line triggers a rotation, regardless of the writer writing it
+			for i := range 10 {
+				assert.NoError(t, writers[i%len(writers)].WriteLine([]byte("123456789\n")))
+
+				info, err := os.Stat(logPath)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(10*(i%3+1)), info.Size(), "line %d", i)
+				backups, err := writers[0].ListBackups()
+				assert.NoError(t, err)
+				assert.Len(t, backups, i/3, "line %d", i)
+			}
+		})
+	}
+}
+
+// TestExclusiveOwnership verifies that a writer holding the lock for its lifetime keeps a second writer
+// from starting, also across rotations, until it is closed.
+func TestExclusiveOwnership(t *testing.T) {
+	for _, rename := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rename=%t", rename), func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "owned.log")
+			options := []Option{WithExclusiveOwnership(), WithMaxBytes(20)}
+			if rename {
+				options = append(options, WithRenameRotation())
+			}
+			owner, err := New(logPath, options...)
+			assert.NoError(t, err)
+
+			_, err = New(logPath, WithExclusiveOwnership())
+			assert.ErrorIs(t, err, ErrLocked)
+			var lockErr *LockError
+			if assert.ErrorAs(t, err, &lockErr) {
+				assert.Equal(t, logPath, lockErr.Path)
+			}
+
+			for range 5 {
+				assert.NoError(t, owner.WriteLine([]byte("owned line\n")))
+			}
+			assert.NoError(t, owner.Rotate())
+			assert.Equal(t, int64(5), owner.Stats().Rotations)
+
+			start := time.Now()
+			_, err = New(logPath, WithExclusiveOwnership(), WithLockTimeout(50*time.Millisecond))
+			assert.ErrorIs(t, err, ErrLockTimeout)
+			assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+			assert.NoError(t, owner.Close())
+			next, err := New(logPath, WithExclusiveOwnership())
+			assert.NoError(t, err)
+			assert.NoError(t, next.Close())
+		})
+	}
+}
+
+// TestRenameRotationCompression verifies that rotations renaming the log file don't race with the
+// background compression of earlier backups, which cleans up, records checksums and links the
+// latest backup without holding the writer's lock.
+func TestRenameRotationCompression(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "renamed.log")
+	logger, err := New(logPath,
+		WithRenameRotation(),
+		WithCompression(),
+		WithChecksums(),
+		WithLatestSymlink(""),
+		WithMaxBackups(3),
+		WithMaxBytes(100),
+	)
+	assert.NoError(t, err)
+	for i := range 200 {
+		assert.NoError(t, logger.WriteLine([]byte(fmt.Sprintf("line %04d\n", i))))
+	}
+	assert.NoError(t, logger.Close())
+
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 3) {
+		for _, backup := range backups {
+			assert.True(t, strings.HasSuffix(backup.Path, ".gz"), backup.Path)
+		}
+	}
+	results, err := VerifyBackups(logPath)
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.NoError(t, result.Err, result.Path)
+		assert.Equal(t, result.Expected, result.Actual, result.Path)
+	}
+}
+
+// TestStats verifies that the statistics line up with a known workload including rotations.
+func TestStats(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "stats.log")
+	assert.NoError(t, os.WriteFile(logPath+".20240101-120000", []byte("old\n"), 0644))
+	logger, err := New(logPath, WithMaxBytes(35), WithFileLocking())
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	stats := logger.Stats()
+	assert.Equal(t, Stats{BackupCount: 1, LockWaitTotal: stats.LockWaitTotal}, stats)
+
+	// Every fourth line triggers a rotation
+	before := time.Now()
+	for range 10 {
+		_, err := logger.Write([]byte("123456789\n"))
+		assert.NoError(t, err)
+	}
+
+	stats = logger.Stats()
+	assert.Equal(t, int64(10), stats.CurrentSize)
+	assert.Equal(t, int64(100), stats.BytesWritten)
+	assert.Equal(t, int64(10), stats.LinesWritten)
+	assert.Equal(t, int64(3), stats.Rotations)
+	assert.Equal(t, 4, stats.BackupCount)
+	assert.False(t, stats.LastRotation.Before(before))
+	assert.Positive(t, stats.LockWaitTotal)
+}
+
+// TestListBackups verifies that ListBackups and OpenBackups return compressed and uncompressed backups
+// oldest first, and skip files that aren't finished backups of the log file.
+func TestListBackups(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "list.log")
+	files := map[string]string{
+		logPath + ".20240101-120000.000.pid1.gz":  "gzip",
+		logPath + ".20240101-120000.000.pid1.1":   "second",
+		logPath + ".20240101-110000":              "legacy",
+		logPath + ".20240101-130000.250.pid2.zst": "zstd",
+		// Not backups of the log file
+		logPath + ".pos": "foreign",
+		logPath + ".20240101-140000.000.pid1.tmp":          "in progress",
+		filepath.Join(tmpDir, "other.log.20240101-120000"): "other log",
+	}
+	for path, data := range files {
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	}
+
+	logger, err := New(logPath)
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	want := []BackupInfo{
+		{Path: logPath + ".20240101-110000", Timestamp: time.Date(2024, 1, 1, 11, 0, 0, 0, time.Local), Size: 6},
+		{Path: logPath + ".20240101-120000.000.pid1.gz", Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local), Size: 4, Compressed: true},
+		{Path: logPath + ".20240101-120000.000.pid1.1", Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local), Index: 1, Size: 6},
+		{Path: logPath + ".20240101-130000.250.pid2.zst", Timestamp: time.Date(2024, 1, 1, 13, 0, 0, int(250*time.Millisecond), time.Local), Size: 4, Compressed: true},
+	}
+	assert.Equal(t, want, backups)
+
+	opened, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, backups, opened)
+}
+
+// TestReaderRoundTrip verifies that NewReader returns all lines written across many compressed
+// rotations in the order they were written.
+func TestReaderRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "roundtrip.log")
+	const linesPerWriter = 2500
+
+	var wg sync.WaitGroup
+	for _, prefix := range []string{"a", "b"} {
+		logger, err := New(logPath,
+			WithMaxBytes(1024),
+			WithCompression(),
+			WithFileLocking(),
+			WithPrefix([]byte(prefix+" ")),
+		)
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range linesPerWriter {
+				_, err := fmt.Fprintf(logger, "%d\n", i)
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, logger.Close())
+		}()
+	}
+	wg.Wait()
+
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	assert.Greater(t, len(backups), 10)
+
+	reader, err := NewReader(logPath)
+	assert.NoError(t, err)
+	defer reader.Close()
+	next := map[string]int{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		prefix, number, ok := strings.Cut(scanner.Text(), " ")
+		assert.True(t, ok, "malformed line %q", scanner.Text())
+		assert.Equal(t, strconv.Itoa(next[prefix]), number, "out of order line for %s", prefix)
+		next[prefix]++
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, map[string]int{"a": linesPerWriter, "b": linesPerWriter}, next)
+
+	// Backups rotated before the given time are skipped
+	since := backups[len(backups)-1].Timestamp
+	reader, err = NewReader(logPath, ReadSince(since))
+	assert.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	live, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(data, live))
+	assert.Less(t, bytes.Count(data, []byte("\n")), 2*linesPerWriter)
+}
+
+// TestBinaryRecords verifies that binary records containing newlines, written through every write
+// method, are read back unchanged with ScanRecords across several compressed backups, that no
+// frame is split by a rotation, and that oversized records are rejected.
+func TestBinaryRecords(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "records.log")
+	header := []byte{0xab, '\n'}
+	logger, err := New(logPath,
+		WithBinaryRecords(),
+		WithMaxBytes(256),
+		WithMaxBackups(100),
+		WithCompression(),
+		WithPrefix(header),
+		WithOversizeLinePolicy(OversizeSplit),
+	)
+	assert.NoError(t, err)
+
+	random := rand.New(rand.NewPCG(1, 2))
+	var records [][]byte
+	for i := range 300 {
+		record := make([]byte, random.IntN(80))
+		for j := range record {
+			record[j] = "ab\n\r\x00\xff"[random.IntN(6)]
+		}
+		records = append(records, record)
+
+		switch i % 5 {
+		case 0:
+			n, err := logger.Write(record)
+			assert.NoError(t, err)
+			assert.Equal(t, len(record), n)
+		case 1:
+			assert.NoError(t, logger.WriteLine(record))
+		case 2:
+			_, err := logger.WriteString(string(record))
+			assert.NoError(t, err)
+		case 3:
+			n, err := logger.ReadFrom(iotest.OneByteReader(bytes.NewReader(record)))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(record)), n)
+		case 4:
+			// Batched together with the next record
+			record := bytes.Clone(record)
+			records = append(records, record)
+			assert.NoError(t, logger.WriteLines([][]byte{records[len(records)-2], record}))
+		}
+	}
+
+	n, err := logger.Write(make([]byte, 251))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+	assert.Equal(t, 0, n)
+	var lineErr *LineTooLongError
+	if assert.ErrorAs(t, err, &lineErr) {
+		assert.Equal(t, 257, lineErr.Length)
+	}
+	assert.NoError(t, logger.Close())
+
+	// Every backup consists of whole frames
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	assert.Greater(t, len(backups), 10)
+	for _, backup := range backups {
+		assert.True(t, backup.Compressed)
+		file, err := os.Open(backup.Path)
+		assert.NoError(t, err)
+		gzipReader, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+		scanner := bufio.NewScanner(gzipReader)
+		scanner.Split(ScanRecords)
+		for scanner.Scan() {
+		}
+		assert.NoError(t, scanner.Err(), backup.Path)
+		file.Close()
+	}
+
+	reader, err := NewReader(logPath)
+	assert.NoError(t, err)
+	defer reader.Close()
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(ScanRecords)
+	var read [][]byte
+	for scanner.Scan() {
+		assert.True(t, bytes.HasPrefix(scanner.Bytes(), header))
+		read = append(read, bytes.Clone(scanner.Bytes()[len(header):]))
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, records, read)
+
+	// A frame cut short is reported
+	scanner = bufio.NewScanner(strings.NewReader("\x00\x00\x00\x05abc"))
+	scanner.Split(ScanRecords)
+	assert.False(t, scanner.Scan())
+	assert.ErrorIs(t, scanner.Err(), io.ErrUnexpectedEOF)
+}
+
+// TestCrashSafeRotation verifies that the backup is synced and renamed into place, and the directory
+// synced with WithDirSync, before the log file is truncated.
+func TestCrashSafeRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "test.log")
+
+	var ops []string
+	fsys := &faultFS{
+		sync: func(f fsFile) error {
+			ops = append(ops, "sync "+filepath.Base(f.Name()))
+			return f.Sync()
+		},
+		rename: func(oldPath, newPath string) error {
+			ops = append(ops, "rename "+filepath.Base(oldPath))
+			return os.Rename(oldPath, newPath)
+		},
+		truncate: func(f fsFile, size int64) error {
+			ops = append(ops, "truncate "+filepath.Base(f.Name()))
+			return f.Truncate(size)
+		},
+	}
+	defer func(sync func(string) error) { syncDir = sync }(syncDir)
+	syncDir = func(path string) error {
+		ops = append(ops, "syncdir")
+		return nil
+	}
+
+	logger, err := New(logPath, WithDirSync(), withFS(fsys))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
+
+	backups, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		tmpName := filepath.Base(backups[0]) + ".tmp"
+		// The final sync of the log file is Close's
+		assert.Equal(t, []string{"sync " + tmpName, "rename " + tmpName, "syncdir", "truncate test.log", "sync test.log"}, ops)
+		data, err := os.ReadFile(backups[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "line\n", string(data))
+	}
+}
+
+// TestSyncPolicy verifies that the log file is synced at the cadence of the sync policy.
+func TestSyncPolicy(t *testing.T) {
+	var mu sync.Mutex
+	syncs := 0
+	fsys := &faultFS{sync: func(f fsFile) error {
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+		return f.Sync()
+	}}
+	syncCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return syncs
+	}
+
+	tests := []struct {
+		name   string
+		policy SyncPolicy
+		want   int
+	}{
+		{"never", SyncNever, 0},
+		{"every line", SyncEveryLine, 10},
+		{"every 25 bytes", SyncEveryNBytes(25), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := New(filepath.Join(t.TempDir(), "sync.log"), WithSyncPolicy(tt.policy), WithFullFsync(), withFS(fsys))
+			assert.NoError(t, err)
+			defer logger.Close()
+
+			mu.Lock()
+			syncs = 0
+			mu.Unlock()
+			for range 10 {
+				_, err := logger.Write([]byte("123456789\n"))
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, syncCount())
+		})
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		logger, err := New(filepath.Join(t.TempDir(), "sync.log"), WithSyncPolicy(SyncInterval(10*time.Millisecond)), withFS(fsys))
+		assert.NoError(t, err)
+		defer logger.Close()
+
+		mu.Lock()
+		syncs = 0
+		mu.Unlock()
+		_, err = logger.Write([]byte("123456789\n"))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return syncCount() == 1 }, time.Second, time.Millisecond)
+
+		// Without writes, there is nothing to sync
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 1, syncCount())
+	})
+}
+
+// TestDirSync verifies that the directory is only synced with WithDirSync, after backups are created
+// and after old backups are removed.
+func TestDirSync(t *testing.T) {
+	var synced []string
+	defer func(sync func(string) error) { syncDir = sync }(syncDir)
+	syncDir = func(path string) error {
+		synced = append(synced, path)
+		return nil
+	}
+
+	for _, dirSync := range []bool{false, true} {
+		synced = nil
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "test.log")
+		options := []Option{WithMaxBackups(1)}
+		if dirSync {
+			options = append(options, WithDirSync())
+		}
+		logger, err := New(logPath, options...)
+		assert.NoError(t, err)
+		for range 2 {
+			_, err = logger.Write([]byte("line\n"))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+		}
+		assert.NoError(t, logger.Close())
+
+		if dirSync {
+			// Two rotations and one removal
+			assert.Equal(t, []string{tmpDir, tmpDir, tmpDir}, synced)
+		} else {
+			assert.Empty(t, synced)
+		}
+	}
+}
+
+// TestFailedBackupKeepsLog verifies that the log file is left untouched and no temporary file
+// remains if the backup cannot be completed.
+func TestFailedBackupKeepsLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "test.log")
+
+	fsys := &faultFS{rename: func(oldPath, newPath string) error {
+		return fmt.Errorf("rename failed")
+	}}
+
+	logger, err := New(logPath, withFS(fsys))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("line\n"))
+	assert.NoError(t, err)
+	assert.Error(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "line\n", string(data))
+	backups, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+}
+
+// TestFailedBackupSyncKeepsLog verifies that the log file is not truncated if the backup cannot be
+// persisted, and that the rotated lines remain in the log file.
+func TestFailedBackupSyncKeepsLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "test.log")
+
+	fsys := &faultFS{sync: func(f fsFile) error {
+		if f.Name() != logPath {
+			return fmt.Errorf("sync %s: input/output error", f.Name())
+		}
+		return f.Sync()
+	}}
+
+	logger, err := New(logPath, WithMaxBytes(10), withFS(fsys))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("line 1\n"))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("line 2\n"))
+	assert.ErrorContains(t, err, "input/output error")
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "line 1\n", string(data))
+	backups, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Empty(t, backups)
+
+	// Once the backup can be persisted again, the buffered line is written on Close
+	fsys.sync = nil
+	assert.NoError(t, logger.Close())
+	data, err = os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "line 2\n", string(data))
+}
+
+// TestOrphanedTempFiles verifies that New removes stale temporary backups left behind by a crash,
+// but keeps recent ones that may belong to a rotation in progress.
+func TestOrphanedTempFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "test.log")
+	stale := logPath + ".20240101-000000.000.pid1.tmp"
+	recent := logPath + ".20240101-000000.000.pid2.tmp"
+	assert.NoError(t, os.WriteFile(stale, []byte("partial"), 0644))
+	assert.NoError(t, os.WriteFile(recent, []byte("partial"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(stale, old, old))
+
+	logger, err := New(logPath)
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, recent)
+}
+
+// TestRotationLinesRetained ensures that all log lines are retained across rotated files.
+func TestRotationLinesRetained(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "file.log")
+
+	const lineCount = 50
+	const lineSize = 15
+	const rotationSize = 100
+
+	logger, err := New(logPath,
+		WithMaxBytes(rotationSize),
+		WithMaxBackups(100),
+		WithFileLocking(),
+	)
+	assert.NoError(t, err)
+
+	for i := 0; i < lineCount; i++ {
+		msg := strings.Repeat("y", lineSize) + "\n"
+		_, err := logger.Write([]byte(msg))
+		assert.NoError(t, err)
+	}
+
+	files, err := filepath.Glob(logPath + "*")
+	assert.NoError(t, err)
+
+	nLogFiles := lineCount/(rotationSize/lineSize) + 1
+	assert.Equal(t, nLogFiles, len(files), "expected %d logFiles, found %d", nLogFiles, len(files))
+
+	total := 0
+
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		total += len(bytes.Split(data, []byte("\n"))) - 1
+	}
+
+	assert.Equal(t, lineCount, total, "expected %d lines in all files, got %d", lineCount, total)
+}
+
+// TestCompression verifies that log files are compressed after rotation.
+func TestCompression(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "compress.log")
+	const lineCount = 8
+	const lineSize = 15
+	const rotationSize = 100
+
+	logger, err := New(logPath,
+		WithMaxBytes(rotationSize),
+		WithMaxBackups(100),
+		WithCompression(),
+		WithFileLocking(),
+	)
+	assert.NoError(t, err)
+
+	for i := 0; i < lineCount; i++ {
+		msg := strings.Repeat("y", lineSize) + "\n"
+		_, err := logger.Write([]byte(msg))
+		assert.NoError(t, err)
+	}
+
+	err = logger.Sync()
+	assert.NoError(t, err)
+	err = logger.Close()
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(logPath + ".*")
+	if err != nil {
+		t.Fatalf("failed to list rotated files: %v", err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected exactly one rotated file, found %d", len(files))
+	}
+
+	gzFile, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("failed to list rotated files: %v", err)
+	}
+	defer gzFile.Close()
+
+	// Create a gzip.Reader
+	gr, err := gzip.NewReader(gzFile)
+	if err != nil {
+		t.Fatalf("Failed to create gzip reader: %v", err)
+	}
+	defer gr.Close()
+
+	decompressedData, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("Failed to read decompressed data: %v", err)
+	}
+	assert.Equal(t, (lineSize+1)*(rotationSize/lineSize), len(decompressedData), "expected %d bytes, got %d", lineSize*(rotationSize/lineSize), len(decompressedData))
+	lines := bytes.Split(decompressedData, []byte("\n"))
+	assert.Equal(t, rotationSize/lineSize, len(lines)-1, "expected %d lines, got %d", rotationSize/lineSize, len(lines)-1)
+}
+
+// TestZstdCompression verifies that zstd compressed backups round-trip and that compressing
+// a large file with zstd does not hold the rotation lock noticeably longer than gzip.
+func TestZstdCompression(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "zstd.log")
+	logger, err := New(logPath,
+		WithCompressionFormat(CompressionZstd),
+		WithFileLocking(),
+	)
+	assert.NoError(t, err)
+
+	message := strings.Repeat("z", 100) + "\n"
+	_, err = logger.Write([]byte(message))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
+
+	files, err := filepath.Glob(logPath + ".*.zst")
+	assert.NoError(t, err)
+	if len(files) != 1 {
+		t.Fatalf("expected exactly one rotated file, found %d", len(files))
+	}
+
+	zstFile, err := os.Open(files[0])
+	assert.NoError(t, err)
+	defer zstFile.Close()
+	zr, err := zstd.NewReader(zstFile)
+	assert.NoError(t, err)
+	defer zr.Close()
+	decompressedData, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, message, string(decompressedData))
+
+	if testing.Short() {
+		t.Skip("skipping rotation timing comparison in short mode")
+	}
+
+	rotateDuration := func(format CompressionFormat) time.Duration {
+		logPath := filepath.Join(tmpDir, string(format)+"-large.log")
+		logger, err := New(logPath, WithCompressionFormat(format), WithFileLocking())
+		assert.NoError(t, err)
+		defer logger.Close()
+
+		line := []byte(strings.Repeat("lorem ipsum dolor sit amet ", 39) + "\n")
+		for range (10 * 1024 * 1024) / len(line) {
+			_, err := logger.Write(line)
+			assert.NoError(t, err)
+		}
+
+		start := time.Now()
+		assert.NoError(t, logger.Rotate())
+		return time.Since(start)
+	}
+
+	gzipDuration := rotateDuration(CompressionGzip)
+	zstdDuration := rotateDuration(CompressionZstd)
+	assert.LessOrEqual(t, zstdDuration, 2*gzipDuration+100*time.Millisecond,
+		"zstd rotation took %v, gzip rotation took %v", zstdDuration, gzipDuration)
+}
+
+// TestAsyncCompression verifies that backups are compressed in the background, that Close waits
+// for outstanding compressions and that compression errors are reported to the error handler.
+func TestAsyncCompression(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "async.log")
+
+	var errs []error
+	var errsMu sync.Mutex
+	logger, err := New(logPath,
+		WithCompression(),
+		WithFileLocking(),
+		WithErrorHandler(func(err error) {
+			errsMu.Lock()
+			defer errsMu.Unlock()
+			errs = append(errs, err)
+		}),
+	)
+	assert.NoError(t, err)
+
+	for range 3 {
+		_, err = logger.Write([]byte("line\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+	}
+
+	// Compressing a missing backup must be reported instead of dropped
+	logger.compressions.Add(1)
+	logger.compressBackup(CompressionGzip, filepath.Join(tmpDir, "missing"), filepath.Join(tmpDir, "missing.gz"))
+
+	assert.NoError(t, logger.Close())
+
+	errsMu.Lock()
+	assert.Len(t, errs, 1)
+	errsMu.Unlock()
+
+	tmpFiles, err := filepath.Glob(logPath + ".*.tmp")
+	assert.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+
+	files, err := filepath.Glob(logPath + ".*.gz")
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+	for _, f := range files {
+		gzFile, err := os.Open(f)
+		assert.NoError(t, err)
+		gr, err := gzip.NewReader(gzFile)
+		assert.NoError(t, err)
+		data, err := io.ReadAll(gr)
+		assert.NoError(t, err)
+		assert.Equal(t, "line\n", string(data))
+		gzFile.Close()
+	}
+}
+
+func TestConcurrentWritesAndRotation(t *testing.T) {
+	// Parent mode: spawn N child processes
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+
+	const (
+		writers        = 5
+		linesPerWriter = 20
+		lineSize       = 10
+		rotationSize   = 100
+	)
+
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			prefix := strconv.Itoa(id)
+			logger, err := New(
+				logPath,
+				WithMaxBytes(rotationSize),
+				WithMaxBackups(10000),
+				WithPrefix([]byte(prefix)),
+				WithFileLocking(),
+			)
+			assert.NoError(t, err)
+			defer logger.Close()
+
+			msg := []byte(strings.Repeat("x", lineSize-len(prefix)-1) + "\n")
+			for range linesPerWriter {
+				_, err := logger.Write(msg)
+				assert.NoError(t, err)
+			}
+			err = logger.Sync()
+			assert.NoError(t, err)
+		}(i)
+	}
+
+	wg.Wait()
+
+	// now validate total lines
+	files, _ := filepath.Glob(logPath + "*")
+	assert.GreaterOrEqual(t, len(files), (writers*linesPerWriter*lineSize)/rotationSize)
+	total := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		total += len(bytes.Split(data, []byte("\n"))) - 1
+
+	}
+	want := writers * linesPerWriter
+	assert.Equal(t, want, total, "expected %d lines in all files, got %d", want, total)
+}
+
+// TestConcurrentWritesSingleInstance hammers a single writer from many goroutines and verifies
+// that no lines are lost or interleaved. Run with -race to detect unsynchronized access.
+func TestConcurrentWritesSingleInstance(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+
+	const (
+		writers        = 50
+		linesPerWriter = 20
+		lineSize       = 10
+		rotationSize   = 100
+	)
+
+	logger, err := New(
+		logPath,
+		WithMaxBytes(rotationSize),
+		WithMaxBackups(10000),
+		WithFileLocking(),
+	)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			msg := []byte(fmt.Sprintf("%02d%s\n", id, strings.Repeat("x", lineSize-3)))
+			for range linesPerWriter {
+				_, err := logger.Write(msg)
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	err = logger.Close()
+	assert.NoError(t, err)
+
+	files, _ := filepath.Glob(logPath + "*")
+	total := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		assert.LessOrEqual(t, len(data), rotationSize, "file %s exceeds rotation size", f)
+		lines := bytes.Split(data, []byte("\n"))
+		for _, line := range lines[:len(lines)-1] {
+			assert.Len(t, line, lineSize-1, "interleaved line %q in %s", line, f)
+		}
+		total += len(lines) - 1
+	}
+	want := writers * linesPerWriter
+	assert.Equal(t, want, total, "expected %d lines in all files, got %d", want, total)
+}
 
 // TestConcurrentWritesAndRotation ensures that concurrent writes and log rotation work correctly.
 // It spawns multiple processes, each writing to the same log file.
 // The test checks that the total number of lines written across all files matches the expected count (no interleaving).
 // It also verifies that the log files are correctly rotated based on the specified rotation size.
 
-// The test uses a helper binary to perform the actual writing, which is built from a separate Go source file.
-// This is to simulate processes on different machines writing to the same log file using fcntl locking.
+// The test uses a helper binary to perform the actual writing, which is built from a separate Go source file.
+// This is to simulate processes on different machines writing to the same log file using fcntl locking.
+
+func TestConcurrentWritesAndRotationMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock")
+}
+
+// TestRenameRotationMultiProc ensures that no lines are lost when several processes share a log file
+// that is rotated by renaming it, forcing the other processes to detect the rename and reopen.
+func TestRenameRotationMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-rename")
+}
+
+// TestNumericBackupsMultiProc ensures that no backup content is lost when several processes shift
+// numeric backups.
+func TestNumericBackupsMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-numeric")
+}
+
+// TestSimultaneousRotationMultiProc ensures that no backup content is lost when several processes
+// force rotations at the same time and their backup names would collide at second resolution.
+func TestSimultaneousRotationMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-rotateEvery=1")
+}
+
+// TestLockFileMultiProc ensures that no lines are lost when several processes lock a lock file
+// instead of the log file.
+func TestLockFileMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-lockFile")
+}
+
+// TestLockFileRenameMultiProc is TestLockFileMultiProc with rotation by renaming.
+func TestLockFileRenameMultiProc(t *testing.T) {
+	runMultiProcWriters(t, "-lock", "-lockFile", "-rename")
+}
+
+// runMultiProcWriters spawns several helper processes writing to the same log file with the given
+// extra flags and verifies that all lines are retained across the log file and its backups.
+func runMultiProcWriters(t *testing.T, flags ...string) {
+	out := buildHelper(t)
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	if f, err := os.Create(logPath); err != nil {
+		t.Fatalf("create log: %v", err)
+	} else {
+		f.Close()
+	}
+
+	const (
+		writers        = 5
+		linesPerWriter = 20
+		lineSize       = 10
+		rotationSize   = 100
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		args := append([]string{
+			"-log=" + logPath,
+			"-prefix=" + strconv.Itoa(i),
+			"-lines=" + strconv.Itoa(linesPerWriter),
+			"-lineSize=" + strconv.Itoa(lineSize),
+			"-rotationSize=" + strconv.Itoa(rotationSize),
+		}, flags...)
+		cmd := exec.Command(out, args...)
+		// inherit environment
+		cmd.Env = os.Environ()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cmd.Start(); err != nil {
+				fmt.Printf("failed to start child %d: %v\n", i, err)
+			}
+			if err := cmd.Wait(); err != nil {
+				fmt.Printf("child %d failed: %v\n", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// now validate total lines
+	files, _ := filepath.Glob(logPath + "*")
+	assert.GreaterOrEqual(t, len(files), (writers*linesPerWriter*lineSize)/rotationSize)
+	total := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		total += len(bytes.Split(data, []byte("\n"))) - 1
+
+	}
+	want := writers * linesPerWriter
+	assert.Equal(t, want, total, "expected %d lines in all files, got %d", want, total)
+}
+
+// buildHelper builds the helper binary in cmd/test into a temporary directory and returns its path.
+// TestLockTimeout verifies that writes give up with ErrLockTimeout while a helper process holds the
+// lock, that the time spent waiting is recorded, and that writing resumes once the lock is released.
+func TestLockTimeout(t *testing.T) {
+	if !lockingSupported {
+		t.Skip("file locking not supported")
+	}
+	logPath := filepath.Join(t.TempDir(), "locked.log")
+	helper := exec.Command(buildHelper(t), "-log="+logPath, "-holdLock=1m")
+	stdout, err := helper.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, helper.Start())
+	defer helper.Process.Kill()
+	locked, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "locked\n", locked)
+
+	logger, err := New(logPath, WithFileLocking(), WithLockTimeout(200*time.Millisecond))
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	start := time.Now()
+	_, err = logger.Write([]byte("blocked\n"))
+	elapsed := time.Since(start)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	var lockErr *LockError
+	if assert.ErrorAs(t, err, &lockErr) {
+		assert.Equal(t, logPath, lockErr.Path)
+	}
+	assert.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+	assert.Less(t, elapsed, 2*time.Second)
+	assert.GreaterOrEqual(t, logger.Stats().LockWaitTotal, 200*time.Millisecond)
+
+	// The line stays buffered and is written once the helper releases the lock
+	assert.NoError(t, helper.Process.Kill())
+	helper.Wait()
+	assert.NoError(t, logger.Sync())
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "blocked\n", string(contents))
+}
+
+// TestWriteContextCancel verifies that cancelling the context stops waiting for a lock held by a helper
+// process promptly, for both WriteContext and WriteLineContext, while plain writes keep waiting.
+func TestWriteContextCancel(t *testing.T) {
+	if !lockingSupported {
+		t.Skip("file locking not supported")
+	}
+	logPath := filepath.Join(t.TempDir(), "locked.log")
+	helper := exec.Command(buildHelper(t), "-log="+logPath, "-holdLock=1m")
+	stdout, err := helper.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, helper.Start())
+	defer helper.Process.Kill()
+	locked, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "locked\n", locked)
+
+	logger, err := New(logPath, WithFileLocking())
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = logger.WriteContext(ctx, []byte("cancelled\n"))
+	assert.ErrorIs(t, err, context.Canceled)
+	var lockErr *LockError
+	assert.ErrorAs(t, err, &lockErr)
+	assert.Less(t, time.Since(start), time.Second)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	assert.ErrorIs(t, logger.WriteLineContext(ctx, []byte("deadline\n")), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// A plain write blocks until the helper releases the lock, then writes the line buffered by WriteContext
+	done := make(chan error)
+	go func() {
+		_, err := logger.Write([]byte("plain\n"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Write to block, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.NoError(t, helper.Process.Kill())
+	helper.Wait()
+	assert.NoError(t, <-done)
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "cancelled\nplain\n", string(contents))
+}
+
+// TestLockHeldByHelper verifies that a lock held by a helper process makes New fail with ErrLocked under
+// exclusive ownership and blocks writes needing the exclusive lock until the lock timeout, while a shared
+// lock still admits atomic writes, and that everything succeeds once the helper is gone.
+func TestLockHeldByHelper(t *testing.T) {
+	if !lockingSupported {
+		t.Skip("file locking not supported")
+	}
+	out := buildHelper(t)
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared=%t", shared), func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "locked.log")
+			helper := exec.Command(out, "-log="+logPath, "-holdLock=1m", fmt.Sprintf("-shared=%t", shared))
+			stdout, err := helper.StdoutPipe()
+			assert.NoError(t, err)
+			assert.NoError(t, helper.Start())
+			defer helper.Process.Kill()
+			locked, err := bufio.NewReader(stdout).ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "locked\n", locked)
+
+			_, err = New(logPath, WithExclusiveOwnership())
+			assert.ErrorIs(t, err, ErrLocked)
+
+			logger, err := New(logPath, WithFileLocking(), WithAtomicLineSize(8), WithLockTimeout(100*time.Millisecond))
+			assert.NoError(t, err)
+			defer logger.Close()
+			_, err = logger.Write([]byte("short\n"))
+			if shared {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrLockTimeout)
+			}
+			_, err = logger.Write([]byte("exceeding\n"))
+			assert.ErrorIs(t, err, ErrLockTimeout)
+
+			assert.NoError(t, helper.Process.Kill())
+			helper.Wait()
+			assert.NoError(t, logger.Sync())
+			owner, err := New(logPath, WithExclusiveOwnership())
+			if assert.NoError(t, err) {
+				owner.Close()
+			}
+			contents, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			assert.Equal(t, "short\nexceeding\n", string(contents))
+		})
+	}
+}
+
+func buildHelper(t *testing.T) string {
+	out := filepath.Join(t.TempDir(), "logwriter")
+	cmd := exec.Command("go", "build", "-o", out, "./cmd/test")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build helper: %v\n", err)
+		os.Exit(1)
+	}
+	return out
+}
+
+func BenchmarkLoggerWrite(b *testing.B) {
+	tmpDir := b.TempDir()
+	logPath := filepath.Join(tmpDir, "benchmark.log")
+	logger, err := New(logPath,
+		WithFileLocking(),
+		WithMaxBytes(100*1024*1024), // 100MB
+	)
+	if err != nil {
+		b.Fatalf("failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	message := []byte("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores et ea rebum. Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet. Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores et ea rebum. Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet.\n")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := logger.Write(message)
+		if err != nil {
+			b.Fatalf("failed to write log: %v", err)
+		}
+	}
+}
+
+func BenchmarkLoggerWriteMultiLine(b *testing.B) {
+	tmpDir := b.TempDir()
+	logPath := filepath.Join(tmpDir, "benchmark.log")
+	logger, err := New(logPath,
+		WithMaxBytes(100*1024*1024), // 100MB
+	)
+	if err != nil {
+		b.Fatalf("failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	// Ten JSON lines of about 8KB each, the last one split across writes
+	line := `{"level":"info","msg":"` + strings.Repeat("x", 8*1024) + `"}` + "\n"
+	payload := []byte(strings.Repeat(line, 10))
+	split := len(payload) - len(line)/2
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := logger.Write(payload[:split]); err != nil {
+			b.Fatalf("failed to write log: %v", err)
+		}
+		if _, err := logger.Write(payload[split:]); err != nil {
+			b.Fatalf("failed to write log: %v", err)
+		}
+	}
+}
+
+func BenchmarkLoggerWriteExclusiveOwnership(b *testing.B) {
+	tmpDir := b.TempDir()
+	logPath := filepath.Join(tmpDir, "benchmark.log")
+	logger, err := New(logPath,
+		WithExclusiveOwnership(),
+		WithMaxBytes(100*1024*1024), // 100MB
+	)
+	if err != nil {
+		b.Fatalf("failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	message := []byte("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat.\n")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := logger.Write(message)
+		if err != nil {
+			b.Fatalf("failed to write log: %v", err)
+		}
+	}
+}
+
+func BenchmarkLoggerWriteBatch(b *testing.B) {
+	tmpDir := b.TempDir()
+	logPath := filepath.Join(tmpDir, "benchmark.log")
+	logger, err := New(logPath,
+		WithFileLocking(),
+		WithMaxBytes(100*1024*1024), // 100MB
+	)
+	if err != nil {
+		b.Fatalf("failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	// 100 lines per write
+	payload := []byte(strings.Repeat("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor.\n", 100))
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := logger.Write(payload); err != nil {
+			b.Fatalf("failed to write log: %v", err)
+		}
+	}
+}
+
+// BenchmarkLoggerWriteString compares writing string lines with WriteString to converting them
+// for Write.
+func BenchmarkLoggerWriteString(b *testing.B) {
+	message := "Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat.\n"
+	writers := []struct {
+		name  string
+		write func(w *DistributedFileWriter, s string) (int, error)
+	}{
+		{"Write", func(w *DistributedFileWriter, s string) (int, error) { return w.Write([]byte(s)) }},
+		{"WriteString", (*DistributedFileWriter).WriteString},
+	}
+	for _, writer := range writers {
+		b.Run(writer.name, func(b *testing.B) {
+			logPath := filepath.Join(b.TempDir(), "benchmark.log")
+			logger, err := New(logPath,
+				WithMaxBytes(100*1024*1024), // 100MB
+			)
+			if err != nil {
+				b.Fatalf("failed to create logger: %v", err)
+			}
+			defer logger.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := writer.write(logger, message); err != nil {
+					b.Fatalf("failed to write log: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoggerWriteTimestamps compares writing lines without timestamps, with millisecond
+// timestamps from WithTimestamps and with timestamps formatted for every line by TimestampPrefix.
+func BenchmarkLoggerWriteTimestamps(b *testing.B) {
+	const layout = "2006-01-02T15:04:05.000Z07:00"
+	options := []struct {
+		name   string
+		option Option
+	}{
+		{"none", WithPrefix(nil)},
+		{"WithTimestamps", WithTimestamps(layout, true)},
+		{"TimestampPrefix", WithPrefixFunc(TimestampPrefix(layout))},
+	}
+	message := []byte("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat.\n")
+	for _, option := range options {
+		b.Run(option.name, func(b *testing.B) {
+			logPath := filepath.Join(b.TempDir(), "benchmark.log")
+			logger, err := New(logPath,
+				WithMaxBytes(100*1024*1024), // 100MB
+				option.option,
+			)
+			if err != nil {
+				b.Fatalf("failed to create logger: %v", err)
+			}
+			defer logger.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := logger.Write(message); err != nil {
+					b.Fatalf("failed to write log: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoggerWriteRecentBuffer compares writing lines without and with a recent buffer, which
+// should not allocate once its slots are filled.
+func BenchmarkLoggerWriteRecentBuffer(b *testing.B) {
+	message := []byte("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat.\n")
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("lines=%d", size), func(b *testing.B) {
+			logPath := filepath.Join(b.TempDir(), "benchmark.log")
+			logger, err := New(logPath,
+				WithMaxBytes(100*1024*1024), // 100MB
+				WithRecentBuffer(size),
+			)
+			if err != nil {
+				b.Fatalf("failed to create logger: %v", err)
+			}
+			defer logger.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := logger.Write(message); err != nil {
+					b.Fatalf("failed to write log: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLoggerWriteWithoutLocking(b *testing.B) {
+	tmpDir := b.TempDir()
+	logPath := filepath.Join(tmpDir, "benchmark.log")
+	logger, err := New(logPath,
+		WithMaxBytes(100*1024*1024), // 100MB
+	)
+	if err != nil {
+		b.Fatalf("failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	message := []byte("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat.\n")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := logger.Write(message)
+		if err != nil {
+			b.Fatalf("failed to write log: %v", err)
+		}
+	}
+}
+
+// TestFollow verifies that a Follower attached while the log file is rotated several times reads
+// every line exactly once and in order.
+func TestFollow(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "copy"},
+		{name: "rename", options: []Option{WithRenameRotation()}},
+		{name: "compressed", options: []Option{WithCompression()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "follow.log")
+			const lines = 1000
+
+			logger, err := New(logPath, append([]Option{WithMaxBytes(512), WithFileLocking()}, tt.options...)...)
+			assert.NoError(t, err)
+			follower, err := Follow(logPath, FollowPollInterval(time.Millisecond))
+			assert.NoError(t, err)
+			defer follower.Close()
+			// Unblock the reads if lines are missing
+			defer time.AfterFunc(10*time.Second, func() { follower.Close() }).Stop()
+
+			written := make(chan struct{})
+			go func() {
+				defer close(written)
+				for i := range lines {
+					assert.NoError(t, logger.WriteLine([]byte(fmt.Sprintf("%d\n", i))))
+				}
+				assert.NoError(t, logger.Close())
+			}()
+
+			scanner := bufio.NewScanner(follower)
+			for i := range lines {
+				if !assert.True(t, scanner.Scan(), "missing line %d", i) {
+					break
+				}
+				assert.Equal(t, strconv.Itoa(i), scanner.Text())
+			}
+			<-written
+
+			backups, err := OpenBackups(logPath)
+			assert.NoError(t, err)
+			assert.Greater(t, len(backups), 5)
+		})
+	}
+}
+
+// TestFollowOffsetFile verifies that a Follower resumes from the position persisted in its offset
+// file, including lines rotated into backups while it wasn't running.
+func TestFollowOffsetFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "resume.log")
+	offsetPath := filepath.Join(tmpDir, "resume.offset")
+	logger, err := New(logPath, WithMaxBytes(40), WithFileLocking())
+	assert.NoError(t, err)
+	defer logger.Close()
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			assert.NoError(t, logger.WriteLine([]byte(fmt.Sprintf("%02d\n", i))))
+		}
+	}
+	read := func(n int) string {
+		follower, err := Follow(logPath, FollowOffsetFile(offsetPath), FollowPollInterval(time.Millisecond))
+		assert.NoError(t, err)
+		defer follower.Close()
+		defer time.AfterFunc(10*time.Second, func() { follower.Close() }).Stop()
+		data := make([]byte, 3*n)
+		_, err = io.ReadFull(follower, data)
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	write(0, 5)
+	assert.Equal(t, "00\n01\n02\n", read(3))
+
+	// Several rotations happen while no Follower is running
+	write(5, 40)
+	var want strings.Builder
+	for i := 3; i < 40; i++ {
+		fmt.Fprintf(&want, "%02d\n", i)
+	}
+	assert.Equal(t, want.String(), read(37))
+}
+
+// TestMultiWriter verifies that lines with interleaved keys are routed to the file of their key,
+// that every file rotates independently, and that writers are closed by the LRU cap and the idle
+// timeout and reopened on demand.
+func TestMultiWriter(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyFn := func(line []byte) string {
+		key, _, _ := bytes.Cut(line, []byte(":"))
+		return string(key)
+	}
+	multi, err := NewMulti(filepath.Join(tmpDir, "{key}.log"), keyFn,
+		WithMaxBytes(16),
+		WithMaxBackups(10),
+		WithMaxOpenFiles(2),
+	)
+	assert.NoError(t, err)
+
+	for _, payload := range []string{"a: 1\nb: 1\na: 2\na", ": 3\n", "b: 2\nc: 1\n", "a: 4\na: 5\na: 6\n", "b: 3"} {
+		n, err := multi.Write([]byte(payload))
+		assert.NoError(t, err)
+		assert.Equal(t, len(payload), n)
+	}
+	// Writing c closed a, writing a again closed b
+	assert.Equal(t, 2, multi.Open())
+	assert.NoError(t, multi.Sync())
+	assert.Equal(t, 2, multi.Open())
+
+	_, err = multi.Write([]byte("../escape: 1\n"))
+	assert.ErrorContains(t, err, "invalid key")
+	assert.NoError(t, multi.Close())
+	assert.NoError(t, multi.Close())
+	_, err = multi.Write([]byte("a: 7\n"))
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// Only a exceeded the max size
+	for key, want := range map[string][]string{
+		"a": {"a: 1\na: 2\na: 3\n", "a: 4\na: 5\na: 6\n"},
+		"b": {"b: 1\nb: 2\nb: 3"},
+		"c": {"c: 1\n"},
+	} {
+		logPath := filepath.Join(tmpDir, key+".log")
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		var contents []string
+		for _, backup := range backups {
+			data, err := os.ReadFile(backup.Path)
+			assert.NoError(t, err)
+			contents = append(contents, string(data))
+		}
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		contents = append(contents, string(data))
+		assert.Equal(t, want, contents, key)
+	}
+
+	multi, err = NewMulti(filepath.Join(tmpDir, "{key}.log"), keyFn, WithIdleTimeout(20*time.Millisecond))
+	assert.NoError(t, err)
+	_, err = multi.Write([]byte("d: 1\ne: 1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, multi.Open())
+	assert.Eventually(t, func() bool { return multi.Open() == 0 }, time.Second, time.Millisecond)
+	_, err = multi.Write([]byte("d: 2\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, multi.Open())
+	assert.NoError(t, multi.Close())
+	data, err := os.ReadFile(filepath.Join(tmpDir, "d.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "d: 1\nd: 2\n", string(data))
+
+	_, err = NewMulti(filepath.Join(tmpDir, "static.log"), keyFn)
+	assert.Error(t, err)
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("tee failed")
+}
+
+func TestTee(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "tee.log")
+	var tee bytes.Buffer
+	var errs []error
+	logger, err := New(logPath,
+		WithPrefix([]byte("[T] ")),
+		WithTee(&tee),
+		WithTee(failingWriter{}),
+		WithErrorHandler(func(err error) {
+			errs = append(errs, err)
+		}),
+	)
+	assert.NoError(t, err)
+
+	// The failing tee doesn't fail the write
+	for _, payload := range []string{"line 1\nline", " 2\n", "line 3\nline 4\n"} {
+		n, err := logger.Write([]byte(payload))
+		assert.NoError(t, err)
+		assert.Equal(t, len(payload), n)
+	}
+	assert.NoError(t, logger.WriteLine([]byte("line 5")))
+	assert.NoError(t, logger.Close())
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "[T] line 1\n[T] line 2\n[T] line 3\n[T] line 4\n[T] line 5", string(data))
+	assert.Equal(t, string(data), tee.String())
+	// One error per write of the file
+	assert.Len(t, errs, 4)
+	for _, err := range errs {
+		assert.ErrorContains(t, err, "failed to write to tee: tee failed")
+	}
+}
+
+// TestErrorHandler verifies that background errors are delivered to the error handler without
+// blocking writes, that errors exceeding the queue are counted and that errors are written to
+// stderr by default.
+func TestErrorHandler(t *testing.T) {
+	t.Run("capture", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "handler.log")
+		called := make(chan struct{}, 1)
+		release := make(chan struct{})
+		var errs []error
+		logger, err := New(logPath,
+			WithTee(failingWriter{}),
+			WithErrorHandler(func(err error) {
+				select {
+				case called <- struct{}{}:
+				default:
+				}
+				<-release
+				errs = append(errs, err)
+			}),
+		)
+		assert.NoError(t, err)
+
+		// The blocked handler doesn't block writes
+		assert.NoError(t, logger.WriteLine([]byte("line")))
+		<-called
+		for range errorQueueSize + 10 {
+			assert.NoError(t, logger.WriteLine([]byte("line")))
+		}
+		close(release)
+		assert.NoError(t, logger.Close())
+
+		// The errors exceeding the queue are counted and reported after the queued ones
+		if assert.Len(t, errs, errorQueueSize+2) {
+			for _, err := range errs[:errorQueueSize+1] {
+				assert.ErrorContains(t, err, "failed to write to tee")
+			}
+			assert.EqualError(t, errs[errorQueueSize+1], "dropped 10 errors exceeding the error queue")
+		}
+
+		// Errors reported after Close are delivered directly
+		logger.handleError(errors.New("late"))
+		assert.EqualError(t, errs[len(errs)-1], "late")
+	})
+
+	t.Run("stderr", func(t *testing.T) {
+		r, pw, err := os.Pipe()
+		assert.NoError(t, err)
+		defer func(stderr *os.File) { os.Stderr = stderr }(os.Stderr)
+		os.Stderr = pw
+
+		logger, err := New(filepath.Join(t.TempDir(), "stderr.log"), WithTee(failingWriter{}))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.WriteLine([]byte("line")))
+		assert.NoError(t, logger.Close())
+		pw.Close()
+
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "dfwriter: failed to write to tee: tee failed\n", string(data))
+	})
+}
+
+// TestRotateOnOpen verifies that New rotates an existing log file exceeding the limits of the
+// rotate on open policy, but never an empty one.
+func TestRotateOnOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		age     time.Duration
+		policy  RotateOnOpenPolicy
+		rotated bool
+	}{
+		{name: "oversized", content: "0123456789\n", policy: RotateOnOpenLimits, rotated: true},
+		{name: "oversized never", content: "0123456789\n", policy: RotateOnOpenNever},
+		{name: "small", content: "012\n", age: 2 * time.Hour, policy: RotateOnOpenLimits},
+		{name: "stale", content: "012\n", age: 2 * time.Hour, policy: RotateOnOpenOlderThan(time.Hour), rotated: true},
+		{name: "recent", content: "012\n", age: time.Minute, policy: RotateOnOpenOlderThan(time.Hour)},
+		{name: "empty", age: 2 * time.Hour, policy: RotateOnOpenOlderThan(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "open.log")
+			assert.NoError(t, os.WriteFile(logPath, []byte(tt.content), 0644))
+			modTime := time.Now().Add(-tt.age)
+			assert.NoError(t, os.Chtimes(logPath, modTime, modTime))
+
+			logger, err := New(logPath, WithMaxBytes(10), WithFileLocking(), WithRotateOnOpen(tt.policy))
+			assert.NoError(t, err)
+
+			backups, err := OpenBackups(logPath)
+			assert.NoError(t, err)
+			data, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			if tt.rotated {
+				if assert.Len(t, backups, 1) {
+					backup, err := os.ReadFile(backups[0].Path)
+					assert.NoError(t, err)
+					assert.Equal(t, tt.content, string(backup))
+				}
+				assert.Empty(t, data)
+				assert.Equal(t, int64(1), logger.Stats().Rotations)
+			} else {
+				assert.Empty(t, backups)
+				assert.Equal(t, tt.content, string(data))
+			}
+			assert.NoError(t, logger.Close())
+		})
+	}
+}
+
+// TestNoEmptyBackups verifies that a line filling an empty log file doesn't rotate it, and that
+// empty backups don't count towards the max backups.
+func TestNoEmptyBackups(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "empty.log")
+	var empty []string
+	for i := 3; i > 1; i-- {
+		path := logPath + "." + time.Now().Add(-time.Duration(i)*time.Hour).Format(backupTimeFormat)
+		assert.NoError(t, os.WriteFile(path, nil, 0644))
+		empty = append(empty, path)
+	}
+	nonEmpty := logPath + "." + time.Now().Add(-time.Hour).Format(backupTimeFormat)
+	assert.NoError(t, os.WriteFile(nonEmpty, []byte("backup\n"), 0644))
+
+	logger, err := New(logPath, WithMaxBytes(100), WithMaxBackups(1))
+	assert.NoError(t, err)
+	for _, path := range append(empty, nonEmpty) {
+		assert.FileExists(t, path)
+	}
+
+	first := strings.Repeat("x", 94) + "\n"
+	_, err = logger.Write([]byte(first))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), logger.Stats().Rotations)
+
+	// The next line rotates the full file, removing the older non-empty backup only
+	_, err = logger.Write([]byte("second\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+	assert.NoFileExists(t, nonEmpty)
+	for _, path := range empty {
+		assert.FileExists(t, path)
+	}
+
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 3) {
+		data, err := os.ReadFile(backups[2].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, first, string(data))
+	}
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "second\n", string(data))
+}
+
+// TestMaxBackupsSemantics verifies that UnlimitedBackups keeps all backups, that NoBackups truncates
+// the log file on rotation without creating, renaming or naming any backup, and that other negative
+// max backups are rejected.
+func TestMaxBackupsSemantics(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "unlimited.log")
+		logger, err := New(logPath, WithMaxBytes(10), WithMaxBackups(UnlimitedBackups))
+		assert.NoError(t, err)
+		for range 5 {
+			_, err := logger.Write([]byte("012345678\n"))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, logger.Close())
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		assert.Len(t, backups, 4)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "none.log")
+		fsys := &faultFS{rename: func(oldPath, newPath string) error {
+			t.Errorf("unexpected rename of %s to %s", oldPath, newPath)
+			return os.Rename(oldPath, newPath)
+		}}
+		logger, err := New(logPath,
+			withFS(fsys),
+			WithMaxBytes(10),
+			WithMaxBackups(NoBackups),
+			WithBackupNameTemplate("{name}.{timestamp}.{index}"),
+			WithOnRotate(func(backupPath string) {
+				t.Errorf("unexpected backup %s", backupPath)
+			}),
+		)
+		assert.NoError(t, err)
+		for i := range 5 {
+			_, err := fmt.Fprintf(logger, "line %04d\n", i)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, logger.Rotate())
+		_, err = logger.Write([]byte("last\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), logger.Stats().Rotations)
+		assert.NoError(t, logger.Close())
+
+		entries, err := os.ReadDir(tmpDir)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, "none.log", entries[0].Name())
+		}
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "last\n", string(data))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(filepath.Join(t.TempDir(), "invalid.log"), WithMaxBackups(-2))
+		assert.ErrorContains(t, err, "invalid max backups -2")
+	})
+}
+
+// TestReconfigure verifies that reconfigured limits and prefixes take effect with the next write,
+// that invalid options are rejected without applying any, and that reconfiguring is safe while
+// writing concurrently.
+func TestReconfigure(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "reconfigure.log")
+	logger, err := New(logPath, WithMaxBytes(1000), WithPrefix([]byte("[A] ")))
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("one\ntwo\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Reconfigure(WithMaxBytes(20), WithPrefix([]byte("[B] "))))
+	_, err = logger.Write([]byte("three\n"))
+	assert.NoError(t, err)
+
+	// The shrunk max size rotated the file before the next write
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		data, err := os.ReadFile(backups[0].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, "[A] one\n[A] two\n", string(data))
+	}
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "[B] three\n", string(data))
+
+	// Invalid options are rejected without applying the valid ones
+	err = logger.Reconfigure(WithPrefix([]byte("[C] ")), WithCompressionFormat("lz4"))
+	assert.ErrorContains(t, err, `unsupported compression format "lz4"`)
+	assert.ErrorContains(t, logger.Reconfigure(WithMaxBackups(-2)), "invalid max backups")
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				_, err := logger.Write([]byte("line\n"))
+				assert.NoError(t, err)
+				assert.NoError(t, logger.Reconfigure(WithMaxBytes(int64(50+i)), WithMaxBackups(2), WithCompression()))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, logger.Close())
+	assert.ErrorIs(t, logger.Reconfigure(WithMaxBytes(10)), ErrClosed)
+
+	data, err = os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "[C] ")
+	backups, err = OpenBackups(logPath)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+}
+
+// TestReopen verifies that Reopen continues on a recreated log file with the previous permissions
+// after the log file was renamed, keeping a buffered partial line.
+func TestReopen(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "reopen.log")
+	assert.NoError(t, os.WriteFile(logPath, nil, 0600))
+	var reopened []string
+	logger, err := New(logPath, WithOnReopen(func(path string) {
+		reopened = append(reopened, path)
+	}))
+	assert.NoError(t, err)
+
+	_, err = logger.Write([]byte("before\npart"))
+	assert.NoError(t, err)
+	renamed := logPath + ".1"
+	assert.NoError(t, os.Rename(logPath, renamed))
+	_, err = logger.Write([]byte("ial\nafter"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, logger.Reopen())
+	_, err = logger.Write([]byte(" reopen\nlast"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+	assert.ErrorIs(t, logger.Reopen(), ErrClosed)
+	assert.Equal(t, []string{logPath}, reopened)
+
+	data, err := os.ReadFile(renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, "before\npartial\n", string(data))
+	data, err = os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "after reopen\nlast", string(data))
+	info, err := os.Stat(logPath)
+	if assert.NoError(t, err) && runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+// TestHeader verifies that the header is written once, without prefix, at the start of the log file
+// opened empty and after each rotation, counting towards the max size.
+func TestHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "header.log")
+	header := "time,level,message"
+	logger, err := New(logPath,
+		WithMaxBytes(40),
+		WithPrefix([]byte("> ")),
+		WithFileLocking(),
+		WithHeader(func() []byte { return []byte(header) }),
+	)
+	assert.NoError(t, err)
+
+	// The header and a line fill the file, the next line rotates it
+	for i := range 3 {
+		_, err := fmt.Fprintf(logger, "%d,info,first\n", i)
+		assert.NoError(t, err)
+		_, err = fmt.Fprintf(logger, "%d,info,second\n", i)
+		assert.NoError(t, err)
+	}
+	// A line exceeding the space after the header doesn't rotate a file containing only the header
+	assert.NoError(t, logger.Rotate())
+	_, err = logger.Write([]byte(strings.Repeat("x", 20) + "\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	var contents []string
+	for _, backup := range backups {
+		data, err := os.ReadFile(backup.Path)
+		assert.NoError(t, err)
+		contents = append(contents, string(data))
+	}
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	contents = append(contents, string(data))
+	assert.Equal(t, []string{
+		header + "\n> 0,info,first\n",
+		header + "\n> 0,info,second\n",
+		header + "\n> 1,info,first\n",
+		header + "\n> 1,info,second\n",
+		header + "\n> 2,info,first\n",
+		header + "\n> 2,info,second\n",
+		header + "\n> " + strings.Repeat("x", 20) + "\n",
+	}, contents)
+
+	// Opening a file that isn't empty doesn't add the header again
+	logger, err = New(logPath, WithHeader(func() []byte { return []byte(header) }))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Close())
+	data, err = os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, contents[len(contents)-1], string(data))
+
+	_, err = New(filepath.Join(tmpDir, "binary.log"), WithBinaryRecords(), WithHeader(func() []byte { return nil }))
+	assert.ErrorContains(t, err, "binary records")
+}
+
+// TestFooter verifies that the footer is written once at the end of every backup and of the log
+// file on Close, with the counts of the lines written to that file.
+func TestFooter(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "footer.log")
+	footer := func(stats FileStats) []byte {
+		return fmt.Appendf(nil, "# lines=%d bytes=%d", stats.Lines, stats.Bytes)
+	}
+	logger, err := New(logPath, WithMaxBytes(30), WithPrefix([]byte("> ")), WithFileLocking(), WithFooter(footer))
+	assert.NoError(t, err)
+
+	for _, line := range []string{"one", "two", "three", "four", "five", "six", "seven", "eight", "nine"} {
+		_, err := logger.Write([]byte(line + "\n"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, logger.Close())
+
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	var contents []string
+	for _, backup := range backups {
+		data, err := os.ReadFile(backup.Path)
+		assert.NoError(t, err)
+		contents = append(contents, string(data))
+	}
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	contents = append(contents, string(data))
+	assert.Equal(t, []string{
+		"> one\n> two\n> three\n> four\n# lines=4 bytes=27\n",
+		"> five\n> six\n> seven\n> eight\n# lines=4 bytes=29\n",
+		"> nine\n# lines=1 bytes=7\n",
+	}, contents)
+}
+
+// TestLatestLinkFallback verifies that a text file containing the path of the newest backup is
+// maintained where symbolic links aren't supported.
+func TestLatestLinkFallback(t *testing.T) {
+	defer func(link func(string, string) error) { symlink = link }(symlink)
+	symlink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "fallback.log")
+	latest := filepath.Join(tmpDir, "newest")
+	logger, err := New(logPath, WithLatestSymlink("newest"), WithBackupDir("backups"), WithMaxBackups(1))
+	assert.NoError(t, err)
+
+	for range 2 {
+		_, err = logger.Write([]byte("line\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+
+		backups, err := OpenBackupsInDir(logPath, "backups")
+		assert.NoError(t, err)
+		data, err := os.ReadFile(latest)
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 1) {
+			assert.Equal(t, backups[0].Path+"\n", string(data))
+		}
+	}
+	assert.NoError(t, logger.Close())
+
+	entries, err := os.ReadDir(tmpDir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"backups", "fallback.log", "newest"}, names)
+}
+
+// TestChecksums verifies that the digests of uncompressed and compressed backups are recorded in the
+// manifest, that entries of removed backups are pruned and that corrupted backups are detected.
+func TestChecksums(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options []Option
+	}{
+		{name: "copy"},
+		{name: "rename", options: []Option{WithRenameRotation()}},
+		{name: "gzip", options: []Option{WithCompression()}},
+		{name: "zstd", options: []Option{WithCompressionFormat(CompressionZstd), WithFileLocking()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "audit.log")
+			logger, err := New(logPath, append(tt.options, WithChecksums(), WithMaxBackups(2))...)
+			assert.NoError(t, err)
+			for i := range 3 {
+				_, err := fmt.Fprintf(logger, "line %d\n", i)
+				assert.NoError(t, err)
+				assert.NoError(t, logger.Rotate())
+			}
+			assert.NoError(t, logger.Close())
+
+			// The manifest isn't listed as a backup and only covers the retained backups
+			backups, err := OpenBackups(logPath)
+			assert.NoError(t, err)
+			results, err := VerifyBackups(logPath)
+			assert.NoError(t, err)
+			// Backups compressed in the background may be recorded in any order
+			byPath := func(results []VerifyResult) []VerifyResult {
+				sorted := make([]VerifyResult, len(backups))
+				for _, result := range results {
+					i := slices.IndexFunc(backups, func(backup BackupInfo) bool { return backup.Path == result.Path })
+					if assert.GreaterOrEqual(t, i, 0) {
+						sorted[i] = result
+					}
+				}
+				return sorted
+			}
+			if assert.Len(t, backups, 2) && assert.Len(t, results, 2) {
+				for _, result := range byPath(results) {
+					assert.True(t, result.OK())
+					data, err := os.ReadFile(result.Path)
+					assert.NoError(t, err)
+					assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), result.Expected)
+				}
+			}
+
+			// Tampering with a backup is detected
+			assert.NoError(t, os.WriteFile(backups[1].Path, []byte("tampered\n"), 0644))
+			assert.NoError(t, os.Remove(backups[0].Path))
+			results, err = VerifyBackups(logPath)
+			assert.NoError(t, err)
+			if assert.Len(t, results, 2) {
+				results = byPath(results)
+				assert.False(t, results[0].OK())
+				assert.ErrorIs(t, results[0].Err, os.ErrNotExist)
+				assert.False(t, results[1].OK())
+				assert.NoError(t, results[1].Err)
+				assert.NotEqual(t, results[1].Expected, results[1].Actual)
+			}
+		})
+	}
+
+	_, err := New(filepath.Join(t.TempDir(), "numeric.log"), WithChecksums(), WithNumericBackups())
+	assert.ErrorContains(t, err, "checksums")
+}
+
+// TestChecksumsWriteContext verifies that recording the checksums of backups compressed in the
+// background doesn't use the context of the write in progress, which is only valid while holding
+// the writer's lock.
+func TestChecksumsWriteContext(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "context.log")
+	var mu sync.Mutex
+	var errs []error
+	logger, err := New(logPath,
+		WithFileLocking(),
+		WithCompression(),
+		WithChecksums(),
+		WithMaxBytes(100),
+		WithErrorHandler(func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		}),
+	)
+	assert.NoError(t, err)
+	for i := range 100 {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := logger.WriteContext(ctx, []byte(fmt.Sprintf("line %04d\n", i)))
+		cancel()
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, logger.Close())
+	assert.Empty(t, errs)
+
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	results, err := VerifyBackups(logPath)
+	assert.NoError(t, err)
+	assert.Len(t, results, len(backups))
+	for _, result := range results {
+		assert.True(t, result.OK(), result.Path)
+	}
+}
+
+// TestEncryption verifies that backups are encrypted after compression, named with the .enc
+// extension, and read back with DecryptBackup and NewReader given the key, while a wrong
+// key, a modified and a truncated backup fail to decrypt.
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, EncryptionKeySize)
+	// Spans several chunks of the encrypted framing
+	long := strings.Repeat("x", 3*encryptedChunkSize/2)
+
+	for _, tt := range []struct {
+		name    string
+		ext     string
+		options []Option
+	}{
+		{name: "none", ext: ".enc"},
+		{name: "gzip", ext: ".gz.enc", options: []Option{WithCompression()}},
+		{name: "zstd", ext: ".zst.enc", options: []Option{WithCompressionFormat(CompressionZstd), WithRenameRotation()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "secret.log")
+			logger, err := New(logPath, append(tt.options, WithEncryption(key))...)
+			assert.NoError(t, err)
+			var want bytes.Buffer
+			for i := range 2 {
+				line := fmt.Sprintf("secret %d %s\n", i, long[:i*len(long)])
+				want.WriteString(line)
+				_, err := logger.WriteString(line)
+				assert.NoError(t, err)
+				assert.NoError(t, logger.Rotate())
+			}
+			_, err = logger.WriteString("live\n")
+			assert.NoError(t, err)
+			want.WriteString("live\n")
+			assert.NoError(t, logger.Close())
+
+			backups, err := OpenBackups(logPath)
+			assert.NoError(t, err)
+			if !assert.Len(t, backups, 2) {
+				return
+			}
+			for _, backup := range backups {
+				assert.True(t, strings.HasSuffix(backup.Path, tt.ext), backup.Path)
+				data, err := os.ReadFile(backup.Path)
+				assert.NoError(t, err)
+				assert.NotContains(t, string(data), "secret")
+			}
+
+			var decrypted bytes.Buffer
+			assert.NoError(t, DecryptBackup(backups[0].Path, key, &decrypted))
+			if tt.name == "none" {
+				assert.Equal(t, "secret 0 \n", decrypted.String())
+			}
+
+			reader, err := NewReader(logPath, ReadDecryptionKey(key))
+			assert.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.NoError(t, reader.Close())
+			assert.Equal(t, want.String(), string(data))
+
+			// Reading without or with the wrong key fails
+			reader, err = NewReader(logPath)
+			assert.NoError(t, err)
+			_, err = io.ReadAll(reader)
+			assert.ErrorContains(t, err, "decryption key")
+			assert.NoError(t, reader.Close())
+			wrongKey := bytes.Repeat([]byte{8}, EncryptionKeySize)
+			reader, err = NewReader(logPath, ReadDecryptionKey(wrongKey))
+			assert.NoError(t, err)
+			_, err = io.ReadAll(reader)
+			assert.ErrorIs(t, err, ErrDecryptionFailed)
+			assert.NoError(t, reader.Close())
+			assert.ErrorIs(t, DecryptBackup(backups[1].Path, wrongKey, io.Discard), ErrDecryptionFailed)
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "secret.log")
+		logger, err := New(logPath, WithEncryption(key))
+		assert.NoError(t, err)
+		_, err = logger.WriteString("secret " + long + "\n")
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		assert.NoError(t, logger.Close())
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		if !assert.Len(t, backups, 1) {
+			return
+		}
+		data, err := os.ReadFile(backups[0].Path)
+		assert.NoError(t, err)
+
+		modified := bytes.Clone(data)
+		modified[len(modified)-1] ^= 1
+		assert.NoError(t, os.WriteFile(backups[0].Path, modified, 0644))
+		assert.ErrorIs(t, DecryptBackup(backups[0].Path, key, io.Discard), ErrDecryptionFailed)
+
+		// Dropping the last chunk leaves a backup that decrypts, but isn't flagged complete
+		firstChunk := len(encryptedMagic) + noncePrefixSize + 4 + encryptedChunkSize + 16
+		assert.NoError(t, os.WriteFile(backups[0].Path, data[:firstChunk], 0644))
+		assert.ErrorIs(t, DecryptBackup(backups[0].Path, key, io.Discard), ErrDecryptionFailed)
+
+		assert.NoError(t, os.WriteFile(backups[0].Path, data, 0644))
+		assert.NoError(t, DecryptBackup(backups[0].Path, key, io.Discard))
+	})
+
+	_, err := New(filepath.Join(t.TempDir(), "short.log"), WithEncryption([]byte("too short")))
+	assert.ErrorContains(t, err, "encryption key")
+}
+
+// fakeUploader is an in-memory Uploader failing the given number of uploads before succeeding.
+type fakeUploader struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	uploaded map[string]string
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, localPath string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.attempts++
+	if u.failures > 0 {
+		u.failures--
+		return errors.New("upload failed")
+	}
+	if u.uploaded == nil {
+		u.uploaded = map[string]string{}
+	}
+	u.uploaded[filepath.Base(localPath)] = string(data)
+	return nil
+}
+
+// contents returns the uploaded backups by name.
+func (u *fakeUploader) contents() map[string]string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return maps.Clone(u.uploaded)
+}
+
+// TestUploader verifies that completed backups are uploaded and optionally deleted, that failed
+// uploads are retried with backoff, and that uploads still queued when closing are resumed by the
+// next writer.
+func TestUploader(t *testing.T) {
+	defer func(min, max time.Duration) { minUploadBackoff, maxUploadBackoff = min, max }(minUploadBackoff, maxUploadBackoff)
+	minUploadBackoff, maxUploadBackoff = time.Millisecond, 5*time.Millisecond
+
+	t.Run("retries", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "upload.log")
+		uploader := &fakeUploader{failures: 3}
+		var mu sync.Mutex
+		var errs []error
+		logger, err := New(logPath,
+			WithUploader(uploader, true),
+			WithCompression(),
+			WithErrorHandler(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}),
+		)
+		assert.NoError(t, err)
+		for _, line := range []string{"first\n", "second\n"} {
+			_, err := logger.WriteString(line)
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+		}
+
+		assert.Eventually(t, func() bool { return len(uploader.contents()) == 2 }, 5*time.Second, time.Millisecond)
+		assert.NoError(t, logger.Close())
+		var lines []string
+		for name, data := range uploader.contents() {
+			assert.True(t, strings.HasSuffix(name, ".gz"), name)
+			r, err := gzip.NewReader(strings.NewReader(data))
+			if assert.NoError(t, err) {
+				line, err := io.ReadAll(r)
+				assert.NoError(t, err)
+				lines = append(lines, string(line))
+			}
+		}
+		sort.Strings(lines)
+		assert.Equal(t, []string{"first\n", "second\n"}, lines)
+		assert.Equal(t, 5, uploader.attempts)
+
+		// Uploaded backups are deleted, the queue isn't listed as a backup
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		assert.Empty(t, backups)
+		queue, err := os.ReadFile(logPath + uploadQueueExt)
+		assert.NoError(t, err)
+		assert.Empty(t, queue)
+		mu.Lock()
+		defer mu.Unlock()
+		if assert.Len(t, errs, 3) {
+			assert.ErrorContains(t, errs[0], "upload failed")
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "upload.log")
+		logger, err := New(logPath, WithUploader(&fakeUploader{failures: math.MaxInt}, true), WithErrorHandler(func(error) {}))
+		assert.NoError(t, err)
+		_, err = logger.WriteString("pending\n")
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		assert.NoError(t, logger.Close())
+
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		if !assert.Len(t, backups, 1) {
+			return
+		}
+		queue, err := os.ReadFile(logPath + uploadQueueExt)
+		assert.NoError(t, err)
+		assert.Equal(t, backups[0].Path+"\n", string(queue))
+
+		uploader := &fakeUploader{}
+		logger, err = New(logPath, WithUploader(uploader, false))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return len(uploader.contents()) == 1 }, 5*time.Second, time.Millisecond)
+		assert.NoError(t, logger.Close())
+		assert.Equal(t, map[string]string{filepath.Base(backups[0].Path): "pending\n"}, uploader.contents())
+
+		// Without deleteAfter, the backup is kept
+		_, err = os.Stat(backups[0].Path)
+		assert.NoError(t, err)
+		queue, err = os.ReadFile(logPath + uploadQueueExt)
+		assert.NoError(t, err)
+		assert.Empty(t, queue)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "upload.log")
+		errs := make(chan error, 100)
+		logger, err := New(logPath,
+			WithUploader(&fakeUploader{failures: math.MaxInt}, false),
+			WithErrorHandler(func(err error) { errs <- err }),
+		)
+		assert.NoError(t, err)
+		_, err = logger.WriteString("lost\n")
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		backups, err := logger.ListBackups()
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 1) {
+			assert.NoError(t, os.Remove(backups[0].Path))
+		}
+
+		// The backup removed before its upload is dropped from the queue
+		for err := range errs {
+			if strings.Contains(err.Error(), "removed before its upload") {
+				break
+			}
+			assert.ErrorContains(t, err, "failed to upload")
+		}
+		assert.NoError(t, logger.Close())
+		queue, err := os.ReadFile(logPath + uploadQueueExt)
+		assert.NoError(t, err)
+		assert.Empty(t, queue)
+	})
+
+	t.Run("write context", func(t *testing.T) {
+		// The queue is updated in the background, regardless of the contexts of writes
+		logPath := filepath.Join(t.TempDir(), "upload.log")
+		uploader := &fakeUploader{}
+		var mu sync.Mutex
+		var errs []error
+		logger, err := New(logPath,
+			WithUploader(uploader, false),
+			WithFileLocking(),
+			WithCompression(),
+			WithMaxBytes(100),
+			WithErrorHandler(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}),
+		)
+		assert.NoError(t, err)
+		for i := range 100 {
+			ctx, cancel := context.WithCancel(context.Background())
+			_, err := logger.WriteContext(ctx, []byte(fmt.Sprintf("line %04d\n", i)))
+			cancel()
+			assert.NoError(t, err)
+		}
+
+		backups, err := logger.ListBackups()
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return len(uploader.contents()) == len(backups) }, 5*time.Second, time.Millisecond)
+		assert.NoError(t, logger.Close())
+		queue, err := os.ReadFile(logPath + uploadQueueExt)
+		assert.NoError(t, err)
+		assert.Empty(t, queue)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Empty(t, errs)
+	})
+
+	_, err := New(filepath.Join(t.TempDir(), "numeric.log"), WithUploader(&fakeUploader{}, false), WithNumericBackups())
+	assert.ErrorContains(t, err, "uploader")
+}
+
+// TestCompressionLevel verifies that backups compressed with the fastest and the best gzip level,
+// reusing pooled writers across rotations, are readable, and that invalid levels are rejected by New.
+func TestCompressionLevel(t *testing.T) {
+	var want strings.Builder
+	for i := range 1000 {
+		fmt.Fprintf(&want, "line %d of a fairly compressible log file\n", i)
+	}
+
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		logPath := filepath.Join(t.TempDir(), "level.log")
+		logger, err := New(logPath, WithCompression(), WithCompressionLevel(level))
+		assert.NoError(t, err)
+		for range 3 {
+			_, err := logger.WriteString(want.String())
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+		}
+		assert.NoError(t, logger.Close())
+
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		assert.Len(t, backups, 3)
+		for _, backup := range backups {
+			assert.True(t, backup.Compressed)
+			f, err := os.Open(backup.Path)
+			assert.NoError(t, err)
+			r, err := gzip.NewReader(f)
+			if assert.NoError(t, err) {
+				data, err := io.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, want.String(), string(data))
+			}
+			f.Close()
+		}
+	}
+
+	for _, level := range []int{gzip.HuffmanOnly - 1, gzip.BestCompression + 1} {
+		_, err := New(filepath.Join(t.TempDir(), "invalid.log"), WithCompression(), WithCompressionLevel(level))
+		assert.ErrorContains(t, err, "compression level")
+	}
+}
+
+// BenchmarkRotateCompressionLevel measures rotating a 20 MB log file, including its compression,
+// at each gzip compression level.
+func BenchmarkRotateCompressionLevel(b *testing.B) {
+	var chunk bytes.Buffer
+	for i := 0; chunk.Len() < 1<<20; i++ {
+		fmt.Fprintf(&chunk, "%d request served in %dms from %x\n", i, i%997, i*7919)
+	}
+
+	for level := gzip.HuffmanOnly; level <= gzip.BestCompression; level++ {
+		b.Run(strconv.Itoa(level), func(b *testing.B) {
+			logger, err := New(filepath.Join(b.TempDir(), "benchmark.log"),
+				WithCompression(),
+				WithCompressionLevel(level),
+				WithMaxBackups(1),
+			)
+			if err != nil {
+				b.Fatalf("failed to create logger: %v", err)
+			}
+			defer logger.Close()
+
+			b.SetBytes(20 * int64(chunk.Len()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for range 20 {
+					if _, err := logger.Write(chunk.Bytes()); err != nil {
+						b.Fatalf("failed to write log: %v", err)
+					}
+				}
+				b.StartTimer()
+				if err := logger.Rotate(); err != nil {
+					b.Fatalf("failed to rotate: %v", err)
+				}
+				logger.compressions.Wait()
+			}
+		})
+	}
+}
+
+// TestCompressExisting verifies that plain backups left by runs without compression are compressed
+// in the background or with CompressBackups, keeping their contents and leaving compressed backups
+// alone, and that Close interrupts the compression without leaving partial files behind.
+func TestCompressExisting(t *testing.T) {
+	// mixedBackups creates a compressed backup followed by two plain ones and returns the lines written
+	mixedBackups := func(t *testing.T, logPath string) string {
+		var want strings.Builder
+		for i, options := range [][]Option{{WithCompression()}, nil, nil} {
+			logger, err := New(logPath, options...)
+			assert.NoError(t, err)
+			line := fmt.Sprintf("run %d\n", i)
+			want.WriteString(line)
+			_, err = logger.WriteString(line)
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+			assert.NoError(t, logger.Close())
+		}
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 3) {
+			assert.True(t, backups[0].Compressed)
+			assert.False(t, backups[1].Compressed)
+		}
+		return want.String()
+	}
+	readAll := func(t *testing.T, logPath string) string {
+		reader, err := NewReader(logPath)
+		assert.NoError(t, err)
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	t.Run("writer", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "existing.log")
+		want := mixedBackups(t, logPath)
+		compressed, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+
+		logger, err := New(logPath, WithCompressionFormat(CompressionZstd), WithCompressExisting())
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			backups, err := logger.ListBackups()
+			return err == nil && len(backups) == 3 && !slices.ContainsFunc(backups, func(backup BackupInfo) bool {
+				return !backup.Compressed
+			})
+		}, 5*time.Second, time.Millisecond)
+		assert.NoError(t, logger.Close())
+
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 3) {
+			assert.Equal(t, compressed[0].Path, backups[0].Path)
+			assert.Equal(t, compressed[1].Path+".zst", backups[1].Path)
+			assert.Equal(t, compressed[2].Path+".zst", backups[2].Path)
+		}
+		assert.Equal(t, want, readAll(t, logPath))
+	})
+
+	t.Run("CompressBackups", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "existing.log")
+		want := mixedBackups(t, logPath)
+		assert.NoError(t, CompressBackups(logPath))
+
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		assert.Len(t, backups, 3)
+		for _, backup := range backups {
+			assert.True(t, strings.HasSuffix(backup.Path, ".gz"), backup.Path)
+		}
+		assert.Equal(t, want, readAll(t, logPath))
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "existing.log")
+		logger, err := New(logPath)
+		assert.NoError(t, err)
+		line := strings.Repeat("x", 1023) + "\n"
+		for range 16 << 10 {
+			_, err := logger.WriteString(line)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, logger.Rotate())
+		assert.NoError(t, logger.Close())
+
+		logger, err = New(logPath, WithCompression(), WithCompressionLevel(gzip.BestCompression), WithCompressExisting())
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Close())
+
+		// Either the plain or the compressed backup is left, without temporary files
+		backups, err := OpenBackups(logPath)
+		assert.NoError(t, err)
+		assert.Len(t, backups, 1)
+		tmpFiles, err := filepath.Glob(filepath.Join(tmpDir, "*"+tmpExt))
+		assert.NoError(t, err)
+		assert.Empty(t, tmpFiles)
+		assert.Equal(t, 16<<20, len(readAll(t, logPath)))
+	})
+
+	_, err := New(filepath.Join(t.TempDir(), "numeric.log"), WithCompressExisting(), WithNumericBackups())
+	assert.ErrorContains(t, err, "compressing existing backups")
+}
+
+// TestVerifyRotation verifies that a backup silently losing data while being copied is detected
+// before the log file is truncated: the write triggering the rotation fails, the bad backup is
+// deleted and the log file is left untouched.
+func TestVerifyRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "verify.log")
+	logger, err := New(logPath, WithMaxBytes(64), WithVerifyRotation())
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	line := []byte(strings.Repeat("a", 39))
+	first := string(line)
+	assert.NoError(t, logger.WriteLine(line))
+
+	// The copy claims success, but drops the last byte
+	defer func(copy func(io.Writer, io.Reader) (int64, error)) { copyFile = copy }(copyFile)
+	copyFile = func(dst io.Writer, src io.Reader) (int64, error) {
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return 0, err
+		}
+		n, err := dst.Write(data[:len(data)-1])
+		return int64(n + 1), err
+	}
+	assert.ErrorIs(t, logger.WriteLine(line), ErrBackupVerification)
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, first, string(data))
+	files, err := filepath.Glob(logPath + ".*")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// Once copies are reliable again, the rotation succeeds
+	copyFile = io.Copy
+	assert.NoError(t, logger.WriteLine(line))
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		data, err := os.ReadFile(backups[0].Path)
+		assert.NoError(t, err)
+		assert.Equal(t, first, string(data))
+	}
+}
+
+func TestDropCacheAfterRotate(t *testing.T) {
+	var mu sync.Mutex
+	var dropped []string
+	defer func(drop func(fsFile) error) { dropFileCache = drop }(dropFileCache)
+	dropFileCache = func(f fsFile) error {
+		mu.Lock()
+		defer mu.Unlock()
+		dropped = append(dropped, filepath.Base(f.Name()))
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    func(backup string) []string
+	}{
+		{"copy", nil, func(backup string) []string {
+			return []string{backup + tmpExt, "cache.log"}
+		}},
+		{"rename", []Option{WithRenameRotation()}, func(backup string) []string {
+			return []string{"cache.log"}
+		}},
+		{"compressed", []Option{WithCompression()}, func(backup string) []string {
+			uncompressed := strings.TrimSuffix(backup, CompressionGzip.extension())
+			return []string{uncompressed + tmpExt, "cache.log", uncompressed, backup + tmpExt}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			dropped = nil
+			mu.Unlock()
+
+			logPath := filepath.Join(t.TempDir(), "cache.log")
+			logger, err := New(logPath, append(tt.options, WithMaxBytes(16), WithDropCacheAfterRotate())...)
+			assert.NoError(t, err)
+			assert.NoError(t, logger.WriteLine([]byte("first line\n")))
+			assert.NoError(t, logger.WriteLine([]byte("second line\n")))
+			assert.NoError(t, logger.Close())
+
+			backups, err := logger.ListBackups()
+			assert.NoError(t, err)
+			if assert.Len(t, backups, 1) {
+				mu.Lock()
+				assert.Equal(t, tt.want(filepath.Base(backups[0].Path)), dropped)
+				mu.Unlock()
+			}
+		})
+	}
+
+	// Without the option, nothing is dropped
+	dropped = nil
+	logger, err := New(filepath.Join(t.TempDir(), "cache.log"), WithMaxBytes(16))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.WriteLine([]byte("first line\n")))
+	assert.NoError(t, logger.WriteLine([]byte("second line\n")))
+	assert.NoError(t, logger.Close())
+	assert.Empty(t, dropped)
+
+	// Dropping the cache fails the rotation only by reporting the error
+	dropFileCache = func(f fsFile) error { return errors.New("fadvise failed") }
+	var errs []error
+	logger, err = New(filepath.Join(t.TempDir(), "cache.log"), WithMaxBytes(16), WithDropCacheAfterRotate(),
+		WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.WriteLine([]byte("first line\n")))
+	assert.NoError(t, logger.WriteLine([]byte("second line\n")))
+	assert.NoError(t, logger.Close())
+	assert.Len(t, errs, 2)
+}
+
+func TestAsync(t *testing.T) {
+	// stall holds the writer's lock once the worker took the first queued write, so the following
+	// writes fill the queue
+	stall := func(t *testing.T, logger *DistributedFileWriter) {
+		logger.mu.Lock()
+		assert.NoError(t, logger.WriteLine([]byte("a\n")))
+		assert.Eventually(t, func() bool {
+			logger.async.mu.Lock()
+			defer logger.async.mu.Unlock()
+			return logger.async.count == 0
+		}, time.Second, time.Millisecond)
+	}
+
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		want    string
+		dropped int64
+	}{
+		{"block", OverflowBlock, "a\nb\nc\nd\n", 0},
+		{"drop newest", OverflowDropNewest, "a\nb\nc\ndfwriter: dropped 2 lines, async queue full\n", 2},
+		{"drop oldest", OverflowDropOldest, "a\ndfwriter: dropped 2 lines, async queue full\nd\ne\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "async.log")
+			logger, err := New(logPath, WithAsync(2, tt.policy))
+			assert.NoError(t, err)
+
+			stall(t, logger)
+			assert.NoError(t, logger.WriteLine([]byte("b\n")))
+			assert.NoError(t, logger.WriteLine([]byte("c\n")))
+			blocked := make(chan error, 1)
+			if tt.policy == OverflowBlock {
+				// A full queue blocks further writes until the worker continues
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				assert.ErrorIs(t, logger.WriteLineContext(ctx, []byte("x\n")), context.DeadlineExceeded)
+				go func() {
+					blocked <- logger.WriteLine([]byte("d\n"))
+				}()
+				select {
+				case <-blocked:
+					t.Fatal("write didn't block on a full queue")
+				case <-time.After(10 * time.Millisecond):
+				}
+			} else {
+				assert.NoError(t, logger.WriteLine([]byte("d\n")))
+				_, err := logger.Write([]byte("e\n"))
+				assert.NoError(t, err)
+			}
+			logger.mu.Unlock()
+			if tt.policy == OverflowBlock {
+				assert.NoError(t, <-blocked)
+			}
+
+			// Sync returns once the queue is written
+			assert.NoError(t, logger.Sync())
+			data, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(data))
+			assert.Equal(t, tt.dropped, logger.Stats().AsyncDropped)
+			assert.NoError(t, logger.Close())
+		})
+	}
+
+	t.Run("order", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "async.log")
+		logger, err := New(logPath, WithAsync(4, OverflowBlock))
+		assert.NoError(t, err)
+
+		var want strings.Builder
+		for i := range 500 {
+			line := fmt.Sprintf("line %d\n", i)
+			want.WriteString(line)
+			switch i % 3 {
+			case 0:
+				assert.NoError(t, logger.WriteLine([]byte(line)))
+			case 1:
+				// Partial lines are completed by the following write
+				_, err := logger.WriteString(line[:3])
+				assert.NoError(t, err)
+				_, err = logger.Write([]byte(line[3:]))
+				assert.NoError(t, err)
+			default:
+				assert.NoError(t, logger.WriteLines([][]byte{[]byte(line)}))
+			}
+		}
+		// Close returns once the queue is written
+		assert.NoError(t, logger.Close())
+		assert.ErrorIs(t, logger.WriteLine([]byte("closed\n")), ErrClosed)
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, want.String(), string(data))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		writeErr := errors.New("disk on fire")
+		fsys := &faultFS{write: func(f fsFile, b []byte) (int, error) {
+			return 0, writeErr
+		}}
+
+		var mu sync.Mutex
+		var reported []error
+		logPath := filepath.Join(t.TempDir(), "async.log")
+		logger, err := New(logPath, WithAsync(2, OverflowBlock), WithAsyncFailOnError(),
+			WithErrorHandler(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported = append(reported, err)
+			}),
+			withFS(fsys))
+		assert.NoError(t, err)
+
+		assert.NoError(t, logger.WriteLine([]byte("lost\n")))
+		assert.ErrorIs(t, logger.Sync(), writeErr)
+		// The error is returned once
+		fsys.write = nil
+		assert.NoError(t, logger.WriteLine([]byte("written\n")))
+		assert.NoError(t, logger.Close())
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "written\n", string(data))
+		mu.Lock()
+		defer mu.Unlock()
+		if assert.Len(t, reported, 1) {
+			assert.ErrorIs(t, reported[0], writeErr)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "async.log")
+		_, err := New(logPath, WithAsync(-1, OverflowBlock))
+		assert.Error(t, err)
+		_, err = New(logPath, WithAsync(2, OverflowPolicy(42)))
+		assert.Error(t, err)
+		_, err = New(logPath, WithAsync(2, OverflowDropNewest), WithAsyncFailOnError())
+		assert.Error(t, err)
+		_, err = New(logPath, WithAsyncFailOnError())
+		assert.Error(t, err)
+	})
+}
+
+func TestChild(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "child.log")
+	logger, err := New(logPath, WithPrefix([]byte("parent ")))
+	assert.NoError(t, err)
+
+	child := logger.Child([]byte("child "))
+	same := logger.Child(nil)
+
+	// Partial lines are assembled per child
+	_, err = child.Write([]byte("one "))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("two "))
+	assert.NoError(t, err)
+	_, err = same.WriteString("three\n")
+	assert.NoError(t, err)
+	_, err = child.Write([]byte("continued\nfive"))
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("continued\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, child.WriteLine([]byte("six\n")))
+
+	// Closing a child flushes its partial line
+	assert.NoError(t, child.Close())
+	assert.NoError(t, child.Close())
+	_, err = child.Write([]byte("closed\n"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.NoError(t, logger.Close())
+	assert.ErrorIs(t, same.WriteLine([]byte("closed\n")), ErrClosed)
+	assert.ErrorIs(t, logger.Child(nil).WriteLine([]byte("closed\n")), ErrClosed)
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "parent three\nchild one continued\nparent two continued\nchild six\nchild five", string(data))
+
+	t.Run("concurrent", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "child.log")
+		logger, err := New(logPath, WithMaxBytes(4096), WithMaxBackups(100))
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := range 16 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				child := logger.Child(nil)
+				defer child.Close()
+				for j := range 100 {
+					// Without a child each, the pieces of the lines would be interleaved
+					fmt.Fprintf(child, "goroutine=%d ", i)
+					fmt.Fprintf(child, "line=%d\n", j)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.NoError(t, logger.Close())
+
+		files, err := filepath.Glob(logPath + "*")
+		assert.NoError(t, err)
+		lines := 0
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			for line := range strings.Lines(string(data)) {
+				assert.Regexp(t, `^goroutine=\d+ line=\d+\n$`, line)
+				lines++
+			}
+		}
+		assert.Equal(t, 1600, lines)
+		assert.Equal(t, int64(1600), logger.Stats().LinesWritten)
+	})
+
+	t.Run("async", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "child.log")
+		logger, err := New(logPath, WithAsync(4, OverflowBlock))
+		assert.NoError(t, err)
+		child := logger.Child([]byte("child "))
+		_, err = child.Write([]byte("one\ntwo"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.WriteLine([]byte("three\n")))
+		// Closing the parent flushes the open children
+		assert.NoError(t, logger.Close())
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "child one\nthree\nchild two", string(data))
+	})
+}
+
+// BenchmarkChildWriters compares goroutines writing lines in pieces through a shared writer, which
+// interleaves the pieces, with each writing through its own child.
+func BenchmarkChildWriters(b *testing.B) {
+	const goroutines = 16
+	for _, children := range []bool{false, true} {
+		name := "shared"
+		if children {
+			name = "children"
+		}
+		b.Run(name, func(b *testing.B) {
+			logger, err := New(filepath.Join(b.TempDir(), "benchmark.log"), WithMaxBytes(64<<20), WithMaxBackups(1))
+			if err != nil {
+				b.Fatalf("failed to create logger: %v", err)
+			}
+			defer logger.Close()
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i := range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var w io.Writer = logger
+					if children {
+						child := logger.Child(nil)
+						defer child.Close()
+						w = child
+					}
+					for j := i; j < b.N; j += goroutines {
+						for _, piece := range []string{"level=info ", "msg=\"request served\" ", "status=200 ", "\n"} {
+							if _, err := io.WriteString(w, piece); err != nil {
+								b.Errorf("failed to write log: %v", err)
+								return
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestWriteWithPrefix(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithAsync(4, OverflowBlock)}} {
+		logPath := filepath.Join(t.TempDir(), "prefix.log")
+		logger, err := New(logPath, append(options, WithPrefix([]byte("default ")), WithMaxBytes(1024))...)
+		assert.NoError(t, err)
+
+		alice := logger.WriterWithPrefix([]byte("req=alice "))
+		bob := logger.WriterWithPrefix([]byte("req=bob "))
+		_, err = alice.Write([]byte("one\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.WriteLine([]byte("two\n")))
+		_, err = fmt.Fprintf(bob, "three\nfour\n")
+		assert.NoError(t, err)
+		assert.NoError(t, logger.WriteLineWithPrefix([]byte("req=carol "), []byte("five\n")))
+		_, err = logger.Write([]byte("six\n"))
+		assert.NoError(t, err)
+		_, err = alice.Write([]byte("seven\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.WriteLineWithPrefix(nil, []byte("eight\n")))
+		assert.NoError(t, logger.Close())
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "req=alice one\ndefault two\nreq=bob three\nreq=bob four\nreq=carol five\ndefault six\n"+
+			"req=alice seven\neight\n", string(data))
+	}
+
+	// The oversized line check accounts for the effective prefix
+	logPath := filepath.Join(t.TempDir(), "prefix.log")
+	logger, err := New(logPath, WithPrefix([]byte("p ")), WithMaxBytes(32))
+	assert.NoError(t, err)
+	defer logger.Close()
+	line := []byte(strings.Repeat("x", 20) + "\n")
+	assert.ErrorIs(t, logger.WriteLineWithPrefix([]byte(strings.Repeat("r", 12)), line), ErrLineTooLong)
+	_, err = logger.WriterWithPrefix([]byte(strings.Repeat("r", 12))).Write(line)
+	assert.ErrorIs(t, err, ErrLineTooLong)
+	assert.NoError(t, logger.WriteLine(line))
+	assert.NoError(t, logger.WriteLineWithPrefix([]byte("q "), []byte("y\n")))
+	assert.Equal(t, int64(len(line)+2+4), logger.Stats().CurrentSize)
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "envelope.log")
+	logger, err := New(logPath, WithJSONEnvelope(), WithPrefix([]byte("app ")), WithMaxBytes(4096))
+	assert.NoError(t, err)
+
+	messages := []string{
+		`say "hi" \ bye`,
+		"tab\tcarriage\rbell\x07",
+		"multi-byte: héllo 世界 🎉",
+		"separators \u2028 \u2029",
+		"invalid \xff\xfe utf-8",
+		"",
+	}
+	for _, msg := range messages[:3] {
+		assert.NoError(t, logger.WriteLine([]byte(msg+"\n")))
+	}
+	// Lines of a write are wrapped one by one, a partial line once flushed
+	_, err = logger.Write([]byte(messages[3] + "\n" + messages[4] + "\n" + messages[5] + "\npartial"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Sync())
+	messages = append(messages, "partial")
+	before := time.Now()
+	assert.NoError(t, logger.Close())
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), logger.Stats().CurrentSize)
+	lines := strings.SplitAfter(string(data), "\n")
+	assert.Equal(t, "", lines[len(lines)-1])
+	lines = lines[:len(lines)-1]
+	if assert.Len(t, lines, len(messages)) {
+		for i, line := range lines {
+			var entry map[string]string
+			assert.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+			// Converting to runes replaces every invalid byte like the envelope
+			assert.Equal(t, string([]rune(messages[i])), entry["msg"])
+			assert.Equal(t, "app ", entry["prefix"])
+			ts, err := time.Parse(time.RFC3339Nano, entry["ts"])
+			assert.NoError(t, err)
+			assert.WithinDuration(t, before, ts, time.Minute)
+		}
+	}
+	assert.Contains(t, lines[0], `"msg":"say \"hi\" \\ bye"`)
+	assert.Contains(t, lines[1], `"msg":"tab\tcarriage\rbell\u0007"`)
+	assert.Contains(t, lines[2], `"msg":"multi-byte: héllo 世界 🎉"`)
+	assert.Contains(t, lines[3], `"msg":"separators \u2028 \u2029"`)
+	assert.Contains(t, lines[4], `"msg":"invalid \ufffd\ufffd utf-8"`)
+
+	t.Run("field names", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "envelope.log")
+		logger, err := New(logPath, WithJSONEnvelope("time", "source"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.WriteLines([][]byte{[]byte("one\n"), []byte("two\n")}))
+		assert.NoError(t, logger.Close())
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Regexp(t, `^\{"time":"[^"]+","source":"","msg":"one"\}\n\{"time":"[^"]+","source":"","msg":"two"\}\n$`,
+			string(data))
+
+		_, err = New(logPath, WithJSONEnvelope("a", "b", "c", "d"))
+		assert.Error(t, err)
+		_, err = New(logPath, WithJSONEnvelope("a", ""))
+		assert.Error(t, err)
+		_, err = New(logPath, WithJSONEnvelope("msg"))
+		assert.Error(t, err)
+		_, err = New(logPath, WithJSONEnvelope(), WithOversizeLinePolicy(OversizeTruncate))
+		assert.Error(t, err)
+		_, err = New(logPath, WithJSONEnvelope(), WithBinaryRecords())
+		assert.Error(t, err)
+	})
+
+	t.Run("max size", func(t *testing.T) {
+		// The envelope counts towards the max size
+		logPath := filepath.Join(t.TempDir(), "envelope.log")
+		logger, err := New(logPath, WithJSONEnvelope(), WithMaxBytes(64))
+		assert.NoError(t, err)
+		defer logger.Close()
+		assert.ErrorIs(t, logger.WriteLine([]byte(strings.Repeat("x", 30)+"\n")), ErrLineTooLong)
+		assert.ErrorIs(t, logger.WriteLine([]byte(strings.Repeat("\x01", 10)+"\n")), ErrLineTooLong)
+		assert.NoError(t, logger.WriteLine([]byte("x\n")))
+		assert.NoError(t, logger.WriteLine([]byte("y\n")))
+		assert.Equal(t, int64(1), logger.Stats().Rotations)
+	})
+}
+
+func BenchmarkAppendJSONString(b *testing.B) {
+	messages := map[string][]byte{
+		"ascii":   []byte(`GET /api/v1/users?id=42 HTTP/1.1 200 "Mozilla/5.0" 1532 bytes in 12ms`),
+		"escaped": []byte("path=\"C:\\logs\\app\"\tstatus=\"failed\"\r\x00 retrying \"soon\""),
+		"unicode": []byte("Größe überschritten: 日本語のメッセージ 🎉 ünïcödé"),
+	}
+	for name, msg := range messages {
+		b.Run(name, func(b *testing.B) {
+			var buf []byte
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf = appendJSONString(buf[:0], msg)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  SanitizeMode
+		input string
+		want  string
+	}{
+		{"clean", SanitizeAll, "plain line\twith tab ünïcödé", "plain line\twith tab ünïcödé"},
+		{"ansi colors", SanitizeANSI, "\x1b[1;31merror\x1b[0m: failed", "error: failed"},
+		{"ansi title", SanitizeANSI, "\x1b]0;title\x07before\x1b]8;;http://x\x1b\\link", "beforelink"},
+		{"ansi unterminated", SanitizeANSI, "text\x1b[12", "text"},
+		{"ansi only", SanitizeANSI, "bell\x07 \xff", "bell\x07 \xff"},
+		{"lone csi byte utf8", SanitizeUTF8, "a\x9b31mb", "a�31mb"},
+		{"lone csi byte control", SanitizeControl, "a\x9b31mb", `a\x9b31mb`},
+		{"invalid utf8", SanitizeUTF8, "bad \xff\xfe end \xe4\xb8", "bad �� end ��"},
+		{"control", SanitizeControl, "nul\x00 cr\r del\x7f esc\x1b c1\u009b", `nul\x00 cr\x0d del\x7f esc\x1b c1\u009b`},
+		{"all", SanitizeAll, "\x1b[32mok\x1b[0m\x00\xff", "ok\\x00�"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "sanitize.log")
+			logger, err := New(logPath, WithSanitize(tt.mode))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.WriteLine([]byte(tt.input+"\n")))
+			assert.NoError(t, logger.Close())
+
+			data, err := os.ReadFile(logPath)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want+"\n", string(data))
+		})
+	}
+
+	t.Run("max size", func(t *testing.T) {
+		// The line only exceeds the max size once escaped
+		logPath := filepath.Join(t.TempDir(), "sanitize.log")
+		logger, err := New(logPath, WithSanitize(SanitizeControl), WithMaxBytes(16))
+		assert.NoError(t, err)
+		defer logger.Close()
+		_, err = logger.Write([]byte("\x00\x01\x02\x03\x04\n"))
+		assert.ErrorIs(t, err, ErrLineTooLong)
+		// Stripped sequences may make a line fit
+		logger, err = New(logPath, WithSanitize(SanitizeANSI), WithMaxBytes(16))
+		assert.NoError(t, err)
+		defer logger.Close()
+		_, err = logger.Write([]byte("\x1b[1;31mred text\x1b[0m\n"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("allocations", func(t *testing.T) {
+		logger, err := New(filepath.Join(t.TempDir(), "sanitize.log"), WithSanitize(SanitizeAll))
+		assert.NoError(t, err)
+		defer logger.Close()
+		clean := []byte("a perfectly clean line\n")
+		dirty := []byte("\x1b[31mred\x1b[0m \xff\x00\n")
+		assert.NoError(t, logger.WriteLine(dirty))
+		assert.Zero(t, testing.AllocsPerRun(100, func() {
+			assert.NoError(t, logger.WriteLine(clean))
+		}))
+		line := []byte("a clean line")
+		sanitized, changed := sanitizeLine(nil, line, SanitizeAll)
+		assert.False(t, changed)
+		assert.Same(t, &line[0], &sanitized[0])
+		assert.Zero(t, testing.AllocsPerRun(100, func() {
+			sanitizeLine(logger.sanitizeBuf, dirty, SanitizeAll)
+		}))
+	})
+
+	_, err := New(filepath.Join(t.TempDir(), "sanitize.log"), WithSanitize(SanitizeMode(64)))
+	assert.Error(t, err)
+	_, err = New(filepath.Join(t.TempDir(), "sanitize.log"), WithSanitize(SanitizeAll), WithBinaryRecords())
+	assert.Error(t, err)
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	defer func(size int64) { sequenceBlockSize = size }(sequenceBlockSize)
+	sequenceBlockSize = 3
+
+	t.Run("restart continuity", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "app.log")
+		for run := 0; run < 2; run++ {
+			w, err := New(logPath, WithSequenceNumbers(), WithPrefix([]byte("p ")))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(run*4), w.Stats().Sequence)
+			assert.NoError(t, w.WriteLine([]byte("a\n")))
+			_, err = w.Write([]byte("b\nc\nd\n"))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(run*4+4), w.Stats().Sequence)
+			assert.NoError(t, w.Close())
+		}
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "seq=1 p a\nseq=2 p b\nseq=3 p c\nseq=4 p d\n"+
+			"seq=5 p a\nseq=6 p b\nseq=7 p c\nseq=8 p d\n", string(data))
+		// The unused numbers were returned on close
+		data, err = os.ReadFile(logPath + sequenceExt)
+		assert.NoError(t, err)
+		assert.Equal(t, "9", string(data))
+	})
+
+	t.Run("epochs", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "app.log")
+		var writers []*DistributedFileWriter
+		for epoch := 1; epoch <= 2; epoch++ {
+			w, err := New(logPath, WithSequenceNumbers(), WithFileLocking(), WithPrefix([]byte("p ")))
+			assert.NoError(t, err)
+			defer w.Close()
+			stats := w.Stats()
+			assert.Equal(t, int64(epoch), stats.SequenceEpoch)
+			assert.Zero(t, stats.Sequence)
+			writers = append(writers, w)
+		}
+		// Each writer numbers its lines within its epoch, without reserving blocks
+		for range 4 {
+			for _, w := range writers {
+				assert.NoError(t, w.WriteLine([]byte("a\n")))
+			}
+		}
+		assert.Equal(t, int64(4), writers[1].Stats().Sequence)
+		for _, w := range writers {
+			assert.NoError(t, w.Close())
+		}
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "seq=1.1 p a\nseq=2.1 p a\nseq=1.2 p a\nseq=2.2 p a\n"+
+			"seq=1.3 p a\nseq=2.3 p a\nseq=1.4 p a\nseq=2.4 p a\n", string(data))
+		data, err = os.ReadFile(logPath + sequenceExt)
+		assert.NoError(t, err)
+		assert.Equal(t, "3", string(data))
+	})
+
+	t.Run("end position", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "app.log")
+		w, err := New(logPath, WithSequenceNumbers(), WithSequencePosition(SequenceEnd), WithPrefix([]byte("p ")))
+		assert.NoError(t, err)
+		_, err = w.Write([]byte("a\nb\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "p a seq=1\np b seq=2\n", string(data))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "app.log")
+		_, err := New(logPath, WithSequenceNumbers(), WithSequencePosition(SequencePosition(2)))
+		assert.Error(t, err)
+		_, err = New(logPath, WithSequenceNumbers(), WithBinaryRecords())
+		assert.Error(t, err)
+
+		assert.NoError(t, os.WriteFile(logPath+sequenceExt, []byte("garbage"), 0644))
+		_, err = New(logPath, WithSequenceNumbers())
+		assert.ErrorContains(t, err, "invalid sequence file")
+	})
+
+	t.Run("multi-process uniqueness", func(t *testing.T) {
+		if !lockingSupported {
+			t.Skip("file locking not supported")
+		}
+		out := buildHelper(t)
+		logPath := filepath.Join(t.TempDir(), "app.log")
+
+		const (
+			writers        = 4
+			linesPerWriter = 2500
+		)
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			cmd := exec.Command(out, "-log="+logPath, "-prefix="+strconv.Itoa(i)+" ",
+				"-lines="+strconv.Itoa(linesPerWriter), "-lineSize=10", "-lock", "-seq")
+			cmd.Stderr = os.Stderr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, cmd.Run())
+			}()
+		}
+		wg.Wait()
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		assert.Len(t, lines, writers*linesPerWriter)
+		// Every writer numbers its lines from 1 without gaps in an epoch of its own
+		next := make(map[string]int)
+		prefixes := make(map[string]string)
+		for _, line := range lines {
+			seq, rest, _ := strings.Cut(strings.TrimPrefix(line, "seq="), " ")
+			epoch, n, _ := strings.Cut(seq, ".")
+			prefix, _, _ := strings.Cut(rest, " ")
+			if _, ok := prefixes[epoch]; !ok {
+				prefixes[epoch] = prefix
+			}
+			assert.Equal(t, prefixes[epoch], prefix, "epoch %s shared", epoch)
+			next[epoch]++
+			assert.Equal(t, strconv.Itoa(next[epoch]), n, "line %q", line)
+		}
+		assert.Len(t, next, writers)
+	})
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		level := 3
+		marker := "…"
+		config := Config{
+			MaxBytes:         10 << 20,
+			MaxBackups:       3,
+			MaxTotalBytes:    1536,
+			MaxAge:           Duration(7 * 24 * time.Hour),
+			RotationInterval: Duration(36 * time.Hour),
+			RotateAt:         "03:30",
+			RotateOnOpen:     "2d",
+			Compression:      CompressionZstd,
+			CompressionLevel: &level,
+			Prefix:           "[app] ",
+			TruncationMarker: &marker,
+			Sanitize:         []string{"utf8", "ansi"},
+			FileMode:         "0640",
+			FileLocking:      true,
+			LockMode:         "ofd",
+			LockTimeout:      Duration(1500 * time.Millisecond),
+			SyncEveryBytes:   1 << 30,
+			AtomicLineSize:   4096,
+		}
+
+		data, err := json.Marshal(config)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), `"maxBytes":"10MB"`)
+		assert.Contains(t, string(data), `"maxAge":"7d"`)
+		assert.Contains(t, string(data), `"rotationInterval":"1d12h0m0s"`)
+		var decoded Config
+		assert.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, config, decoded)
+		_, err = decoded.Options()
+		assert.NoError(t, err)
+	})
+
+	t.Run("load", func(t *testing.T) {
+		var config Config
+		assert.NoError(t, json.Unmarshal([]byte(`{
+			"maxBytes": "64 kb",
+			"maxBackups": 2,
+			"MaxTotalBytes": 1048576,
+			"maxAge": "7d",
+			"prefix": "p "
+		}`), &config))
+		assert.Equal(t, Size(64<<10), config.MaxBytes)
+		assert.Equal(t, Size(1<<20), config.MaxTotalBytes)
+		assert.Equal(t, Duration(7*24*time.Hour), config.MaxAge)
+
+		logPath := filepath.Join(t.TempDir(), "app.log")
+		w, err := config.New(logPath, WithMaxBackups(1))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(64<<10), w.maxSize)
+		// Options passed to New override the config
+		assert.Equal(t, 1, w.maxBackups)
+		assert.NoError(t, w.WriteLine([]byte("a\n")))
+		assert.NoError(t, w.Close())
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "p a\n", string(data))
+	})
+
+	t.Run("bad sizes", func(t *testing.T) {
+		for _, size := range []string{`"10XB"`, `"MB"`, `"-1MB"`, `"1.5B"`, `"9999999PB"`, `-1`, `true`} {
+			var config Config
+			err := json.Unmarshal([]byte(`{"maxBytes":`+size+`}`), &config)
+			var configErr *ConfigError
+			if assert.ErrorAs(t, err, &configErr, size) {
+				assert.Equal(t, "maxBytes", configErr.Field)
+				assert.ErrorContains(t, err, "invalid config field maxBytes")
+			}
+		}
+	})
+
+	t.Run("invalid fields", func(t *testing.T) {
+		var config Config
+		err := json.Unmarshal([]byte(`{"maxAge":"7 days"}`), &config)
+		assert.ErrorContains(t, err, "invalid config field maxAge")
+		err = json.Unmarshal([]byte(`{"maxBytez":"1MB"}`), &config)
+		assert.ErrorContains(t, err, "invalid config field maxBytez: unknown field")
+
+		for field, config := range map[string]Config{
+			"lockMode":           {LockMode: "posix"},
+			"rotateAt":           {RotateAt: "25:00"},
+			"compression":        {Compression: "lz4"},
+			"oversizeLinePolicy": {OversizeLinePolicy: "drop"},
+			"fileMode":           {FileMode: "0999"},
+			"delimiter":          {Delimiter: "\r\n"},
+			"sanitize":           {Sanitize: []string{"emoji"}},
+			"syncEveryLine":      {SyncEveryLine: true, SyncInterval: Duration(time.Second)},
+		} {
+			_, err := config.New(filepath.Join(t.TempDir(), "app.log"))
+			var configErr *ConfigError
+			if assert.ErrorAs(t, err, &configErr, field) {
+				assert.Equal(t, field, configErr.Field)
+			}
+		}
+	})
+
+	t.Run("invalid counts", func(t *testing.T) {
+		for _, field := range []string{"maxBackups", "diskFullRetries", "diskFullMinBackups", "rateLimitBurst", "async", "recentBuffer", "eventBuffer", "maxOpenFiles"} {
+			var config Config
+			assert.NoError(t, json.Unmarshal([]byte(`{"`+field+`":-1}`), &config))
+			_, err := config.New(filepath.Join(t.TempDir(), "app.log"))
+			var configErr *ConfigError
+			if assert.ErrorAs(t, err, &configErr, field) {
+				assert.Equal(t, field, configErr.Field)
+			}
+		}
+
+		for field, config := range map[string]Config{
+			"noBackups":        {NoBackups: true, MaxBackups: 3},
+			"asyncFailOnError": {AsyncFailOnError: true},
+		} {
+			_, err := config.Options()
+			var configErr *ConfigError
+			if assert.ErrorAs(t, err, &configErr, field) {
+				assert.Equal(t, field, configErr.Field)
+			}
+		}
+
+		// NoBackups round-trips through its own field
+		logger, err := (&Config{NoBackups: true}).New(filepath.Join(t.TempDir(), "app.log"))
+		assert.NoError(t, err)
+		defer logger.Close()
+		assert.Equal(t, NoBackups, logger.maxBackups)
+		config := logger.Config()
+		assert.True(t, config.NoBackups)
+		assert.Zero(t, config.MaxBackups)
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "512K", want: 512 << 10},
+		{in: "512KB", want: 512 << 10},
+		{in: "512KiB", want: 512 << 10},
+		{in: "512kb", want: 512 << 10},
+		{in: "100MiB", want: 100 << 20},
+		{in: "100 MB", want: 100 << 20},
+		{in: " 100M ", want: 100 << 20},
+		{in: "1.5GB", want: 3 << 29},
+		{in: "1.5G", want: 3 << 29},
+		{in: "0.5K", want: 512},
+		{in: ".5K", want: 512},
+		{in: "2.K", want: 2 << 10},
+		{in: "2TB", want: 2 << 40},
+		{in: "3PiB", want: 3 << 50},
+		{in: "9223372036854775807", want: math.MaxInt64},
+		{in: "007MB", want: 7 << 20},
 
-func TestConcurrentWritesAndRotationMultiProc(t *testing.T) {
-	// build helper binary into temp dir
-	out := filepath.Join(t.TempDir(), "logwriter")
-	cmd := exec.Command("go", "build", "-o", out, "./cmd/test/main.go")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to build helper: %v\n", err)
-		os.Exit(1)
+		// Negative, signed and empty
+		{in: "-1", err: true},
+		{in: "-1MB", err: true},
+		{in: "+1MB", err: true},
+		{in: "", err: true},
+		{in: " ", err: true},
+		{in: "MB", err: true},
+		{in: ".", err: true},
+		{in: ".MB", err: true},
+		// Ambiguous or malformed
+		{in: "1.5B", err: true},
+		{in: "1.0001K", err: true},
+		{in: "1..5K", err: true},
+		{in: "1.5.5K", err: true},
+		{in: "1e3", err: true},
+		{in: "1/2K", err: true},
+		{in: "0x10", err: true},
+		{in: "1 0MB", err: true},
+		{in: "10MBB", err: true},
+		{in: "10Mb ps", err: true},
+		{in: "10XB", err: true},
+		{in: "10 bytes", err: true},
+		{in: "1,000", err: true},
+		// Overflow
+		{in: "9223372036854775808", err: true},
+		{in: "8192PB", err: true},
+	} {
+		got, err := ParseSize(tt.in)
+		if tt.err {
+			assert.Error(t, err, "%q", tt.in)
+			continue
+		}
+		if assert.NoError(t, err, "%q", tt.in) {
+			assert.Equal(t, tt.want, got, "%q", tt.in)
+		}
 	}
+}
 
-	dir := t.TempDir()
-	logPath := filepath.Join(dir, "app.log")
-	if f, err := os.Create(logPath); err != nil {
-		t.Fatalf("create log: %v", err)
-	} else {
-		f.Close()
+func TestParseAge(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "0", want: 0},
+		{in: "0d", want: 0},
+		{in: "36h", want: 36 * time.Hour},
+		{in: "90m", want: 90 * time.Minute},
+		{in: "1.5h", want: 90 * time.Minute},
+		{in: "500ms", want: 500 * time.Millisecond},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "4w", want: 28 * 24 * time.Hour},
+		{in: "1.5d", want: 36 * time.Hour},
+		{in: "0.5w", want: 84 * time.Hour},
+		{in: "1w2d12h", want: (9*24 + 12) * time.Hour},
+		{in: "1d1d", want: 48 * time.Hour},
+		{in: "2h1w", want: (7*24 + 2) * time.Hour},
+		{in: " 7d ", want: 7 * 24 * time.Hour},
+		{in: "1d30m15s", want: 24*time.Hour + 30*time.Minute + 15*time.Second},
+
+		// Negative, signed and empty
+		{in: "-1h", err: true},
+		{in: "-7d", err: true},
+		{in: "1d-1h", err: true},
+		{in: "+1h", err: true},
+		{in: "", err: true},
+		{in: "d", err: true},
+		// Ambiguous or malformed
+		{in: "7", err: true},
+		{in: "1d7", err: true},
+		{in: "7D", err: true},
+		{in: "7 d", err: true},
+		{in: "1h 30m", err: true},
+		{in: "1y", err: true},
+		{in: "1mo", err: true},
+		{in: "7days", err: true},
+		{in: "1..5d", err: true},
+		{in: ".d", err: true},
+		{in: "1e3d", err: true},
+		// Overflow
+		{in: "16000w", err: true},
+		{in: "106752d", err: true},
+		{in: "106751d24h", err: true},
+	} {
+		got, err := ParseAge(tt.in)
+		if tt.err {
+			assert.Error(t, err, "%q", tt.in)
+			continue
+		}
+		if assert.NoError(t, err, "%q", tt.in) {
+			assert.Equal(t, tt.want, got, "%q", tt.in)
+		}
 	}
+}
 
-	const (
-		writers        = 5
-		linesPerWriter = 20
-		lineSize       = 10
-		rotationSize   = 100
+func TestStringOptions(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	w, err := New(logPath, WithMaxBytesString("1.5KB"), WithMaxAgeString("2w"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1536), w.maxSize)
+	assert.Equal(t, 14*24*time.Hour, w.maxAge)
+
+	assert.ErrorContains(t, w.Reconfigure(WithMaxBytesString("-1MB")), "invalid max bytes")
+	assert.Equal(t, int64(1536), w.maxSize)
+	assert.NoError(t, w.Reconfigure(WithMaxBytesString("1MiB")))
+	assert.Equal(t, int64(1<<20), w.maxSize)
+	assert.NoError(t, w.Close())
+
+	_, err = New(logPath, WithMaxBytesString("10XB"), WithMaxAgeString("7"))
+	assert.ErrorContains(t, err, "invalid max bytes")
+	assert.ErrorContains(t, err, "invalid max age")
+}
+
+func TestWriterConfig(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(filepath.Join(dir, "app.log"),
+		WithMaxBytesString("10MB"),
+		WithMaxBackups(5),
+		WithMaxAgeString("7d"),
+		WithCompressionFormat(CompressionZstd),
+		WithLockFile(""),
+		WithPrefix([]byte("[app] ")),
+		WithRotateAt(3, 30),
+		WithRotateOnOpen(RotateOnOpenOlderThan(36*time.Hour)),
+		WithSanitize(SanitizeAll),
+		WithSyncPolicy(SyncEveryNBytes(1<<20)),
+		WithFileMode(0640),
+	)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	config := w.Config()
+	assert.Equal(t, Size(10<<20), config.MaxBytes)
+	assert.Equal(t, 5, config.MaxBackups)
+	assert.Equal(t, Duration(7*24*time.Hour), config.MaxAge)
+	assert.Equal(t, CompressionZstd, config.Compression)
+	assert.False(t, config.FileLocking)
+	assert.True(t, config.LockFile)
+	assert.Equal(t, filepath.Join(dir, "app.log.lock"), config.LockFilePath)
+	assert.Equal(t, "[app] ", config.Prefix)
+	assert.Equal(t, "03:30", config.RotateAt)
+	assert.Equal(t, "1d12h0m0s", config.RotateOnOpen)
+	assert.Equal(t, []string{"utf8", "ansi", "control"}, config.Sanitize)
+	assert.Equal(t, Size(1<<20), config.SyncEveryBytes)
+	assert.Equal(t, "0640", config.FileMode)
+	assert.Equal(t, "flock", config.LockMode)
+	assert.Equal(t, Size(4096), config.AtomicLineSize)
+
+	// The snapshot reflects Reconfigure and recreates an equivalent writer
+	assert.NoError(t, w.Reconfigure(WithMaxBytes(1<<20)))
+	config = w.Config()
+	assert.Equal(t, Size(1<<20), config.MaxBytes)
+	copied, err := config.New(filepath.Join(dir, "copy.log"))
+	assert.NoError(t, err)
+	defer copied.Close()
+	assert.Equal(t, config, copied.Config())
+}
+
+func TestSettings(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	prefix := []byte("[app] ")
+	w, err := New(logPath,
+		WithMaxBytes(10<<20),
+		WithMaxBackups(3),
+		WithMaxAge(7*24*time.Hour),
+		WithPrefix(prefix),
+		WithCompression(),
+		WithFileLocking(),
+		WithAtomicLineSize(512),
 	)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	settings := w.Settings()
+	assert.Equal(t, Settings{
+		Path:           logPath,
+		MaxBytes:       10 << 20,
+		MaxBackups:     3,
+		MaxAge:         7 * 24 * time.Hour,
+		Prefix:         prefix,
+		Compression:    CompressionGzip,
+		FileLocking:    true,
+		AtomicLineSize: 512,
+	}, settings)
+	// The prefix is a copy
+	settings.Prefix[0] = 'X'
+	assert.Equal(t, []byte("[app] "), w.Settings().Prefix)
+	assert.Equal(t, `dfwriter(path=`+logPath+` maxBytes=10MB maxBackups=3 maxAge=7d compression=gzip locking=true prefix="[app] ")`,
+		w.String())
 
+	// Reconfiguring is reflected while writing concurrently
 	var wg sync.WaitGroup
-	for i := 0; i < writers; i++ {
-		cmd := exec.Command(
-			out,
-			"-log="+logPath,
-			"-prefix="+strconv.Itoa(i),
-			"-lines="+strconv.Itoa(linesPerWriter),
-			"-lineSize="+strconv.Itoa(lineSize),
-			"-rotationSize="+strconv.Itoa(rotationSize),
-			"-lock",
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			assert.NoError(t, w.WriteLine([]byte("line\n")))
+		}
+	}()
+	assert.NoError(t, w.Reconfigure(WithMaxBytes(1<<20), WithPrefix(nil), WithCompressionFormat(CompressionNone)))
+	settings = w.Settings()
+	wg.Wait()
+	assert.Equal(t, int64(1<<20), settings.MaxBytes)
+	assert.Empty(t, settings.Prefix)
+	assert.Equal(t, CompressionNone, settings.Compression)
+
+	w, err = New(filepath.Join(t.TempDir(), "default.log"))
+	assert.NoError(t, err)
+	defer w.Close()
+	settings = w.Settings()
+	assert.False(t, settings.FileLocking)
+	assert.Equal(t, 4096, settings.AtomicLineSize)
+	assert.Contains(t, w.String(), "maxBytes=0 maxBackups=0 maxAge=0s compression=none locking=false")
+}
+
+// faultFS is the file system of the os package with failures injected by tests.
+type faultFS struct {
+	osFS
+	statErr    error // returned by Stat of opened files, if set
+	copyErr    error // returned by writes to temporary backup files beyond copyLimit bytes, if set
+	copyLimit  int
+	removeErr  error    // returned by Remove, if set
+	removeSeen []string // paths passed to Remove
+	statSeen   []string // paths passed to Stat
+	readDirErr error    // returned by ReadDir, if set
+	mkdirErr   error    // returned by MkdirAll, if set
+
+	// The operations replacing those of the os package, if set. Files are passed unwrapped.
+	rename   func(oldpath, newpath string) error
+	remove   func(name string) error
+	write    func(f fsFile, b []byte) (int, error)
+	sync     func(f fsFile) error
+	truncate func(f fsFile, size int64) error
+}
+
+func (fsys *faultFS) OpenFile(name string, flag int, perm os.FileMode) (fsFile, error) {
+	f, err := fsys.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fsFile: f, fsys: fsys}, nil
+}
+
+func (fsys *faultFS) Stat(name string) (os.FileInfo, error) {
+	fsys.statSeen = append(fsys.statSeen, name)
+	return fsys.osFS.Stat(name)
+}
+
+func (fsys *faultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if fsys.readDirErr != nil {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: fsys.readDirErr}
+	}
+	return fsys.osFS.ReadDir(name)
+}
+
+func (fsys *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if fsys.mkdirErr != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: fsys.mkdirErr}
+	}
+	return fsys.osFS.MkdirAll(path, perm)
+}
+
+func (fsys *faultFS) Rename(oldpath, newpath string) error {
+	if fsys.rename != nil {
+		return fsys.rename(oldpath, newpath)
+	}
+	return fsys.osFS.Rename(oldpath, newpath)
+}
+
+func (fsys *faultFS) Remove(name string) error {
+	fsys.removeSeen = append(fsys.removeSeen, name)
+	if fsys.removeErr != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: fsys.removeErr}
+	}
+	if fsys.remove != nil {
+		return fsys.remove(name)
+	}
+	return fsys.osFS.Remove(name)
+}
+
+// faultFile is a file opened on a faultFS.
+type faultFile struct {
+	fsFile
+	fsys    *faultFS
+	written int
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	if f.fsys.copyErr == nil || !strings.HasSuffix(f.Name(), tmpExt) {
+		if f.fsys.write != nil {
+			return f.fsys.write(f.fsFile, b)
+		}
+		return f.fsFile.Write(b)
+	}
+	n, err := f.fsFile.Write(b[:min(len(b), max(f.fsys.copyLimit-f.written, 0))])
+	f.written += n
+	if err == nil && n < len(b) {
+		err = f.fsys.copyErr
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if f.fsys.sync != nil {
+		return f.fsys.sync(f.fsFile)
+	}
+	return f.fsFile.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if f.fsys.truncate != nil {
+		return f.fsys.truncate(f.fsFile, size)
+	}
+	return f.fsFile.Truncate(size)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if f.fsys.statErr != nil {
+		return nil, f.fsys.statErr
+	}
+	return f.fsFile.Stat()
+}
+
+// TestFSFaults verifies that failures of the file system leave the log file and its backups
+// consistent: a rotation failing midway through copying, the log file failing to stat before
+// deciding to rotate, backups failing to be removed or archived, and directories failing to be created
+// or listed.
+func TestFSFaults(t *testing.T) {
+	errInjected := errors.New("injected failure")
+
+	t.Run("copy", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "copy.log")
+		fsys := &faultFS{}
+		logger, err := New(logPath, WithMaxBackups(3), withFS(fsys))
+		assert.NoError(t, err)
+		defer logger.Close()
+		_, err = logger.Write([]byte("first line\nsecond line\n"))
+		assert.NoError(t, err)
+
+		fsys.copyErr, fsys.copyLimit = errInjected, 4
+		assert.ErrorIs(t, logger.Rotate(), errInjected)
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "first line\nsecond line\n", string(data))
+		// The partial backup is removed
+		files, err := filepath.Glob(logPath + ".*")
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+
+		fsys.copyErr = nil
+		assert.NoError(t, logger.Rotate())
+		backups, err := logger.ListBackups()
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 1) {
+			data, err := os.ReadFile(backups[0].Path)
+			assert.NoError(t, err)
+			assert.Equal(t, "first line\nsecond line\n", string(data))
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "stat.log")
+		fsys := &faultFS{}
+		logger, err := New(logPath, WithMaxBytes(32), WithFileLocking(), withFS(fsys))
+		assert.NoError(t, err)
+		defer logger.Close()
+		_, err = logger.Write([]byte("first line\n"))
+		assert.NoError(t, err)
+
+		// The size is refreshed from the locked file before deciding to rotate
+		fsys.statErr = errInjected
+		_, err = logger.Write([]byte("second line\n"))
+		assert.ErrorIs(t, err, errInjected)
+		// The failed line is retried with the next write, which rotates
+		fsys.statErr = nil
+		_, err = logger.Write([]byte("third line\n"))
+		assert.NoError(t, err)
+
+		data, err := os.ReadFile(logPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "second line\nthird line\n", string(data))
+		backups, err := logger.ListBackups()
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 1) {
+			data, err := os.ReadFile(backups[0].Path)
+			assert.NoError(t, err)
+			assert.Equal(t, "first line\n", string(data))
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		logPath := filepath.Join(t.TempDir(), "remove.log")
+		var backups []string
+		for i := 3; i > 0; i-- {
+			path := logPath + "." + time.Now().Add(-time.Duration(i)*time.Hour).Format(backupTimeFormat)
+			assert.NoError(t, os.WriteFile(path, []byte("backup\n"), 0644))
+			backups = append(backups, path)
+		}
+
+		fsys := &faultFS{removeErr: os.ErrPermission}
+		var removed []string
+		var errs []error
+		logger, err := New(logPath,
+			WithMaxBackups(1),
+			WithOnBackupRemoved(func(path string, reason RemovalReason) {
+				removed = append(removed, path)
+			}),
+			WithErrorHandler(func(err error) {
+				errs = append(errs, err)
+			}),
+			withFS(fsys),
 		)
-		// inherit environment
-		cmd.Env = os.Environ()
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := cmd.Start(); err != nil {
-				fmt.Printf("failed to start child %d: %v\n", i, err)
-			}
-			if err := cmd.Wait(); err != nil {
-				fmt.Printf("child %d failed: %v\n", i, err)
-			}
-		}()
+		assert.NoError(t, err)
+		assert.Equal(t, backups[:2], fsys.removeSeen)
+		assert.Equal(t, 3, logger.Stats().BackupCount)
+
+		// Removals succeed once permitted again
+		fsys.removeErr = nil
+		_, err = logger.Write([]byte("line\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		assert.NoError(t, logger.Close())
+
+		assert.Equal(t, backups, removed)
+		if assert.Len(t, errs, 1) {
+			assert.ErrorIs(t, errs[0], os.ErrPermission)
+			assert.ErrorContains(t, errs[0], "failed to clean up backups")
+		}
+		for _, path := range backups {
+			assert.NoFileExists(t, path)
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "archive.log")
+		archiveDir := filepath.Join(tmpDir, "archive")
+		var backups []string
+		for i := 2; i > 0; i-- {
+			path := logPath + "." + time.Now().Add(-time.Duration(i)*time.Hour).Format(backupTimeFormat)
+			assert.NoError(t, os.WriteFile(path, []byte("backup\n"), 0644))
+			backups = append(backups, path)
+		}
+
+		// The archive is on another device, and the copied backup can't be removed
+		fsys := &faultFS{removeErr: os.ErrPermission}
+		fsys.rename = func(oldPath, newPath string) error {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errInjected}
+		}
+		var errs []error
+		logger, err := New(logPath,
+			WithMaxBackups(1),
+			WithArchiveDir(archiveDir),
+			WithErrorHandler(func(err error) {
+				errs = append(errs, err)
+			}),
+			withFS(fsys),
+		)
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Close())
+
+		assert.Equal(t, backups[:1], fsys.removeSeen)
+		if assert.Len(t, errs, 1) {
+			assert.ErrorIs(t, errs[0], os.ErrPermission)
+		}
+		assert.FileExists(t, backups[0])
+		assert.FileExists(t, filepath.Join(archiveDir, filepath.Base(backups[0])))
+		assert.FileExists(t, backups[1])
+	})
+
+	t.Run("directories", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		logPath := filepath.Join(tmpDir, "dirs.log")
+		fsys := &faultFS{mkdirErr: errInjected}
+		for _, option := range []Option{WithMkdirAll(0755), WithBackupDir("backups"), WithArchiveDir(filepath.Join(tmpDir, "archive"))} {
+			_, err := New(logPath, option, withFS(fsys))
+			assert.ErrorIs(t, err, errInjected)
+		}
+		assert.NoDirExists(t, filepath.Join(tmpDir, "backups"))
+		assert.NoDirExists(t, filepath.Join(tmpDir, "archive"))
+
+		fsys.mkdirErr = nil
+		logger, err := New(logPath, WithBackupNameTemplate("{name}-{timestamp}.{index}{ext}"), withFS(fsys))
+		assert.NoError(t, err)
+		defer logger.Close()
+		assert.NoError(t, logger.Rotate())
+		fsys.readDirErr = errInjected
+		_, err = logger.ListBackups()
+		assert.ErrorIs(t, err, errInjected)
+	})
+}
+
+// TestNewStdLogger verifies that every call of the standard library logger writes exactly one line,
+// escaping newlines within messages, and that no entry is split by rotation. The logger's prefix
+// follows that of WithPrefix.
+func TestNewStdLogger(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "std.log")
+	logger, w, err := NewStdLogger(logPath, 0, WithPrefix([]byte("[app] ")), WithMaxBytes(100))
+	assert.NoError(t, err)
+
+	const entries = 50
+	for i := range entries {
+		logger.Printf("entry %d\nsecond line\n\nlast line", i)
 	}
-	wg.Wait()
+	logger.SetPrefix("svc: ")
+	logger.Print("prefixed\n")
+	assert.NoError(t, w.Close())
 
-	// now validate total lines
-	files, _ := filepath.Glob(logPath + "*")
-	assert.GreaterOrEqual(t, len(files), (writers*linesPerWriter*lineSize)/rotationSize)
-	total := 0
-	for _, f := range files {
-		data, err := os.ReadFile(f)
-		if err != nil {
-			t.Fatalf("read %s: %v", f, err)
+	backups, err := w.ListBackups()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, backups)
+	var paths []string
+	for _, backup := range backups {
+		paths = append(paths, backup.Path)
+	}
+	var lines []string
+	for _, path := range append(paths, logPath) {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		lines = append(lines, strings.SplitAfter(string(data), "\n")...)
+	}
+	lines = slices.DeleteFunc(lines, func(line string) bool { return line == "" })
+
+	if assert.Len(t, lines, entries+1) {
+		for i, line := range lines[:entries] {
+			assert.Equal(t, fmt.Sprintf(`[app] entry %d\nsecond line\n\nlast line`+"\n", i), line)
 		}
-		total += len(bytes.Split(data, []byte("\n"))) - 1
+		assert.Equal(t, "[app] svc: prefixed\n", lines[entries])
+	}
 
+	_, _, err = NewStdLogger(filepath.Join(t.TempDir(), "missing", "std.log"), log.LstdFlags)
+	assert.Error(t, err)
+}
+
+// TestRecentBuffer verifies that the recent buffer keeps the last lines written as written, oldest
+// first, after wrapping around and across rotations.
+func TestRecentBuffer(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "recent.log")
+	w, err := New(logPath, WithRecentBuffer(3), WithPrefix([]byte("> ")), WithMaxBytes(32))
+	assert.NoError(t, err)
+	assert.Empty(t, w.RecentLines())
+	assert.NotNil(t, w.RecentLines())
+
+	_, err = w.Write([]byte("one\ntwo\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("> one\n"), []byte("> two\n")}, w.RecentLines())
+
+	for _, line := range []string{"three\n", "a longer fourth line\n", "five\n", "6\n"} {
+		assert.NoError(t, w.WriteLine([]byte(line)))
 	}
-	want := writers * linesPerWriter
-	assert.Equal(t, want, total, "expected %d lines in all files, got %d", want, total)
+	lines := w.RecentLines()
+	assert.Equal(t, [][]byte{[]byte("> a longer fourth line\n"), []byte("> five\n"), []byte("> 6\n")}, lines)
+	lines[2][2] = '7'
+	assert.Equal(t, []byte("> 6\n"), w.RecentLines()[2])
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 3, w.Config().RecentBuffer)
+
+	w, err = New(logPath)
+	assert.NoError(t, err)
+	assert.Nil(t, w.RecentLines())
+	assert.NoError(t, w.Close())
+
+	_, err = New(logPath, WithRecentBuffer(-1))
+	assert.Error(t, err)
+	_, err = New(logPath, WithRecentBuffer(10), WithBinaryRecords())
+	assert.Error(t, err)
 }
 
-func BenchmarkLoggerWrite(b *testing.B) {
-	tmpDir := b.TempDir()
-	logPath := filepath.Join(tmpDir, "benchmark.log")
-	logger, err := New(logPath,
-		WithFileLocking(),
-		WithMaxBytes(100*1024*1024), // 100MB
-	)
-	if err != nil {
-		b.Fatalf("failed to create logger: %v", err)
+// TestEvents verifies that the events of a scripted workload are delivered in order, and that the
+// channel is closed by Close.
+func TestEvents(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "events.log")
+	w, err := New(logPath, WithEventBuffer(16), WithMaxBytes(10), WithMaxBackups(1),
+		WithTee(failingWriter{}), WithErrorHandler(func(error) {}))
+	assert.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, err := w.Write([]byte(line))
+		assert.NoError(t, err)
 	}
-	defer logger.Close()
+	assert.NoError(t, w.Reopen())
+	assert.NoError(t, w.Close())
 
-	message := []byte("Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores et ea rebum. Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet. Lorem ipsum dolor sit amet, consetetur sadipscing elitr, sed diam nonumy eirmod tempor invidunt ut labore et dolore magna aliquyam erat, sed diam voluptua. At vero eos et accusam et justo duo dolores et ea rebum. Stet clita kasd gubergren, no sea takimata sanctus est Lorem ipsum dolor sit amet.\n")
+	var events []Event
+	for e := range w.Events() {
+		events = append(events, e)
+	}
+	backups, err := w.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) && assert.Len(t, events, 7) {
+		if occurred, ok := events[0].(ErrorOccurred); assert.True(t, ok, events[0]) {
+			assert.EqualError(t, occurred.Err, "failed to write to tee: tee failed")
+		}
+		first, ok := events[1].(Rotated)
+		if assert.True(t, ok, events[1]) {
+			assert.Equal(t, int64(len("first\n")), first.Size)
+		}
+		assert.IsType(t, ErrorOccurred{}, events[2])
+		assert.Equal(t, Rotated{BackupPath: backups[0].Path, Size: int64(len("second\n"))}, events[3])
+		assert.Equal(t, BackupRemoved{Path: first.BackupPath, Reason: RemovalMaxBackups}, events[4])
+		assert.IsType(t, ErrorOccurred{}, events[5])
+		assert.Equal(t, Reopened{}, events[6])
+	}
+	assert.Zero(t, w.Stats().EventsDropped)
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, err := logger.Write(message)
-		if err != nil {
-			b.Fatalf("failed to write log: %v", err)
+	w, err = New(logPath)
+	assert.NoError(t, err)
+	assert.Nil(t, w.Events())
+	assert.NoError(t, w.Close())
+	_, err = New(logPath, WithEventBuffer(-1))
+	assert.Error(t, err)
+}
+
+// TestEventsDropped verifies that events not fitting into the buffer are dropped and counted
+// without blocking writes when nobody reads them.
+func TestEventsDropped(t *testing.T) {
+	w, err := New(filepath.Join(t.TempDir(), "dropped.log"), WithEventBuffer(2), WithMaxBytes(10), WithMaxBackups(1))
+	assert.NoError(t, err)
+
+	const rotations = 10
+	for i := range rotations {
+		_, err := fmt.Fprintf(w, "line %d\n", i)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	// Every rotation but the first one removes a backup
+	delivered := 0
+	for range w.Events() {
+		delivered++
+	}
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, int64(rotations-1+rotations-2-delivered), w.Stats().EventsDropped)
+}
+
+// TestGarbageBackups verifies that cleanups remove empty backups and orphaned temporary files once
+// untouched for an hour, regardless of the limits, reporting them with their own reasons.
+func TestGarbageBackups(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "garbage.log")
+	archive := filepath.Join(dir, "archive")
+	seed := func(name, data string, age time.Duration) string {
+		path := logPath + "." + name
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+		mtime := time.Now().Add(-age)
+		assert.NoError(t, os.Chtimes(path, mtime, mtime))
+		return path
+	}
+	oldEmpty := seed("20240101-000000", "", 48*time.Hour)
+	oldBackup := seed("20240102-000000", "backup\n", 48*time.Hour)
+	oldTemp := seed("20240103-000000.000.pid1.tmp", "partial", 2*time.Hour)
+	oldCompressedTemp := seed("20240104-000000.gz.tmp", "partial", 2*time.Hour)
+	recentEmpty := seed("20240105-000000", "", time.Minute)
+	recentTemp := seed("20240106-000000.000.pid2.tmp", "partial", time.Minute)
+
+	removed := make(map[string]RemovalReason)
+	var mu sync.Mutex
+	fsys := &faultFS{}
+	logger, err := New(logPath, WithArchiveDir(archive), WithOnBackupRemoved(func(path string, reason RemovalReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		removed[path] = reason
+	}), withFS(fsys))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]RemovalReason{
+		oldEmpty:          RemovalEmpty,
+		oldTemp:           RemovalOrphanedTemp,
+		oldCompressedTemp: RemovalOrphanedTemp,
+	}, removed)
+	for _, path := range []string{oldBackup, recentEmpty, recentTemp} {
+		assert.FileExists(t, path)
+	}
+	// Garbage is removed instead of archived
+	archived, err := filepath.Glob(filepath.Join(archive, "*"))
+	assert.NoError(t, err)
+	assert.Empty(t, archived)
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+
+	// Without limits, later cleanups only stat the backups that may still be empty
+	fsys.statSeen = nil
+	assert.NoError(t, logger.WriteLine([]byte("line\n")))
+	assert.NoError(t, logger.Rotate())
+	assert.Contains(t, fsys.statSeen, recentEmpty)
+	assert.NotContains(t, fsys.statSeen, oldBackup)
+	assert.NoError(t, logger.Close())
+
+	// Empty backups don't count towards the max backups, and are removed once old enough
+	mtime := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(recentEmpty, mtime, mtime))
+	logger, err = New(logPath, WithMaxBackups(2), WithFileLocking())
+	assert.NoError(t, err)
+	assert.NoFileExists(t, recentEmpty)
+	assert.FileExists(t, oldBackup)
+	assert.FileExists(t, recentTemp)
+	assert.NoError(t, logger.Close())
+	assert.Equal(t, "orphaned temporary file", RemovalOrphanedTemp.String())
+}
+
+// TestForeignFiles verifies that files next to the log file not named like backups, e.g. the
+// position file of a log shipper, are neither listed, counted nor removed as backups.
+func TestForeignFiles(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	for i := range 10 {
+		name := logPath + "." + start.Add(time.Duration(i)*time.Hour).Format(backupTimeFormat)
+		if i%2 == 0 {
+			name += ".gz"
 		}
+		assert.NoError(t, os.WriteFile(name, []byte("backup\n"), 0644))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	var foreign []string
+	for _, suffix := range []string{".pos", ".1", ".20240101-000000.bak", ".20240101-000000.gz.old", ".pos.tmp", ".swp.tmp"} {
+		path := logPath + suffix
+		assert.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), 1000), 0644))
+		assert.NoError(t, os.Chtimes(path, old, old))
+		foreign = append(foreign, path)
+	}
+
+	// Only backups count towards the byte budget
+	logger, err := New(logPath, WithMaxBackups(3), WithMaxTotalBytes(int64(len("backup\n")*3)))
+	assert.NoError(t, err)
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 3) {
+		assert.Equal(t, logPath+"."+start.Add(7*time.Hour).Format(backupTimeFormat), backups[0].Path)
+	}
+	assert.Equal(t, 3, logger.Stats().BackupCount)
+	_, err = logger.Write([]byte("line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
+
+	for _, path := range foreign {
+		assert.FileExists(t, path)
+	}
+	backups, err = OpenBackups(logPath)
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 3) {
+		assert.Equal(t, logPath+"."+start.Add(8*time.Hour).Format(backupTimeFormat)+".gz", backups[0].Path)
+	}
+}
+
+// TestPreserveBackupTimes verifies that backups get the modification time of the rotated log file,
+// also when compressed or written with a footer, while their names keep the rotation time.
+func TestPreserveBackupTimes(t *testing.T) {
+	tests := map[string][]Option{
+		"copy":   nil,
+		"rename": {WithRenameRotation()},
+		"gzip":   {WithCompression()},
+		"footer": {WithFooter(func(FileStats) []byte { return []byte("end\n") })},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "times.log")
+			logger, err := New(logPath, append(options, WithPreserveBackupTimes())...)
+			assert.NoError(t, err)
+			_, err = logger.Write([]byte("line\n"))
+			assert.NoError(t, err)
+			written := time.Now().Add(-time.Hour).Truncate(time.Second)
+			assert.NoError(t, os.Chtimes(logPath, written, written))
+			assert.NoError(t, logger.Rotate())
+			assert.NoError(t, logger.Close())
+
+			backups, err := logger.ListBackups()
+			assert.NoError(t, err)
+			if assert.Len(t, backups, 1) {
+				info, err := os.Stat(backups[0].Path)
+				assert.NoError(t, err)
+				assert.True(t, written.Equal(info.ModTime()), "backup modified at %s, expected %s", info.ModTime(), written)
+				assert.WithinDuration(t, time.Now(), backups[0].Timestamp, time.Minute)
+			}
+		})
+	}
+
+	// By default, backups are modified at the rotation
+	logPath := filepath.Join(t.TempDir(), "default.log")
+	logger, err := New(logPath)
+	assert.NoError(t, err)
+	_, err = logger.Write([]byte("line\n"))
+	assert.NoError(t, err)
+	written := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(logPath, written, written))
+	assert.NoError(t, logger.Rotate())
+	assert.NoError(t, logger.Close())
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		info, err := os.Stat(backups[0].Path)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
 	}
 }
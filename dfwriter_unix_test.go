@@ -0,0 +1,337 @@
+//go:build unix
+
+package dfwriter
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCompressedBackupPreservesModeAndOwner verifies that compressed backups keep the permissions
+// and, when running as root, the ownership of the log file.
+func TestCompressedBackupPreservesModeAndOwner(t *testing.T) {
+	for _, compression := range []CompressionFormat{CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "private.log")
+			assert.NoError(t, os.WriteFile(logPath, nil, 0600))
+			root := os.Geteuid() == 0
+			if root {
+				assert.NoError(t, os.Chown(logPath, 1234, 5678))
+			}
+
+			logger, err := New(logPath, WithCompressionFormat(compression))
+			assert.NoError(t, err)
+			_, err = logger.Write([]byte("secret\n"))
+			assert.NoError(t, err)
+			assert.NoError(t, logger.Rotate())
+			assert.NoError(t, logger.Close())
+
+			files, err := filepath.Glob(logPath + ".*" + compression.extension())
+			assert.NoError(t, err)
+			if !assert.Len(t, files, 1) {
+				return
+			}
+			info, err := os.Stat(files[0])
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			if root {
+				stat := info.Sys().(*syscall.Stat_t)
+				assert.Equal(t, uint32(1234), stat.Uid)
+				assert.Equal(t, uint32(5678), stat.Gid)
+			}
+		})
+	}
+}
+
+// TestDiskFullPolicy verifies that the oldest backups are deleted to free space when the disk is full,
+// keeping the minimum number of backups and giving up after the maximum number of retries.
+func TestDiskFullPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		minBackups int
+		wantPruned int
+		wantErr    string
+	}{
+		{name: "freed", maxRetries: 5, minBackups: 1, wantPruned: 3},
+		{name: "min backups", maxRetries: 5, minBackups: 3, wantPruned: 2, wantErr: "no backups left"},
+		{name: "max retries", maxRetries: 1, minBackups: 0, wantPruned: 1, wantErr: "disk still full"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			logPath := filepath.Join(tmpDir, "full.log")
+			var pruned []string
+			fsys := &faultFS{}
+			logger, err := New(logPath,
+				withFS(fsys),
+				WithDiskFullPolicy(tt.maxRetries, tt.minBackups, func(path string, err error) {
+					assert.ErrorIs(t, err, syscall.ENOSPC)
+					pruned = append(pruned, path)
+				}),
+				WithOnBackupRemoved(func(path string, reason RemovalReason) {
+					assert.Equal(t, RemovalDiskFull, reason)
+				}),
+			)
+			assert.NoError(t, err)
+			defer logger.Close()
+
+			for range 5 {
+				assert.NoError(t, logger.WriteLine([]byte("line\n")))
+				assert.NoError(t, logger.Rotate())
+			}
+			backups, err := logger.backups()
+			assert.NoError(t, err)
+
+			// The disk is full as long as more than two backups exist
+			fsys.write = func(f fsFile, b []byte) (int, error) {
+				if current, _ := logger.backups(); len(current) > 2 {
+					return 0, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+				}
+				return f.Write(b)
+			}
+			err = logger.WriteLine([]byte("line\n"))
+			if tt.wantErr != "" {
+				assert.ErrorIs(t, err, syscall.ENOSPC)
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// The oldest backups are pruned first
+			var wantPruned []string
+			for _, backup := range backups[:tt.wantPruned] {
+				wantPruned = append(wantPruned, backup.path)
+			}
+			assert.Equal(t, wantPruned, pruned)
+		})
+	}
+}
+
+// TestLockFile verifies that the lock is taken on the lock file rather than the log file, that the lock
+// file is created with restrictive permissions and survives cleanup, and that writers locking the log
+// file itself refuse to share it.
+func TestLockFile(t *testing.T) {
+	if !lockingSupported {
+		t.Skip("file locking not supported")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	lockPath := logPath + ".lock"
+	logger, err := New(logPath,
+		WithLockFile(""),
+		WithFileMode(0644),
+		WithMaxBytes(10),
+		WithMaxBackups(1),
+		WithLockTimeout(100*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	defer logger.Close()
+
+	info, err := os.Stat(lockPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+
+	_, err = New(logPath, WithFileLocking())
+	assert.ErrorContains(t, err, "WithLockFile")
+
+	// A lock held on the log file doesn't block the writer, one held on the lock file does
+	other, err := os.Open(logPath)
+	assert.NoError(t, err)
+	defer other.Close()
+	assert.NoError(t, lockFile(other, true))
+	for range 3 {
+		assert.NoError(t, logger.WriteLine([]byte("rotated\n")))
+	}
+	assert.NoError(t, unlockFile(other))
+
+	lock, err := os.Open(lockPath)
+	assert.NoError(t, err)
+	defer lock.Close()
+	assert.NoError(t, lockFile(lock, true))
+	var lockErr *LockError
+	if assert.ErrorAs(t, logger.WriteLine([]byte("blocked\n")), &lockErr) {
+		assert.Equal(t, lockPath, lockErr.Path)
+		assert.ErrorIs(t, lockErr, ErrLockTimeout)
+	}
+	assert.NoError(t, unlockFile(lock))
+
+	// Cleanup kept a single backup and neither lists nor removes the lock file
+	backups, err := logger.ListBackups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	assert.Equal(t, int64(2), logger.Stats().Rotations)
+	assert.FileExists(t, lockPath)
+}
+
+// TestNotifyReopen verifies that the writer reopens the log file on SIGHUP until stopped.
+func TestNotifyReopen(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "hup.log")
+	logger, err := New(logPath)
+	assert.NoError(t, err)
+	defer logger.Close()
+	stop := logger.NotifyReopen(syscall.SIGHUP)
+
+	renamed := logPath + ".1"
+	assert.NoError(t, os.Rename(logPath, renamed))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(logPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = logger.Write([]byte("after\n"))
+	assert.NoError(t, err)
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "after\n", string(data))
+
+	// Once stopped, the signal isn't handled anymore
+	stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	assert.NoError(t, os.Rename(logPath, renamed))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	<-signals
+	assert.NoFileExists(t, logPath)
+}
+
+// TestLatestSymlink verifies that the latest backup link points to the newest complete backup after
+// each rotation and survives the cleanup of backups.
+func TestLatestSymlink(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "latest.log")
+	latest := logPath + ".latest"
+	logger, err := New(logPath, WithLatestSymlink(""), WithCompression(), WithMaxBackups(2))
+	assert.NoError(t, err)
+
+	for i := range 3 {
+		_, err := fmt.Fprintf(logger, "line %d\n", i)
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		// Wait for the compression
+		assert.Eventually(t, func() bool {
+			backups, err := OpenBackups(logPath)
+			if err != nil || len(backups) == 0 {
+				return false
+			}
+			resolved, err := filepath.EvalSymlinks(latest)
+			return err == nil && resolved == backups[len(backups)-1].Path && strings.HasSuffix(resolved, ".gz")
+		}, time.Second, 10*time.Millisecond)
+	}
+	assert.NoError(t, logger.Close())
+
+	target, err := os.Readlink(latest)
+	assert.NoError(t, err)
+	assert.False(t, filepath.IsAbs(target))
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+}
+
+// TestPostRotateCommand verifies that the post-rotate command is run once per backup with its path
+// as the last argument and in the environment, one at a time, and that failures and timeouts are
+// reported to the error handler.
+func TestPostRotateCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "hook.log")
+	invocations := filepath.Join(tmpDir, "invocations")
+	// Records its arguments and detects overlapping runs through a lock directory
+	script := filepath.Join(tmpDir, "record.sh")
+	assert.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+mkdir "$0.running" || echo overlap >> "`+invocations+`"
+echo "$1 $2 $DFWRITER_BACKUP" >> "`+invocations+`"
+sleep 0.05
+rmdir "$0.running"
+`), 0755))
+
+	var mu sync.Mutex
+	var errs []error
+	logger, err := New(logPath,
+		WithCompression(),
+		WithPostRotateCommand([]string{script, "rotated"}, 5*time.Second),
+		WithErrorHandler(func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		}),
+	)
+	assert.NoError(t, err)
+	for i := range 3 {
+		_, err := fmt.Fprintf(logger, "line %d\n", i)
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+	}
+	assert.NoError(t, logger.Close())
+
+	// Close waited for all commands
+	data, err := os.ReadFile(invocations)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	backups, err := OpenBackups(logPath)
+	assert.NoError(t, err)
+	if assert.Len(t, lines, 3) && assert.Len(t, backups, 3) {
+		var paths []string
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if assert.Len(t, fields, 3, line) {
+				assert.Equal(t, "rotated", fields[0])
+				assert.Equal(t, fields[1], fields[2])
+				paths = append(paths, fields[1])
+			}
+		}
+		for _, backup := range backups {
+			assert.Contains(t, paths, backup.Path)
+		}
+	}
+	mu.Lock()
+	assert.Empty(t, errs)
+	mu.Unlock()
+
+	t.Run("failure", func(t *testing.T) {
+		errs := make(chan error, 10)
+		logger, err := New(filepath.Join(t.TempDir(), "fail.log"),
+			WithPostRotateCommand([]string{"/bin/sh", "-c", "echo oops >&2; exit 3"}, 0),
+			WithErrorHandler(func(err error) { errs <- err }),
+		)
+		assert.NoError(t, err)
+		_, err = logger.WriteString("line\n")
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		assert.NoError(t, logger.Close())
+		close(errs)
+		err = <-errs
+		assert.ErrorContains(t, err, "exit status 3: oops")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		errs := make(chan error, 10)
+		logger, err := New(filepath.Join(t.TempDir(), "slow.log"),
+			WithPostRotateCommand([]string{"/bin/sh", "-c", "sleep 10"}, 50*time.Millisecond),
+			WithErrorHandler(func(err error) { errs <- err }),
+		)
+		assert.NoError(t, err)
+		_, err = logger.WriteString("line\n")
+		assert.NoError(t, err)
+		assert.NoError(t, logger.Rotate())
+		start := time.Now()
+		assert.NoError(t, logger.Close())
+		assert.Less(t, time.Since(start), 5*time.Second)
+		close(errs)
+		err = <-errs
+		assert.ErrorContains(t, err, "killed")
+	})
+
+	_, err = New(filepath.Join(t.TempDir(), "empty.log"), WithPostRotateCommand([]string{}, 0))
+	assert.ErrorContains(t, err, "post-rotate command")
+}
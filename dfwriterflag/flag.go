@@ -0,0 +1,80 @@
+// Package dfwriterflag binds command line flags configuring a dfwriter.DistributedFileWriter to a flag.FlagSet.
+package dfwriterflag
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/romosch/dfwriter"
+)
+
+// Builder creates writers configured by the flags registered with Bind.
+type Builder struct {
+	config dfwriter.Config
+}
+
+// Bind registers the flags -max-bytes, -max-backups, -max-age, -compress, -lock and -prefix on fs,
+// each preceded by prefix and a dash unless prefix is empty, e.g. -log-max-bytes for the prefix
+// "log". Sizes are parsed with dfwriter.ParseSize, e.g. "100MB", and ages with dfwriter.ParseAge,
+// e.g. "7d". -compress enables gzip compression, or the given format, e.g. -log-compress=zstd.
+// Use the returned Builder once fs is parsed.
+func Bind(fs *flag.FlagSet, prefix string) *Builder {
+	b := &Builder{}
+	name := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "-" + name
+	}
+
+	fs.TextVar(&b.config.MaxBytes, name("max-bytes"), dfwriter.Size(0), "rotate the log file once it exceeds this size, e.g. 100MB (0: never)")
+	fs.IntVar(&b.config.MaxBackups, name("max-backups"), 0, "number of log file backups to keep (0: all)")
+	fs.TextVar(&b.config.MaxAge, name("max-age"), dfwriter.Duration(0), "delete log file backups older than this age, e.g. 7d (0: never)")
+	fs.Var((*compressFlag)(&b.config.Compression), name("compress"), "compress log file backups with gzip, or the given format: gzip or zstd")
+	fs.BoolVar(&b.config.FileLocking, name("lock"), false, "lock the log file while writing, to share it with other processes")
+	fs.StringVar(&b.config.Prefix, name("prefix"), "", "prefix of every log line")
+	return b
+}
+
+// Config returns the configuration set by the flags.
+func (b *Builder) Config() dfwriter.Config {
+	return b.config
+}
+
+// New returns a writer for the log file at path configured by the flags, followed by options.
+func (b *Builder) New(path string, options ...dfwriter.Option) (*dfwriter.DistributedFileWriter, error) {
+	return b.config.New(path, options...)
+}
+
+// compressFlag is a boolean flag setting the compression format, which also accepts a format.
+type compressFlag dfwriter.CompressionFormat
+
+func (f *compressFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(*f)
+}
+
+func (f *compressFlag) Set(s string) error {
+	switch format := dfwriter.CompressionFormat(s); format {
+	case dfwriter.CompressionGzip, dfwriter.CompressionZstd:
+		*f = compressFlag(format)
+		return nil
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("expected a boolean, gzip or zstd")
+	}
+	*f = ""
+	if enabled {
+		*f = compressFlag(dfwriter.CompressionGzip)
+	}
+	return nil
+}
+
+// IsBoolFlag allows the flag without a value, enabling gzip compression.
+func (f *compressFlag) IsBoolFlag() bool {
+	return true
+}
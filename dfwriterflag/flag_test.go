@@ -0,0 +1,126 @@
+package dfwriterflag
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/romosch/dfwriter"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBind verifies that the flags configure the writer for various command lines.
+func TestBind(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		prefix string
+		args   []string
+		check  func(t *testing.T, c dfwriter.Config)
+	}{
+		{
+			name:   "defaults",
+			prefix: "log",
+			check: func(t *testing.T, c dfwriter.Config) {
+				assert.Equal(t, dfwriter.Size(0), c.MaxBytes)
+				assert.Equal(t, 0, c.MaxBackups)
+				assert.Equal(t, dfwriter.Duration(0), c.MaxAge)
+				assert.Equal(t, dfwriter.CompressionNone, c.Compression)
+				assert.False(t, c.FileLocking)
+				assert.Equal(t, "", c.Prefix)
+			},
+		},
+		{
+			name:   "all flags",
+			prefix: "log",
+			args: []string{"-log-max-bytes=100MB", "-log-max-backups", "3", "-log-max-age=7d",
+				"-log-compress", "-log-lock", "-log-prefix=[api] "},
+			check: func(t *testing.T, c dfwriter.Config) {
+				assert.Equal(t, dfwriter.Size(100<<20), c.MaxBytes)
+				assert.Equal(t, 3, c.MaxBackups)
+				assert.Equal(t, dfwriter.Duration(7*24*time.Hour), c.MaxAge)
+				assert.Equal(t, dfwriter.CompressionGzip, c.Compression)
+				assert.True(t, c.FileLocking)
+				assert.Equal(t, "[api] ", c.Prefix)
+			},
+		},
+		{
+			name:   "compression format",
+			prefix: "log",
+			args:   []string{"-log-compress=zstd", "-log-max-bytes", "1.5KiB", "-log-max-age=36h"},
+			check: func(t *testing.T, c dfwriter.Config) {
+				assert.Equal(t, dfwriter.CompressionZstd, c.Compression)
+				assert.Equal(t, dfwriter.Size(1536), c.MaxBytes)
+				assert.Equal(t, dfwriter.Duration(36*time.Hour), c.MaxAge)
+			},
+		},
+		{
+			name:   "compression disabled",
+			prefix: "log",
+			args:   []string{"-log-compress", "-log-compress=false"},
+			check: func(t *testing.T, c dfwriter.Config) {
+				assert.Equal(t, dfwriter.CompressionNone, c.Compression)
+			},
+		},
+		{
+			name: "no prefix",
+			args: []string{"-max-bytes=1M", "-lock=true"},
+			check: func(t *testing.T, c dfwriter.Config) {
+				assert.Equal(t, dfwriter.Size(1<<20), c.MaxBytes)
+				assert.True(t, c.FileLocking)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			b := Bind(fs, tt.prefix)
+			assert.NoError(t, fs.Parse(tt.args))
+
+			w, err := b.New(filepath.Join(t.TempDir(), "app.log"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer w.Close()
+			tt.check(t, w.Config())
+		})
+	}
+}
+
+// TestBindInvalid verifies that invalid values are rejected by Parse.
+func TestBindInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-log-max-bytes=10XB"},
+		{"-log-max-bytes=-1MB"},
+		{"-log-max-age=7"},
+		{"-log-max-age=-7d"},
+		{"-log-max-backups=many"},
+		{"-log-compress=lz4"},
+		{"-max-bytes=1MB"},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		Bind(fs, "log")
+		assert.Error(t, fs.Parse(args), "%q", args)
+	}
+}
+
+// TestBuilderWrites verifies that the writer created by the builder writes with the configured
+// prefix and rotates at the configured size.
+func TestBuilderWrites(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b := Bind(fs, "log")
+	assert.NoError(t, fs.Parse([]string{"-log-max-bytes=8", "-log-prefix=p "}))
+
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	w, err := b.New(logPath, dfwriter.WithMaxBackups(dfwriter.NoBackups))
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("aaa\nbbb\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "p bbb\n", string(data))
+}
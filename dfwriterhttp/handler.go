@@ -0,0 +1,61 @@
+// Package dfwriterhttp provides an HTTP handler serving the last lines written by a dfwriter.DistributedFileWriter for debugging.
+package dfwriterhttp
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/romosch/dfwriter"
+)
+
+// TailHandler returns a handler serving the lines kept by the recent buffer of w, see
+// dfwriter.WithRecentBuffer, as text/plain, oldest first and as written, including their prefix
+// and delimiter. The query parameter n limits the response to the last n lines, and prefix to the
+// lines starting with the given string, matched against the lines as written. Responds with
+// 404 Not Found if w has no recent buffer.
+func TailHandler(w *dfwriter.DistributedFileWriter) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n := -1
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 0 {
+				http.Error(rw, "invalid n "+strconv.Quote(s)+", expected a non-negative number of lines", http.StatusBadRequest)
+				return
+			}
+		}
+		lines := w.RecentLines()
+		if lines == nil {
+			http.Error(rw, "no recent buffer, see dfwriter.WithRecentBuffer", http.StatusNotFound)
+			return
+		}
+		if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+			matching := lines[:0]
+			for _, line := range lines {
+				if bytes.HasPrefix(line, []byte(prefix)) {
+					matching = append(matching, line)
+				}
+			}
+			lines = matching
+		}
+		if n >= 0 && n < len(lines) {
+			lines = lines[len(lines)-n:]
+		}
+
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			return
+		}
+		for _, line := range lines {
+			if _, err := rw.Write(line); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package dfwriterhttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romosch/dfwriter"
+	"github.com/stretchr/testify/assert"
+)
+
+// get requests target from h and returns the status code and body of the response.
+func get(t *testing.T, h http.Handler, target string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	body, err := io.ReadAll(rec.Result().Body)
+	assert.NoError(t, err)
+	return rec.Code, string(body)
+}
+
+// TestTailHandler verifies that the last lines are served after the ring wrapped around, filtered
+// by the n and prefix query parameters.
+func TestTailHandler(t *testing.T) {
+	w, err := dfwriter.New(filepath.Join(t.TempDir(), "tail.log"), dfwriter.WithRecentBuffer(4), dfwriter.WithMaxBytes(64))
+	assert.NoError(t, err)
+	defer w.Close()
+	h := TailHandler(w)
+
+	code, body := get(t, h, "/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, body)
+
+	for i := range 10 {
+		level := "INFO"
+		if i%3 == 0 {
+			level = "WARN"
+		}
+		_, err := fmt.Fprintf(w, "%s line %d\n", level, i)
+		assert.NoError(t, err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "WARN line 6\nINFO line 7\nINFO line 8\nWARN line 9\n", rec.Body.String())
+
+	for target, want := range map[string]string{
+		"/?n=2":                "INFO line 8\nWARN line 9\n",
+		"/?n=0":                "",
+		"/?n=100":              "WARN line 6\nINFO line 7\nINFO line 8\nWARN line 9\n",
+		"/?prefix=WARN":        "WARN line 6\nWARN line 9\n",
+		"/?prefix=INFO&n=1":    "INFO line 8\n",
+		"/?prefix=DEBUG":       "",
+		"/?prefix=WARN+line+9": "WARN line 9\n",
+		"/?prefix=&n=3":        "INFO line 7\nINFO line 8\nWARN line 9\n",
+	} {
+		code, body := get(t, h, target)
+		assert.Equal(t, http.StatusOK, code, target)
+		assert.Equal(t, want, body, target)
+	}
+
+	for _, target := range []string{"/?n=-1", "/?n=x"} {
+		code, _ := get(t, h, target)
+		assert.Equal(t, http.StatusBadRequest, code, target)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// Without a recent buffer
+	plain, err := dfwriter.New(filepath.Join(t.TempDir(), "plain.log"))
+	assert.NoError(t, err)
+	defer plain.Close()
+	code, _ = get(t, TailHandler(plain), "/")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// TestTailHandlerConcurrent verifies that requests served while lines are written concurrently
+// return whole lines in the order they were written.
+func TestTailHandlerConcurrent(t *testing.T) {
+	w, err := dfwriter.New(filepath.Join(t.TempDir(), "concurrent.log"), dfwriter.WithRecentBuffer(50), dfwriter.WithMaxBytes(4096))
+	assert.NoError(t, err)
+	defer w.Close()
+	srv := httptest.NewServer(TailHandler(w))
+	defer srv.Close()
+
+	const goroutines, lines = 4, 500
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				_, err := fmt.Fprintf(w, "goroutine %d line %04d %s\n", g, i, strings.Repeat("x", i%40))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	for range 50 {
+		resp, err := http.Get(srv.URL + "?n=20")
+		if !assert.NoError(t, err) {
+			break
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		served := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		assert.LessOrEqual(t, len(served), 20)
+		last := make(map[int]int)
+		for _, line := range served {
+			if line == "" {
+				continue
+			}
+			var g, i int
+			var rest string
+			n, _ := fmt.Sscanf(line, "goroutine %d line %d %s", &g, &i, &rest)
+			if assert.GreaterOrEqual(t, n, 2, line) {
+				assert.Equal(t, strings.Repeat("x", i%40), rest, line)
+				if prev, ok := last[g]; ok {
+					assert.Greater(t, i, prev, "lines of goroutine %d out of order", g)
+				}
+				last[g] = i
+			}
+		}
+	}
+	wg.Wait()
+
+	code, body := get(t, TailHandler(w), "/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 50, strings.Count(body, "\n"))
+}
@@ -0,0 +1,79 @@
+// Package dfwriterlogrus provides a logrus hook writing entries to dfwriter.DistributedFileWriter instances.
+package dfwriterlogrus
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/romosch/dfwriter"
+	"github.com/sirupsen/logrus"
+)
+
+// Hook is a logrus.Hook writing each entry, formatted with its formatter, to the writer of the
+// entry's level. Every entry is written as exactly one line with a single WriteLine call, so it is
+// never split by rotation or interleaved with lines from other processes. Newlines within the
+// formatted entry, e.g. of a multi-line message with a formatter not quoting it, are escaped as
+// `\n`. Usually, the logger's own output is discarded with SetOutput(io.Discard).
+type Hook struct {
+	formatter logrus.Formatter
+	writers   map[logrus.Level]*dfwriter.DistributedFileWriter
+	levels    []logrus.Level
+}
+
+// NewHook creates a Hook writing the entries of the given levels, or of all levels if none are
+// given, to w. If formatter is nil, entries are formatted with a logrus.TextFormatter.
+func NewHook(w *dfwriter.DistributedFileWriter, formatter logrus.Formatter, levels ...logrus.Level) *Hook {
+	if len(levels) == 0 {
+		levels = logrus.AllLevels
+	}
+	writers := make(map[logrus.Level]*dfwriter.DistributedFileWriter, len(levels))
+	for _, level := range levels {
+		writers[level] = w
+	}
+	return NewLevelHook(writers, formatter)
+}
+
+// NewLevelHook creates a Hook writing the entries of each level to the writer given for it, e.g.
+// errors to error.log and everything else to app.log. Entries of levels without a writer are
+// skipped. If formatter is nil, entries are formatted with a logrus.TextFormatter.
+func NewLevelHook(writers map[logrus.Level]*dfwriter.DistributedFileWriter, formatter logrus.Formatter) *Hook {
+	if formatter == nil {
+		formatter = &logrus.TextFormatter{}
+	}
+	h := &Hook{formatter: formatter, writers: make(map[logrus.Level]*dfwriter.DistributedFileWriter, len(writers))}
+	for level, w := range writers {
+		if w != nil {
+			h.writers[level] = w
+			h.levels = append(h.levels, level)
+		}
+	}
+	slices.Sort(h.levels)
+	return h
+}
+
+// Levels returns the levels with a writer.
+func (h *Hook) Levels() []logrus.Level {
+	return h.levels
+}
+
+// Fire formats entry and writes it as one line to the writer of its level.
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	w, ok := h.writers[entry.Level]
+	if !ok {
+		return nil
+	}
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return w.WriteLine(singleLine(line))
+}
+
+// singleLine returns line ending in a newline, with any newlines before escaped as `\n`.
+func singleLine(line []byte) []byte {
+	content, _ := bytes.CutSuffix(line, []byte("\n"))
+	if bytes.IndexByte(content, '\n') >= 0 {
+		content = bytes.ReplaceAll(content, []byte("\n"), []byte(`\n`))
+	}
+	return append(content, '\n')
+}
@@ -0,0 +1,160 @@
+package dfwriterlogrus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romosch/dfwriter"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLogger returns a logger writing only through hook.
+func newLogger(hook logrus.Hook) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(logrus.DebugLevel)
+	logger.AddHook(hook)
+	return logger
+}
+
+// readLines returns the lines of the log file at path, including those of its backups.
+func readLines(t *testing.T, w *dfwriter.DistributedFileWriter) []string {
+	backups, err := w.ListBackups()
+	assert.NoError(t, err)
+	var lines []string
+	for _, path := range append(pathsOf(backups), w.Name()) {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+	}
+	return lines
+}
+
+func pathsOf(backups []dfwriter.BackupInfo) []string {
+	var paths []string
+	for _, backup := range backups {
+		paths = append(paths, backup.Path)
+	}
+	return paths
+}
+
+// TestHookFormatters verifies that entries are written as one line each with the JSON and text
+// formatters, escaping newlines the formatter leaves in.
+func TestHookFormatters(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		w, err := dfwriter.New(filepath.Join(t.TempDir(), "json.log"))
+		assert.NoError(t, err)
+		logger := newLogger(NewHook(w, &logrus.JSONFormatter{DisableTimestamp: true}))
+		logger.WithField("id", "abc").Info("first line\nsecond line")
+		logger.Debug("debug")
+		assert.NoError(t, w.Close())
+
+		lines := readLines(t, w)
+		if assert.Len(t, lines, 2) {
+			var entry map[string]any
+			assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+			assert.Equal(t, map[string]any{"id": "abc", "level": "info", "msg": "first line\nsecond line"}, entry)
+			assert.Equal(t, `{"level":"debug","msg":"debug"}`, lines[1])
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		w, err := dfwriter.New(filepath.Join(t.TempDir(), "text.log"), dfwriter.WithPrefix([]byte("[app] ")))
+		assert.NoError(t, err)
+		logger := newLogger(NewHook(w, &logrus.TextFormatter{DisableTimestamp: true}))
+		logger.WithField("id", "abc").Warn("first line\nsecond line")
+		assert.NoError(t, w.Close())
+		assert.Equal(t, []string{`[app] level=warning msg="first line\nsecond line" id=abc`}, readLines(t, w))
+	})
+
+	t.Run("unquoted", func(t *testing.T) {
+		w, err := dfwriter.New(filepath.Join(t.TempDir(), "unquoted.log"))
+		assert.NoError(t, err)
+		logger := newLogger(NewHook(w, &logrus.TextFormatter{DisableTimestamp: true, DisableQuote: true}))
+		logger.Error("first line\nsecond line\n")
+		assert.NoError(t, w.Close())
+		assert.Equal(t, []string{`level=error msg=first line\nsecond line\n`}, readLines(t, w))
+	})
+}
+
+// TestHookLevels verifies that entries are only written for the hook's levels, to the writer of
+// their level.
+func TestHookLevels(t *testing.T) {
+	dir := t.TempDir()
+	app, err := dfwriter.New(filepath.Join(dir, "app.log"))
+	assert.NoError(t, err)
+	errs, err := dfwriter.New(filepath.Join(dir, "error.log"))
+	assert.NoError(t, err)
+
+	formatter := &logrus.TextFormatter{DisableTimestamp: true}
+	hook := NewLevelHook(map[logrus.Level]*dfwriter.DistributedFileWriter{
+		logrus.ErrorLevel: errs,
+		logrus.WarnLevel:  app,
+		logrus.InfoLevel:  app,
+	}, formatter)
+	assert.Equal(t, []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}, hook.Levels())
+	logger := newLogger(hook)
+	logger.Info("started")
+	logger.Error("failed")
+	logger.Debug("skipped")
+	logger.Warn("slow")
+
+	// A hook for some levels of a single writer
+	debug, err := dfwriter.New(filepath.Join(dir, "debug.log"))
+	assert.NoError(t, err)
+	logger.AddHook(NewHook(debug, formatter, logrus.DebugLevel))
+	logger.Debug("written")
+	logger.Info("not written")
+	assert.Len(t, NewHook(debug, nil).Levels(), len(logrus.AllLevels))
+
+	for _, w := range []*dfwriter.DistributedFileWriter{app, errs, debug} {
+		assert.NoError(t, w.Close())
+	}
+	assert.Equal(t, []string{"level=info msg=started", "level=warning msg=slow", "level=info msg=\"not written\""}, readLines(t, app))
+	assert.Equal(t, []string{"level=error msg=failed"}, readLines(t, errs))
+	assert.Equal(t, []string{"level=debug msg=written"}, readLines(t, debug))
+}
+
+// TestHookConcurrent verifies that entries fired concurrently from several goroutines are written
+// intact, one per line, across rotations.
+func TestHookConcurrent(t *testing.T) {
+	w, err := dfwriter.New(filepath.Join(t.TempDir(), "concurrent.log"), dfwriter.WithMaxBytes(4096), dfwriter.WithFileLocking())
+	assert.NoError(t, err)
+	logger := newLogger(NewHook(w, &logrus.JSONFormatter{}))
+
+	const goroutines, entries = 8, 200
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range entries {
+				logger.WithField("goroutine", g).Info(fmt.Sprintf("entry %d\n%s", i, bytes.Repeat([]byte("x"), i)))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, w.Close())
+
+	lines := readLines(t, w)
+	assert.Len(t, lines, goroutines*entries)
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		var entry struct {
+			Goroutine int    `json:"goroutine"`
+			Msg       string `json:"msg"`
+		}
+		if assert.NoError(t, json.Unmarshal([]byte(line), &entry), line) {
+			seen[fmt.Sprintf("%d %s", entry.Goroutine, entry.Msg)] = true
+		}
+	}
+	assert.Len(t, seen, goroutines*entries)
+}
@@ -0,0 +1,108 @@
+// Package dfwriterprom provides a Prometheus collector for the metrics of dfwriter.DistributedFileWriter instances.
+package dfwriterprom
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/romosch/dfwriter"
+)
+
+const namespace = "dfwriter"
+
+var (
+	bytesWrittenDesc = prometheus.NewDesc(namespace+"_bytes_written_total",
+		"Bytes written to the log file, including prefixes.", []string{"path"}, nil)
+	linesWrittenDesc = prometheus.NewDesc(namespace+"_lines_written_total",
+		"Lines written to the log file.", []string{"path"}, nil)
+	rotationsDesc = prometheus.NewDesc(namespace+"_rotations_total",
+		"Rotations of the log file performed by the writer.", []string{"path"}, nil)
+	backupsDesc = prometheus.NewDesc(namespace+"_backups",
+		"Backups of the log file as of the last cleanup.", []string{"path"}, nil)
+)
+
+// Collector is a prometheus.Collector reporting the metrics of any number of writers, labeled by
+// the path of their log file. It is safe to register a Collector and add writers to it in any order.
+type Collector struct {
+	rotationDuration *prometheus.HistogramVec
+	lockWait         *prometheus.HistogramVec
+
+	mu      sync.Mutex
+	writers []*dfwriter.DistributedFileWriter
+}
+
+// NewCollector creates a Collector without writers.
+func NewCollector() *Collector {
+	return &Collector{
+		rotationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rotation_duration_seconds",
+			Help:      "Time taken by rotations of the log file performed by the writer.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"path"}),
+		lockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "lock_wait_seconds",
+			Help:      "Time spent waiting for file locks on the log file.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"path"}),
+	}
+}
+
+// Add adds w to the writers reported by the collector. Rotations and lock waits are recorded
+// from then on, the counters report the totals since w was created.
+func (c *Collector) Add(w *dfwriter.DistributedFileWriter) {
+	path := w.Name()
+	o := observer{
+		rotationDuration: c.rotationDuration.WithLabelValues(path),
+		lockWait:         c.lockWait.WithLabelValues(path),
+	}
+	w.AddStatsObserver(o)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writers = append(c.writers, w)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bytesWrittenDesc
+	ch <- linesWrittenDesc
+	ch <- rotationsDesc
+	ch <- backupsDesc
+	c.rotationDuration.Describe(ch)
+	c.lockWait.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	writers := c.writers
+	c.mu.Unlock()
+
+	for _, w := range writers {
+		stats := w.Stats()
+		path := w.Name()
+		ch <- prometheus.MustNewConstMetric(bytesWrittenDesc, prometheus.CounterValue, float64(stats.BytesWritten), path)
+		ch <- prometheus.MustNewConstMetric(linesWrittenDesc, prometheus.CounterValue, float64(stats.LinesWritten), path)
+		ch <- prometheus.MustNewConstMetric(rotationsDesc, prometheus.CounterValue, float64(stats.Rotations), path)
+		ch <- prometheus.MustNewConstMetric(backupsDesc, prometheus.GaugeValue, float64(stats.BackupCount), path)
+	}
+	c.rotationDuration.Collect(ch)
+	c.lockWait.Collect(ch)
+}
+
+// observer records the rotations and lock waits of a writer in the histograms of a Collector.
+type observer struct {
+	rotationDuration prometheus.Observer
+	lockWait         prometheus.Observer
+}
+
+func (o observer) ObserveRotation(duration time.Duration) {
+	o.rotationDuration.Observe(duration.Seconds())
+}
+
+func (o observer) ObserveLockWait(duration time.Duration) {
+	o.lockWait.Observe(duration.Seconds())
+}
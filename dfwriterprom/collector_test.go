@@ -0,0 +1,89 @@
+package dfwriterprom
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/romosch/dfwriter"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCollector verifies the metrics reported for two writers after a scripted workload, with the
+// collector registered before anything was written.
+func TestCollector(t *testing.T) {
+	tmpDir := t.TempDir()
+	pathA := filepath.Join(tmpDir, "a.log")
+	pathB := filepath.Join(tmpDir, "b.log")
+	a, err := dfwriter.New(pathA, dfwriter.WithMaxBytes(35), dfwriter.WithFileLocking())
+	assert.NoError(t, err)
+	defer a.Close()
+	b, err := dfwriter.New(pathB)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	collector := NewCollector()
+	registry := prometheus.NewPedanticRegistry()
+	assert.NoError(t, registry.Register(collector))
+	collector.Add(a)
+	collector.Add(b)
+
+	// Every fourth line on a triggers a rotation
+	for range 10 {
+		_, err := a.Write([]byte("123456789\n"))
+		assert.NoError(t, err)
+	}
+	_, err = b.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+
+	expected := fmt.Sprintf(`
+# HELP dfwriter_backups Backups of the log file as of the last cleanup.
+# TYPE dfwriter_backups gauge
+dfwriter_backups{path=%[1]q} 3
+dfwriter_backups{path=%[2]q} 0
+# HELP dfwriter_bytes_written_total Bytes written to the log file, including prefixes.
+# TYPE dfwriter_bytes_written_total counter
+dfwriter_bytes_written_total{path=%[1]q} 100
+dfwriter_bytes_written_total{path=%[2]q} 6
+# HELP dfwriter_lines_written_total Lines written to the log file.
+# TYPE dfwriter_lines_written_total counter
+dfwriter_lines_written_total{path=%[1]q} 10
+dfwriter_lines_written_total{path=%[2]q} 1
+# HELP dfwriter_rotations_total Rotations of the log file performed by the writer.
+# TYPE dfwriter_rotations_total counter
+dfwriter_rotations_total{path=%[1]q} 3
+dfwriter_rotations_total{path=%[2]q} 0
+`, pathA, pathB)
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"dfwriter_backups", "dfwriter_bytes_written_total", "dfwriter_lines_written_total", "dfwriter_rotations_total"))
+
+	// The durations vary, so only the number of observations is compared
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	counts := map[string]uint64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if histogram := metric.GetHistogram(); histogram != nil {
+				counts[family.GetName()+" "+metric.GetLabel()[0].GetValue()] = histogram.GetSampleCount()
+			}
+		}
+	}
+	assert.Equal(t, map[string]uint64{
+		"dfwriter_rotation_duration_seconds " + pathA: 3,
+		"dfwriter_rotation_duration_seconds " + pathB: 0,
+		"dfwriter_lock_wait_seconds " + pathA:         10,
+		"dfwriter_lock_wait_seconds " + pathB:         0,
+	}, counts)
+}
+
+// TestCollectorWithoutWriters verifies that an empty collector can be registered and scraped.
+func TestCollectorWithoutWriters(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	assert.NoError(t, registry.Register(NewCollector()))
+	assert.Equal(t, 0, testutil.CollectAndCount(NewCollector()))
+	_, err := registry.Gather()
+	assert.NoError(t, err)
+}
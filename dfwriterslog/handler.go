@@ -0,0 +1,28 @@
+// Package dfwriterslog provides a log/slog handler writing JSON lines to a dfwriter.DistributedFileWriter.
+package dfwriterslog
+
+import (
+	"log/slog"
+
+	"github.com/romosch/dfwriter"
+)
+
+// NewHandler creates a slog.Handler that formats records as JSON lines and writes each record
+// to w with exactly one WriteLine call, so a record is never split by rotation or interleaved
+// with lines from other processes. If opts is nil, the default options are used.
+func NewHandler(w *dfwriter.DistributedFileWriter, opts *slog.HandlerOptions) slog.Handler {
+	return slog.NewJSONHandler(lineWriter{w: w}, opts)
+}
+
+// lineWriter adapts WriteLine to io.Writer. slog.JSONHandler emits each record,
+// including its trailing newline, in a single Write call.
+type lineWriter struct {
+	w *dfwriter.DistributedFileWriter
+}
+
+func (l lineWriter) Write(p []byte) (int, error) {
+	if err := l.w.WriteLine(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
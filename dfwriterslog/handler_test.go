@@ -0,0 +1,81 @@
+package dfwriterslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/romosch/dfwriter"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHandlerWritesJSONLines verifies that each record is written as one JSON line including
+// levels, attributes and groups.
+func TestHandlerWritesJSONLines(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "slog.log")
+	w, err := dfwriter.New(logPath)
+	assert.NoError(t, err)
+
+	logger := slog.New(NewHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	logger.Debug("debug message", "count", 1)
+	logger.With("service", "api").WithGroup("request").Warn("warn message", "id", "abc")
+	assert.NoError(t, w.Close())
+
+	contents, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSuffix(contents, []byte("\n")), []byte("\n"))
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+
+	var first map[string]any
+	assert.NoError(t, json.Unmarshal(lines[0], &first))
+	assert.Equal(t, "DEBUG", first["level"])
+	assert.Equal(t, "debug message", first["msg"])
+	assert.Equal(t, float64(1), first["count"])
+
+	var second map[string]any
+	assert.NoError(t, json.Unmarshal(lines[1], &second))
+	assert.Equal(t, "WARN", second["level"])
+	assert.Equal(t, "api", second["service"])
+	assert.Equal(t, map[string]any{"id": "abc"}, second["request"])
+}
+
+// TestHandlerRotationKeepsRecordsWhole verifies that rotation while logging never splits a record
+// across files.
+func TestHandlerRotationKeepsRecordsWhole(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "slog.log")
+	w, err := dfwriter.New(logPath,
+		dfwriter.WithMaxBytes(512),
+		dfwriter.WithMaxBackups(1000),
+	)
+	assert.NoError(t, err)
+
+	const records = 100
+	logger := slog.New(NewHandler(w, nil))
+	for i := range records {
+		logger.Info("record", "i", i, "payload", "some payload to fill up the file")
+	}
+	assert.NoError(t, w.Close())
+
+	files, err := filepath.Glob(logPath + "*")
+	assert.NoError(t, err)
+	assert.Greater(t, len(files), 1)
+
+	total := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		assert.NoError(t, err)
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			assert.True(t, json.Valid(line), "split record %q in %s", line, f)
+			total++
+		}
+	}
+	assert.Equal(t, records, total)
+}
@@ -0,0 +1,114 @@
+// Package dfwritertest provides helpers for testing code using a dfwriter.DistributedFileWriter,
+// such as a fake clock to test rotation and retention policies without waiting.
+package dfwritertest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/romosch/dfwriter"
+)
+
+// Clock is a fake dfwriter.Clock whose time only changes with Advance, to be set with
+// dfwriter.WithClock. Clock is safe for concurrent use by multiple goroutines.
+type Clock struct {
+	mu      sync.Mutex
+	changed sync.Cond // signaled when tickers are created or stopped
+	now     time.Time
+	tickers map[*ticker]struct{}
+}
+
+// NewClock creates a fake clock starting at start.
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start, tickers: make(map[*ticker]struct{})}
+	c.changed.L = &c.mu
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker firing every d of the clock's time. It panics if d is not positive,
+// like time.NewTicker.
+func (c *Clock) NewTicker(d time.Duration) dfwriter.Ticker {
+	if d <= 0 {
+		panic("dfwritertest: non-positive interval for NewTicker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &ticker{clock: c, interval: d, next: c.now.Add(d), c: make(chan time.Time), stop: make(chan struct{})}
+	c.tickers[t] = struct{}{}
+	c.changed.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d and delivers a tick to each ticker that became due. Like
+// time.Ticker, a ticker due several times delivers a single tick. Advance returns once every tick
+// is received or its ticker stopped, so advancing the clock again waits until the goroutines
+// receiving the previous ticks are ready for the next ones, e.g. until a cleanup has completed.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*ticker
+	for t := range c.tickers {
+		if t.next.After(now) {
+			continue
+		}
+		due = append(due, t)
+		t.next = t.next.Add((now.Sub(t.next)/t.interval + 1) * t.interval)
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case t.c <- now:
+			case <-t.stop:
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BlockUntilTickers waits until at least n tickers are running, e.g. until the background
+// goroutines of a new writer are started, so a following Advance doesn't miss them.
+func (c *Clock) BlockUntilTickers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.tickers) < n {
+		c.changed.Wait()
+	}
+}
+
+// ticker is a dfwriter.Ticker of a Clock.
+type ticker struct {
+	clock    *Clock
+	interval time.Duration
+	next     time.Time // guarded by clock.mu
+	c        chan time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *ticker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *ticker) Stop() {
+	t.stopOnce.Do(func() {
+		t.clock.mu.Lock()
+		defer t.clock.mu.Unlock()
+		delete(t.clock.tickers, t)
+		close(t.stop)
+		t.clock.changed.Broadcast()
+	})
+}
@@ -0,0 +1,46 @@
+package dfwritertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestClock verifies that the time only changes with Advance, and that tickers deliver one tick
+// per Advance when due, until stopped.
+func TestClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := NewClock(start)
+	assert.Equal(t, start, c.Now())
+	c.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), c.Now())
+
+	ticker := c.NewTicker(time.Minute)
+	ticks := make(chan time.Time, 10)
+	go func() {
+		for range 3 {
+			ticks <- <-ticker.C()
+		}
+	}()
+	c.BlockUntilTickers(1)
+
+	// Not due yet
+	c.Advance(30 * time.Second)
+	assert.Len(t, ticks, 0)
+	c.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(time.Hour+time.Minute), <-ticks)
+
+	// Missed ticks are dropped, and the next tick keeps the period
+	c.Advance(150 * time.Second)
+	assert.Equal(t, start.Add(time.Hour+210*time.Second), <-ticks)
+	c.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(time.Hour+4*time.Minute), <-ticks)
+
+	// A stopped ticker doesn't block Advance
+	ticker.Stop()
+	c.Advance(time.Hour)
+	assert.Len(t, ticks, 0)
+
+	assert.Panics(t, func() { c.NewTicker(0) })
+}
@@ -0,0 +1,70 @@
+package dfwriter
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// retryOnDiskFull runs op and, if it fails because the disk is full and a disk full policy is set,
+// deletes the oldest backup and retries op, up to the configured number of retries.
+// The caller must hold w.mu.
+func (w *DistributedFileWriter) retryOnDiskFull(op func() error) error {
+	err := op()
+	if w.diskFullRetries <= 0 {
+		return err
+	}
+
+	for attempt := 0; isDiskFull(err); attempt++ {
+		if attempt == w.diskFullRetries {
+			return fmt.Errorf("disk still full after removing %d backups: %w", attempt, err)
+		}
+
+		path, pruneErr := w.pruneOldestBackup()
+		if pruneErr != nil {
+			return fmt.Errorf("failed to free disk space: %w; %w", err, pruneErr)
+		}
+		if path == "" {
+			return fmt.Errorf("disk full and no backups left to remove: %w", err)
+		}
+		if w.onDiskFullPrune != nil {
+			w.onDiskFullPrune(path, err)
+		}
+
+		err = op()
+	}
+
+	return err
+}
+
+// pruneOldestBackup deletes the oldest backup not vetoed by the removal filter, unless only the
+// minimum number of backups to keep is left. Returns the path of the deleted backup, or an empty path if none was deleted.
+func (w *DistributedFileWriter) pruneOldestBackup() (string, error) {
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+
+	backups, err := w.backups()
+	if err != nil && len(backups) == 0 {
+		return "", err
+	}
+
+	// Backups still being compressed are removed once compressed and don't count
+	var candidates []backupFile
+	for _, backup := range backups {
+		if !w.isCompressing(backup) {
+			candidates = append(candidates, backup)
+		}
+	}
+
+	// Vetoed backups are skipped in favor of the next oldest one
+	for _, backup := range candidates[:max(len(candidates)-w.diskFullMinBackups, 0)] {
+		gone, err := w.removeBackup(backup.path, RemovalDiskFull)
+		if err != nil {
+			return "", err
+		}
+		if gone {
+			return backup.path, w.syncDir(filepath.Dir(backup.path))
+		}
+	}
+
+	return "", nil
+}
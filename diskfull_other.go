@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+
+package dfwriter
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isDiskFull reports whether err was caused by a full disk.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,254 @@
+package dfwriter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptedExt is appended to the name of encrypted backups, after the compression extension.
+const encryptedExt = ".enc"
+
+// EncryptionKeySize is the size in bytes of the AES-256 key passed to WithEncryption.
+const EncryptionKeySize = 32
+
+// An encrypted backup starts with encryptedMagic and a random nonce prefix, followed by chunks of
+// at most encryptedChunkSize plaintext bytes, each sealed with AES-256-GCM and framed as the 4-byte
+// big-endian length of its ciphertext. The nonce of a chunk is the prefix, the chunk's 4-byte
+// big-endian counter and a byte flagging the last chunk, so reordered, dropped and truncated
+// chunks fail to open.
+var encryptedMagic = []byte("dfwenc1\n")
+
+const (
+	encryptedChunkSize = 64 << 10
+	noncePrefixSize    = 7
+)
+
+// backupExtensions lists the extensions a finished backup may carry, longest first.
+var backupExtensions = []string{
+	CompressionGzip.extension() + encryptedExt,
+	CompressionZstd.extension() + encryptedExt,
+	encryptedExt,
+	CompressionGzip.extension(),
+	CompressionZstd.extension(),
+}
+
+// isEncrypted reports whether path has the extension of an encrypted backup.
+func isEncrypted(path string) bool {
+	return strings.HasSuffix(path, encryptedExt)
+}
+
+// validateEncryptionKey checks that key is an AES-256 key.
+func validateEncryptionKey(key []byte) error {
+	if len(key) != EncryptionKeySize {
+		return fmt.Errorf("invalid encryption key size %d, must be %d bytes", len(key), EncryptionKeySize)
+	}
+	return nil
+}
+
+// newGCM returns the AES-256-GCM cipher for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if err := validateEncryptionKey(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with counter, see encryptedMagic.
+func chunkNonce(nonce, prefix []byte, counter uint32, last bool) []byte {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts everything written to it into out. Close seals the last chunk.
+type encryptWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+}
+
+// newEncryptWriter writes the header of an encrypted backup to out and returns a writer encrypting
+// into out with key.
+func newEncryptWriter(out io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptedMagic)+noncePrefixSize)
+	copy(header, encryptedMagic)
+	if _, err := rand.Read(header[len(encryptedMagic):]); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		out:    out,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+// Write buffers p, sealing every full chunk once more data follows it.
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == encryptedChunkSize {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		m := min(len(p), encryptedChunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:m]...)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// Close seals the buffered data as the last chunk. It doesn't close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts the buffered data as the next chunk and writes it.
+func (e *encryptWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("encrypted backup exceeds the maximum number of chunks")
+	}
+	nonce := chunkNonce(e.nonce, e.prefix, e.counter, last)
+	e.sealed = e.aead.Seal(append(e.sealed[:0], 0, 0, 0, 0), nonce, e.buf, nil)
+	binary.BigEndian.PutUint32(e.sealed, uint32(len(e.sealed)-4))
+	if _, err := e.out.Write(e.sealed); err != nil {
+		return err
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptReader decrypts an encrypted backup read from in.
+type decryptReader struct {
+	in      io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	nonce   []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	last    bool
+	err     error
+}
+
+// newDecryptReader reads the header of an encrypted backup from in and returns a reader decrypting
+// the rest of in with key.
+func newDecryptReader(in io.Reader, key []byte) (*decryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptedMagic)+noncePrefixSize)
+	if _, err := io.ReadFull(in, header); err != nil || !bytes.Equal(header[:len(encryptedMagic)], encryptedMagic) {
+		return nil, fmt.Errorf("%w: not an encrypted backup", ErrDecryptionFailed)
+	}
+	return &decryptReader{
+		in:     in,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		nonce:  make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+// Read returns decrypted data, opening the next chunk once the previous one is consumed.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.last {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.in, length[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated", ErrDecryptionFailed)
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size < uint32(d.aead.Overhead()) || size > uint32(encryptedChunkSize+d.aead.Overhead()) {
+		return fmt.Errorf("%w: invalid chunk size %d", ErrDecryptionFailed, size)
+	}
+	d.sealed = append(d.sealed[:0], make([]byte, size)...)
+	if _, err := io.ReadFull(d.in, d.sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated", ErrDecryptionFailed)
+		}
+		return err
+	}
+
+	// Whether the chunk is the last one is only known by the nonce it opens with
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.nonce, d.prefix, d.counter, false), d.sealed, nil)
+	if err != nil {
+		plain, err = d.aead.Open(d.plain[:0], chunkNonce(d.nonce, d.prefix, d.counter, true), d.sealed, nil)
+		if err != nil {
+			return ErrDecryptionFailed
+		}
+		d.last = true
+		if n, _ := d.in.Read(length[:1]); n > 0 {
+			return fmt.Errorf("%w: data after the last chunk", ErrDecryptionFailed)
+		}
+	}
+	d.counter++
+	d.plain = plain
+	return nil
+}
+
+// DecryptBackup writes the decrypted contents of the encrypted backup at path to dst, see
+// WithEncryption. Backups compressed before encryption remain compressed. Fails with an error
+// matching ErrDecryptionFailed if key is wrong or the backup was modified or truncated, in which
+// case dst may have received part of the contents.
+func DecryptBackup(path string, key []byte, dst io.Writer) error {
+	f, err := osFS{}.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newDecryptReader(f, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
@@ -0,0 +1,86 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLineTooLong is returned when a line, including its prefix, exceeds the maximum file size.
+	// The returned error is a *LineTooLongError carrying the offending sizes.
+	ErrLineTooLong = errors.New("line exceeds max size")
+
+	// ErrClosed is returned when writing to or syncing a writer that has been closed.
+	ErrClosed = errors.New("writer is closed")
+
+	// ErrLockTimeout is returned when a file lock could not be acquired in time.
+	ErrLockTimeout = errors.New("timed out acquiring file lock")
+
+	// ErrLocked is returned by New with WithExclusiveOwnership when another writer holds the file lock.
+	ErrLocked = errors.New("file lock is held by another writer")
+
+	// ErrBackupVerification is returned when a backup read back with WithVerifyRotation doesn't match
+	// the log file it was copied from.
+	ErrBackupVerification = errors.New("backup verification failed")
+
+	// ErrDecryptionFailed is returned when reading an encrypted backup with the wrong key, or one that
+	// was modified or truncated.
+	ErrDecryptionFailed = errors.New("failed to decrypt backup")
+)
+
+// LineTooLongError is returned when a line exceeds the maximum size. It matches ErrLineTooLong.
+type LineTooLongError struct {
+	// Length is the size of the rejected line in bytes, including the prefix.
+	Length int
+	// Max is the maximum size in bytes.
+	Max int64
+}
+
+func (e *LineTooLongError) Error() string {
+	return fmt.Sprintf("line of %d bytes exceeds max size of %d bytes", e.Length, e.Max)
+}
+
+// Is reports whether target is ErrLineTooLong.
+func (e *LineTooLongError) Is(target error) bool {
+	return target == ErrLineTooLong
+}
+
+// LockError is returned when a file lock could not be acquired.
+type LockError struct {
+	// Path is the path of the locked file.
+	Path string
+	// Exclusive is true if an exclusive lock was requested, false for a shared lock.
+	Exclusive bool
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *LockError) Error() string {
+	mode := "shared"
+	if e.Exclusive {
+		mode = "exclusive"
+	}
+	return fmt.Sprintf("failed to acquire %s lock on %s: %v", mode, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned for an invalid setting of a Config.
+type ConfigError struct {
+	// Field is the name of the offending field in JSON.
+	Field string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config field %s: %v", e.Field, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,83 @@
+package dfwriter
+
+import "sync"
+
+// Event is a notification delivered by Events: Rotated, BackupRemoved, Reopened or ErrorOccurred.
+type Event interface {
+	event()
+}
+
+// Rotated is delivered once the backup of a rotation is complete, including its compression.
+type Rotated struct {
+	BackupPath string // path of the backup, including the compression extension
+	Size       int64  // size of the backup, 0 if it was removed before the event
+}
+
+// BackupRemoved is delivered after this writer removed or archived a backup.
+type BackupRemoved struct {
+	Path   string
+	Reason RemovalReason
+}
+
+// Reopened is delivered after the log file was reopened, by Reopen or after it was renamed or
+// removed by another process.
+type Reopened struct{}
+
+// ErrorOccurred is delivered for each error reported to the error handler, see WithErrorHandler.
+type ErrorOccurred struct {
+	Err error
+}
+
+func (Rotated) event()       {}
+func (BackupRemoved) event() {}
+func (Reopened) event()      {}
+func (ErrorOccurred) event() {}
+
+// eventQueue is the buffered channel returned by Events.
+type eventQueue struct {
+	ch     chan Event
+	mu     sync.Mutex // guards closed and sending to ch
+	closed bool
+}
+
+// Events returns the channel the events of the writer are delivered on, see WithEventBuffer. It is
+// closed by Close once the final events were sent. Without WithEventBuffer, Events returns nil,
+// which never delivers an event.
+func (w *DistributedFileWriter) Events() <-chan Event {
+	if w.events == nil {
+		return nil
+	}
+	return w.events.ch
+}
+
+// emit sends e to the event channel without blocking. If the buffer is full, e is dropped and
+// counted in Stats instead.
+func (w *DistributedFileWriter) emit(e Event) {
+	if w.events == nil {
+		return
+	}
+	w.events.mu.Lock()
+	defer w.events.mu.Unlock()
+	if w.events.closed {
+		return
+	}
+	select {
+	case w.events.ch <- e:
+	default:
+		w.stats.eventsDropped.Add(1)
+	}
+}
+
+// closeEvents closes the event channel. Events emitted afterwards are discarded. closeEvents is
+// idempotent.
+func (w *DistributedFileWriter) closeEvents() {
+	if w.events == nil {
+		return
+	}
+	w.events.mu.Lock()
+	defer w.events.mu.Unlock()
+	if !w.events.closed {
+		w.events.closed = true
+		close(w.events.ch)
+	}
+}
@@ -0,0 +1,9 @@
+package dfwriter
+
+import "golang.org/x/sys/unix"
+
+// fadviseDontNeed advises the kernel to drop the cached pages of f, which must be synced so they
+// aren't dirty.
+func fadviseDontNeed(f fsFile) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
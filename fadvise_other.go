@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dfwriter
+
+import "errors"
+
+// fadviseDontNeed fails with errors.ErrUnsupported, as dropping cached pages is only supported on
+// Linux.
+func fadviseDontNeed(f fsFile) error {
+	return errors.ErrUnsupported
+}
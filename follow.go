@@ -0,0 +1,465 @@
+package dfwriter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FollowOption configures a Follower created with Follow.
+type FollowOption func(*Follower)
+
+// FollowPollInterval returns an option to set how often a Follower checks for new data once it
+// has read everything (default: 200ms).
+func FollowPollInterval(interval time.Duration) FollowOption {
+	return func(f *Follower) {
+		f.pollInterval = interval
+	}
+}
+
+// FollowOffsetFile returns an option to persist the position of a Follower to the file at path
+// after every read, and to resume from the persisted position when following again.
+func FollowOffsetFile(path string) FollowOption {
+	return func(f *Follower) {
+		f.offsetFile = path
+	}
+}
+
+// FollowBackupDir returns an option to read backups stored in dir, see WithBackupDir.
+func FollowBackupDir(dir string) FollowOption {
+	return func(f *Follower) {
+		f.backupDir = dir
+	}
+}
+
+// FollowDecryptionKey returns an option to decrypt backups encrypted with key, see WithEncryption.
+// Without it, reading an encrypted backup fails.
+func FollowDecryptionKey(key []byte) FollowOption {
+	return func(f *Follower) {
+		f.key = key
+	}
+}
+
+// FollowLockMode returns an option to set the mechanism used for file locking, which must match the
+// lock mode of the writers, see WithLockMode.
+func FollowLockMode(mode LockMode) FollowOption {
+	return func(f *Follower) {
+		f.lockMode = mode
+	}
+}
+
+// FollowLockFile returns an option to lock the lock file at path instead of the log file, which must
+// match the lock file of the writers, see WithLockFile. An empty path selects the log path with ".lock"
+// appended, a relative path is relative to the log file's directory.
+func FollowLockFile(path string) FollowOption {
+	return func(f *Follower) {
+		f.useLockFile = true
+		f.lockPath = path
+	}
+}
+
+// Follower continuously reads a log file as it is written, like tail -F, following it across
+// rotations by both copying and truncating and by renaming. Data rotated into a backup before it
+// was read is read from the backup, so every line is read exactly once, provided the writers use
+// file locking and backups aren't removed before the Follower reads them.
+type Follower struct {
+	logPath      string
+	pollInterval time.Duration
+	offsetFile   string
+	backupDir    string
+	lockMode     LockMode
+	useLockFile  bool
+	lockPath     string
+	key          []byte
+
+	mu         sync.Mutex
+	live       *os.File
+	lockHandle *os.File // open lock file, if locking through a lock file
+
+	// The position consists of the newest backup read completely, if any, and the offset in the
+	// generation following it. That generation is the next backup, or the live file if none is newer.
+	latest    backupFile
+	hasLatest bool
+	offset    int64
+
+	// backup is the backup currently being read, if any
+	backup        io.Reader
+	backupFile    backupFile
+	backupClosers []io.Closer
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// followState is the position of a Follower persisted to its offset file.
+type followState struct {
+	Backup string `json:"backup,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// Follow returns a Follower reading the log file at logPath from the beginning, or from the position
+// persisted in the offset file, if set. Backups existing when following starts without a persisted
+// position are not read.
+func Follow(logPath string, options ...FollowOption) (*Follower, error) {
+	f := &Follower{
+		logPath:      logPath,
+		pollInterval: 200 * time.Millisecond,
+		done:         make(chan struct{}),
+	}
+	for _, o := range options {
+		o(f)
+	}
+
+	if f.useLockFile {
+		if f.lockPath == "" {
+			f.lockPath = logPath + lockExt
+		} else if !filepath.IsAbs(f.lockPath) {
+			f.lockPath = filepath.Join(filepath.Dir(logPath), f.lockPath)
+		}
+		lockFile, err := os.OpenFile(f.lockPath, os.O_RDONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+		f.lockHandle = lockFile
+	}
+
+	restored, err := f.restoreState()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !restored {
+		backups, err := f.backups()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+		if len(backups) > 0 {
+			f.latest, f.hasLatest = backups[len(backups)-1], true
+		}
+	}
+
+	return f, nil
+}
+
+// Read reads the next data written to the log file, blocking until data is available or the Follower
+// is closed. Returns ErrClosed once closed.
+func (f *Follower) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-f.done:
+			return 0, ErrClosed
+		default:
+		}
+
+		f.mu.Lock()
+		n, err := f.read(p)
+		if n > 0 && err == nil {
+			err = f.saveState()
+		}
+		f.mu.Unlock()
+		if n > 0 || err != nil {
+			return n, err
+		}
+
+		select {
+		case <-f.done:
+			return 0, ErrClosed
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+// read reads from the current generation, moving on to the next generation once a rotated one is
+// read completely. Returns 0 bytes and no error if there is no new data. The caller must hold f.mu.
+func (f *Follower) read(p []byte) (int, error) {
+	for {
+		if err := f.lockLive(); err != nil {
+			return 0, err
+		}
+		if f.live == nil {
+			// The log file doesn't exist at the moment
+			return 0, nil
+		}
+
+		// The lock keeps writers from rotating between listing backups and reading the live file
+		backups, err := f.backups()
+		if err != nil {
+			f.unlockLive()
+			return 0, fmt.Errorf("failed to list backups: %w", err)
+		}
+		if len(backups) == 0 {
+			n, err := f.readLive(p)
+			if unlockErr := f.unlockLive(); err == nil {
+				err = unlockErr
+			}
+			return n, err
+		}
+		if err := f.unlockLive(); err != nil {
+			return 0, err
+		}
+
+		// Backups are immutable, so they are read without holding the lock
+		n, err := f.readBackup(backups[0], p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		f.closeBackup()
+		f.latest, f.hasLatest = backups[0], true
+		f.offset = 0
+	}
+}
+
+// lockLive opens the log file if necessary and acquires a shared lock on it, reopening it if it was
+// replaced by a rotation by renaming. The caller must hold f.mu.
+func (f *Follower) lockLive() error {
+	for {
+		if f.live == nil {
+			file, err := os.Open(f.logPath)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			f.live = file
+		}
+
+		if lockingSupported {
+			if err := f.lockMode.lock(f.lockedFile(), false); err != nil {
+				return &LockError{Path: f.lockedFile().Name(), Exclusive: false, Err: err}
+			}
+		}
+
+		pathStat, err := os.Stat(f.logPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			f.unlockLive()
+			return err
+		}
+		fileStat, err := f.live.Stat()
+		if err != nil {
+			f.unlockLive()
+			return err
+		}
+		if pathStat != nil && os.SameFile(pathStat, fileStat) {
+			return nil
+		}
+
+		// Renamed, the data left in it is read from the backup
+		f.unlockLive()
+		f.live.Close()
+		f.live = nil
+		if pathStat == nil {
+			return nil
+		}
+	}
+}
+
+// unlockLive releases the shared lock on the log file.
+func (f *Follower) unlockLive() error {
+	if !lockingSupported {
+		return nil
+	}
+	if err := f.lockMode.unlock(f.lockedFile()); err != nil {
+		return fmt.Errorf("failed to unlock %s: %w", f.lockedFile().Name(), err)
+	}
+	return nil
+}
+
+// lockedFile returns the file the lock is acquired on: the lock file, if set, or the log file.
+func (f *Follower) lockedFile() *os.File {
+	if f.lockHandle != nil {
+		return f.lockHandle
+	}
+	return f.live
+}
+
+// readLive reads from the log file at the current offset.
+func (f *Follower) readLive(p []byte) (int, error) {
+	info, err := f.live.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < f.offset {
+		// Truncated without a backup, e.g. by an external tool
+		f.offset = 0
+	}
+
+	n, err := f.live.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// readBackup reads from backup at the current offset, opening it if necessary.
+func (f *Follower) readBackup(backup backupFile, p []byte) (int, error) {
+	if f.backup == nil || !sameBackup(f.backupFile, backup) {
+		f.closeBackup()
+		if err := f.openBackup(backup); err != nil {
+			return 0, err
+		}
+		if f.backup == nil {
+			// Removed by cleanup before it could be read
+			return 0, nil
+		}
+	}
+
+	n, err := f.backup.Read(p)
+	f.offset += int64(n)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// openBackup opens backup, decrypting and decompressing it if necessary, and skips to the current offset.
+func (f *Follower) openBackup(backup backupFile) error {
+	path := backup.path
+	current, closers, err := openBackupFile(osFS{}, path, f.key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.backupClosers = closers
+	f.backupFile = backup
+	f.backup = current
+
+	if _, err := io.CopyN(io.Discard, f.backup, f.offset); err != nil && !errors.Is(err, io.EOF) {
+		f.closeBackup()
+		return fmt.Errorf("failed to skip to offset %d in %s: %w", f.offset, path, err)
+	}
+
+	return nil
+}
+
+// closeBackup closes the backup currently being read, if any.
+func (f *Follower) closeBackup() {
+	for i := len(f.backupClosers) - 1; i >= 0; i-- {
+		f.backupClosers[i].Close()
+	}
+	f.backupClosers = nil
+	f.backup = nil
+}
+
+// backups returns the backups newer than the latest completely read backup, oldest first.
+func (f *Follower) backups() ([]backupFile, error) {
+	all, err := listBackups(osFS{}, backupPrefix(f.logPath, f.backupDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, backup := range all {
+		if f.hasLatest && !backupLess(backupKey(f.latest), backupKey(backup)) {
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// backupKey returns backup without the compression and encryption extensions in its path, so a
+// backup compares equal before and after its compression and encryption.
+func backupKey(backup backupFile) backupFile {
+	for _, ext := range backupExtensions {
+		if strings.HasSuffix(backup.path, ext) {
+			backup.path = strings.TrimSuffix(backup.path, ext)
+			break
+		}
+	}
+	return backup
+}
+
+// sameBackup reports whether a and b are the same backup, regardless of its compression.
+func sameBackup(a, b backupFile) bool {
+	return backupKey(a).path == backupKey(b).path
+}
+
+// restoreState restores the position from the offset file. Reports whether a position was restored.
+func (f *Follower) restoreState() (bool, error) {
+	if f.offsetFile == "" {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.offsetFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read offset file: %w", err)
+	}
+
+	var state followState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, fmt.Errorf("failed to parse offset file %s: %w", f.offsetFile, err)
+	}
+	if state.Backup != "" {
+		prefix := backupPrefix(f.logPath, f.backupDir)
+		var ok bool
+		f.latest, ok = parseBackup(prefix, filepath.Join(filepath.Dir(prefix), state.Backup))
+		if !ok {
+			return false, fmt.Errorf("invalid backup %q in offset file %s", state.Backup, f.offsetFile)
+		}
+		f.hasLatest = true
+	}
+	f.offset = state.Offset
+
+	return true, nil
+}
+
+// saveState atomically persists the position to the offset file, if set.
+func (f *Follower) saveState() error {
+	if f.offsetFile == "" {
+		return nil
+	}
+
+	state := followState{Offset: f.offset}
+	if f.hasLatest {
+		state.Backup = filepath.Base(backupKey(f.latest).path)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := f.offsetFile + tmpExt
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write offset file: %w", err)
+	}
+	if err := os.Rename(tmpPath, f.offsetFile); err != nil {
+		return fmt.Errorf("failed to write offset file: %w", err)
+	}
+	return nil
+}
+
+// Close stops following the log file. A blocked Read returns ErrClosed.
+func (f *Follower) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeBackup()
+	if f.lockHandle != nil {
+		f.lockHandle.Close()
+		f.lockHandle = nil
+	}
+	if f.live == nil {
+		return nil
+	}
+	err := f.live.Close()
+	f.live = nil
+	return err
+}
@@ -0,0 +1,120 @@
+package dfwriter
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileSystem is the file system the log file is opened on and its directories, backups and sidecar
+// files are created, listed and removed on. It is the os package unless replaced by tests with withFS.
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (fsFile, error)
+	Create(name string) (fsFile, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Glob(pattern string) ([]string, error)
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// fsFile is a file opened on a fileSystem, implemented by *os.File. Fd is used for locking,
+// preallocating and dropping cached pages.
+type fsFile interface {
+	io.ReadWriteCloser
+	io.WriterAt
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Chmod(mode os.FileMode) error
+	Chown(uid, gid int) error
+	Fd() uintptr
+}
+
+// osFS is the fileSystem of the os package.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (fsFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// A nil *os.File would be a non-nil fsFile
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Create(name string) (fsFile, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// readFile reads the file at name on fsys like os.ReadFile.
+func readFile(fsys fileSystem, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFile writes data to the file at name on fsys like os.WriteFile.
+func writeFile(fsys fileSystem, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// withFS returns an option to open, create, rename and remove files on fsys instead of the os
+// package, to inject failures in tests.
+func withFS(fsys fileSystem) Option {
+	return func(w *DistributedFileWriter) {
+		w.fs = fsys
+	}
+}
@@ -0,0 +1,10 @@
+package dfwriter
+
+import "golang.org/x/sys/unix"
+
+// fullSyncFile flushes f to stable storage with F_FULLFSYNC, which unlike fsync on darwin also
+// flushes the drive's write cache.
+func fullSyncFile(f fsFile) error {
+	_, err := unix.FcntlInt(f.Fd(), unix.F_FULLFSYNC, 0)
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package dfwriter
+
+// fullSyncFile syncs f. Only darwin distinguishes a full sync.
+func fullSyncFile(f fsFile) error {
+	return f.Sync()
+}
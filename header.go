@@ -0,0 +1,99 @@
+package dfwriter
+
+import "fmt"
+
+// writeHeader writes the header, if set, as the first line of the empty log file, without prefix.
+// The caller must hold w.mu and, with file locking, the exclusive lock.
+func (w *DistributedFileWriter) writeHeader() error {
+	header := w.headerLine()
+	if len(header) == 0 {
+		return nil
+	}
+
+	n, err := w.file.Write(header)
+	w.headerSize = int64(n)
+	w.setSize(w.size+int64(n), w.clock.Now())
+	if err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+// headerLine returns the header terminated by the delimiter, or nil if there is none.
+func (w *DistributedFileWriter) headerLine() []byte {
+	if w.header == nil {
+		return nil
+	}
+	header := w.header()
+	if len(header) == 0 || header[len(header)-1] == w.delimiter {
+		return header
+	}
+	return append(header[:len(header):len(header)], w.delimiter)
+}
+
+// writeInitialHeader writes the header to the log file opened by New if it is empty, holding the
+// exclusive lock if file locking is enabled, so concurrently starting processes write it once.
+func (w *DistributedFileWriter) writeInitialHeader() (err error) {
+	if w.header == nil {
+		return nil
+	}
+
+	if w.fsLock {
+		if err := w.lock(true); err != nil {
+			return err
+		}
+		defer w.unlock(&err)
+	}
+
+	if err := w.statFile(); err != nil {
+		return err
+	}
+	if w.size != 0 {
+		// A file of a previous run may contain only its header
+		w.headerSize = int64(len(w.headerLine()))
+		return nil
+	}
+	return w.writeHeader()
+}
+
+// writeFooter writes the footer, if set, as the last line of the log file before it is rotated or
+// closed, without prefix. The caller must hold w.mu and, with file locking, the exclusive lock.
+func (w *DistributedFileWriter) writeFooter() error {
+	if w.footer == nil {
+		return nil
+	}
+	footer := w.footer(w.segment)
+	if len(footer) == 0 {
+		return nil
+	}
+	if footer[len(footer)-1] != w.delimiter {
+		footer = append(footer[:len(footer):len(footer)], w.delimiter)
+	}
+
+	n, err := w.file.Write(footer)
+	w.setSize(w.size+int64(n), w.clock.Now())
+	if err != nil {
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+	return nil
+}
+
+// closeFooter writes the footer when closing the writer, holding the exclusive lock if file locking
+// is enabled, and syncs the log file.
+func (w *DistributedFileWriter) closeFooter() (err error) {
+	if w.footer == nil {
+		return nil
+	}
+
+	if w.fsLock {
+		if err := w.lock(true); err != nil {
+			return err
+		}
+		defer w.unlock(&err)
+	}
+
+	if err := w.writeFooter(); err != nil {
+		return err
+	}
+	return w.syncLog()
+}
@@ -0,0 +1,123 @@
+package dfwriter
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultEnvelopeFields are the names of the timestamp, prefix and message fields of the JSON
+// envelope, see WithJSONEnvelope.
+var defaultEnvelopeFields = [3]string{"ts", "prefix", "msg"}
+
+// jsonEnvelope holds the keys of the JSON envelope, each encoded with its quotes and colon.
+type jsonEnvelope struct {
+	ts, prefix, msg []byte
+}
+
+// newJSONEnvelope returns the envelope with the given field names, replacing the default names in
+// order.
+func newJSONEnvelope(fieldNames []string) (*jsonEnvelope, error) {
+	if len(fieldNames) > len(defaultEnvelopeFields) {
+		return nil, fmt.Errorf("JSON envelope has %d fields, got %d names", len(defaultEnvelopeFields), len(fieldNames))
+	}
+	names := defaultEnvelopeFields
+	for i, name := range fieldNames {
+		if name == "" {
+			return nil, fmt.Errorf("JSON envelope field name must not be empty")
+		}
+		names[i] = name
+	}
+	for i, name := range names {
+		for _, other := range names[i+1:] {
+			if name == other {
+				return nil, fmt.Errorf("duplicate JSON envelope field name %q", name)
+			}
+		}
+	}
+
+	key := func(name string) []byte {
+		return append(appendJSONString(nil, []byte(name)), ':')
+	}
+	return &jsonEnvelope{ts: key(names[0]), prefix: key(names[1]), msg: key(names[2])}, nil
+}
+
+// appendTo appends the JSON object wrapping a line of content with the given prefix, written at now,
+// to dst.
+func (e *jsonEnvelope) appendTo(dst, prefix, content []byte, now time.Time) []byte {
+	dst = append(dst, '{')
+	dst = append(dst, e.ts...)
+	dst = append(dst, '"')
+	dst = now.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, '"', ',')
+	dst = append(dst, e.prefix...)
+	dst = appendJSONString(dst, prefix)
+	dst = append(dst, ',')
+	dst = append(dst, e.msg...)
+	dst = appendJSONString(dst, content)
+	return append(dst, '}')
+}
+
+// envelope returns the line of content with the given prefix wrapped in the JSON envelope, if
+// enabled, to be written without prefix and delimited. Otherwise, the arguments are returned as is.
+// The caller must hold w.mu.
+func (w *DistributedFileWriter) envelope(prefix, content []byte, delimited bool) ([]byte, []byte, bool) {
+	if w.jsonEnvelope == nil {
+		return prefix, content, delimited
+	}
+	w.envelopeBuf = w.jsonEnvelope.appendTo(w.envelopeBuf[:0], prefix, content, w.clock.Now())
+	return nil, w.envelopeBuf, true
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s to dst as a quoted JSON string. Quotes, backslashes and control
+// characters are escaped, as are U+2028 and U+2029 like by encoding/json, and invalid UTF-8 is
+// replaced with U+FFFD.
+func appendJSONString(dst, s []byte) []byte {
+	dst = append(dst, '"')
+	start := 0 // start of the bytes not yet appended, which need no escaping
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
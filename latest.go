@@ -0,0 +1,65 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// latestExt is appended to the log path to name the default link to the latest backup, see
+// WithLatestSymlink.
+const latestExt = ".latest"
+
+// symlink creates a symbolic link. It is a variable so tests can simulate platforms without symlinks.
+var symlink = os.Symlink
+
+// linkLatest points the latest backup link at the newest complete backup, replacing the link
+// atomically. Failures are reported to the error handler.
+func (w *DistributedFileWriter) linkLatest() {
+	if w.latestPath == "" {
+		return
+	}
+
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+
+	// Unparsable backups don't prevent linking the newest one
+	backups, _ := w.backups()
+	for i := len(backups) - 1; i >= 0; i-- {
+		if w.isCompressing(backups[i]) {
+			// Linked once the compressed copy is complete
+			continue
+		}
+		if err := replaceLink(w.fs, backups[i].path, w.latestPath); err != nil {
+			w.handleError(fmt.Errorf("failed to link latest backup: %w", err))
+		}
+		return
+	}
+}
+
+// replaceLink atomically replaces the file at link with a symbolic link to target, relative if
+// possible. Where symbolic links aren't supported, link is replaced with a text file containing the
+// path of target instead.
+func replaceLink(fsys fileSystem, target, link string) error {
+	tmpPath := fmt.Sprintf("%s.%d%s", link, os.Getpid(), tmpExt)
+	if err := fsys.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	linkTarget := target
+	if rel, err := filepath.Rel(filepath.Dir(link), target); err == nil {
+		linkTarget = rel
+	}
+	if err := symlink(linkTarget, tmpPath); err != nil {
+		if err := writeFile(fsys, tmpPath, []byte(target+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := fsys.Rename(tmpPath, link); err != nil {
+		fsys.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package dfwriter
+
+import (
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+const ofdSupported = true
+
+// ofdLockFile acquires an open file description lock covering all of f, blocking until it is available.
+func ofdLockFile(f fsFile, exclusive bool) error {
+	return lockErr(ofdFcntl(f, unix.F_OFD_SETLKW, ofdLockType(exclusive)))
+}
+
+// ofdTryLockFile attempts to acquire an open file description lock covering all of f without blocking.
+// Reports false if the lock is held by another process.
+func ofdTryLockFile(f fsFile, exclusive bool) (bool, error) {
+	err := ofdFcntl(f, unix.F_OFD_SETLK, ofdLockType(exclusive))
+	if err == unix.EAGAIN || err == unix.EACCES {
+		return false, nil
+	}
+	return err == nil, lockErr(err)
+}
+
+// ofdUnlockFile releases the open file description lock held on f.
+func ofdUnlockFile(f fsFile) error {
+	return ofdFcntl(f, unix.F_OFD_SETLK, unix.F_UNLCK)
+}
+
+func ofdLockType(exclusive bool) int16 {
+	if exclusive {
+		return unix.F_WRLCK
+	}
+	return unix.F_RDLCK
+}
+
+// ofdFcntl applies a lock of the given type to all of f, including data appended later.
+func ofdFcntl(f fsFile, cmd int, lockType int16) error {
+	lock := unix.Flock_t{Type: lockType, Whence: io.SeekStart, Start: 0, Len: 0}
+	return unix.FcntlFlock(f.Fd(), cmd, &lock)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package dfwriter
+
+import "errors"
+
+const ofdSupported = false
+
+var errOFDUnsupported = errors.New("open file description locks are not supported on this platform")
+
+func ofdLockFile(f fsFile, exclusive bool) error {
+	return errOFDUnsupported
+}
+
+func ofdTryLockFile(f fsFile, exclusive bool) (bool, error) {
+	return false, errOFDUnsupported
+}
+
+func ofdUnlockFile(f fsFile) error {
+	return errOFDUnsupported
+}
@@ -0,0 +1,21 @@
+//go:build (!unix && !windows) || aix || (solaris && !illumos)
+
+package dfwriter
+
+import "errors"
+
+const lockingSupported = false
+
+var errLockingUnsupported = errors.New("file locking is not supported on this platform")
+
+func lockFile(f fsFile, exclusive bool) error {
+	return errLockingUnsupported
+}
+
+func tryLockFile(f fsFile, exclusive bool) (bool, error) {
+	return false, errLockingUnsupported
+}
+
+func unlockFile(f fsFile) error {
+	return errLockingUnsupported
+}
@@ -0,0 +1,48 @@
+//go:build unix && !aix && (!solaris || illumos)
+
+// AIX and Solaris lack flock(2) and use the fallback in lock_other.go; illumos provides it.
+
+package dfwriter
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const lockingSupported = true
+
+// lockFile acquires an advisory flock on f, blocking until it is available.
+func lockFile(f fsFile, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return lockErr(syscall.Flock(int(f.Fd()), how))
+}
+
+// tryLockFile attempts to acquire an advisory flock on f without blocking.
+// Reports false if the lock is held by another process.
+func tryLockFile(f fsFile, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH | syscall.LOCK_NB
+	if exclusive {
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+	err := syscall.Flock(int(f.Fd()), how)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, lockErr(err)
+}
+
+// unlockFile releases the flock held on f.
+func unlockFile(f fsFile) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// lockErr explains ENOLCK, which is returned if no lock manager is available, e.g. on NFS.
+func lockErr(err error) error {
+	if err == syscall.ENOLCK {
+		return fmt.Errorf("%w: no lock manager available, e.g. on an NFS mount with nolock or without lockd running", err)
+	}
+	return err
+}
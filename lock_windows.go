@@ -0,0 +1,46 @@
+//go:build windows
+
+package dfwriter
+
+import "golang.org/x/sys/windows"
+
+const lockingSupported = true
+
+// Windows byte-range locks are mandatory, so a shared lock over the file contents would
+// block our own writes. Instead we lock a single byte far beyond any realistic file size,
+// which serves purely as a mutual exclusion token between processes.
+const (
+	lockOffsetLow  = 0xFFFFFFFE
+	lockOffsetHigh = 0xFFFFFFFF
+)
+
+// lockFile acquires a LockFileEx lock on f, blocking until it is available.
+func lockFile(f fsFile, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := windows.Overlapped{Offset: lockOffsetLow, OffsetHigh: lockOffsetHigh}
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &ol)
+}
+
+// tryLockFile attempts to acquire a LockFileEx lock on f without blocking.
+// Reports false if the lock is held by another process.
+func tryLockFile(f fsFile, exclusive bool) (bool, error) {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := windows.Overlapped{Offset: lockOffsetLow, OffsetHigh: lockOffsetHigh}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlockFile releases the LockFileEx lock held on f.
+func unlockFile(f fsFile) error {
+	ol := windows.Overlapped{Offset: lockOffsetLow, OffsetHigh: lockOffsetHigh}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
@@ -0,0 +1,50 @@
+package dfwriter
+
+// LockMode selects the mechanism used for file locking.
+type LockMode int
+
+const (
+	// LockFlock locks with flock(2) on unix and LockFileEx on Windows (default).
+	LockFlock LockMode = iota
+	// LockOFD locks the whole file with open file description locks (fcntl F_OFD_SETLK), only available
+	// on Linux. Unlike flock locks, they are forwarded to the server by NFS clients and so exclude
+	// writers on other machines sharing the file.
+	LockOFD
+)
+
+// String returns the name of the lock mode.
+func (m LockMode) String() string {
+	switch m {
+	case LockFlock:
+		return "flock"
+	case LockOFD:
+		return "ofd"
+	default:
+		return "unknown"
+	}
+}
+
+// lock acquires the file lock on f, blocking until it is available.
+func (m LockMode) lock(f fsFile, exclusive bool) error {
+	if m == LockOFD {
+		return ofdLockFile(f, exclusive)
+	}
+	return lockFile(f, exclusive)
+}
+
+// tryLock attempts to acquire the file lock on f without blocking.
+// Reports false if the lock is held by another process.
+func (m LockMode) tryLock(f fsFile, exclusive bool) (bool, error) {
+	if m == LockOFD {
+		return ofdTryLockFile(f, exclusive)
+	}
+	return tryLockFile(f, exclusive)
+}
+
+// unlock releases the file lock held on f.
+func (m LockMode) unlock(f fsFile) error {
+	if m == LockOFD {
+		return ofdUnlockFile(f)
+	}
+	return unlockFile(f)
+}
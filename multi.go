@@ -0,0 +1,266 @@
+package dfwriter
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPlaceholder is replaced with the key of a line in the path template of a MultiWriter.
+const keyPlaceholder = "{key}"
+
+// MultiWriter demultiplexes lines to one DistributedFileWriter per key, e.g. a log file per tenant.
+// The writers are created on demand with the same options and closed when exceeding the max open
+// files or after being idle, see WithMaxOpenFiles and WithIdleTimeout.
+// MultiWriter is safe for concurrent use by multiple goroutines.
+type MultiWriter struct {
+	pathTemplate string
+	keyFn        func(line []byte) string
+	options      []Option
+	delimiter    byte
+	maxOpen      int
+	idleTimeout  time.Duration
+	clock        Clock
+
+	mu       sync.Mutex
+	children map[string]*list.Element // of *multiChild, by key
+	lru      list.List                // of *multiChild, most recently used first
+	buf      bytes.Buffer
+	closed   bool
+	reporter *errorReporter
+
+	done       chan struct{}
+	stopOnce   sync.Once
+	background sync.WaitGroup
+}
+
+// multiChild is the writer of a key of a MultiWriter.
+type multiChild struct {
+	key      string
+	writer   *DistributedFileWriter
+	lastUsed time.Time
+}
+
+// NewMulti creates a MultiWriter writing each line to the log file at pathTemplate with "{key}"
+// replaced by the key returned by keyFn for the line, e.g. "/logs/{key}.log". Keys must not be
+// empty or contain path separators. The options configure every writer created, in addition to
+// WithMaxOpenFiles and WithIdleTimeout for the MultiWriter itself.
+func NewMulti(pathTemplate string, keyFn func(line []byte) string, options ...Option) (*MultiWriter, error) {
+	if !strings.Contains(pathTemplate, keyPlaceholder) {
+		return nil, fmt.Errorf("path template %q doesn't contain %s", pathTemplate, keyPlaceholder)
+	}
+
+	// The options only set fields, so applying them to a writer reveals the MultiWriter's settings
+	var settings DistributedFileWriter
+	settings.delimiter = '\n'
+	for _, o := range options {
+		o(&settings)
+	}
+
+	m := &MultiWriter{
+		pathTemplate: pathTemplate,
+		keyFn:        keyFn,
+		options:      options,
+		delimiter:    settings.delimiter,
+		maxOpen:      settings.maxOpenFiles,
+		idleTimeout:  settings.idleTimeout,
+		clock:        settings.clock,
+		children:     make(map[string]*list.Element),
+		reporter:     newErrorReporter(settings.onError),
+		done:         make(chan struct{}),
+	}
+	if m.clock == nil {
+		m.clock = realClock{}
+	}
+	if m.idleTimeout > 0 {
+		m.background.Add(1)
+		go m.closeIdleLoop()
+	}
+
+	return m, nil
+}
+
+// Write buffers the given bytes and writes each complete line with WriteLine to the writer of its
+// key, the first one continuing the buffered partial line, if any. Returns the number of bytes
+// buffered and any error encountered. On error, the returned count covers the input up to the
+// last line successfully written.
+func (m *MultiWriter) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	written := 0
+	for {
+		end := bytes.IndexByte(b[written:], m.delimiter)
+		if end < 0 {
+			break
+		}
+		line := b[written : written+end+1]
+		if m.buf.Len() > 0 {
+			m.buf.Write(line)
+			line = m.buf.Bytes()
+		}
+		if err := m.writeLine(line); err != nil {
+			m.buf.Reset()
+			return written, err
+		}
+		m.buf.Reset()
+		written += end + 1
+	}
+
+	m.buf.Write(b[written:])
+	return len(b), nil
+}
+
+// writeLine writes line to the writer of its key. The caller must hold m.mu.
+func (m *MultiWriter) writeLine(line []byte) error {
+	child, err := m.child(m.keyFn(line))
+	if err != nil {
+		return err
+	}
+	return child.WriteLine(line)
+}
+
+// child returns the writer of key, creating it if necessary. Creating a writer closes the least
+// recently used one if the max open files would be exceeded. The caller must hold m.mu.
+func (m *MultiWriter) child(key string) (*DistributedFileWriter, error) {
+	if elem, ok := m.children[key]; ok {
+		m.lru.MoveToFront(elem)
+		child := elem.Value.(*multiChild)
+		child.lastUsed = m.clock.Now()
+		return child.writer, nil
+	}
+
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return nil, fmt.Errorf("invalid key %q", key)
+	}
+	if m.maxOpen > 0 && m.lru.Len() >= m.maxOpen {
+		if err := m.closeChild(m.lru.Back()); err != nil {
+			m.handleError(err)
+		}
+	}
+
+	path := filepath.Clean(strings.ReplaceAll(m.pathTemplate, keyPlaceholder, key))
+	writer, err := New(path, m.options...)
+	if err != nil {
+		return nil, err
+	}
+	m.children[key] = m.lru.PushFront(&multiChild{key: key, writer: writer, lastUsed: m.clock.Now()})
+	return writer, nil
+}
+
+// closeChild closes the writer of elem and forgets it. The caller must hold m.mu.
+func (m *MultiWriter) closeChild(elem *list.Element) error {
+	child := m.lru.Remove(elem).(*multiChild)
+	delete(m.children, child.key)
+	if err := child.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close writer of key %q: %w", child.key, err)
+	}
+	return nil
+}
+
+// closeIdleLoop periodically closes the writers idle for longer than the idle timeout until the
+// MultiWriter is closed.
+func (m *MultiWriter) closeIdleLoop() {
+	defer m.background.Done()
+	ticker := m.clock.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C():
+			m.closeIdle()
+		}
+	}
+}
+
+// closeIdle closes the writers idle for longer than the idle timeout.
+func (m *MultiWriter) closeIdle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deadline := m.clock.Now().Add(-m.idleTimeout)
+	for elem := m.lru.Back(); elem != nil; elem = m.lru.Back() {
+		child := elem.Value.(*multiChild)
+		if child.lastUsed.After(deadline) {
+			return
+		}
+		if err := m.closeChild(elem); err != nil {
+			m.handleError(err)
+		}
+	}
+}
+
+// handleError reports an error closing an evicted or idle writer to the error handler, see
+// WithErrorHandler.
+func (m *MultiWriter) handleError(err error) {
+	m.reporter.report(err)
+}
+
+// Open returns the number of writers currently open.
+func (m *MultiWriter) Open() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// Sync writes any buffered partial line to the writer of its key and syncs all open writers.
+func (m *MultiWriter) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	var errs []error
+	if m.buf.Len() > 0 {
+		errs = append(errs, m.writeLine(m.buf.Bytes()))
+		m.buf.Reset()
+	}
+	for elem := m.lru.Front(); elem != nil; elem = elem.Next() {
+		child := elem.Value.(*multiChild)
+		if err := child.writer.Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to sync writer of key %q: %w", child.key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close writes any buffered partial line and closes all open writers. Close is idempotent.
+func (m *MultiWriter) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.done)
+	})
+	m.background.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	var errs []error
+	if m.buf.Len() > 0 {
+		errs = append(errs, m.writeLine(m.buf.Bytes()))
+		m.buf.Reset()
+	}
+	for elem := m.lru.Front(); elem != nil; elem = m.lru.Front() {
+		errs = append(errs, m.closeChild(elem))
+	}
+	m.reporter.close()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,113 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// numericBackupPattern matches the part of a numeric backup name following the log file name,
+// capturing the index.
+var numericBackupPattern = regexp.MustCompile(`^(\d+)(?:\.gz|\.zst)?(?:\.enc)?$`)
+
+// listNumericBackups returns the backups named after prefix with numeric indices, oldest first,
+// i.e. ordered by descending index. As the names carry no rotation time, the modification time is used.
+func listNumericBackups(fsys fileSystem, prefix string) ([]backupFile, error) {
+	matches, err := fsys.Glob(prefix + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, file := range matches {
+		m := numericBackupPattern.FindStringSubmatch(strings.TrimPrefix(file, prefix+"."))
+		if m == nil || !strings.HasPrefix(file, prefix+".") {
+			continue
+		}
+		index, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		info, err := fsys.Stat(file)
+		if err != nil {
+			// Removed by another process since the glob
+			continue
+		}
+		backups = append(backups, backupFile{path: file, time: info.ModTime(), index: index})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].index != backups[j].index {
+			return backups[i].index > backups[j].index
+		}
+		return backups[i].path < backups[j].path
+	})
+
+	// A backup found both uncompressed and compressed is just being compressed
+	compacted := backups[:0]
+	for i, backup := range backups {
+		if i+1 < len(backups) && sameBackup(backup, backups[i+1]) {
+			continue
+		}
+		compacted = append(compacted, backup)
+	}
+	return compacted, nil
+}
+
+// createNumericBackup shifts the existing numeric backups and creates the temporary file of the new
+// backup with index 1. Returns the created temporary file and the path of the backup once it is complete.
+// The caller must hold the exclusive lock, so concurrent processes don't shift the backups twice.
+func (w *DistributedFileWriter) createNumericBackup(info os.FileInfo) (fsFile, string, error) {
+	if err := w.shiftNumericBackups(); err != nil {
+		return nil, "", fmt.Errorf("failed to shift backups: %w", err)
+	}
+
+	backupPath := w.backupPrefix() + ".1"
+	// Under the exclusive lock, an existing temporary file was left behind by a crashed rotation
+	if err := w.fs.Remove(backupPath + tmpExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, "", err
+	}
+	tmpFile, err := createBackupFile(w.fs, backupPath+tmpExt, info)
+	if err != nil {
+		return nil, "", err
+	}
+	return tmpFile, backupPath, nil
+}
+
+// shiftNumericBackups renames each numeric backup to the next higher index, starting with the highest.
+// Backups that would exceed the max backups are removed instead.
+func (w *DistributedFileWriter) shiftNumericBackups() error {
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+
+	backups, err := listNumericBackups(w.fs, w.backupPrefix())
+	if err != nil {
+		return err
+	}
+
+	prefix := w.backupPrefix()
+	for _, backup := range backups {
+		if w.maxBackups > 0 && backup.index >= w.maxBackups {
+			gone, err := w.removeBackup(backup.path, RemovalMaxBackups)
+			if err != nil {
+				return err
+			}
+			if gone {
+				continue
+			}
+		}
+
+		ext := strings.TrimPrefix(backup.path, backupKey(backup).path)
+		shifted := fmt.Sprintf("%s.%d%s", prefix, backup.index+1, ext)
+		if err := w.fs.Rename(backup.path, shifted); err != nil {
+			return err
+		}
+	}
+
+	return w.syncDir(filepath.Dir(prefix))
+}
@@ -1,42 +1,324 @@
 package dfwriter
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"time"
 )
 
 type Option func(*DistributedFileWriter)
 
 // New creates a new DistributedFileWriter writing to the specified fileName.
-// It opens or creates the log file and applies functional options for configuration.
+// It applies functional options for configuration and then opens or creates the log file.
 // The file is opened in append mode, and the file permissions are set to the same as the existing file if it exists.
-// If the file does not exist, it is created with default permissions (0644).
-
+// If the file does not exist, it is created with default permissions (0644) unless set with WithFileMode.
 func New(fileName string, options ...Option) (*DistributedFileWriter, error) {
-	mode := os.FileMode(0644)
-	info, err := os.Stat(fileName)
-	if err == nil {
-		mode = info.Mode()
+	logger := &DistributedFileWriter{
+		atomicLineSize:   4096, // Default atomic line size for most unix systems
+		readBufferSize:   defaultReadBufferSize,
+		delimiter:        '\n',
+		truncationMarker: defaultTruncationMarker,
+		done:             make(chan struct{}),
+		compressing:      make(map[string]struct{}),
+		timeLayout:       time.RFC3339,
+		compressionLevel: gzip.DefaultCompression,
+		clock:            realClock{},
+		fs:               osFS{},
+		path:             fileName,
+	}
+
+	for _, o := range options {
+		o(logger)
+	}
+
+	if err := logger.validateLimits(); err != nil {
+		return nil, err
+	}
+
+	if err := validateGzipLevel(logger.compressionLevel); err != nil {
+		return nil, err
+	}
+
+	if err := logger.validateAsync(); err != nil {
+		return nil, err
+	}
+
+	if logger.templateText != "" {
+		var err error
+		logger.template, err = compilePrefixTemplate(logger.templateText)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if (logger.fsLock || logger.exclusiveOwner) && !lockingSupported {
+		return nil, fmt.Errorf("failed to enable file locking: not supported on this platform")
+	}
+	if (logger.fsLock || logger.exclusiveOwner) && logger.lockMode == LockOFD && !ofdSupported {
+		return nil, fmt.Errorf("failed to enable file locking: %s locks are not supported on this platform", logger.lockMode)
+	}
+
+	if logger.mkdirPerm != 0 {
+		if err := logger.fs.MkdirAll(filepath.Dir(fileName), logger.mkdirPerm); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+
+	if logger.backupDir != "" {
+		if !filepath.IsAbs(logger.backupDir) {
+			logger.backupDir = filepath.Join(filepath.Dir(fileName), logger.backupDir)
+		}
+		perm := logger.mkdirPerm
+		if perm == 0 {
+			perm = 0755
+		}
+		if err := logger.fs.MkdirAll(logger.backupDir, perm); err != nil {
+			return nil, fmt.Errorf("failed to create backup directory: %w", err)
+		}
+	}
+
+	if (logger.header != nil || logger.footer != nil) && logger.binaryRecords {
+		return nil, fmt.Errorf("a header or footer can't be combined with binary records")
 	}
 
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, mode)
+	if logger.sanitizeMode&^SanitizeAll != 0 {
+		return nil, fmt.Errorf("invalid sanitize mode %d", logger.sanitizeMode)
+	}
+	if logger.sanitizeMode != 0 && logger.binaryRecords {
+		return nil, fmt.Errorf("sanitizing lines can't be combined with binary records")
+	}
+
+	if logger.sequencePosition != SequenceStart && logger.sequencePosition != SequenceEnd {
+		return nil, fmt.Errorf("invalid sequence position %d", logger.sequencePosition)
+	}
+	if logger.sequenceNumbers && logger.binaryRecords {
+		return nil, fmt.Errorf("sequence numbers can't be combined with binary records")
+	}
+
+	if logger.recentSize < 0 {
+		return nil, fmt.Errorf("invalid recent buffer size %d", logger.recentSize)
+	}
+	if logger.recentSize > 0 {
+		if logger.binaryRecords {
+			return nil, fmt.Errorf("a recent buffer can't be combined with binary records")
+		}
+		logger.recent = newRecentLines(logger.recentSize)
+	}
+
+	if logger.eventBuffer < 0 {
+		return nil, fmt.Errorf("invalid event buffer size %d", logger.eventBuffer)
+	}
+	if logger.eventBuffer > 0 {
+		logger.events = &eventQueue{ch: make(chan Event, logger.eventBuffer)}
+	}
+
+	if logger.envelopeFields != nil {
+		if logger.binaryRecords {
+			return nil, fmt.Errorf("a JSON envelope can't be combined with binary records")
+		}
+		if logger.oversizePolicy != OversizeError {
+			return nil, fmt.Errorf("a JSON envelope can't be combined with truncating or splitting oversized lines, as it would break the JSON")
+		}
+		var err error
+		if logger.jsonEnvelope, err = newJSONEnvelope(logger.envelopeFields); err != nil {
+			return nil, err
+		}
+	}
+
+	if logger.encryptionKey != nil {
+		if err := validateEncryptionKey(logger.encryptionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if logger.numericBackups && logger.checksums {
+		return nil, fmt.Errorf("numeric backups can't be combined with checksums, as their names change")
+	}
+	if logger.postRotateCommand != nil && len(logger.postRotateCommand) == 0 {
+		return nil, fmt.Errorf("post-rotate command must not be empty")
+	}
+	if logger.numericBackups && logger.uploader != nil {
+		return nil, fmt.Errorf("numeric backups can't be combined with an uploader, as their names change")
+	}
+	if logger.numericBackups && logger.compressExisting {
+		return nil, fmt.Errorf("numeric backups can't be combined with compressing existing backups, as their names change")
+	}
+	if logger.numericBackups && logger.nameTemplateText != "" {
+		return nil, fmt.Errorf("numeric backups can't be combined with a backup name template")
+	}
+
+	if logger.nameTemplateText != "" {
+		var err error
+		logger.nameTemplate, err = compileBackupNameTemplate(logger.nameTemplateText, fileName, logger.backupDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if logger.archiveDir != "" {
+		if err := logger.fs.MkdirAll(logger.archiveDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create archive directory: %w", err)
+		}
+	}
+
+	explicitMode := logger.mode != 0
+	if !explicitMode {
+		logger.mode = os.FileMode(0644)
+		if info, err := logger.fs.Stat(fileName); err == nil {
+			logger.mode = info.Mode().Perm()
+		}
+	}
+
+	if logger.latestLink {
+		if logger.latestPath == "" {
+			logger.latestPath = fileName + latestExt
+		} else if !filepath.IsAbs(logger.latestPath) {
+			logger.latestPath = filepath.Join(filepath.Dir(fileName), logger.latestPath)
+		}
+	}
+
+	if logger.uploader != nil {
+		logger.uploadQueuePath = fileName + uploadQueueExt
+		logger.uploadWake = make(chan struct{}, 1)
+	}
+	if logger.sequenceNumbers {
+		logger.sequencePath = fileName + sequenceExt
+	}
+
+	if logger.useLockFile {
+		if logger.lockPath == "" {
+			logger.lockPath = fileName + lockExt
+		} else if !filepath.IsAbs(logger.lockPath) {
+			logger.lockPath = filepath.Join(filepath.Dir(fileName), logger.lockPath)
+		}
+		// Only the writers sharing the log file need access, others not even to read it
+		lockFile, err := logger.fs.OpenFile(logger.lockPath, os.O_RDWR|os.O_CREATE, logger.mode&0660)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+		logger.lockHandle = lockFile
+	} else if logger.fsLock || logger.exclusiveOwner {
+		// Writers locking the log file itself wouldn't exclude writers locking the lock file
+		if _, err := logger.fs.Stat(fileName + lockExt); err == nil {
+			return nil, fmt.Errorf("log file %s is locked through the lock file %s by other writers, use WithLockFile",
+				fileName, fileName+lockExt)
+		}
+	}
+
+	file, err := logger.openLogFile(fileName)
 	if err != nil {
+		logger.closeLockFile()
 		return nil, fmt.Errorf("failed to open log file: %v", err)
 	}
+	if explicitMode {
+		// Apply the configured mode regardless of the umask and of an existing file's mode
+		if err := file.Chmod(logger.mode); err != nil {
+			file.Close()
+			logger.closeLockFile()
+			return nil, fmt.Errorf("failed to set log file mode: %w", err)
+		}
+	}
+	logger.file = file
 
-	logger := &DistributedFileWriter{
-		file:           file,
-		atomicLineSize: 4096, // Default atomic line size for most unix systems
+	if logger.exclusiveOwner {
+		if err := logger.acquireOwnership(); err != nil {
+			file.Close()
+			logger.closeLockFile()
+			return nil, err
+		}
+		// Holding the lock until Close, lines are written without locking
+		logger.fsLock = false
 	}
 
-	for _, o := range options {
-		o(logger)
+	if err := logger.statFile(); err != nil {
+		file.Close()
+		logger.closeLockFile()
+		return nil, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	if backups, err := logger.backups(); err == nil {
+		logger.stats.backups.Store(int64(len(backups)))
+	}
+
+	logger.reporter = newErrorReporter(logger.onError)
+	logger.preallocate()
+	if logger.sequenceNumbers {
+		if err := logger.reserveSequence(); err != nil {
+			file.Close()
+			logger.closeLockFile()
+			logger.reporter.close()
+			return nil, fmt.Errorf("failed to reserve sequence numbers: %w", err)
+		}
+	}
+	if err := logger.writeInitialHeader(); err != nil {
+		file.Close()
+		logger.closeLockFile()
+		logger.reporter.close()
+		return nil, err
+	}
+	if err := logger.rotateOnOpen(); err != nil {
+		file.Close()
+		logger.closeLockFile()
+		logger.reporter.close()
+		return nil, fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	// Enforce the backup limits even if the writer never rotates, e.g. after lowering them
+	logger.cleanup()
+
+	if logger.dedupe.window > 0 {
+		logger.startBackground(logger.dedupeLoop)
+	}
+	if logger.syncPolicy.interval > 0 {
+		logger.startBackground(func() {
+			logger.syncLoop(logger.syncPolicy.interval)
+		})
+	}
+
+	if logger.flushInterval > 0 {
+		logger.startBackground(func() {
+			logger.flushLoop(logger.flushInterval)
+		})
+	}
+	if logger.cleanupInterval > 0 {
+		logger.startBackground(func() {
+			logger.cleanupLoop(logger.cleanupInterval)
+		})
+	}
+	if logger.compressExisting {
+		logger.startBackground(logger.compressExistingLoop)
+	}
+	if logger.uploader != nil {
+		// Uploads interrupted by a previous run are resumed from the queue
+		logger.startBackground(logger.uploadLoop)
+	}
+	if logger.asyncSize > 0 {
+		logger.async = newAsyncQueue(logger.asyncSize, logger.asyncPolicy, logger.asyncFailOnError)
+		logger.startBackground(logger.asyncLoop)
 	}
 
 	return logger, nil
 }
 
+// WithFileMode returns an option to set the permissions of the log file and its backups.
+// By default, the permissions of an existing log file are kept, and new log files are created with 0644.
+func WithFileMode(mode os.FileMode) Option {
+	return func(w *DistributedFileWriter) {
+		w.mode = mode.Perm()
+	}
+}
+
+// WithMkdirAll returns an option to create missing parent directories of the log file with the given permissions.
+func WithMkdirAll(perm os.FileMode) Option {
+	return func(w *DistributedFileWriter) {
+		w.mkdirPerm = perm
+	}
+}
+
 // WithMaxBytes returns an option to set the maximum size in bytes before rotation.
 func WithMaxBytes(maxBytes int64) Option {
 	return func(w *DistributedFileWriter) {
@@ -44,13 +326,199 @@ func WithMaxBytes(maxBytes int64) Option {
 	}
 }
 
-// WithMaxBackups returns an option to set the maximum number of backup files to retain.
+// WithMaxBytesString returns an option to set the maximum size before rotation like WithMaxBytes,
+// parsed with ParseSize, e.g. "100MB". An invalid size fails New or Reconfigure.
+func WithMaxBytesString(maxBytes string) Option {
+	n, err := ParseSize(maxBytes)
+	return func(w *DistributedFileWriter) {
+		if err != nil {
+			w.optionErr = errors.Join(w.optionErr, fmt.Errorf("invalid max bytes: %w", err))
+			return
+		}
+		w.maxSize = n
+	}
+}
+
+// WithMaxBufferedBytes returns an option to limit the size in bytes of a partial line buffered by Write
+// while waiting for a newline. Exceeding it discards the partial line and returns ErrLineTooLong.
+// If unset, partial lines are limited by the max size set with WithMaxBytes.
+func WithMaxBufferedBytes(maxBuffered int) Option {
+	return func(w *DistributedFileWriter) {
+		w.maxBuffered = maxBuffered
+	}
+}
+
+// WithOversizeLinePolicy returns an option to set how lines exceeding the max size are handled.
+// The default, OversizeError, rejects them with ErrLineTooLong.
+func WithOversizeLinePolicy(policy OversizeLinePolicy) Option {
+	return func(w *DistributedFileWriter) {
+		w.oversizePolicy = policy
+	}
+}
+
+// WithTruncationMarker returns an option to set the marker appended to lines cut by OversizeTruncate.
+func WithTruncationMarker(marker []byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.truncationMarker = marker
+	}
+}
+
+// WithDelimiter returns an option to set the byte terminating lines, which Write splits its input on.
+// The default is '\n'. The delimiter is what counts as a line ending for WriteLine, WriteLines and the
+// oversize line policies as well.
+func WithDelimiter(delimiter byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.delimiter = delimiter
+	}
+}
+
+// WithLineTransform returns an option to transform the content of every line before it is written,
+// e.g. to redact secrets with RedactPatterns. The transform receives the line without its delimiter
+// and prefix, and the transformed length is what counts against the max size. Returning nil drops
+// the line. Delimiters in the returned line are escaped, so a transform can't split a line.
+// The transform must not retain or modify the line passed to it.
+func WithLineTransform(transform func(line []byte) []byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.lineTransform = transform
+	}
+}
+
+// WithBinaryRecords returns an option to write binary records instead of lines. Every call to Write,
+// WriteLine or ReadFrom and every element passed to WriteLines is a complete record, which is framed
+// as its 4-byte big-endian length followed by the prefix, if set, and the record. The length covers
+// the prefix. Frames are never split by rotation, and records whose frame exceeds the max size are
+// rejected with ErrLineTooLong regardless of the oversize line policy. Use ScanRecords to read them.
+func WithBinaryRecords() Option {
+	return func(w *DistributedFileWriter) {
+		w.binaryRecords = true
+	}
+}
+
+// WithNormalizeCRLF returns an option to drop a '\r' immediately preceding the delimiter of a line
+// before the prefix is applied, so "\r\n" terminated input is written LF terminated. The max size
+// and atomic line size apply to the normalized line.
+func WithNormalizeCRLF() Option {
+	return func(w *DistributedFileWriter) {
+		w.normalizeCRLF = true
+	}
+}
+
+// WithHeader returns an option to write the line returned by header, without prefix, at the start
+// of every empty log file: when New opens an empty file and after each rotation. The header counts
+// towards the max size, but a file containing only the header is never rotated. With file locking,
+// it is written under the exclusive lock, so concurrent processes write it once. A header can't be
+// combined with binary records.
+func WithHeader(header func() []byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.header = header
+	}
+}
+
+// WithFooter returns an option to write the line returned by footer, without prefix, at the end of
+// the log file right before it is rotated and when closing the writer. The footer is passed the
+// statistics of the lines written by this writer to the log file since it was opened or rotated.
+// It may exceed the max size by its own length. With file locking, it is written under the
+// exclusive lock. A footer can't be combined with binary records.
+func WithFooter(footer func(stats FileStats) []byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.footer = footer
+	}
+}
+
+// WithMaxBackups returns an option to set the maximum number of backup files to retain. Empty backups,
+// as left by older versions, are not counted. UnlimitedBackups (0) keeps all backups, NoBackups
+// truncates the log file on rotation without keeping a backup.
 func WithMaxBackups(maxBackups int) Option {
 	return func(w *DistributedFileWriter) {
 		w.maxBackups = maxBackups
 	}
 }
 
+// WithMaxTotalBytes returns an option to limit the bytes used by the log file and its backups together.
+// If exceeded, the oldest backups are deleted until the total fits, in addition to the
+// limits set by WithMaxBackups and WithMaxAge.
+func WithMaxTotalBytes(maxTotalBytes int64) Option {
+	return func(w *DistributedFileWriter) {
+		w.maxTotalBytes = maxTotalBytes
+	}
+}
+
+// WithOnBackupRemoved returns an option to set a callback invoked with the path of each backup and the
+// reason it was removed, after it was successfully removed by this writer. The callback is called
+// synchronously while the writer holds its locks, including during writes pruning backups on a full
+// disk, so it must return quickly and must not call methods of the writer. Use Events to observe
+// removals without blocking.
+func WithOnBackupRemoved(fn func(path string, reason RemovalReason)) Option {
+	return func(w *DistributedFileWriter) {
+		w.onBackupRemoved = fn
+	}
+}
+
+// WithBackupRemovalFilter returns an option to set a function deciding whether a backup may be removed
+// for the given reason. Backups for which fn returns false are kept. Like the WithOnBackupRemoved
+// callback, fn runs while the writer's locks are held, so it must be fast and must not call back into
+// the writer.
+func WithBackupRemovalFilter(fn func(path string, reason RemovalReason) bool) Option {
+	return func(w *DistributedFileWriter) {
+		w.keepBackup = fn
+	}
+}
+
+// WithBackupDir returns an option to store backups in dir instead of next to the log file. A relative dir
+// is resolved against the log file's directory. The directory is created if it doesn't exist.
+// With WithRenameRotation, dir must be on the same filesystem as the log file.
+func WithBackupDir(dir string) Option {
+	return func(w *DistributedFileWriter) {
+		w.backupDir = dir
+	}
+}
+
+// WithBackupNameTemplate returns an option to name backups after tmpl instead of "<log file>.<timestamp>...".
+// Supported tokens are {name} (log file name without extension), {ext} (log file extension including
+// the dot), {timestamp} (rotation time with millisecond resolution), {index} (distinguishes backups
+// with the same name, starting at 0) and {pid} (process id). {timestamp} and {index} are required, so
+// backups can be ordered for cleanup. The compression extension is appended to the expanded template.
+// For example, "{name}-{timestamp}.{index}{ext}" names backups of app.log like
+// "app-20240101-120000.000.0.log.gz". OpenBackups, NewReader and Follow only support the default names.
+func WithBackupNameTemplate(tmpl string) Option {
+	return func(w *DistributedFileWriter) {
+		w.nameTemplateText = tmpl
+	}
+}
+
+// WithNumericBackups returns an option to name backups like logrotate, with the numeric indices .1, .2, ...
+// where .1 is always the most recent backup. On rotation, existing backups are shifted to the next higher
+// index and backups exceeding the max backups are removed. Compressed backups are compressed during
+// rotation, before they can be shifted again. Multiple processes sharing the log file must use file
+// locking. OpenBackups, NewReader and Follow only support the default names.
+func WithNumericBackups() Option {
+	return func(w *DistributedFileWriter) {
+		w.numericBackups = true
+	}
+}
+
+// WithArchiveDir returns an option to move backups into dir instead of deleting them when they are
+// removed by the retention limits. Backups keep their names, with a numeric suffix appended if the name
+// is taken. If dir is on another filesystem, backups are copied and then deleted. Only backups next to
+// the log file count towards the limits.
+func WithArchiveDir(dir string) Option {
+	return func(w *DistributedFileWriter) {
+		w.archiveDir = dir
+	}
+}
+
+// WithDiskFullPolicy returns an option to free disk space when a write or rotation fails because the
+// disk is full. The oldest backups are deleted one by one, retrying the operation after each deletion,
+// up to maxRetries times. The newest minBackups backups are always kept. If set, onPrune is called
+// with the path of each deleted backup and the error that caused its deletion.
+func WithDiskFullPolicy(maxRetries, minBackups int, onPrune func(path string, err error)) Option {
+	return func(w *DistributedFileWriter) {
+		w.diskFullRetries = maxRetries
+		w.diskFullMinBackups = minBackups
+		w.onDiskFullPrune = onPrune
+	}
+}
+
 // WithPrefix returns an option to prepend the given byte prefix to each log entry.
 func WithPrefix(prefix []byte) Option {
 	return func(w *DistributedFileWriter) {
@@ -58,13 +526,138 @@ func WithPrefix(prefix []byte) Option {
 	}
 }
 
-// WithPrefix returns an option to prepend the given byte prefix to each log entry.
+// WithTimestamps returns an option to prepend the time each line is written, formatted with layout
+// in UTC if utc is set and in local time otherwise, followed by a space, to every line before the
+// prefix. The formatted timestamp is reused for lines written within the same tick of the layout's
+// resolution, i.e. its fractional seconds or else seconds. It counts against the max size.
+func WithTimestamps(layout string, utc bool) Option {
+	return func(w *DistributedFileWriter) {
+		w.timestamps = newTimestampCache(layout, utc)
+	}
+}
+
+// WithDedupe returns an option to suppress consecutive duplicate lines. A line identical to the
+// previous line written within window is counted instead of written. The count is written as a
+// summary line "… last message repeated N times" before the next different line, once the window
+// has expired, and on Sync, Rotate and Close. Lines are compared after the line transform, without
+// the timestamp and prefix.
+func WithDedupe(window time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.dedupe.window = window
+	}
+}
+
+// WithRateLimit returns an option to limit the lines written to linesPerSec on average, with bursts
+// of up to burst lines, using a token bucket. Lines exceeding the limit are handled according to
+// the rate limit mode set with WithRateLimitMode. Dropped lines are counted in Stats, and the next
+// line written is preceded by a marker line "dfwriter: dropped N lines".
+func WithRateLimit(linesPerSec float64, burst int) Option {
+	return func(w *DistributedFileWriter) {
+		w.rateLimit.rate = linesPerSec
+		w.rateLimit.burst = float64(max(burst, 1))
+		w.rateLimit.tokens = w.rateLimit.burst
+	}
+}
+
+// WithRateLimitMode returns an option to set what happens to lines exceeding the rate limit. The
+// default, RateLimitDrop, drops them. RateLimitBlock delays writes until they are admitted.
+func WithRateLimitMode(mode RateLimitMode) Option {
+	return func(w *DistributedFileWriter) {
+		w.rateLimit.mode = mode
+	}
+}
+
+// WithPrefixFunc returns an option to prepend the output of fn to each log entry. fn is called once per line.
+// If a static prefix is set as well, the static prefix is written first, followed by the output of fn.
+func WithPrefixFunc(fn func() []byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.prefixFunc = fn
+	}
+}
+
+// WithPrefixTemplate returns an option to prepend a prefix expanded from tmpl to each log entry.
+// Supported tokens are %t (current timestamp, see WithPrefixTimeLayout), %p (process id),
+// %h (hostname) and %% (a literal percent sign). The expanded template is written after the
+// static prefix and before the output of the prefix function, if those are set.
+func WithPrefixTemplate(tmpl string) Option {
+	return func(w *DistributedFileWriter) {
+		w.templateText = tmpl
+	}
+}
+
+// WithPrefixTimeLayout returns an option to set the layout of %t timestamps in prefix templates (default: time.RFC3339).
+func WithPrefixTimeLayout(layout string) Option {
+	return func(w *DistributedFileWriter) {
+		w.timeLayout = layout
+	}
+}
+
+// WithMaxAge returns an option to delete backup files older than the given age.
 func WithMaxAge(age time.Duration) Option {
 	return func(w *DistributedFileWriter) {
 		w.maxAge = age
 	}
 }
 
+// WithRetentionTiers returns an option to thin out backups by age in tiers, e.g. to keep every backup
+// for a day, one per day for two weeks and one per week for three months:
+//
+//	WithRetentionTiers([]Tier{{Age: 24 * time.Hour}, {Age: 14 * 24 * time.Hour, Granularity: 24 * time.Hour},
+//		{Age: 90 * 24 * time.Hour, Granularity: 7 * 24 * time.Hour}})
+//
+// A backup belongs to the first tier younger than Age, by the rotation time in its name. Within
+// each tier, the newest backup of every Granularity interval is kept and the others are removed.
+// Intervals are aligned to UTC, e.g. days start at midnight UTC and weeks on Monday. Backups older
+// than the last tier are removed. The ages must be increasing. The tiers compose with the other
+// limits, whichever removes more wins: a backup is removed if any of them removes it, and
+// WithMaxBackups limits the backups kept by the tiers.
+func WithRetentionTiers(tiers []Tier) Option {
+	return func(w *DistributedFileWriter) {
+		w.retentionTiers = slices.Clone(tiers)
+	}
+}
+
+// WithMaxAgeString returns an option to delete backup files older than the given age like
+// WithMaxAge, parsed with ParseAge, e.g. "7d". An invalid age fails New or Reconfigure.
+func WithMaxAgeString(age string) Option {
+	d, err := ParseAge(age)
+	return func(w *DistributedFileWriter) {
+		if err != nil {
+			w.optionErr = errors.Join(w.optionErr, fmt.Errorf("invalid max age: %w", err))
+			return
+		}
+		w.maxAge = d
+	}
+}
+
+// WithRotationInterval returns an option to rotate the log file once every interval, regardless of its size.
+// Boundaries are aligned to multiples of the interval since the zero time, so an interval of 24h
+// rotates at midnight UTC.
+func WithRotationInterval(interval time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.interval = interval
+	}
+}
+
+// WithRotateAt returns an option to rotate the log file daily at the given local hour and minute,
+// regardless of its size.
+func WithRotateAt(hour, minute int) Option {
+	return func(w *DistributedFileWriter) {
+		w.rotateDaily = true
+		w.rotateHour = hour
+		w.rotateMinute = minute
+	}
+}
+
+// WithRotateOnOpen returns an option to set whether New rotates an existing log file before
+// returning, so lines of a previous run exceeding the limits aren't mixed with new ones until the
+// first write. See RotateOnOpenLimits and RotateOnOpenOlderThan.
+func WithRotateOnOpen(policy RotateOnOpenPolicy) Option {
+	return func(w *DistributedFileWriter) {
+		w.openPolicy = policy
+	}
+}
+
 // WithFileLocking returns an option to enable filesystem file-locking during writes.
 func WithFileLocking() Option {
 	return func(w *DistributedFileWriter) {
@@ -72,10 +665,398 @@ func WithFileLocking() Option {
 	}
 }
 
+// WithLockFile returns an option to enable file locking on a dedicated lock file at path instead of the
+// log file itself, which avoids interfering with rotation by renaming and with external tools locking
+// the log file. An empty path selects the log path with ".lock" appended, a relative path is relative
+// to the log file's directory. The lock file is created on demand, accessible only to the owner and
+// group, and never removed. All writers sharing a log file must use the same lock file; writers
+// locking the log file itself refuse to start while the default lock file exists.
+func WithLockFile(path string) Option {
+	return func(w *DistributedFileWriter) {
+		w.fsLock = true
+		w.useLockFile = true
+		w.lockPath = path
+	}
+}
+
+// WithSyncPolicy returns an option to set when the log file is synced to stable storage after writes:
+// SyncNever (default), SyncEveryLine, SyncEveryNBytes or SyncInterval. Without syncing, lines
+// reported as written can be lost in a crash of the machine.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(w *DistributedFileWriter) {
+		w.syncPolicy = policy
+	}
+}
+
+// WithFullFsync returns an option to sync the log file with F_FULLFSYNC on darwin, where fsync doesn't
+// flush the drive's write cache. It has no effect on other platforms.
+func WithFullFsync() Option {
+	return func(w *DistributedFileWriter) {
+		w.fullFsync = true
+	}
+}
+
+// WithOpenSync returns an option to open the log file with O_SYNC, so the kernel completes every
+// write only once it is durable.
+func WithOpenSync() Option {
+	return func(w *DistributedFileWriter) {
+		w.openSync = true
+	}
+}
+
+// WithExclusiveOwnership returns an option to acquire the exclusive file lock in New and hold it until Close,
+// for a single writer that doesn't need locking per line but must not run twice. If another writer
+// holds the lock, New fails right away with a *LockError matching ErrLocked, or, with WithLockTimeout,
+// waits up to the lock timeout. Rotation happens under the lock already held. A Follower of the log
+// file, which takes shared locks, blocks until the writer is closed.
+func WithExclusiveOwnership() Option {
+	return func(w *DistributedFileWriter) {
+		w.exclusiveOwner = true
+	}
+}
+
+// WithLockMode returns an option to set the mechanism used for file locking, see LockMode (default: LockFlock).
+// Over NFS, flock locks are only reliable where the client emulates them with byte-range locks, so
+// writers on different machines should use LockOFD. All processes sharing a log file must use the same mode.
+func WithLockMode(mode LockMode) Option {
+	return func(w *DistributedFileWriter) {
+		w.lockMode = mode
+	}
+}
+
+// WithLockTimeout returns an option to give up acquiring the file lock after the given duration,
+// failing the write with a *LockError matching ErrLockTimeout, instead of blocking until the lock
+// is available. This keeps writers from freezing if another process hangs while holding the lock.
+// The lock is polled with exponential backoff up to 100ms. Zero blocks indefinitely (default).
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.lockTimeout = timeout
+	}
+}
+
+// WithRenameRotation returns an option to rotate by renaming the log file to the backup path and
+// opening a fresh log file, instead of copying and truncating it. Writers sharing the file detect
+// the rename and reopen the log path before their next write. Implies WithReopenOnRotate.
+func WithRenameRotation() Option {
+	return func(w *DistributedFileWriter) {
+		w.renameRotation = true
+		w.reopenOnRotate = true
+	}
+}
+
+// WithDirSync returns an option to sync the log file's directory after backups are created, compressed
+// or removed, so they survive a power loss. This costs an additional syscall per rotation and is a no-op on
+// platforms that don't support syncing directories.
+func WithDirSync() Option {
+	return func(w *DistributedFileWriter) {
+		w.dirSync = true
+	}
+}
+
+// WithReopenOnRotate returns an option to check before each write whether the log file was renamed or
+// removed, e.g. by logrotate or another process, and reopen the log path if so.
+func WithReopenOnRotate() Option {
+	return func(w *DistributedFileWriter) {
+		w.reopenOnRotate = true
+	}
+}
+
+// WithOnReopen returns an option to set a callback invoked with the log path whenever the log file is reopened.
+func WithOnReopen(onReopen func(path string)) Option {
+	return func(w *DistributedFileWriter) {
+		w.onReopen = onReopen
+	}
+}
+
+// WithOnRotate returns an option to set a hook invoked with the path of each backup once it is complete,
+// including the compression extension if compression is enabled. The hook is called in a background
+// goroutine without holding any locks, so slow hooks like uploads don't block writers. Calls are
+// serialized in the order the backups completed, which may differ from the rotation order with
+// compression. Close waits for in-flight calls, so the hook must not write to or close the writer.
+func WithOnRotate(fn func(backupPath string)) Option {
+	return func(w *DistributedFileWriter) {
+		w.onRotate = fn
+	}
+}
+
+// WithPreserveBackupTimes returns an option to set the access and modification times of each backup
+// to the modification time of the log file when it was rotated, i.e. the time of its last write,
+// instead of the time the backup was written, so tools removing files by their modification time
+// see the age of the data. This also applies to compressed and encrypted backups. The rotation time
+// in the backup name is unaffected.
+func WithPreserveBackupTimes() Option {
+	return func(w *DistributedFileWriter) {
+		w.preserveTimes = true
+	}
+}
+
+// WithEventBuffer returns an option to deliver the rotations, backup removals, reopens and errors of
+// the writer as events on the channel returned by Events, buffering up to size events. Events are
+// sent without blocking, so the write path never waits for a slow reader; events not fitting into
+// the buffer are dropped and counted in Stats. A size of 0 disables events.
+func WithEventBuffer(size int) Option {
+	return func(w *DistributedFileWriter) {
+		w.eventBuffer = size
+	}
+}
+
+// WithPostRotateCommand returns an option to run the command argv with the path of each backup once
+// it is complete appended as the last argument, and in the environment as DFWRITER_BACKUP. The
+// command is run like the hook set with WithOnRotate, after it: in a background goroutine, one at a
+// time in the order the backups completed. Its combined output is reported to the error handler if
+// it fails. A command running longer than timeout is killed; zero means no timeout. Close waits for
+// queued and running commands.
+func WithPostRotateCommand(argv []string, timeout time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.postRotateCommand = slices.Clone(argv)
+		w.postRotateTimeout = timeout
+	}
+}
+
+// WithLatestSymlink returns an option to maintain a symbolic link at path pointing to the newest
+// backup, replaced atomically once a backup is complete, including its compression. The path is
+// relative to the log file's directory unless absolute, and defaults to the log path with a .latest
+// extension if empty. Where symbolic links aren't supported, a text file containing the path of the
+// newest backup is maintained instead. The link is never treated as a backup.
+func WithLatestSymlink(path string) Option {
+	return func(w *DistributedFileWriter) {
+		w.latestLink = true
+		w.latestPath = path
+	}
+}
+
+// WithChecksums returns an option to record the SHA-256 digest of every backup in the manifest
+// named like the log file with a .sha256 extension next to the backups, in the format of sha256sum.
+// The digest is computed while copying or compressing the backup and recorded once it is complete.
+// Entries of removed backups are pruned by the cleanup. See VerifyBackups. Checksums can't be
+// combined with numeric backups.
+func WithChecksums() Option {
+	return func(w *DistributedFileWriter) {
+		w.checksums = true
+	}
+}
+
+// WithUploader returns an option to upload every completed backup with u, e.g. to object storage,
+// and delete it locally once uploaded if deleteAfter is set. Completed backups are appended to a
+// queue file named like the log file with an .uploads extension, which a background worker drains,
+// oldest first, retrying failed uploads with exponential backoff. Close cancels the context of a
+// running upload; uploads still queued are resumed by the next writer on the log file. With several
+// processes sharing the log file, a backup may be uploaded more than once. Backups removed by the
+// cleanup before their upload are reported to the error handler and dropped from the queue. An
+// uploader can't be combined with numeric backups.
+func WithUploader(u Uploader, deleteAfter bool) Option {
+	return func(w *DistributedFileWriter) {
+		w.uploader = u
+		w.deleteUploaded = deleteAfter
+	}
+}
+
+// WithEncryption returns an option to encrypt backups with AES-256-GCM using key, which must be
+// EncryptionKeySize bytes long. Backups are encrypted after compression and named with an additional
+// .enc extension. The backup is written unencrypted first and replaced by the encrypted copy in the
+// background, like for compression. Read encrypted backups with DecryptBackup or NewReader with
+// ReadDecryptionKey.
+func WithEncryption(key []byte) Option {
+	return func(w *DistributedFileWriter) {
+		w.encryptionKey = bytes.Clone(key)
+	}
+}
+
 // WithCompression returns an option to enable gzip compression for generated backup log files.
 func WithCompression() Option {
+	return WithCompressionFormat(CompressionGzip)
+}
+
+// WithCompressionFormat returns an option to set the compression format for generated backup log files.
+func WithCompressionFormat(format CompressionFormat) Option {
+	return func(w *DistributedFileWriter) {
+		w.compression = format
+	}
+}
+
+// WithCompressionLevel returns an option to set the gzip compression level of backups, from
+// gzip.HuffmanOnly and gzip.BestSpeed to gzip.BestCompression, trading compression ratio for speed.
+// Defaults to gzip.DefaultCompression. It doesn't affect zstd compression.
+func WithCompressionLevel(level int) Option {
+	return func(w *DistributedFileWriter) {
+		w.compressionLevel = level
+	}
+}
+
+// WithCompressExisting returns an option to compress the backups left uncompressed by previous runs,
+// e.g. after enabling compression, with the current compression format and encryption. New starts
+// compressing them in the background, one at a time, verifying each compressed backup before the
+// uncompressed one is removed. Close interrupts the compression. It can't be combined with numeric
+// backups. See CompressBackups for compressing backups without a writer.
+func WithCompressExisting() Option {
+	return func(w *DistributedFileWriter) {
+		w.compressExisting = true
+	}
+}
+
+// WithVerifyRotation returns an option to read every backup back before truncating the log file
+// during rotation and compare its size and CRC-32 with the data copied from the log file, catching
+// writes silently lost e.g. by network filesystems. On a mismatch, the backup is deleted, the log
+// file is left untouched and the write triggering the rotation fails with ErrBackupVerification.
+// Compressed backups are also decompressed and compared with the uncompressed backup before it is
+// removed. Backups created by WithRenameRotation are not copied, so there is nothing to verify.
+func WithVerifyRotation() Option {
 	return func(w *DistributedFileWriter) {
-		w.compress = true
+		w.verifyRotation = true
+	}
+}
+
+// WithPreallocate returns an option to allocate disk space for the log file up to the max size when
+// opening it and after each rotation, with fallocate and without changing the file's size, avoiding
+// fragmentation and running out of space midway. Preallocating is only supported on Linux and
+// silently skipped elsewhere, on filesystems not supporting it and without a max size.
+func WithPreallocate() Option {
+	return func(w *DistributedFileWriter) {
+		w.preallocateSpace = true
+	}
+}
+
+// WithDropCacheAfterRotate returns an option to drop the cached pages of each backup and of the
+// log file it was copied from once the backup is synced, with posix_fadvise(POSIX_FADV_DONTNEED),
+// so rotating large files doesn't evict other processes' data from the page cache. Backups
+// compressed in the background are dropped once compressed. Dropping is only supported on Linux
+// and silently skipped elsewhere.
+func WithDropCacheAfterRotate() Option {
+	return func(w *DistributedFileWriter) {
+		w.dropCacheOnRotate = true
+	}
+}
+
+// WithSanitize returns an option to clean up every line before it is written according to mode,
+// e.g. to keep binary garbage from breaking downstream parsers. Lines are sanitized after the line
+// transform, if set, and before the size check, so escaping may make a line exceed the max size.
+// Clean lines are written without copying them.
+func WithSanitize(mode SanitizeMode) Option {
+	return func(w *DistributedFileWriter) {
+		w.sanitizeMode = mode
+	}
+}
+
+// WithSequenceNumbers returns an option to add "seq=N " before the prefix of every line, where N
+// counts the lines written to the log file, so gaps and duplicates can be detected downstream. The
+// next number is kept in a file next to the log file, "<log>.seq", so numbering continues after a
+// restart. Writers reserve numbers in blocks; numbers reserved but unused by a writer that doesn't
+// close cleanly are skipped, as are those of failed writes.
+//
+// With file locking, writers sharing the log file instead reserve an epoch E in that file, under an
+// exclusive lock on it, and add "seq=E.N ", with N counting their own lines from 1. Numbers are
+// unique and increase without gaps within an epoch, but the lines of concurrent writers interleave,
+// e.g. 1.1, 2.1, 1.2, 2.2, so gaps are detected per epoch. Use WithSequencePosition to append the
+// number instead.
+func WithSequenceNumbers() Option {
+	return func(w *DistributedFileWriter) {
+		w.sequenceNumbers = true
+	}
+}
+
+// WithSequencePosition returns an option to set where the sequence number is added to a line, see
+// WithSequenceNumbers. Defaults to SequenceStart.
+func WithSequencePosition(pos SequencePosition) Option {
+	return func(w *DistributedFileWriter) {
+		w.sequencePosition = pos
+	}
+}
+
+// WithJSONEnvelope returns an option to write every line as a JSON object of the form
+// {"ts":"<RFC3339Nano>","prefix":"<prefix>","msg":"<line>"}, e.g. for log collectors requiring
+// JSON lines. The timestamp is the time the line is written, the prefix is the line's prefix and
+// the message is the line without the delimiter, escaped as JSON strings with invalid UTF-8
+// replaced by U+FFFD. fieldNames replace the default field names in order. The envelope counts
+// towards the max size, and oversized lines are rejected, see WithOversizeLinePolicy.
+func WithJSONEnvelope(fieldNames ...string) Option {
+	return func(w *DistributedFileWriter) {
+		w.envelopeFields = append([]string{}, fieldNames...)
+	}
+}
+
+// WithAsync returns an option to queue up to queueLines writes and write them in order on a
+// background goroutine, so Write, WriteLine and their variants return without waiting for disk I/O
+// or file locks. Each write is queued as a whole, usually as a single line. If the queue is full,
+// policy determines whether the write blocks, is dropped or replaces the oldest queued write.
+// Dropped writes are counted in Stats and by marker lines written where they were dropped.
+// Sync and Close return once the queued writes are written. Errors writing queued writes are
+// reported to the error handler, see WithAsyncFailOnError.
+func WithAsync(queueLines int, policy OverflowPolicy) Option {
+	return func(w *DistributedFileWriter) {
+		w.asyncSize = queueLines
+		w.asyncPolicy = policy
+	}
+}
+
+// WithAsyncFailOnError returns an option to also return an error writing a queued write from the
+// next write, Sync or Close of an async writer, which isn't queued then. It requires WithAsync with
+// OverflowBlock.
+func WithAsyncFailOnError() Option {
+	return func(w *DistributedFileWriter) {
+		w.asyncFailOnError = true
+	}
+}
+
+// WithFlushInterval returns an option to periodically write any buffered partial line and sync the log file.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.flushInterval = interval
+	}
+}
+
+// WithCleanupInterval returns an option to periodically delete the backups exceeding the limits set
+// with WithMaxBackups, WithMaxAge and WithMaxTotalBytes, so they are enforced even if the log file is
+// rarely rotated. The limits are always enforced by New and after each rotation.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.cleanupInterval = interval
+	}
+}
+
+// WithTee returns an option to copy every line written to the log file, including its prefix, to
+// tee as well, in the same order, e.g. to os.Stderr. It can be given several times to copy to
+// several writers. Errors writing to tee don't fail the write, they are reported to the error
+// handler, see WithErrorHandler. The tee is written to while holding the writer's lock, so it
+// must not block.
+func WithTee(tee io.Writer) Option {
+	return func(w *DistributedFileWriter) {
+		w.tees = append(w.tees, tee)
+	}
+}
+
+// WithClock returns an option to take the current time and tickers from c instead of the time
+// package, e.g. to test rotation and retention policies with a fake clock like the one of the
+// dfwritertest package. It applies to the timestamps of backups and lines, time-based rotation,
+// retention by age, and the background flushes, syncs and cleanups. File modification times are
+// still set by the file system. A nil clock selects the real one.
+func WithClock(c Clock) Option {
+	return func(w *DistributedFileWriter) {
+		if c == nil {
+			c = realClock{}
+		}
+		w.clock = c
+	}
+}
+
+// WithRecentBuffer returns an option to keep the last lines written to the log file in memory,
+// e.g. to serve them for debugging with the dfwriterhttp package. The lines are kept as written,
+// including their prefix, in a ring of the given number of slots allocated up front, and are
+// returned by RecentLines. Lines written by other processes are not included. A size of 0 disables
+// the buffer. It can't be combined with binary records.
+func WithRecentBuffer(lines int) Option {
+	return func(w *DistributedFileWriter) {
+		w.recentSize = lines
+	}
+}
+
+// WithErrorHandler returns an option to set a callback for errors that occur outside of the calls
+// returning errors, such as the compression of rotated backup files or writing to a tee. The handler
+// is called from a separate goroutine, one at a time per writer, so reporting never blocks writes.
+// Up to 64 errors are queued, further ones are dropped and their number is reported instead.
+// Close delivers the queued errors before returning. By default, errors are written to os.Stderr.
+func WithErrorHandler(handler func(error)) Option {
+	return func(w *DistributedFileWriter) {
+		w.onError = handler
 	}
 }
 
@@ -86,3 +1067,29 @@ func WithAtomicLineSize(size int) Option {
 		w.atomicLineSize = size
 	}
 }
+
+// WithReadBufferSize returns an option to set the size in bytes of the chunks read by ReadFrom.
+// The default is 32KB. Sizes below 1 are ignored.
+func WithReadBufferSize(size int) Option {
+	return func(w *DistributedFileWriter) {
+		if size > 0 {
+			w.readBufferSize = size
+		}
+	}
+}
+
+// WithMaxOpenFiles returns an option to limit the writers a MultiWriter keeps open at the same time.
+// Creating a writer beyond the limit closes the least recently used one. It is ignored by New.
+func WithMaxOpenFiles(maxOpen int) Option {
+	return func(w *DistributedFileWriter) {
+		w.maxOpenFiles = maxOpen
+	}
+}
+
+// WithIdleTimeout returns an option to close the writers of a MultiWriter that haven't been written
+// to for the given duration. They are created again once needed. It is ignored by New.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(w *DistributedFileWriter) {
+		w.idleTimeout = timeout
+	}
+}
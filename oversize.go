@@ -0,0 +1,73 @@
+package dfwriter
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// OversizeLinePolicy determines how lines exceeding the max size are handled.
+type OversizeLinePolicy int
+
+const (
+	// OversizeError rejects oversized lines with ErrLineTooLong.
+	OversizeError OversizeLinePolicy = iota
+	// OversizeTruncate cuts oversized lines to fit the max size and appends the truncation marker.
+	OversizeTruncate
+	// OversizeSplit breaks oversized lines into several lines of at most the max size, each carrying the prefix.
+	OversizeSplit
+)
+
+// defaultTruncationMarker is appended to lines cut by OversizeTruncate.
+var defaultTruncationMarker = []byte("…[truncated]")
+
+// writeOversizeLine handles a line of content, followed by the delimiter if delimited, exceeding the
+// max size according to the oversize line policy. Binary records are always rejected. prefixLen is
+// the length of the prefix the line would be written with. The caller must hold w.mu.
+func (w *DistributedFileWriter) writeOversizeLine(content []byte, delimited bool, prefixLen int) error {
+	length := w.lineLength(prefixLen, len(content), delimited)
+	tooLong := &LineTooLongError{Length: length, Max: w.maxSize}
+	if w.binaryRecords {
+		// Records can't be cut without corrupting them
+		if w.maxSize <= 0 || w.maxSize > maxFrameSize {
+			tooLong.Max = maxFrameSize
+		}
+		return tooLong
+	}
+	// Space left for line content once the prefix and a trailing delimiter are accounted for
+	space := int(w.maxSize) - length + len(content)
+
+	switch w.oversizePolicy {
+	case OversizeTruncate:
+		keep := space - len(w.truncationMarker)
+		if keep <= 0 {
+			return tooLong
+		}
+		// Avoid cutting a multi-byte UTF-8 sequence in half
+		for keep > 0 && !utf8.RuneStart(content[keep]) {
+			keep--
+		}
+
+		truncated := make([]byte, 0, space)
+		truncated = append(truncated, content[:keep]...)
+		truncated = append(truncated, w.truncationMarker...)
+		return w.writeContent(truncated, delimited)
+	case OversizeSplit:
+		// Every chunk except the last is terminated by an added delimiter
+		chunkSize := int(w.maxSize) - prefixLen - 1
+		if chunkSize <= 0 {
+			return tooLong
+		}
+
+		// Copy the line, as it may alias the write buffer which writeContent resets
+		rest := bytes.Clone(content)
+		for len(rest) > space {
+			if err := w.writeContent(rest[:chunkSize], true); err != nil {
+				return err
+			}
+			rest = rest[chunkSize:]
+		}
+		return w.writeContent(rest, delimited)
+	default:
+		return tooLong
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dfwriter
+
+import "os"
+
+// copyOwner is a no-op on platforms without unix file ownership.
+func copyOwner(f fsFile, src os.FileInfo) error {
+	return nil
+}
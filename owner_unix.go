@@ -0,0 +1,21 @@
+//go:build unix
+
+package dfwriter
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner sets the owner and group of f to those of src. Only root may give away files,
+// so this is a no-op for other users.
+func copyOwner(f fsFile, src os.FileInfo) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	stat, ok := src.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return f.Chown(int(stat.Uid), int(stat.Gid))
+}
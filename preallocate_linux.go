@@ -0,0 +1,9 @@
+package dfwriter
+
+import "golang.org/x/sys/unix"
+
+// preallocateFile allocates disk space for the first size bytes of f without changing its size.
+// Fails with an error matching errors.ErrUnsupported if the filesystem doesn't support it.
+func preallocateFile(f fsFile, size int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+}
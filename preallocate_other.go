@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dfwriter
+
+import "errors"
+
+// preallocateFile fails with errors.ErrUnsupported, as preallocating is only supported on Linux.
+func preallocateFile(f fsFile, size int64) error {
+	return errors.ErrUnsupported
+}
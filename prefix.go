@@ -0,0 +1,194 @@
+package dfwriter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// TimestampPrefix returns a prefix function for WithPrefixFunc that formats the current time
+// with the given layout, followed by a space.
+func TimestampPrefix(layout string) func() []byte {
+	return func() []byte {
+		return append(time.Now().AppendFormat(nil, layout), ' ')
+	}
+}
+
+// timestampCache holds the formatted timestamp of the current resolution tick for WithTimestamps.
+type timestampCache struct {
+	layout     string
+	utc        bool
+	resolution int64 // nanoseconds per tick, the smallest unit the layout formats
+	tick       int64
+	formatted  []byte
+}
+
+// newTimestampCache returns a cache for timestamps formatted with layout, in UTC if utc is set.
+func newTimestampCache(layout string, utc bool) *timestampCache {
+	return &timestampCache{layout: layout, utc: utc, resolution: layoutResolution(layout), tick: -1}
+}
+
+// appendTo appends the timestamp of now to buf, formatting it only once per tick.
+func (c *timestampCache) appendTo(buf []byte, now time.Time) []byte {
+	if tick := now.UnixNano() / c.resolution; tick != c.tick {
+		if c.utc {
+			now = now.UTC()
+		}
+		c.formatted = now.AppendFormat(c.formatted[:0], c.layout)
+		c.tick = tick
+	}
+	return append(buf, c.formatted...)
+}
+
+// layoutResolution returns the nanoseconds per unit of the smallest unit formatted by layout: the
+// fractional seconds, if any, or else seconds.
+func layoutResolution(layout string) int64 {
+	digits := 0
+	for i := 0; i+1 < len(layout); i++ {
+		if layout[i] != '.' && layout[i] != ',' || layout[i+1] != '0' && layout[i+1] != '9' {
+			continue
+		}
+		j := i + 1
+		for j < len(layout) && layout[j] == layout[i+1] {
+			j++
+		}
+		// Like in time.Format, a fraction must not be followed by another digit
+		if j < len(layout) && isDigit(layout[j]) {
+			continue
+		}
+		digits = max(digits, j-i-1)
+	}
+
+	resolution := int64(time.Second)
+	for range min(digits, 9) {
+		resolution /= 10
+	}
+	return resolution
+}
+
+// isDigit reports whether c is an ASCII digit.
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// templatePart is either a literal or a timestamp placeholder of a compiled prefix template.
+type templatePart struct {
+	literal   []byte
+	timestamp bool
+}
+
+// prefixTemplate is a compiled prefix template. See WithPrefixTemplate.
+type prefixTemplate []templatePart
+
+// compilePrefixTemplate parses tmpl, resolving the pid and hostname tokens once, since they don't
+// change over the lifetime of a writer. Only timestamps are expanded per line.
+func compilePrefixTemplate(tmpl string) (prefixTemplate, error) {
+	var parts prefixTemplate
+	var literal []byte
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			literal = append(literal, tmpl[i])
+			continue
+		}
+
+		i++
+		if i == len(tmpl) {
+			return nil, fmt.Errorf("prefix template %q ends with an incomplete token", tmpl)
+		}
+		switch tmpl[i] {
+		case '%':
+			literal = append(literal, '%')
+		case 'p':
+			literal = strconv.AppendInt(literal, int64(os.Getpid()), 10)
+		case 'h':
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve hostname for prefix template: %w", err)
+			}
+			literal = append(literal, hostname...)
+		case 't':
+			if len(literal) > 0 {
+				parts = append(parts, templatePart{literal: literal})
+				literal = nil
+			}
+			parts = append(parts, templatePart{timestamp: true})
+		default:
+			return nil, fmt.Errorf("prefix template %q contains unknown token %%%c", tmpl, tmpl[i])
+		}
+	}
+	if len(literal) > 0 {
+		parts = append(parts, templatePart{literal: literal})
+	}
+
+	return parts, nil
+}
+
+// appendTo appends the expansion of the template to buf, formatting timestamps as now with layout.
+func (t prefixTemplate) appendTo(buf []byte, layout string, now time.Time) []byte {
+	for _, part := range t {
+		if part.timestamp {
+			buf = now.AppendFormat(buf, layout)
+		} else {
+			buf = append(buf, part.literal...)
+		}
+	}
+	return buf
+}
+
+// WriteLineWithPrefix is like WriteLine, but prefix replaces the static prefix set with WithPrefix
+// for this line, e.g. to tag it with a request ID. Other prefixes are still applied, and the
+// oversized line check accounts for prefix.
+func (w *DistributedFileWriter) WriteLineWithPrefix(prefix, line []byte) error {
+	if w.async != nil {
+		// A nil prefix of a queued write keeps the static prefix
+		return w.enqueueEntry(nil, asyncEntry{data: line, line: true, prefix: append([]byte{}, prefix...)})
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	defer func(prefix []byte) { w.prefix = prefix }(w.prefix)
+	w.prefix = prefix
+	return w.writeLine(line)
+}
+
+// WriterWithPrefix returns a view of w whose writes are written like by Write, but with prefix
+// replacing the static prefix set with WithPrefix. The view shares the buffer of w, so a partial
+// line is written with the prefix of the write completing it.
+func (w *DistributedFileWriter) WriterWithPrefix(prefix []byte) io.Writer {
+	// A nil prefix of a queued write keeps the static prefix
+	return prefixWriter{w: w, prefix: append([]byte{}, prefix...)}
+}
+
+// prefixWriter is the view returned by WriterWithPrefix.
+type prefixWriter struct {
+	w      *DistributedFileWriter
+	prefix []byte
+}
+
+func (p prefixWriter) Write(b []byte) (int, error) {
+	w := p.w
+	if w.async != nil {
+		if err := w.enqueueEntry(nil, asyncEntry{data: b, prefix: p.prefix}); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	defer func(prefix []byte) { w.prefix = prefix }(w.prefix)
+	w.prefix = p.prefix
+	return w.write(b)
+}
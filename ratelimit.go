@@ -0,0 +1,107 @@
+package dfwriter
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RateLimitMode determines what happens to lines exceeding the rate limit set with WithRateLimit.
+type RateLimitMode int
+
+const (
+	// RateLimitDrop drops lines exceeding the rate limit and counts them (default).
+	RateLimitDrop RateLimitMode = iota
+	// RateLimitBlock delays lines exceeding the rate limit until they are admitted.
+	RateLimitBlock
+)
+
+// rateLimiter is a token bucket limiting the lines written per second.
+type rateLimiter struct {
+	rate    float64 // tokens added per second, 0 if unlimited
+	burst   float64
+	mode    RateLimitMode
+	tokens  float64
+	last    time.Time
+	dropped int64 // lines dropped since the last marker line
+}
+
+// reserve takes a token from the bucket, refilled up to now. In RateLimitDrop mode, it reports
+// false without taking a token if the bucket is empty. In RateLimitBlock mode, the token is
+// borrowed and the time to wait until it is available is returned.
+func (l *rateLimiter) reserve(now time.Time) (bool, time.Duration) {
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	if l.mode != RateLimitBlock {
+		return false, 0
+	}
+	l.tokens--
+	return true, time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// limitRate reports whether the next line is admitted by the rate limit, counting it as dropped
+// otherwise. In RateLimitBlock mode, it waits for the line to be admitted, giving up with an
+// error once the context of the write, if any, is done. The caller must hold w.mu.
+func (w *DistributedFileWriter) limitRate() (bool, error) {
+	l := &w.rateLimit
+	if l.rate <= 0 {
+		return true, nil
+	}
+
+	admitted, wait := l.reserve(w.clock.Now())
+	if !admitted {
+		l.dropped++
+		w.stats.droppedLines.Add(1)
+		// The line isn't the previous line written to compare duplicates against
+		w.resetDedupe()
+		return false, nil
+	}
+	if wait <= 0 {
+		return true, nil
+	}
+
+	var done <-chan struct{}
+	if w.lockCtx != nil {
+		done = w.lockCtx.Done()
+	}
+	if !w.sleep(wait, done) {
+		// Return the borrowed token
+		l.tokens++
+		return false, fmt.Errorf("failed to wait for rate limit: %w", w.lockCtx.Err())
+	}
+	return true, nil
+}
+
+// admitLine reports whether a line of content is to be written, i.e. neither suppressed as a
+// duplicate nor dropped by the rate limit. The caller must hold w.mu.
+func (w *DistributedFileWriter) admitLine(content []byte, delimited bool) (bool, error) {
+	if w.suppressDuplicate(content, delimited) {
+		return false, nil
+	}
+	return w.limitRate()
+}
+
+// writeDropped writes a marker line for the lines dropped by the rate limit, if any.
+// The caller must hold w.mu.
+func (w *DistributedFileWriter) writeDropped() error {
+	l := &w.rateLimit
+	if l.dropped == 0 {
+		return nil
+	}
+
+	w.notice = append(w.notice[:0], "dfwriter: dropped "...)
+	w.notice = strconv.AppendInt(w.notice, l.dropped, 10)
+	w.notice = append(w.notice, " lines"...)
+	if err := w.writeContent(w.notice, true); err != nil {
+		return err
+	}
+	l.dropped = 0
+	return nil
+}
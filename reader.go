@@ -0,0 +1,192 @@
+package dfwriter
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ReaderOption configures a reader created with NewReader.
+type ReaderOption func(*logReader)
+
+// ReadSince returns an option to skip backups rotated before since. As a backup's timestamp is
+// the time of its rotation, the skipped backups only contain lines written before since.
+func ReadSince(since time.Time) ReaderOption {
+	return func(r *logReader) {
+		r.since = since
+	}
+}
+
+// ReadBackupDir returns an option to read backups stored in dir, see WithBackupDir.
+func ReadBackupDir(dir string) ReaderOption {
+	return func(r *logReader) {
+		r.backupDir = dir
+	}
+}
+
+// ReadDecryptionKey returns an option to decrypt backups encrypted with key, see WithEncryption.
+// Without it, reading an encrypted backup fails.
+func ReadDecryptionKey(key []byte) ReaderOption {
+	return func(r *logReader) {
+		r.key = key
+	}
+}
+
+// logReader reads a log file's backups, oldest first, followed by the log file itself.
+type logReader struct {
+	since     time.Time
+	backupDir string
+	key       []byte
+	paths     []string
+	current   io.Reader
+	closers   []io.Closer
+}
+
+// NewReader returns a reader of everything written to the log file at logPath that is still retained:
+// its backups, oldest first and decrypted and decompressed if necessary, followed by the log file itself.
+// Files removed while reading, e.g. by cleanup of a concurrent writer, are skipped.
+func NewReader(logPath string, options ...ReaderOption) (io.ReadCloser, error) {
+	r := &logReader{}
+	for _, o := range options {
+		o(r)
+	}
+
+	backups, err := OpenBackupsInDir(logPath, r.backupDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	for _, backup := range backups {
+		if backup.Timestamp.Before(r.since) {
+			continue
+		}
+		r.paths = append(r.paths, backup.Path)
+	}
+	r.paths = append(r.paths, logPath)
+
+	return r, nil
+}
+
+// Read reads from the current file, moving on to the next one once it is exhausted.
+func (r *logReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.openNext(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			if closeErr := r.closeCurrent(); closeErr != nil {
+				return n, closeErr
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+// openNext opens the next file to read. Backups that were compressed or encrypted since they were
+// listed are read from the processed file, backups that were removed are skipped.
+func (r *logReader) openNext() error {
+	path := r.paths[0]
+	r.paths = r.paths[1:]
+
+	current, closers, err := openBackupFile(osFS{}, path, r.key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.closers = closers
+	r.current = current
+	return nil
+}
+
+// openBackupFile opens the backup at path on fsys, decrypting it with key and decompressing it as its
+// extensions require. A backup that was compressed or encrypted since it was listed is opened under
+// its new name. Returns the reader of the contents and the closers to close once done reading,
+// innermost first.
+func openBackupFile(fsys fileSystem, path string, key []byte) (io.Reader, []io.Closer, error) {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) && !isCompressed(path) && !isEncrypted(path) {
+		// The backup may have been compressed or encrypted since it was listed
+		for _, ext := range backupExtensions {
+			if file, err = fsys.OpenFile(path+ext, os.O_RDONLY, 0); err == nil {
+				path += ext
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	closers := []io.Closer{file}
+	var current io.Reader = file
+	fail := func(err error) (io.Reader, []io.Closer, error) {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if isEncrypted(path) {
+		if key == nil {
+			return fail(errors.New("encrypted backup requires a decryption key"))
+		}
+		decrypter, err := newDecryptReader(file, key)
+		if err != nil {
+			return fail(err)
+		}
+		current = decrypter
+	}
+
+	switch {
+	case strings.HasSuffix(strings.TrimSuffix(path, encryptedExt), CompressionGzip.extension()):
+		gzipReader, err := gzip.NewReader(current)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, gzipReader)
+		current = gzipReader
+	case strings.HasSuffix(strings.TrimSuffix(path, encryptedExt), CompressionZstd.extension()):
+		decoder, err := zstd.NewReader(current)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, decoder.IOReadCloser())
+		current = decoder
+	}
+
+	return current, closers, nil
+}
+
+// closeCurrent closes the current file and its decompressor.
+func (r *logReader) closeCurrent() error {
+	var errs []error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		errs = append(errs, r.closers[i].Close())
+	}
+	r.closers = nil
+	r.current = nil
+
+	return errors.Join(errs...)
+}
+
+// Close closes the file currently being read.
+func (r *logReader) Close() error {
+	r.paths = nil
+	return r.closeCurrent()
+}
@@ -0,0 +1,65 @@
+package dfwriter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// defaultReadBufferSize is the size of the chunks read by ReadFrom unless set with WithReadBufferSize.
+const defaultReadBufferSize = 32 * 1024
+
+// ReadFrom reads r until EOF in chunks of the read buffer size, see WithReadBufferSize, and writes
+// each chunk like Write, implementing io.ReaderFrom so io.Copy streams into the writer. A trailing
+// partial line is buffered. The writer is only locked while writing a chunk, so other writes may
+// be interleaved between lines of r. Returns the number of bytes consumed from r and the first
+// error encountered other than io.EOF. On a write error, the count covers the input up to the
+// last line successfully written. With binary records, r is read until EOF and written as a single
+// record.
+func (w *DistributedFileWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.mu.Lock()
+	closed, size, binaryRecords := w.closed, w.readBufferSize, w.binaryRecords
+	w.mu.Unlock()
+	if closed {
+		return 0, ErrClosed
+	}
+
+	if binaryRecords {
+		// The whole input is a single record
+		record, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(record); err != nil {
+			return 0, err
+		}
+		return int64(len(record)), nil
+	}
+
+	chunk := make([]byte, size)
+	var total int64
+	// Number of bytes of r up to and including the last newline written
+	var lineEnd int64
+	for {
+		n, readErr := r.Read(chunk)
+		if n > 0 {
+			written, err := w.Write(chunk[:n])
+			if err != nil {
+				if written > 0 {
+					lineEnd = total + int64(written)
+				}
+				return lineEnd, err
+			}
+			if i := bytes.LastIndexByte(chunk[:n], w.delimiter); i >= 0 {
+				lineEnd = total + int64(i) + 1
+			}
+			total += int64(n)
+		}
+		if errors.Is(readErr, io.EOF) {
+			return total, nil
+		}
+		if readErr != nil {
+			return total, readErr
+		}
+	}
+}
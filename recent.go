@@ -0,0 +1,62 @@
+package dfwriter
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+)
+
+// recentLines is a ring of the last lines written, see WithRecentBuffer. Its slots are allocated
+// up front and their buffers reused, so recording a line only allocates once it is longer than
+// any line held by its slot before.
+type recentLines struct {
+	mu    sync.Mutex
+	slots [][]byte
+	next  int // slot of the next line
+	count int // number of slots holding a line
+}
+
+// newRecentLines creates a ring of n lines.
+func newRecentLines(n int) *recentLines {
+	return &recentLines{slots: make([][]byte, n)}
+}
+
+// add records the lines of data, each ending with delimiter except possibly the last one.
+func (r *recentLines) add(data []byte, delimiter byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, delimiter) + 1
+		if end == 0 {
+			end = len(data)
+		}
+		r.slots[r.next] = append(r.slots[r.next][:0], data[:end]...)
+		r.next = (r.next + 1) % len(r.slots)
+		r.count = min(r.count+1, len(r.slots))
+		data = data[end:]
+	}
+}
+
+// lines returns copies of the recorded lines, oldest first.
+func (r *recentLines) lines() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lines := make([][]byte, 0, r.count)
+	for i := range r.count {
+		slot := r.slots[(r.next-r.count+i+len(r.slots))%len(r.slots)]
+		lines = append(lines, slices.Clone(slot))
+	}
+	return lines
+}
+
+// RecentLines returns copies of the last lines written to the log file, oldest first, as written
+// including their prefix and delimiter, see WithRecentBuffer. Returns nil without WithRecentBuffer.
+// It is safe to call concurrently with writes.
+func (w *DistributedFileWriter) RecentLines() [][]byte {
+	if w.recent == nil {
+		return nil
+	}
+	return w.recent.lines()
+}
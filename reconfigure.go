@@ -0,0 +1,65 @@
+package dfwriter
+
+import "fmt"
+
+// validateLimits checks the settings that can be changed by Reconfigure.
+func (w *DistributedFileWriter) validateLimits() error {
+	if w.optionErr != nil {
+		return w.optionErr
+	}
+	switch w.compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("unsupported compression format %q", w.compression)
+	}
+	if w.maxBackups < NoBackups {
+		return fmt.Errorf("invalid max backups %d", w.maxBackups)
+	}
+	return validateTiers(w.retentionTiers)
+}
+
+// Reconfigure applies options to the open writer, e.g. after reloading a configuration, taking
+// effect with the next write. Only the options setting the max size, max backups, max age, max
+// total bytes, retention tiers, prefix and compression are applied, others are ignored. The options are validated
+// like by New, and none are applied if any is invalid. Backups exceeding lowered limits are
+// deleted with the next rotation or cleanup, see WithCleanupInterval.
+func (w *DistributedFileWriter) Reconfigure(options ...Option) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	// The options only set fields, so applying them to a copy of the settings validates them
+	// without touching the writer
+	settings := DistributedFileWriter{
+		maxSize:        w.maxSize,
+		maxBackups:     w.maxBackups,
+		maxAge:         w.maxAge,
+		maxTotalBytes:  w.maxTotalBytes,
+		retentionTiers: w.retentionTiers,
+		prefix:         w.prefix,
+		compression:    w.compression,
+	}
+	for _, o := range options {
+		o(&settings)
+	}
+	if err := settings.validateLimits(); err != nil {
+		return err
+	}
+
+	w.maxSize = settings.maxSize
+	w.prefix = settings.prefix
+	w.compression = settings.compression
+
+	// The retention limits are also read by cleanups after background compressions
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+	w.maxBackups = settings.maxBackups
+	w.maxAge = settings.maxAge
+	w.maxTotalBytes = settings.maxTotalBytes
+	w.retentionTiers = settings.retentionTiers
+
+	return nil
+}
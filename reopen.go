@@ -0,0 +1,92 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// Reopen syncs and closes the log file and opens the log path again, e.g. after an external tool
+// like logrotate renamed it. If the log path doesn't exist anymore, it is created with the
+// permissions and ownership of the previous log file. A buffered partial line is kept and written
+// to the reopened file once complete. Reopen is safe to call concurrently with writes.
+func (w *DistributedFileWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if err := w.writeNotices(); err != nil {
+		return err
+	}
+	if err := w.syncLog(); err != nil {
+		return fmt.Errorf("failed to sync log file: %w", err)
+	}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = w.fs.Stat(w.path)
+	created := errors.Is(err, os.ErrNotExist)
+
+	if err := w.reopen(); err != nil {
+		return err
+	}
+	if created {
+		// Apply the mode regardless of the umask
+		if err := w.file.Chmod(info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to set log file mode: %w", err)
+		}
+		if err := copyOwner(w.file, info); err != nil {
+			return fmt.Errorf("failed to set log file owner: %w", err)
+		}
+	}
+	if w.exclusiveOwner && w.lockHandle == nil {
+		// The lock was held on the previous log file
+		return w.acquireOwnership()
+	}
+	return nil
+}
+
+// NotifyReopen calls Reopen whenever one of the given signals is received, e.g. syscall.SIGHUP sent
+// by logrotate's postrotate script, until the returned function is called or the writer is closed.
+// Errors are reported to the error handler, see WithErrorHandler. Without signals, NotifyReopen
+// does nothing.
+func (w *DistributedFileWriter) NotifyReopen(sig ...os.Signal) (stop func()) {
+	if len(sig) == 0 {
+		return func() {}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig...)
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(stopped)
+		})
+	}
+
+	go func() {
+		defer stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-stopped:
+				return
+			case <-signals:
+				if err := w.Reopen(); err != nil && !errors.Is(err, ErrClosed) {
+					w.handleError(fmt.Errorf("failed to reopen log file: %w", err))
+				}
+			}
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,96 @@
+package dfwriter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// errorQueueSize is the number of errors queued for the error handler before further errors are dropped.
+const errorQueueSize = 64
+
+// defaultErrorHandler writes errors from background operations to stderr unless an error handler
+// is set with WithErrorHandler.
+func defaultErrorHandler(err error) {
+	fmt.Fprintf(os.Stderr, "dfwriter: %v\n", err)
+}
+
+// handleError reports an error from a background operation to the error handler without blocking.
+func (w *DistributedFileWriter) handleError(err error) {
+	w.reporter.report(err)
+	w.emit(ErrorOccurred{Err: err})
+}
+
+// errorReporter calls an error handler in its own goroutine, so reporting an error never blocks
+// the caller, e.g. a write holding the writer's lock.
+type errorReporter struct {
+	handler func(error)
+	queue   chan error
+	dropped atomic.Int64 // errors dropped since the last one delivered
+	mu      sync.Mutex   // guards closed and sending to queue
+	closed  bool
+	done    chan struct{}
+}
+
+// newErrorReporter starts a reporter calling handler, or the default handler if nil.
+func newErrorReporter(handler func(error)) *errorReporter {
+	if handler == nil {
+		handler = defaultErrorHandler
+	}
+	r := &errorReporter{
+		handler: handler,
+		queue:   make(chan error, errorQueueSize),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// report queues err for the error handler. If the queue is full, err is dropped and counted
+// instead. Once the reporter is closed, the handler is called directly.
+func (r *errorReporter) report(err error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		r.handler(err)
+		return
+	}
+	select {
+	case r.queue <- err:
+	default:
+		r.dropped.Add(1)
+	}
+	r.mu.Unlock()
+}
+
+// run calls the error handler for each queued error until the reporter is closed.
+func (r *errorReporter) run() {
+	defer close(r.done)
+	for err := range r.queue {
+		r.handler(err)
+		// The dropped errors were reported after the queued ones
+		if len(r.queue) == 0 {
+			r.reportDropped()
+		}
+	}
+	r.reportDropped()
+}
+
+// reportDropped reports the number of errors dropped since the last call, if any.
+func (r *errorReporter) reportDropped() {
+	if n := r.dropped.Swap(0); n > 0 {
+		r.handler(fmt.Errorf("dropped %d errors exceeding the error queue", n))
+	}
+}
+
+// close delivers the queued errors and waits for the reporter goroutine to return. close is idempotent.
+func (r *errorReporter) close() {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	<-r.done
+}
@@ -0,0 +1,200 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// RemovalReason describes why a backup was removed.
+type RemovalReason int
+
+const (
+	// RemovalMaxBackups means the backup exceeded the number of backups set with WithMaxBackups.
+	RemovalMaxBackups RemovalReason = iota
+	// RemovalMaxAge means the backup was older than the age set with WithMaxAge.
+	RemovalMaxAge
+	// RemovalMaxTotalBytes means the backups exceeded the byte budget set with WithMaxTotalBytes.
+	RemovalMaxTotalBytes
+	// RemovalDiskFull means the backup was removed to free disk space, see WithDiskFullPolicy.
+	RemovalDiskFull
+	// RemovalRetentionTier means the backup was superseded within its retention tier or older than
+	// all tiers, see WithRetentionTiers.
+	RemovalRetentionTier
+	// RemovalEmpty means the backup was empty for an hour, e.g. after a crash. Empty backups are
+	// removed regardless of the limits.
+	RemovalEmpty
+	// RemovalOrphanedTemp means the file was the temporary file of a rotation or compression that
+	// wasn't touched for an hour, e.g. after a crash. They are removed regardless of the limits.
+	RemovalOrphanedTemp
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalMaxBackups:
+		return "max backups"
+	case RemovalMaxAge:
+		return "max age"
+	case RemovalMaxTotalBytes:
+		return "max total bytes"
+	case RemovalDiskFull:
+		return "disk full"
+	case RemovalRetentionTier:
+		return "retention tier"
+	case RemovalEmpty:
+		return "empty"
+	case RemovalOrphanedTemp:
+		return "orphaned temporary file"
+	default:
+		return "unknown"
+	}
+}
+
+// Tier is a retention tier, see WithRetentionTiers.
+type Tier struct {
+	Age         time.Duration // backups younger than Age belong to the tier, unless to a previous one
+	Granularity time.Duration // length of the intervals keeping one backup each, 0 keeps all backups
+}
+
+// validateTiers checks that the ages of tiers are positive and increasing and their granularities
+// not negative.
+func validateTiers(tiers []Tier) error {
+	for i, tier := range tiers {
+		if tier.Age <= 0 || i > 0 && tier.Age <= tiers[i-1].Age {
+			return fmt.Errorf("invalid retention tier age %s, ages must be positive and increasing", tier.Age)
+		}
+		if tier.Granularity < 0 {
+			return fmt.Errorf("invalid retention tier granularity %s", tier.Granularity)
+		}
+	}
+	return nil
+}
+
+// tierExpired reports for each of the backups, oldest first, whether the retention tiers remove it
+// as of now: within each tier, only the newest backup per granularity interval is kept, and backups
+// older than the last tier are removed. Without tiers, no backup is removed.
+func tierExpired(tiers []Tier, backups []backupFile, now time.Time) []bool {
+	expired := make([]bool, len(backups))
+	if len(tiers) == 0 {
+		return expired
+	}
+
+	type bucket struct {
+		tier  int
+		start time.Time
+	}
+	kept := make(map[bucket]bool)
+	// Going newest first keeps the newest backup of each interval
+	for i := len(backups) - 1; i >= 0; i-- {
+		age := now.Sub(backups[i].time)
+		tier := slices.IndexFunc(tiers, func(tier Tier) bool { return age < tier.Age })
+		if tier < 0 {
+			expired[i] = true
+			continue
+		}
+		if tiers[tier].Granularity == 0 {
+			continue
+		}
+		b := bucket{tier, backups[i].time.Truncate(tiers[tier].Granularity)}
+		expired[i] = kept[b]
+		kept[b] = true
+	}
+	return expired
+}
+
+// removeBackup removes the backup at path for the given reason, unless vetoed by the removal filter.
+// If an archive directory is set, the backup is moved there instead.
+// Reports whether the backup is gone, which includes backups removed concurrently by another
+// process. The removal callback is only called for backups removed by this writer.
+// The caller must hold w.cleanupMu.
+func (w *DistributedFileWriter) removeBackup(path string, reason RemovalReason) (bool, error) {
+	if w.keepBackup != nil && !w.keepBackup(path, reason) {
+		return false, nil
+	}
+
+	// Another process sharing the log file may have removed the backup already
+	// Archiving would not free any space on a full disk, and there is nothing to archive of garbage
+	var err error
+	if w.archiveDir != "" && reason != RemovalDiskFull && reason != RemovalEmpty && reason != RemovalOrphanedTemp {
+		err = archiveBackup(w.fs, path, w.archiveDir)
+	} else {
+		err = w.fs.Remove(path)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if w.onBackupRemoved != nil {
+		w.onBackupRemoved(path, reason)
+	}
+	w.emit(BackupRemoved{Path: path, Reason: reason})
+	return true, nil
+}
+
+// archiveBackup moves the backup at path into dir on fsys, keeping its name. If the name is taken, a
+// numeric suffix is appended. If the backup can't be renamed, e.g. because dir is on another
+// filesystem, it is copied and removed instead.
+func archiveBackup(fsys fileSystem, path, dir string) error {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	for i := 0; ; i++ {
+		dst := filepath.Join(dir, name)
+		if i > 0 {
+			dst = fmt.Sprintf("%s.%d", dst, i)
+		}
+		if _, err := fsys.Lstat(dst); err == nil {
+			continue
+		}
+
+		err := fsys.Rename(path, dst)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		err = copyBackup(fsys, path, dst, info)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", path, err)
+		}
+		return fsys.Remove(path)
+	}
+}
+
+// copyBackup copies the backup at src to the new file dst on fsys, keeping its permissions and
+// ownership.
+func copyBackup(fsys fileSystem, src, dst string, info os.FileInfo) error {
+	srcFile, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := createBackupFile(fsys, dst, info)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		fsys.Remove(dst)
+		return err
+	}
+	if err := dstFile.Sync(); err != nil {
+		fsys.Remove(dst)
+		return err
+	}
+	return dstFile.Close()
+}
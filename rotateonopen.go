@@ -0,0 +1,54 @@
+package dfwriter
+
+import "time"
+
+// RotateOnOpenPolicy determines whether New rotates an existing log file before returning, see
+// WithRotateOnOpen.
+type RotateOnOpenPolicy struct {
+	limits bool
+	maxAge time.Duration
+}
+
+var (
+	// RotateOnOpenNever leaves rotating an existing log file to the first write (default).
+	RotateOnOpenNever = RotateOnOpenPolicy{}
+	// RotateOnOpenLimits rotates an existing log file that already exceeds the max size or was last
+	// written before the most recent time-based rotation boundary.
+	RotateOnOpenLimits = RotateOnOpenPolicy{limits: true}
+)
+
+// RotateOnOpenOlderThan returns a policy rotating an existing log file like RotateOnOpenLimits, or
+// if it was last written more than age ago.
+func RotateOnOpenOlderThan(age time.Duration) RotateOnOpenPolicy {
+	return RotateOnOpenPolicy{limits: true, maxAge: age}
+}
+
+// rotateOnOpen rotates the existing log file if the rotate on open policy requires it, holding the
+// exclusive file lock if file locking is enabled. An empty log file is never rotated.
+func (w *DistributedFileWriter) rotateOnOpen() (err error) {
+	policy := w.openPolicy
+	if !policy.limits {
+		return nil
+	}
+
+	if w.fsLock {
+		if err := w.lock(true); err != nil {
+			return err
+		}
+		defer w.unlock(&err)
+	}
+
+	// Another process may have rotated the file while waiting for the lock
+	if err := w.statFile(); err != nil {
+		return err
+	}
+	if !w.hasContent() {
+		return nil
+	}
+	stale := policy.maxAge > 0 && w.modTime.Before(w.clock.Now().Add(-policy.maxAge))
+	if !stale && !w.shouldRotate(0) {
+		return nil
+	}
+
+	return w.retryOnDiskFull(w.rotate)
+}
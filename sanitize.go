@@ -0,0 +1,115 @@
+package dfwriter
+
+import "unicode/utf8"
+
+// SanitizeMode selects how lines are cleaned up before they are written, see WithSanitize. Modes
+// can be combined with |.
+type SanitizeMode int
+
+const (
+	// SanitizeUTF8 replaces every byte of an invalid UTF-8 sequence with U+FFFD.
+	SanitizeUTF8 SanitizeMode = 1 << iota
+	// SanitizeANSI strips ANSI CSI and OSC escape sequences, e.g. colors and terminal titles.
+	SanitizeANSI
+	// SanitizeControl escapes control characters other than tab as \xNN, as well as the C1
+	// control characters U+0080 to U+009F as \u00NN. Without SanitizeUTF8, bytes of invalid UTF-8
+	// sequences that would be C1 control characters in 8-bit encodings, e.g. a lone 0x9b, are
+	// escaped as \xNN as well.
+	SanitizeControl
+
+	// SanitizeAll combines all sanitize modes.
+	SanitizeAll = SanitizeUTF8 | SanitizeANSI | SanitizeControl
+)
+
+// replacementChar is the UTF-8 encoding of U+FFFD.
+var replacementChar = []byte(string(utf8.RuneError))
+
+// sanitizeLine returns content cleaned up according to mode and whether it had to be changed.
+// content is returned as is if it is clean already, otherwise the sanitized line is written to
+// dst, reusing its capacity.
+func sanitizeLine(dst, content []byte, mode SanitizeMode) ([]byte, bool) {
+	changed := false
+	start := 0 // start of the clean bytes not yet copied to dst
+	var escape [6]byte
+	for i := 0; i < len(content); {
+		c := content[i]
+		if c >= 0x20 && c < 0x7f || c == '\t' {
+			i++
+			continue
+		}
+
+		var replacement []byte
+		n := 1 // number of bytes replaced
+		switch {
+		case c == 0x1b && mode&SanitizeANSI != 0 && ansiSequenceLen(content[i:]) > 0:
+			n = ansiSequenceLen(content[i:])
+		case c < utf8.RuneSelf:
+			if mode&SanitizeControl == 0 {
+				i++
+				continue
+			}
+			replacement = append(escape[:0], '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			r, size := utf8.DecodeRune(content[i:])
+			switch {
+			case r == utf8.RuneError && size == 1 && mode&SanitizeUTF8 != 0:
+				replacement = replacementChar
+			case r == utf8.RuneError && size == 1 && mode&SanitizeControl != 0 && c <= 0x9f:
+				replacement = append(escape[:0], '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+			case r >= 0x80 && r <= 0x9f && mode&SanitizeControl != 0:
+				replacement = append(escape[:0], '\\', 'u', '0', '0', hexDigits[r>>4], hexDigits[r&0xf])
+				n = size
+			default:
+				i += size
+				continue
+			}
+		}
+
+		if !changed {
+			dst = dst[:0]
+			changed = true
+		}
+		dst = append(dst, content[start:i]...)
+		dst = append(dst, replacement...)
+		i += n
+		start = i
+	}
+	if !changed {
+		return content, false
+	}
+	return append(dst, content[start:]...), true
+}
+
+// ansiSequenceLen returns the length of the CSI or OSC escape sequence at the start of s, or 0 if
+// there is none. A sequence that isn't terminated extends to the end of s, a malformed CSI
+// sequence up to the offending byte.
+func ansiSequenceLen(s []byte) int {
+	if len(s) < 2 || s[0] != 0x1b {
+		return 0
+	}
+	switch s[1] {
+	case '[':
+		// Parameter and intermediate bytes, followed by the final byte
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+			if s[i] < 0x20 || s[i] > 0x3f {
+				return i
+			}
+		}
+		return len(s)
+	case ']':
+		// Terminated by BEL or ST
+		for i := 2; i < len(s); i++ {
+			if s[i] == 0x07 {
+				return i + 1
+			}
+			if s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	}
+	return 0
+}
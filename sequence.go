@@ -0,0 +1,170 @@
+package dfwriter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// sequenceExt is appended to the log path to name the file holding the next unreserved sequence
+// number, or the next epoch with file locking, see WithSequenceNumbers.
+const sequenceExt = ".seq"
+
+// sequenceBlockSize is the number of sequence numbers a writer reserves at a time. It is a variable
+// so tests can shorten it.
+var sequenceBlockSize int64 = 1024
+
+// SequencePosition determines where the sequence number is added to a line, see
+// WithSequenceNumbers.
+type SequencePosition int
+
+const (
+	// SequenceStart prepends "seq=N " to the line, before any prefix (default).
+	SequenceStart SequencePosition = iota
+	// SequenceEnd appends " seq=N" to the line, before the delimiter.
+	SequenceEnd
+)
+
+// sequence returns the prefix and content of a line with the sequence number following the
+// offset uncommitted lines added, if enabled. Reserves the next block of numbers if the reserved
+// ones are used up, which requires offset to be 0. The number is only used once committed with
+// commitSequence. The caller must hold w.mu.
+func (w *DistributedFileWriter) sequence(prefix, content []byte, offset int) ([]byte, []byte, error) {
+	if !w.sequenceNumbers {
+		return prefix, content, nil
+	}
+	if w.sequenceExhausted(offset) {
+		if err := w.reserveSequence(); err != nil {
+			return nil, nil, fmt.Errorf("failed to reserve sequence numbers: %w", err)
+		}
+	}
+
+	n := w.seqNext + int64(offset)
+	if w.sequencePosition == SequenceEnd {
+		w.seqBuf = append(append(w.seqBuf[:0], content...), " seq="...)
+		w.seqBuf = w.appendSequence(w.seqBuf, n)
+		return prefix, w.seqBuf, nil
+	}
+	w.seqBuf = w.appendSequence(append(w.seqBuf[:0], "seq="...), n)
+	w.seqBuf = append(append(w.seqBuf, ' '), prefix...)
+	return w.seqBuf, content, nil
+}
+
+// appendSequence appends the sequence number n to b, preceded by the epoch and a dot with file
+// locking.
+func (w *DistributedFileWriter) appendSequence(b []byte, n int64) []byte {
+	if w.seqEpoch != 0 {
+		b = append(strconv.AppendInt(b, w.seqEpoch, 10), '.')
+	}
+	return strconv.AppendInt(b, n, 10)
+}
+
+// sequenceExhausted reports whether the line following offset uncommitted lines needs a number
+// beyond the reserved ones. The caller must hold w.mu.
+func (w *DistributedFileWriter) sequenceExhausted(offset int) bool {
+	return w.sequenceNumbers && w.seqNext+int64(offset) >= w.seqLimit
+}
+
+// commitSequence marks the numbers of n written lines as used. The caller must hold w.mu.
+func (w *DistributedFileWriter) commitSequence(n int) {
+	if !w.sequenceNumbers {
+		return
+	}
+	w.seqNext += int64(n)
+	w.stats.sequence.Store(w.seqNext - 1)
+}
+
+// reserveSequence reserves the next block of sequence numbers in the sequence file. With file
+// locking, it instead reserves the next epoch under the exclusive file lock on the sequence file,
+// once, and the writer numbers its lines from 1 within that epoch, so writers sharing the log file
+// never use the same number. The caller must hold w.mu.
+func (w *DistributedFileWriter) reserveSequence() error {
+	f, err := w.openSharedFile(w.sequencePath, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	// Closing the file releases its lock
+	defer f.Close()
+
+	next, err := readSequence(f)
+	if err != nil {
+		return err
+	}
+	if w.fsLock {
+		if err := writeSequence(f, next+1); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		w.seqEpoch, w.seqNext, w.seqLimit = next, 1, math.MaxInt64
+		return nil
+	}
+	if err := writeSequence(f, next+sequenceBlockSize); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	w.seqNext, w.seqLimit = next, next+sequenceBlockSize
+	if w.stats.sequence.Load() == 0 {
+		w.stats.sequence.Store(next - 1)
+	}
+	return nil
+}
+
+// releaseSequence returns the unused reserved sequence numbers to the sequence file, unless other
+// writers reserved numbers since, so the next writer continues without a gap. An epoch is never
+// released. The caller must hold w.mu.
+func (w *DistributedFileWriter) releaseSequence() error {
+	if !w.sequenceNumbers || w.seqEpoch != 0 || w.seqNext >= w.seqLimit {
+		return nil
+	}
+
+	f, err := w.openSharedFile(w.sequencePath, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	next, err := readSequence(f)
+	if err != nil || next != w.seqLimit {
+		return err
+	}
+	if err := writeSequence(f, w.seqNext); err != nil {
+		return err
+	}
+	w.seqLimit = w.seqNext
+	return f.Close()
+}
+
+// readSequence reads the next unreserved sequence number from the sequence file, 1 if it is empty.
+func readSequence(f fsFile) (int64, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return 1, nil
+	}
+	next, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || next < 1 {
+		return 0, fmt.Errorf("invalid sequence file %s: %q is not a positive number", f.Name(), data)
+	}
+	return next, nil
+}
+
+// writeSequence replaces the contents of the sequence file with next and syncs it.
+func writeSequence(f fsFile, next int64) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(strconv.AppendInt(nil, next, 10), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,62 @@
+package dfwriter
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Settings is a snapshot of the main settings of a writer, see DistributedFileWriter.Settings.
+// Use DistributedFileWriter.Config for all of them.
+type Settings struct {
+	// Path is the path of the log file.
+	Path string
+	// MaxBytes is the size at which the log file is rotated, 0 if unlimited.
+	MaxBytes int64
+	// MaxBackups is the number of backups retained, UnlimitedBackups or NoBackups.
+	MaxBackups int
+	// MaxAge is the age at which backups are deleted, 0 if unlimited.
+	MaxAge time.Duration
+	// Prefix is a copy of the static prefix.
+	Prefix []byte
+	// Compression is the compression format of backups.
+	Compression CompressionFormat
+	// FileLocking reports whether the writer locks the log file or a lock file.
+	FileLocking bool
+	// AtomicLineSize is the size in bytes assumed to be atomic for writes.
+	AtomicLineSize int
+}
+
+// Settings returns a snapshot of the main settings of w, including changes made by Reconfigure.
+// It is safe to call concurrently with writes.
+func (w *DistributedFileWriter) Settings() Settings {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cleanupMu.Lock()
+	defer w.cleanupMu.Unlock()
+
+	return Settings{
+		Path:           w.path,
+		MaxBytes:       w.maxSize,
+		MaxBackups:     w.maxBackups,
+		MaxAge:         w.maxAge,
+		Prefix:         bytes.Clone(w.prefix),
+		Compression:    w.compression,
+		FileLocking:    w.fsLock || w.exclusiveOwner,
+		AtomicLineSize: w.atomicLineSize,
+	}
+}
+
+// String returns a one-line summary of the main settings of w for debug logs, e.g.
+// `dfwriter(path=app.log maxBytes=10MB maxBackups=3 maxAge=7d compression=gzip locking=true prefix="")`.
+func (w *DistributedFileWriter) String() string {
+	s := w.Settings()
+	compression := string(s.Compression)
+	if compression == "" {
+		compression = "none"
+	}
+	return fmt.Sprintf("dfwriter(path=%s maxBytes=%s maxBackups=%d maxAge=%s compression=%s locking=%t prefix=%s)",
+		s.Path, Size(s.MaxBytes), s.MaxBackups, Duration(s.MaxAge), compression, s.FileLocking,
+		strconv.Quote(string(s.Prefix)))
+}
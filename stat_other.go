@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package dfwriter
+
+import "time"
+
+// fileSize returns the size and modification time of f.
+func fileSize(f fsFile) (int64, time.Time, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return stat.Size(), stat.ModTime(), nil
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package dfwriter
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileSize returns the size and modification time of f. Unlike f.Stat, it doesn't allocate for
+// an *os.File, as it is called for every line written with file locking.
+func fileSize(f fsFile) (int64, time.Time, error) {
+	if _, ok := f.(*os.File); !ok {
+		stat, err := f.Stat()
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		return stat.Size(), stat.ModTime(), nil
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &stat); err != nil {
+		return 0, time.Time{}, &os.PathError{Op: "fstat", Path: f.Name(), Err: err}
+	}
+	return stat.Size, time.Unix(stat.Mtim.Unix()), nil
+}
@@ -0,0 +1,128 @@
+package dfwriter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds statistics of a DistributedFileWriter.
+type Stats struct {
+	// CurrentSize is the size of the log file in bytes as last seen by the writer.
+	// Writes by other processes are only reflected once the writer checks the file again.
+	CurrentSize int64
+	// BytesWritten is the number of bytes written by the writer, including prefixes.
+	BytesWritten int64
+	// LinesWritten is the number of lines written by the writer.
+	LinesWritten int64
+	// Rotations is the number of rotations performed by the writer.
+	Rotations int64
+	// BackupCount is the number of backups as of the last cleanup.
+	BackupCount int
+	// LastRotation is the time of the last rotation performed by the writer, or the zero time.
+	LastRotation time.Time
+	// LockWaitTotal is the total time spent waiting for file locks.
+	LockWaitTotal time.Duration
+	// DroppedLines is the number of lines dropped by the rate limit.
+	DroppedLines int64
+	// AsyncDropped is the number of writes dropped because the queue was full, see WithAsync.
+	AsyncDropped int64
+	// EventsDropped is the number of events dropped because the event buffer was full, see WithEventBuffer.
+	EventsDropped int64
+	// Sequence is the sequence number of the last line written, see WithSequenceNumbers. Until the
+	// writer writes a line, it is the number preceding the first one it reserved.
+	Sequence int64
+	// SequenceEpoch is the epoch Sequence counts in with file locking, 0 without.
+	SequenceEpoch int64
+}
+
+// FileStats holds statistics of the lines written by a writer to the current log file since it was
+// opened or rotated, see WithFooter.
+type FileStats struct {
+	// Lines is the number of lines written.
+	Lines int64
+	// Bytes is the number of bytes written, including prefixes but not the header.
+	Bytes int64
+}
+
+// writerStats holds the counters backing Stats, so they can be read without locking the writer.
+type writerStats struct {
+	size          atomic.Int64
+	bytesWritten  atomic.Int64
+	linesWritten  atomic.Int64
+	rotations     atomic.Int64
+	backups       atomic.Int64
+	lastRotation  atomic.Int64 // unix nanoseconds
+	lockWait      atomic.Int64 // nanoseconds
+	droppedLines  atomic.Int64
+	asyncDropped  atomic.Int64
+	eventsDropped atomic.Int64
+	sequence      atomic.Int64
+
+	observersMu sync.Mutex
+	observers   atomic.Pointer[[]StatsObserver] // replaced on every change, never modified
+}
+
+// StatsObserver is notified of every rotation and lock acquisition of a writer, e.g. to record the
+// distribution of their durations, which Stats only reports as totals. The methods are called
+// synchronously while the writer holds its lock and must return quickly.
+type StatsObserver interface {
+	// ObserveRotation is called after a successful rotation with the time it took.
+	ObserveRotation(duration time.Duration)
+	// ObserveLockWait is called after acquiring or failing to acquire a file lock with the time spent waiting.
+	ObserveLockWait(duration time.Duration)
+}
+
+// AddStatsObserver registers o to be notified of the rotations and lock acquisitions of the writer.
+// Observers can be added at any time, concurrently with writes.
+func (w *DistributedFileWriter) AddStatsObserver(o StatsObserver) {
+	w.stats.observersMu.Lock()
+	defer w.stats.observersMu.Unlock()
+
+	var observers []StatsObserver
+	if current := w.stats.observers.Load(); current != nil {
+		observers = append(observers, *current...)
+	}
+	observers = append(observers, o)
+	w.stats.observers.Store(&observers)
+}
+
+// observeRotation notifies the observers of a rotation.
+func (s *writerStats) observeRotation(duration time.Duration) {
+	if observers := s.observers.Load(); observers != nil {
+		for _, o := range *observers {
+			o.ObserveRotation(duration)
+		}
+	}
+}
+
+// observeLockWait notifies the observers of a lock acquisition.
+func (s *writerStats) observeLockWait(duration time.Duration) {
+	if observers := s.observers.Load(); observers != nil {
+		for _, o := range *observers {
+			o.ObserveLockWait(duration)
+		}
+	}
+}
+
+// Stats returns statistics of the writer. It doesn't block on writes in progress and is cheap enough to
+// be called frequently, e.g. by a metrics collector.
+func (w *DistributedFileWriter) Stats() Stats {
+	stats := Stats{
+		CurrentSize:   w.stats.size.Load(),
+		BytesWritten:  w.stats.bytesWritten.Load(),
+		LinesWritten:  w.stats.linesWritten.Load(),
+		Rotations:     w.stats.rotations.Load(),
+		BackupCount:   int(w.stats.backups.Load()),
+		LockWaitTotal: time.Duration(w.stats.lockWait.Load()),
+		DroppedLines:  w.stats.droppedLines.Load(),
+		AsyncDropped:  w.stats.asyncDropped.Load(),
+		EventsDropped: w.stats.eventsDropped.Load(),
+		Sequence:      w.stats.sequence.Load(),
+		SequenceEpoch: w.seqEpoch,
+	}
+	if lastRotation := w.stats.lastRotation.Load(); lastRotation != 0 {
+		stats.LastRotation = time.Unix(0, lastRotation)
+	}
+	return stats
+}
@@ -0,0 +1,41 @@
+package dfwriter
+
+import (
+	"bytes"
+	"log"
+)
+
+// NewStdLogger creates a writer for the log file at fileName configured by options, and a standard
+// library logger with the given flags, e.g. log.LstdFlags, writing to it. Each call of the logger
+// writes exactly one line with a single WriteLine call, so an entry is never split by rotation or
+// interleaved with lines from other processes. Newlines within a message, e.g. of a multi-line
+// Print, are escaped as `\n`.
+//
+// The logger has no prefix of its own. A prefix set with WithPrefix is written at the start of
+// each line, before the date and time of the flags, while a prefix set with the logger's SetPrefix
+// follows that of WithPrefix, or the date and time with log.Lmsgprefix. Set only one of them
+// to not prefix lines twice, and likewise don't combine date and time flags with WithTimestamps.
+func NewStdLogger(fileName string, flags int, options ...Option) (*log.Logger, *DistributedFileWriter, error) {
+	w, err := New(fileName, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return log.New(stdLogWriter{w: w}, "", flags), w, nil
+}
+
+// stdLogWriter adapts WriteLine to io.Writer for log.Logger, which calls Write once per entry with
+// the formatted entry ending in a newline.
+type stdLogWriter struct {
+	w *DistributedFileWriter
+}
+
+func (s stdLogWriter) Write(p []byte) (int, error) {
+	line := p
+	if content, _ := bytes.CutSuffix(p, []byte("\n")); bytes.IndexByte(content, '\n') >= 0 {
+		line = append(bytes.ReplaceAll(content, []byte("\n"), []byte(`\n`)), p[len(content):]...)
+	}
+	if err := s.w.WriteLine(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
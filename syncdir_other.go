@@ -0,0 +1,8 @@
+//go:build !unix
+
+package dfwriter
+
+// syncDir is a no-op on platforms that don't support syncing directories.
+var syncDir = func(path string) error {
+	return nil
+}
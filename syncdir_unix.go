@@ -0,0 +1,16 @@
+//go:build unix
+
+package dfwriter
+
+import "os"
+
+// syncDir fsyncs the directory at path, persisting the creation, renaming and removal of its entries.
+var syncDir = func(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
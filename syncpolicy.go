@@ -0,0 +1,93 @@
+package dfwriter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SyncPolicy determines when the log file is synced to stable storage after writes, see WithSyncPolicy.
+type SyncPolicy struct {
+	everyLine bool
+	bytes     int64
+	interval  time.Duration
+}
+
+var (
+	// SyncNever leaves syncing the log file to the operating system, Sync and Close (default).
+	SyncNever = SyncPolicy{}
+	// SyncEveryLine syncs the log file after every write, so lines are durable once written.
+	SyncEveryLine = SyncPolicy{everyLine: true}
+)
+
+// SyncEveryNBytes returns a policy syncing the log file once at least n bytes have been written
+// since the last sync.
+func SyncEveryNBytes(n int64) SyncPolicy {
+	return SyncPolicy{bytes: n}
+}
+
+// SyncInterval returns a policy syncing the log file in the background every interval, if anything
+// has been written since the last sync.
+func SyncInterval(interval time.Duration) SyncPolicy {
+	return SyncPolicy{interval: interval}
+}
+
+// syncAfterWrite syncs the log file after n bytes were written, if the sync policy requires it.
+// The caller must hold w.mu.
+func (w *DistributedFileWriter) syncAfterWrite(n int) error {
+	w.unsynced += int64(n)
+
+	policy := w.syncPolicy
+	if !policy.everyLine && (policy.bytes <= 0 || w.unsynced < policy.bytes) {
+		return nil
+	}
+	if err := w.syncLog(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", w.path, err)
+	}
+	return nil
+}
+
+// syncLog syncs the log file, with F_FULLFSYNC where supported if enabled. The caller must hold w.mu.
+func (w *DistributedFileWriter) syncLog() error {
+	sync := fsFile.Sync
+	if w.fullFsync {
+		sync = fullSyncFile
+	}
+	if err := sync(w.file); err != nil {
+		return err
+	}
+	w.unsynced = 0
+	return nil
+}
+
+// syncLoop periodically syncs the log file if anything has been written since the last sync,
+// until the writer is closed.
+func (w *DistributedFileWriter) syncLoop(interval time.Duration) {
+	ticker := w.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C():
+			if err := w.syncIfDirty(); err != nil && !errors.Is(err, ErrClosed) {
+				w.handleError(fmt.Errorf("failed to sync log file: %w", err))
+			}
+		}
+	}
+}
+
+// syncIfDirty syncs the log file if anything has been written since the last sync.
+func (w *DistributedFileWriter) syncIfDirty() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.unsynced == 0 {
+		return nil
+	}
+	return w.syncLog()
+}
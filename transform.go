@@ -0,0 +1,47 @@
+package dfwriter
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+)
+
+// redacted replaces the matches of the patterns passed to RedactPatterns.
+var redacted = []byte("[REDACTED]")
+
+// RedactPatterns returns a line transform for WithLineTransform replacing every match of the given
+// patterns with "[REDACTED]". The patterns are applied in order.
+func RedactPatterns(patterns ...*regexp.Regexp) func(line []byte) []byte {
+	return func(line []byte) []byte {
+		for _, pattern := range patterns {
+			if pattern.Match(line) {
+				line = pattern.ReplaceAll(line, redacted)
+			}
+		}
+		return line
+	}
+}
+
+// transformLine applies the line transform, if set, to the content of a line and sanitizes it,
+// see WithSanitize. Returns false if the line is to be dropped. Delimiters in the transformed
+// content are escaped, so the transform can't split the line.
+func (w *DistributedFileWriter) transformLine(content []byte) ([]byte, bool) {
+	if w.lineTransform != nil {
+		content = w.lineTransform(content)
+		if content == nil {
+			return nil, false
+		}
+		if !w.binaryRecords && bytes.IndexByte(content, w.delimiter) >= 0 {
+			escaped := strconv.QuoteToASCII(string(w.delimiter))
+			content = bytes.ReplaceAll(content, []byte{w.delimiter}, []byte(escaped[1:len(escaped)-1]))
+		}
+	}
+	if w.sanitizeMode != 0 {
+		var sanitized bool
+		if content, sanitized = sanitizeLine(w.sanitizeBuf, content, w.sanitizeMode); sanitized {
+			// Keep the grown buffer for the next line
+			w.sanitizeBuf = content
+		}
+	}
+	return content, true
+}
@@ -0,0 +1,117 @@
+package dfwriter
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// sizeUnits are the units accepted by ParseSize with their powers of 1024, longest first.
+var sizeUnits = []struct {
+	name  string
+	shift uint
+}{
+	{"PIB", 50}, {"TIB", 40}, {"GIB", 30}, {"MIB", 20}, {"KIB", 10},
+	{"PB", 50}, {"TB", 40}, {"GB", 30}, {"MB", 20}, {"KB", 10},
+	{"P", 50}, {"T", 40}, {"G", 30}, {"M", 20}, {"K", 10},
+	{"B", 0},
+}
+
+// ParseSize parses a human-readable number of bytes: a non-negative decimal number followed by an
+// optional unit, case-insensitively and optionally separated by spaces, e.g. "512K", "100MiB" or
+// "1.5GB". Units are powers of 1024, K, KB and KiB all meaning 1024 bytes, up to P for pebibytes.
+// Sizes must be whole bytes that fit an int64.
+func ParseSize(s string) (int64, error) {
+	str := strings.TrimSpace(s)
+	number, shift := str, uint(0)
+	upper := strings.ToUpper(str)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(upper, unit.name) {
+			number, shift = strings.TrimSpace(str[:len(str)-len(unit.name)]), unit.shift
+			break
+		}
+	}
+
+	// Reject signs, exponents and anything else big.Rat accepts besides plain decimals
+	if number == "" || strings.Trim(number, "0123456789.") != "" || number == "." {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	r, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(1<<shift))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("invalid size %q: not a whole number of bytes", s)
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return r.Num().Int64(), nil
+}
+
+// Units of ParseAge beyond those of time.ParseDuration.
+const (
+	day  = 24 * time.Hour
+	week = 7 * day
+)
+
+// ParseAge parses a human-readable non-negative duration in the format of time.ParseDuration,
+// extended by the units d for days of 24 hours and w for weeks of 7 days, e.g. "36h", "7d", "4w" or
+// "1w2d12h". Numbers without a unit are rejected, except 0.
+func ParseAge(s string) (time.Duration, error) {
+	str := strings.TrimSpace(s)
+	if str == "" {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+
+	var total time.Duration
+	for str != "" {
+		// Split off the next number and its unit
+		n := strings.IndexFunc(str, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if n == 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		if n < 0 {
+			n = len(str)
+		}
+		u := strings.IndexAny(str[n:], "0123456789.")
+		if u < 0 {
+			u = len(str) - n
+		}
+		number, unit := str[:n], str[n:n+u]
+		str = str[n+u:]
+
+		var d time.Duration
+		switch unit {
+		case "d", "w":
+			r, ok := new(big.Rat).SetString(number)
+			if !ok || strings.Trim(number, "0123456789.") != "" {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			length := day
+			if unit == "w" {
+				length = week
+			}
+			// Fractions of a nanosecond are truncated like by time.ParseDuration
+			r.Mul(r, new(big.Rat).SetInt64(int64(length)))
+			ns := new(big.Int).Quo(r.Num(), r.Denom())
+			if !ns.IsInt64() {
+				return 0, fmt.Errorf("invalid age %q: too large", s)
+			}
+			d = time.Duration(ns.Int64())
+		default:
+			var err error
+			if d, err = time.ParseDuration(number + unit); err != nil {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+		}
+		if d > math.MaxInt64-total {
+			return 0, fmt.Errorf("invalid age %q: too large", s)
+		}
+		total += d
+	}
+	return total, nil
+}
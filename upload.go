@@ -0,0 +1,224 @@
+package dfwriter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// uploadQueueExt is appended to the log path to name the queue of backups awaiting upload, see
+// WithUploader.
+const uploadQueueExt = ".uploads"
+
+// Bounds of the backoff between attempts to upload a backup. They are variables so tests can
+// shorten them.
+var (
+	minUploadBackoff = time.Second
+	maxUploadBackoff = 5 * time.Minute
+)
+
+// Uploader uploads completed backups, e.g. to object storage, see WithUploader.
+type Uploader interface {
+	// Upload uploads the backup file at localPath. Failed uploads are retried, so Upload should be
+	// idempotent. ctx is canceled when the writer is closed.
+	Upload(ctx context.Context, localPath string) error
+}
+
+// enqueueUpload appends the path of a completed backup to the upload queue and wakes the upload
+// worker. Failures are reported to the error handler.
+func (w *DistributedFileWriter) enqueueUpload(backupPath string) {
+	if w.uploader == nil {
+		return
+	}
+
+	if err := w.appendUpload(backupPath); err != nil {
+		w.handleError(fmt.Errorf("failed to queue backup %s for upload: %w", backupPath, err))
+		return
+	}
+	select {
+	case w.uploadWake <- struct{}{}:
+	default:
+	}
+}
+
+// appendUpload appends backupPath to the upload queue file.
+func (w *DistributedFileWriter) appendUpload(backupPath string) error {
+	w.uploadMu.Lock()
+	defer w.uploadMu.Unlock()
+
+	f, err := w.openSharedFile(w.uploadQueuePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	// Closing the queue releases its lock
+	defer f.Close()
+
+	if _, err := f.Write([]byte(backupPath + "\n")); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// nextUpload returns the oldest backup in the upload queue. Reports false if the queue is empty.
+func (w *DistributedFileWriter) nextUpload() (string, bool, error) {
+	w.uploadMu.Lock()
+	defer w.uploadMu.Unlock()
+
+	// Opened for writing, as exclusive OFD locks require it
+	f, err := w.openSharedFile(w.uploadQueuePath, os.O_RDWR)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", false, err
+	}
+	for line := range bytes.Lines(data) {
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			return string(line), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// dequeueUpload removes the first entry of backupPath from the upload queue. Reports whether the
+// entry was found, as another process may have uploaded the backup already. The queue is rewritten
+// in place, so writers appending to it concurrently keep their lock on it.
+func (w *DistributedFileWriter) dequeueUpload(backupPath string) (bool, error) {
+	w.uploadMu.Lock()
+	defer w.uploadMu.Unlock()
+
+	f, err := w.openSharedFile(w.uploadQueuePath, os.O_RDWR)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+	var kept []byte
+	removed := false
+	for line := range bytes.Lines(data) {
+		entry := bytes.TrimSuffix(line, []byte("\n"))
+		if !removed && string(entry) == backupPath {
+			removed = true
+			continue
+		}
+		if len(entry) > 0 {
+			kept = append(append(kept, entry...), '\n')
+		}
+	}
+	if !removed {
+		return false, nil
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return true, err
+	}
+	if _, err := f.WriteAt(kept, 0); err != nil {
+		return true, err
+	}
+	if err := f.Sync(); err != nil {
+		return true, err
+	}
+	return true, f.Close()
+}
+
+// uploadLoop uploads the queued backups, oldest first, until the writer is closed. Failed uploads
+// are retried with exponential backoff, backups removed before their upload are dropped.
+func (w *DistributedFileWriter) uploadLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := minUploadBackoff
+	for {
+		backupPath, ok, err := w.nextUpload()
+		if err == nil && !ok {
+			select {
+			case <-w.done:
+				return
+			case <-w.uploadWake:
+				continue
+			}
+		}
+		if err == nil {
+			err = w.upload(ctx, backupPath)
+		}
+		if err == nil {
+			backoff = minUploadBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			// Interrupted by Close, the upload is retried by the next writer
+			return
+		}
+
+		w.handleError(err)
+		if !w.sleep(backoff, w.done) {
+			return
+		}
+		backoff = min(2*backoff, maxUploadBackoff)
+	}
+}
+
+// upload uploads the backup at backupPath and removes it from the queue, deleting the backup
+// afterwards if requested. A backup removed before its upload is dropped from the queue.
+func (w *DistributedFileWriter) upload(ctx context.Context, backupPath string) error {
+	if _, err := w.fs.Stat(backupPath); errors.Is(err, os.ErrNotExist) {
+		removed, err := w.dequeueUpload(backupPath)
+		if err != nil {
+			return fmt.Errorf("failed to update upload queue: %w", err)
+		}
+		// Unless another process uploaded and deleted it, it was removed by the cleanup
+		if removed {
+			w.handleError(fmt.Errorf("backup %s was removed before its upload", backupPath))
+		}
+		return nil
+	}
+
+	if err := w.uploader.Upload(ctx, backupPath); err != nil {
+		return fmt.Errorf("failed to upload backup %s: %w", backupPath, err)
+	}
+	if _, err := w.dequeueUpload(backupPath); err != nil {
+		return fmt.Errorf("failed to update upload queue: %w", err)
+	}
+	if !w.deleteUploaded {
+		return nil
+	}
+
+	// Removed from the queue first, so a crash leaves an uploaded backup behind rather than
+	// uploading a deleted one
+	if err := w.fs.Remove(backupPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		w.handleError(fmt.Errorf("failed to remove uploaded backup: %w", err))
+		return nil
+	}
+	if err := w.syncDir(filepath.Dir(backupPath)); err != nil {
+		w.handleError(err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package dfwriter
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// copyDigest records the size and CRC-32 of the data copied into a backup, see WithVerifyRotation.
+type copyDigest struct {
+	size int64
+	crc  hash.Hash32
+}
+
+// newCopyDigest returns an empty copyDigest.
+func newCopyDigest() *copyDigest {
+	return &copyDigest{crc: crc32.NewIEEE()}
+}
+
+// Write adds p to the digest.
+func (d *copyDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.crc.Write(p)
+}
+
+// verify reads the backup at path on fsys back and checks that it matches the digest.
+func (d *copyDigest) verify(fsys fileSystem, path string) error {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	actual := newCopyDigest()
+	if _, err := io.Copy(actual, f); err != nil {
+		return fmt.Errorf("failed to read back backup %s: %w", path, err)
+	}
+	if actual.size != d.size {
+		return fmt.Errorf("%w: %s has %d bytes, copied %d", ErrBackupVerification, path, actual.size, d.size)
+	}
+	if actual.crc.Sum32() != d.crc.Sum32() {
+		return fmt.Errorf("%w: %s has CRC-32 %08x, copied %08x", ErrBackupVerification, path, actual.crc.Sum32(), d.crc.Sum32())
+	}
+	return nil
+}